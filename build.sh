@@ -42,6 +42,15 @@ if [ "$par" == "current" ]; then
     echo ">>   [$os $arch] Building data-generator -> ./bin/$os-$arch/data-generator"
     GOOS=$os GOARCH=$arch CGO_ENABLED=1 go build -ldflags="-s -w" -o bin/$os-$arch/data-generator -ldflags="-s -w" -trimpath cmd/data-generator/main.go
 
+    echo ">>   [$os $arch] Building dlq-replay -> ./bin/$os-$arch/dlq-replay"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 go build -ldflags="-s -w" -o bin/$os-$arch/dlq-replay -ldflags="-s -w" -trimpath cmd/dlq-replay/main.go
+
+    echo ">>   [$os $arch] Building hmac-verify -> ./bin/$os-$arch/hmac-verify"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 go build -ldflags="-s -w" -o bin/$os-$arch/hmac-verify -ldflags="-s -w" -trimpath cmd/hmac-verify/main.go
+
+    echo ">>   [$os $arch] Building chain-verify -> ./bin/$os-$arch/chain-verify"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 go build -ldflags="-s -w" -o bin/$os-$arch/chain-verify -ldflags="-s -w" -trimpath cmd/chain-verify/main.go
+
     echo ">>   [$os $arch] Building fluent-out-parquet -> ./bin/$os-$arch/fluent-out-parquet.so"
     GOOS=$os GOARCH=$arch CGO_ENABLED=1 go build -buildmode=c-shared -o bin/$os-$arch/fluent-out-parquet.so -ldflags="-s -w" -trimpath cmd/fluent-out-parquet/main.go
 
@@ -62,6 +71,15 @@ if [ "$par" == "linux" ]; then
     echo ">>   [$os $arch] Building data-generator -> ./bin/$os-$arch/data-generator"
     GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=x86_64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/data-generator -ldflags="-s -w" -trimpath cmd/data-generator/main.go
 
+    echo ">>   [$os $arch] Building dlq-replay -> ./bin/$os-$arch/dlq-replay"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=x86_64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/dlq-replay -ldflags="-s -w" -trimpath cmd/dlq-replay/main.go
+
+    echo ">>   [$os $arch] Building hmac-verify -> ./bin/$os-$arch/hmac-verify"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=x86_64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/hmac-verify -ldflags="-s -w" -trimpath cmd/hmac-verify/main.go
+
+    echo ">>   [$os $arch] Building chain-verify -> ./bin/$os-$arch/chain-verify"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=x86_64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/chain-verify -ldflags="-s -w" -trimpath cmd/chain-verify/main.go
+
     echo ">>   [$os $arch] Building fluent-out-parquet -> ./bin/$os-$arch/fluent-out-parquet.so"
     GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=x86_64-linux-gnu-gcc go build -buildmode=c-shared -o bin/$os-$arch/fluent-out-parquet.so -ldflags="-s -w" -trimpath cmd/fluent-out-parquet/main.go
 
@@ -76,6 +94,15 @@ if [ "$par" == "linux" ]; then
     echo ">>   [$os $arch] Building data-generator -> ./bin/$os-$arch/data-generator"
     GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=aarch64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/data-generator -ldflags="-s -w" -trimpath cmd/data-generator/main.go    
 
+    echo ">>   [$os $arch] Building dlq-replay -> ./bin/$os-$arch/dlq-replay"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=aarch64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/dlq-replay -ldflags="-s -w" -trimpath cmd/dlq-replay/main.go
+
+    echo ">>   [$os $arch] Building hmac-verify -> ./bin/$os-$arch/hmac-verify"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=aarch64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/hmac-verify -ldflags="-s -w" -trimpath cmd/hmac-verify/main.go
+
+    echo ">>   [$os $arch] Building chain-verify -> ./bin/$os-$arch/chain-verify"
+    GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=aarch64-linux-gnu-gcc go build -ldflags="-s -w" -o bin/$os-$arch/chain-verify -ldflags="-s -w" -trimpath cmd/chain-verify/main.go
+
     echo ">>   [$os $arch] Building fluent-out-parquet -> ./bin/$os-$arch/fluent-out-parquet.so"
     GOOS=$os GOARCH=$arch CGO_ENABLED=1 CC=aarch64-linux-gnu-gcc go build -buildmode=c-shared -o bin/$os-$arch/fluent-out-parquet.so -ldflags="-s -w" -trimpath cmd/fluent-out-parquet/main.go
     
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"data2parquet/pkg/logger" // "log/slog"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"data2parquet/pkg/chain"
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/writer"
+)
+
+var slog = logger.GetLogger()
+
+func main() {
+	PrintLogo()
+
+	if len(os.Args) < 2 {
+		fmt.Printf("Usage: chain-verify <config_file> [prefix]\n")
+		os.Exit(1)
+	}
+
+	configFile := os.Args[1]
+	cfg, err := config.ConfigClientFromFile(configFile)
+	if err != nil {
+		fmt.Printf("Error loading config file, %s", err)
+		os.Exit(1)
+	}
+
+	prefix := ""
+
+	if len(os.Args) > 2 {
+		prefix = os.Args[2]
+	}
+
+	wr := writer.New(context.Background(), cfg)
+
+	if wr == nil {
+		slog.Error("Error creating writer", "config", configFile, "writer", cfg.WriterType)
+		os.Exit(1)
+	}
+
+	err = wr.Init()
+
+	if err != nil {
+		slog.Error("Error initializing writer", "error", err, "writer", cfg.WriterType)
+		os.Exit(1)
+	}
+
+	store, ok := wr.(chain.Store)
+
+	if !ok {
+		slog.Error("Writer doesn't support audit chain", "writer", cfg.WriterType)
+		os.Exit(1)
+	}
+
+	slog.Info("Starting...", "writer", cfg.WriterType, "prefix", prefix)
+	start := time.Now()
+
+	report, err := chain.Verify(store, prefix)
+	wr.Close()
+
+	if err != nil {
+		slog.Error("Error verifying chain", "error", err, "prefix", prefix)
+		os.Exit(1)
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+
+	slog.Info("Verify - Finished", "keys", report.Keys, "files", report.Files, "breaks", len(report.Breaks), "duration", time.Since(start))
+
+	if len(report.Breaks) > 0 {
+		os.Exit(2)
+	}
+
+	os.Exit(0)
+}
+
+func PrintLogo() {
+	fmt.Print(`
+#################################
+#                               #
+#  Data2Parquet - Chain Verify  #
+#                               #
+#################################
+
+`)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"data2parquet/pkg/logger" // "log/slog"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/receiver"
+)
+
+var slog = logger.GetLogger()
+
+func main() {
+	PrintLogo()
+
+	if len(os.Args) < 2 {
+		fmt.Printf("Usage: dlq-replay <config_file> [replay.json]\n")
+		os.Exit(1)
+	}
+
+	configFile := os.Args[1]
+	cfg, err := config.ConfigClientFromFile(configFile)
+	if err != nil {
+		fmt.Printf("Error loading config file, %s", err)
+		os.Exit(1)
+	}
+
+	request := &receiver.ReplayRequest{}
+
+	if len(os.Args) > 2 {
+		data, err := os.ReadFile(os.Args[2])
+
+		if err != nil {
+			slog.Error("Error reading replay file", "error", err, "file", os.Args[2])
+			os.Exit(1)
+		}
+
+		err = json.Unmarshal(data, request)
+
+		if err != nil {
+			slog.Error("Error decoding replay file", "error", err, "file", os.Args[2])
+			os.Exit(1)
+		}
+	}
+
+	slog.Info("Starting...")
+	start := time.Now()
+
+	rcv := receiver.NewReceiver(context.Background(), cfg)
+
+	if rcv == nil {
+		slog.Error("Error creating receiver")
+		os.Exit(1)
+	}
+
+	result, err := rcv.ReplayDLQ(request.Keys, request.MakeTransform(cfg.RecordType))
+
+	if err != nil {
+		slog.Error("Error replaying DLQ", "error", err)
+		rcv.Close()
+		os.Exit(1)
+	}
+
+	err = rcv.Close()
+
+	if err != nil {
+		slog.Error("Error closing receiver", "error", err)
+	}
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+
+	slog.Info("Replay - Finished", "duration", time.Since(start))
+
+	if len(result.Failed) > 0 {
+		os.Exit(2)
+	}
+
+	os.Exit(0)
+}
+
+func PrintLogo() {
+	fmt.Print(`
+###############################
+#                             #
+#  Data2Parquet - DLQ Replay  #
+#                             #
+###############################
+
+`)
+}
@@ -3,22 +3,29 @@ package main
 import (
 	"C"
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
 
+	"data2parquet/pkg/buffer"
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
 	"data2parquet/pkg/logger" // "log/slog"
+	"data2parquet/pkg/metrics"
 	"data2parquet/pkg/receiver"
+	"data2parquet/pkg/tracing"
 )
 import "runtime/debug"
 
 var cfg = &config.Config{}
 var rcv *receiver.Receiver
+var metricsSrv *http.Server
+var stopTracing func(context.Context) error
 var ctx = context.Background()
 var slog = logger.GetLogger()
 
@@ -58,8 +65,19 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 		slog.SetLogLoggerLevel(logger.LevelDebug)
 	}
 
+	stopTracing, err = tracing.Init(ctx, cfg)
+
+	if err != nil {
+		slog.Error("Error initializing tracing", "error", err)
+		return output.FLB_ERROR
+	}
+
 	rcv = receiver.NewReceiver(ctx, cfg)
 
+	if len(cfg.MetricsAddress) > 0 {
+		metricsSrv = metrics.Serve(cfg.MetricsAddress)
+	}
+
 	slog.Info("Plugin initialized")
 	return output.FLB_OK
 }
@@ -83,6 +101,9 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 		return output.FLB_ERROR
 	}
 
+	// records are decoded first, so a chunk that doesn't fit on buffer can be handled as a whole
+	records := make([]domain.Record, 0)
+
 	for {
 		ret, ts, record = output.GetRecord(dec)
 
@@ -109,10 +130,30 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 			continue
 		}
 
-		record := domain.NewLog(logData)
+		records = append(records, domain.NewLog(logData))
+	}
 
+	for i, record := range records {
 		err := rcv.Write(record)
 
+		// Fluent Bit sends the whole chunk again on retry, it is only asked when no record was accepted yet
+		if errors.Is(err, buffer.ErrBufferFull) && i == 0 {
+			slog.Warn("Buffer is full, asking Fluent Bit to retry the chunk", "error", err)
+			return output.FLB_RETRY
+		}
+
+		if errors.Is(err, buffer.ErrBufferFull) {
+			errDLQ := rcv.WriteDLQ(records[i:], buffer.DLQStageBuffer, err)
+
+			if errDLQ != nil {
+				slog.Error("Buffer is full and records can't be pushed to DLQ, asking Fluent Bit to retry the chunk, accepted records will be sent again", "error", errDLQ, "accepted", i, "records", len(records))
+				return output.FLB_RETRY
+			}
+
+			slog.Warn("Buffer is full, records of the chunk not accepted were pushed to DLQ", "error", err, "accepted", i, "dlq", len(records)-i)
+			return output.FLB_OK
+		}
+
 		if err != nil {
 			slog.Error("Error writing record", "error", err)
 			return output.FLB_ERROR
@@ -127,6 +168,22 @@ func FLBPluginExit() int {
 	slog.Info("Exiting plugin")
 	err := rcv.Close()
 
+	if metricsSrv != nil {
+		errMetrics := metricsSrv.Shutdown(ctx)
+
+		if errMetrics != nil {
+			slog.Error("Error on try close metrics listener", "err", errMetrics)
+		}
+	}
+
+	if stopTracing != nil {
+		errTracing := stopTracing(ctx)
+
+		if errTracing != nil {
+			slog.Error("Error on try flush tracing spans", "err", errTracing)
+		}
+	}
+
 	if err != nil {
 		slog.Error("Error on try close receiver", "err", err)
 		return output.FLB_ERROR
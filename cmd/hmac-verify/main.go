@@ -0,0 +1,84 @@
+package main
+
+import (
+	"data2parquet/pkg/logger" // "log/slog"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/converter"
+)
+
+var slog = logger.GetLogger()
+
+type FileResult struct {
+	File string `json:"file"`
+	*converter.VerifyResult
+	Error string `json:"error,omitempty"`
+}
+
+func main() {
+	PrintLogo()
+
+	if len(os.Args) < 3 {
+		fmt.Printf("Usage: hmac-verify <config_file> <parquet_file> [parquet_file...]\n")
+		os.Exit(1)
+	}
+
+	configFile := os.Args[1]
+	cfg, err := config.ConfigClientFromFile(configFile)
+	if err != nil {
+		fmt.Printf("Error loading config file, %s", err)
+		os.Exit(1)
+	}
+
+	if len(config.HMACSecrets) == 0 {
+		slog.Error("No HMAC keys loaded, set HMACKeys, HMACKeysFile or HMACKeysEnv", "config", configFile, "record-type", cfg.RecordType)
+		os.Exit(1)
+	}
+
+	slog.Info("Starting...")
+	start := time.Now()
+
+	results := make([]*FileResult, 0, len(os.Args)-2)
+	failed := false
+
+	for _, file := range os.Args[2:] {
+		result, err := converter.VerifyHMACFile(file)
+		item := &FileResult{File: file, VerifyResult: result}
+
+		if err != nil {
+			slog.Error("Error verifying file", "error", err, "file", file)
+			item.Error = err.Error()
+			failed = true
+		} else if len(result.Invalid) > 0 {
+			failed = true
+		}
+
+		results = append(results, item)
+	}
+
+	out, _ := json.MarshalIndent(results, "", "  ")
+	fmt.Println(string(out))
+
+	slog.Info("Verify - Finished", "duration", time.Since(start))
+
+	if failed {
+		os.Exit(2)
+	}
+
+	os.Exit(0)
+}
+
+func PrintLogo() {
+	fmt.Print(`
+################################
+#                              #
+#  Data2Parquet - HMAC Verify  #
+#                              #
+################################
+
+`)
+}
@@ -5,6 +5,7 @@ import (
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/logger" // "log/slog"
 	"data2parquet/pkg/server"
+	"data2parquet/pkg/tracing"
 	"fmt"
 	"os"
 	"os/signal"
@@ -35,6 +36,21 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	stopTracing, err := tracing.Init(ctx, cfg)
+
+	if err != nil {
+		fmt.Printf("Error initializing tracing: %s", err)
+		os.Exit(1)
+	}
+
+	defer func() {
+		err := stopTracing(context.Background())
+
+		if err != nil {
+			slog.Error("Error flushing tracing spans", "module", "main", "function", "main", "error", err)
+		}
+	}()
+
 	server := server.NewServer(ctx, cfg)
 	err = server.Run()
 
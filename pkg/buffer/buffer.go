@@ -16,19 +16,31 @@ var slog = logger.GetLogger()
 type Buffer interface {
 	Close() error
 	Push(key string, item domain.Record) (int, error)
-	PushDLQ(key string, item domain.Record) error
-	GetDLQ() (map[string][]domain.Record, error)
+	PushDLQ(key string, item *DLQEnvelope) error
+	GetDLQ() (map[string][]*DLQEnvelope, error)
 	ClearDLQ() error
+	RemoveDLQ(key string, size int) error
 	Get(key string) []domain.Record
 	Clear(key string, size int) error
+	Rollback(key string) error
 	Len(key string) int
+	ByteLen(key string) int
 	Keys() []string
 	IsReady() bool
 	HasRecovery() bool
 	PushRecovery(key string, buf *bytes.Buffer) error
+	PutRecovery(item *RecoveryData) error
 	GetRecovery() ([]*RecoveryData, error)
 	ClearRecoveryData() error
+	RemoveRecovery(key string, size int) error
+	PushPoison(item *RecoveryData) error
+	GetPoison() ([]*RecoveryData, error)
+	ClearPoison() error
 	CheckLock(key string) bool
+	RenewLock(key string) bool
+	ReleaseLock(key string) error
+	Token(key string) int64
+	CheckToken(key string, token int64) bool
 }
 
 func New(ctx context.Context, cfg *config.Config) Buffer {
@@ -40,6 +52,18 @@ func New(ctx context.Context, cfg *config.Config) Buffer {
 			slog.Error("Error creating Redis buffer, using memory buffer instead")
 			ret = NewMem(ctx, cfg)
 		}
+	case config.BufferTypeDisk:
+		ret = NewDisk(ctx, cfg)
+		if ret == nil {
+			slog.Error("Error creating Disk buffer, using memory buffer instead")
+			ret = NewMem(ctx, cfg)
+		}
+	case config.BufferTypeRedisStream:
+		ret = NewRedisStream(ctx, cfg, nil)
+		if ret == nil {
+			slog.Error("Error creating Redis stream buffer, using memory buffer instead")
+			ret = NewMem(ctx, cfg)
+		}
 	case config.BufferTypeMem:
 		ret = NewMem(ctx, cfg)
 	default:
@@ -49,10 +73,46 @@ func New(ctx context.Context, cfg *config.Config) Buffer {
 	return ret
 }
 
+// RecoveryData is a converted batch that failed to be written, Attempts and NextAttempt keep the retry schedule across
+// restarts. Items that exhaust their attempts are moved to the poison store with the last error.
 type RecoveryData struct {
-	Key       string    `msg:"key"`
-	Data      []byte    `msg:"data"`
-	Timestamp time.Time `msg:"timestamp"`
+	Key         string    `msg:"key"`
+	Data        []byte    `msg:"data"`
+	Timestamp   time.Time `msg:"timestamp"`
+	Attempts    int       `msg:"attempts"`
+	NextAttempt time.Time `msg:"next_attempt"`
+	LastError   string    `msg:"last_error"`
+}
+
+func NewRecoveryData(key string, buf *bytes.Buffer) *RecoveryData {
+	return &RecoveryData{
+		Key:       key,
+		Data:      append([]byte{}, buf.Bytes()...),
+		Timestamp: time.Now(),
+	}
+}
+
+// IsDue returns true when the next attempt time of the item is reached
+func (l *RecoveryData) IsDue(now time.Time) bool {
+	return !l.NextAttempt.After(now)
+}
+
+// removeRecovery is the `RemoveRecovery` of buffers that keep recovery items of all keys on one slice, in the order they
+// were put. It returns a new slice without the first size items of key (all of them when size is negative), items of
+// other keys keep their order.
+func removeRecovery(items []*RecoveryData, key string, size int) []*RecoveryData {
+	ret := make([]*RecoveryData, 0, len(items))
+
+	for _, item := range items {
+		if item.Key == key && size != 0 {
+			size--
+			continue
+		}
+
+		ret = append(ret, item)
+	}
+
+	return ret
 }
 
 func (l *RecoveryData) ToMsgPack() []byte {
@@ -6,9 +6,13 @@ import (
 	"data2parquet/pkg/buffer"
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"testing"
 	"time"
@@ -27,9 +31,28 @@ func PrepareConfigMem() *config.Config {
 		RecordType: config.RecordTypeLog,
 		BufferType: config.BufferTypeMem,
 		BufferSize: bfSize,
+		FlushBytes: 128 * 1024 * 1024,
 	}
 }
 
+func PrepareConfigDisk(path string) *config.Config {
+	ret := &config.Config{}
+
+	err := ret.Set(map[string]string{
+		"RecordType":     config.RecordTypeLog,
+		"BufferType":     config.BufferTypeDisk,
+		"BufferSize":     fmt.Sprintf("%d", bfSize),
+		"DiskPath":       path,
+		"DiskSyncPolicy": config.DiskSyncAlways,
+	})
+
+	if err != nil {
+		log.Fatalf("Error setting config: %s", err)
+	}
+
+	return ret
+}
+
 func PrepareConfigRedis() *config.Config {
 	ret := &config.Config{}
 
@@ -59,10 +82,553 @@ func TestMem(t *testing.T) {
 	testBuffer(buf, t)
 }
 
-func TestRedis(t *testing.T) {
-	cfg := PrepareConfigRedis()
+func PrepareConfigMemLimits(policy string, spillPath string) *config.Config {
+	ret := &config.Config{}
 
-	ctx := context.Background()
+	err := ret.Set(map[string]string{
+		"RecordType":       config.RecordTypeLog,
+		"BufferType":       config.BufferTypeMem,
+		"BufferSize":       "100",
+		"MemMaxKeyRecords": "150",
+		"MemMaxRecords":    "200",
+		"MemFullPolicy":    policy,
+		"MemBlockTimeout":  "1",
+		"MemSpillPath":     spillPath,
+	})
+
+	if err != nil {
+		log.Fatalf("Error setting config: %s", err)
+	}
+
+	return ret
+}
+
+func TestMemLimitsReject(t *testing.T) {
+	buf := buffer.New(context.Background(), PrepareConfigMemLimits(config.MemFullPolicyReject, ""))
+	data := generateData(200)
+
+	for i, record := range data {
+		_, err := buf.Push("a", record)
+
+		if i < 150 && err != nil {
+			t.Error(err)
+		}
+
+		if i >= 150 && !errors.Is(err, buffer.ErrBufferFull) {
+			t.Errorf("Record %d was not rejected by key limit: %v", i, err)
+		}
+	}
+
+	for _, record := range data[:50] {
+		_, err := buf.Push("b", record)
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err := buf.Push("c", data[0])
+	var full *buffer.FullError
+
+	if !errors.As(err, &full) || full.Limit != "records" || full.Key != "c" {
+		t.Errorf("Record was not rejected by global limit: %v", err)
+	}
+
+	err = buf.Clear("a", 100)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = buf.Push("c", data[0])
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemLimitsDropOldest(t *testing.T) {
+	buf := buffer.New(context.Background(), PrepareConfigMemLimits(config.MemFullPolicyDropOldest, ""))
+	data := generateData(300)
+
+	for _, record := range data[:100] {
+		buf.Push("a", record)
+	}
+
+	batch := buf.Get("a")
+
+	for _, record := range data[100:] {
+		_, err := buf.Push("a", record)
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if buf.Len("a") != 150 {
+		t.Errorf("Buffer length is %d, expected 150", buf.Len("a"))
+	}
+
+	for i, record := range buf.Get("a") {
+		if record.ToJson() != batch[i].ToJson() {
+			t.Fatalf("Record %d being flushed was dropped", i)
+		}
+	}
+
+	err := buf.Clear("a", 100)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	remains := buf.Get("a")
+
+	if len(remains) != 50 || remains[0].ToJson() != data[250].ToJson() {
+		t.Errorf("Oldest records were not dropped, remains %d", len(remains))
+	}
+}
+
+func TestMemLimitsBlock(t *testing.T) {
+	buf := buffer.New(context.Background(), PrepareConfigMemLimits(config.MemFullPolicyBlock, ""))
+	data := generateData(151)
+
+	for _, record := range data[:150] {
+		buf.Push("a", record)
+	}
+
+	start := time.Now()
+	_, err := buf.Push("a", data[150])
+
+	if !errors.Is(err, buffer.ErrBufferFull) || time.Since(start) < time.Second {
+		t.Errorf("Record was not rejected after block timeout: %v", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		buf.Clear("a", 100)
+	}()
+
+	_, err = buf.Push("a", data[150])
+
+	if err != nil {
+		t.Errorf("Record was not stored after clear: %v", err)
+	}
+}
+
+func TestMemLimitsSpill(t *testing.T) {
+	path := t.TempDir()
+	cfg := PrepareConfigMemLimits(config.MemFullPolicySpill, path)
+	buf := buffer.New(context.Background(), cfg)
+	data := generateData(400)
+
+	for _, record := range data {
+		_, err := buf.Push("a", record)
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if buf.Len("a") != 400 {
+		t.Errorf("Buffer length is %d, expected 400", buf.Len("a"))
+	}
+
+	for page := 0; page < 2; page++ {
+		batch := buf.Get("a")
+
+		if len(batch) != 100 {
+			t.Fatalf("Batch length is %d, expected 100", len(batch))
+		}
+
+		for i, record := range batch {
+			if record.ToJson() != data[page*100+i].ToJson() {
+				t.Fatalf("Record %d of page %d is out of order", i, page)
+			}
+		}
+
+		err := buf.Clear("a", len(batch))
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := buf.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	buf = buffer.New(context.Background(), cfg)
+
+	if buf.Len("a") != 200 {
+		t.Errorf("Spilled records were not reloaded, length is %d, expected 200", buf.Len("a"))
+	}
+
+	batch := buf.Get("a")
+
+	if len(batch) != 100 || batch[0].ToJson() != data[200].ToJson() {
+		t.Errorf("Spilled records are out of order after reload")
+	}
+
+	err = buf.Clear("a", -1)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if buf.Len("a") != 0 {
+		t.Errorf("Buffer length is %d after clear", buf.Len("a"))
+	}
+}
+
+func TestMemSpillCorruptFrame(t *testing.T) {
+	path := t.TempDir()
+	cfg := PrepareConfigMemLimits(config.MemFullPolicySpill, path)
+	buf := buffer.New(context.Background(), cfg)
+
+	for _, record := range generateData(400) {
+		if _, err := buf.Push("a", record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf.Close()
+
+	buf = buffer.New(context.Background(), cfg)
+	spilled := buf.Len("a")
+	buf.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(path, "*.seg"))
+
+	if spilled == 0 || len(segments) != 1 {
+		t.Fatalf("Expected spilled records on 1 segment, got %d records and %v", spilled, segments)
+	}
+
+	// a header with a length far beyond the end of file must not be allocated
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3})
+	file.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	buf = buffer.New(context.Background(), cfg)
+	defer buf.Close()
+
+	runtime.ReadMemStats(&after)
+
+	if after.TotalAlloc-before.TotalAlloc > 1<<30 {
+		t.Errorf("Corrupt frame length was allocated, %d bytes", after.TotalAlloc-before.TotalAlloc)
+	}
+
+	if buf.Len("a") != spilled {
+		t.Errorf("Buffer length is %d, expected %d", buf.Len("a"), spilled)
+	}
+}
+
+func TestByteLen(t *testing.T) {
+	buffers := map[string]buffer.Buffer{
+		"mem":  buffer.New(context.Background(), PrepareConfigMem()),
+		"disk": buffer.New(context.Background(), PrepareConfigDisk(t.TempDir())),
+	}
+
+	for name, buf := range buffers {
+		data := generateData(100)
+
+		for _, record := range data {
+			buf.Push("a", record)
+		}
+
+		if buf.ByteLen("a") != msgPackSize(data) {
+			t.Errorf("%s buffer byte length is %d, expected %d", name, buf.ByteLen("a"), msgPackSize(data))
+		}
+
+		err := buf.Clear("a", 40)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if buf.ByteLen("a") != msgPackSize(data[40:]) {
+			t.Errorf("%s buffer byte length after clear is %d, expected %d", name, buf.ByteLen("a"), msgPackSize(data[40:]))
+		}
+
+		err = buf.Clear("a", -1)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if buf.ByteLen("a") != 0 {
+			t.Errorf("%s buffer byte length after clear all is %d", name, buf.ByteLen("a"))
+		}
+	}
+}
+
+func msgPackSize(data []domain.Record) int {
+	ret := 0
+
+	for _, record := range data {
+		ret += len(record.ToMsgPack())
+	}
+
+	return ret
+}
+
+func TestDisk(t *testing.T) {
+	cfg := PrepareConfigDisk(t.TempDir())
+	buf := buffer.New(context.Background(), cfg)
+
+	if buf == nil {
+		t.Error("Buffer is nil")
+	}
+
+	testBuffer(buf, t)
+}
+
+func TestDiskReplay(t *testing.T) {
+	cfg := PrepareConfigDisk(t.TempDir())
+	buf := buffer.NewDisk(context.Background(), cfg)
+
+	if buf == nil {
+		t.Fatal("Buffer is nil")
+	}
+
+	var key string = "test"
+	data := generateData(bfSize)
+
+	for _, record := range data {
+		_, err := buf.Push(key, record)
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := buf.Clear(key, bfSize/2)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = buf.PushDLQ(key, buffer.NewDLQEnvelope(key, data[0], buffer.DLQStageConverter, errors.New("conversion failed"), "test"))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = buf.PushRecovery(key, bytes.NewBuffer(data[0].ToMsgPack()))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	retry := buffer.NewRecoveryData(key, bytes.NewBuffer(data[1].ToMsgPack()))
+	retry.Attempts = 2
+	retry.NextAttempt = time.Now().Add(time.Minute).Round(time.Millisecond)
+	retry.LastError = "write failed"
+
+	err = buf.PutRecovery(retry)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = buf.PushPoison(buffer.NewRecoveryData(key, bytes.NewBuffer(data[2].ToMsgPack())))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = buf.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	buf = buffer.NewDisk(context.Background(), cfg)
+
+	if buf == nil {
+		t.Fatal("Buffer is nil after restart")
+	}
+
+	if buf.Len(key) != bfSize/2 {
+		t.Errorf("Buffer length after replay is %d, expected %d", buf.Len(key), bfSize/2)
+	}
+
+	result := buf.Get(key)
+
+	for i, record := range result {
+		if record.ToJson() != data[bfSize/2+i].ToJson() {
+			t.Errorf("Replayed record %d is not equal to source", i)
+			break
+		}
+	}
+
+	dlq, err := buf.GetDLQ()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(dlq[key]) != 1 {
+		t.Fatal("DLQ was not replayed")
+	}
+
+	if dlq[key][0].Stage != buffer.DLQStageConverter || dlq[key][0].Error != "conversion failed" || dlq[key][0].Instance != "test" || dlq[key][0].Attempts != 1 {
+		t.Errorf("DLQ envelope was not replayed: %+v", dlq[key][0])
+	}
+
+	if dlq[key][0].Record.ToJson() != data[0].ToJson() {
+		t.Error("DLQ record is not equal to source")
+	}
+
+	if !buf.HasRecovery() {
+		t.Error("Recovery data was not replayed")
+	}
+
+	recovery, err := buf.GetRecovery()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(recovery) != 2 || recovery[1].Attempts != 2 || !recovery[1].NextAttempt.Equal(retry.NextAttempt) || recovery[1].LastError != retry.LastError {
+		t.Error("Recovery retry schedule was not replayed")
+	}
+
+	poison, err := buf.GetPoison()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(poison) != 1 {
+		t.Error("Poison data was not replayed")
+	}
+
+	err = buf.Clear(key, -1)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	buf.Close()
+
+	buf = buffer.NewDisk(context.Background(), cfg)
+
+	if buf.Len(key) != 0 {
+		t.Error("Segment was not truncated after clear")
+	}
+}
+
+func TestDiskCorruptFrame(t *testing.T) {
+	cfg := PrepareConfigDisk(t.TempDir())
+	buf := buffer.NewDisk(context.Background(), cfg)
+
+	if buf == nil {
+		t.Fatal("Buffer is nil")
+	}
+
+	key := "test"
+
+	for _, record := range generateData(3) {
+		if _, err := buf.Push(key, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf.Close()
+
+	segments, err := filepath.Glob(filepath.Join(cfg.DiskPath, "data", "*.seg"))
+
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("Expected 1 segment, got %v %v", segments, err)
+	}
+
+	info, err := os.Stat(segments[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header of a 4 GiB frame followed by a few bytes
+	_, err = file.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3})
+	file.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf = buffer.NewDisk(context.Background(), cfg)
+
+	if buf == nil {
+		t.Fatal("Buffer is nil after restart")
+	}
+
+	defer buf.Close()
+
+	if buf.Len(key) != 3 {
+		t.Errorf("Buffer length after replay is %d, expected 3", buf.Len(key))
+	}
+
+	if after, _ := os.Stat(segments[0]); after.Size() != info.Size() {
+		t.Errorf("Corrupt frame was not truncated, size %d, expected %d", after.Size(), info.Size())
+	}
+}
+
+func TestDLQEnvelopeLegacy(t *testing.T) {
+	data := generateData(1)
+
+	item, err := buffer.DecodeDLQEnvelope(config.RecordTypeLog, data[0].ToMsgPack())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Stage != buffer.DLQStageUnknown || item.Key != data[0].Key() || item.Record.ToJson() != data[0].ToJson() {
+		t.Errorf("Raw DLQ record was not wrapped in an envelope: %+v", item)
+	}
+
+	envelope := buffer.NewDLQEnvelope(data[0].Key(), data[0], buffer.DLQStageWriter, errors.New("write failed"), "test")
+	item, err = buffer.DecodeDLQEnvelope(config.RecordTypeLog, envelope.ToMsgPack())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Stage != buffer.DLQStageWriter || item.Error != "write failed" || item.Record.ToJson() != data[0].ToJson() {
+		t.Errorf("DLQ envelope was not decoded: %+v", item)
+	}
+}
+
+func PrepareConfigRedisStream() *config.Config {
+	ret := PrepareConfigRedis()
+
+	err := ret.Set(map[string]string{
+		"BufferType": config.BufferTypeRedisStream,
+	})
+
+	if err != nil {
+		log.Fatalf("Error setting config: %s", err)
+	}
+
+	return ret
+}
+
+func startRedis(ctx context.Context, t *testing.T) (*redis.Client, func()) {
 	req := testcontainers.ContainerRequest{
 		Image:        "redis:latest",
 		ExposedPorts: []string{"6379/tcp"},
@@ -75,11 +641,6 @@ func TestRedis(t *testing.T) {
 	if err != nil {
 		log.Fatalf("Could not start redis: %s", err)
 	}
-	defer func() {
-		if err := redisC.Terminate(ctx); err != nil {
-			t.Errorf("Could not stop redis: %s", err)
-		}
-	}()
 
 	endpoint, err := redisC.Endpoint(ctx, "")
 	if err != nil {
@@ -90,11 +651,125 @@ func TestRedis(t *testing.T) {
 		Addr: endpoint,
 	})
 
+	return client, func() {
+		if err := redisC.Terminate(ctx); err != nil {
+			t.Errorf("Could not stop redis: %s", err)
+		}
+	}
+}
+
+func TestRedis(t *testing.T) {
+	cfg := PrepareConfigRedis()
+
+	ctx := context.Background()
+	client, stop := startRedis(ctx, t)
+	defer stop()
+
 	buf := buffer.NewRedis(context.Background(), cfg, client)
 
 	testBuffer(buf, t)
 }
 
+func TestRedisStream(t *testing.T) {
+	cfg := PrepareConfigRedisStream()
+
+	ctx := context.Background()
+	client, stop := startRedis(ctx, t)
+	defer stop()
+
+	buf := buffer.NewRedisStream(context.Background(), cfg, client)
+
+	testBuffer(buf, t)
+}
+
+func TestRedisFencing(t *testing.T) {
+	cfg := PrepareConfigRedis()
+
+	ctx := context.Background()
+	client, stop := startRedis(ctx, t)
+	defer stop()
+
+	first := buffer.NewRedis(context.Background(), cfg, client)
+	second := buffer.NewRedis(context.Background(), cfg, client)
+
+	var key string = "test"
+
+	for _, record := range generateData(bfSize) {
+		_, err := first.Push(key, record)
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if !first.CheckLock(key) || !first.RenewLock(key) {
+		t.Error("Buffer lock is not owned by first instance")
+	}
+
+	if second.CheckLock(key) || second.RenewLock(key) {
+		t.Error("Buffer lock is owned by second instance")
+	}
+
+	if len(first.Get(key)) != bfSize {
+		t.Errorf("Buffer length is not %d", bfSize)
+	}
+
+	stale := first.Token(key)
+
+	if stale <= 0 || !first.CheckToken(key, stale) {
+		t.Errorf("Fencing token %d is not valid", stale)
+	}
+
+	// simulates lock expiration while first instance is still writing
+	client.Del(ctx, cfg.RedisLockPrefix+":"+key)
+
+	if !second.CheckLock(key) {
+		t.Error("Buffer lock is not owned by second instance")
+	}
+
+	if len(second.Get(key)) != bfSize {
+		t.Error("Pending batch was not taken by second instance")
+	}
+
+	token := second.Token(key)
+
+	if token <= stale {
+		t.Errorf("Fencing token is not increasing, stale: %d, current: %d", stale, token)
+	}
+
+	if first.CheckToken(key, stale) {
+		t.Error("Stale fencing token is still valid")
+	}
+
+	if first.RenewLock(key) {
+		t.Error("Lock was renewed by a stale instance")
+	}
+
+	if first.Clear(key, bfSize) == nil {
+		t.Error("Batch was committed by a stale instance")
+	}
+
+	err := second.Clear(key, bfSize)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = second.ReleaseLock(key)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if second.Len(key) != 0 || second.CheckToken(key, token) {
+		t.Error("Batch was not committed")
+	}
+
+	if !first.CheckLock(key) {
+		t.Error("Released lock was not taken by first instance")
+	}
+}
+
 func testBuffer(buf buffer.Buffer, t *testing.T) {
 	if buf == nil {
 		t.Error("Buffer is nil")
@@ -127,12 +802,24 @@ func testBuffer(buf buffer.Buffer, t *testing.T) {
 		t.Errorf("Buffer length is not %d", bfSize)
 	}
 
+	if buf.ByteLen(key) != msgPackSize(data) {
+		t.Errorf("Buffer byte length is %d, expected %d", buf.ByteLen(key), msgPackSize(data))
+	}
+
+	if !buf.CheckLock(key) {
+		t.Error("Buffer lock is not owned")
+	}
+
 	result := buf.Get(key)
 
 	if len(result) != bfSize {
 		t.Errorf("Buffer length is not %d", bfSize)
 	}
 
+	if !buf.CheckToken(key, buf.Token(key)) {
+		t.Error("Buffer fencing token is not valid")
+	}
+
 	for i, record := range result {
 		recData := record.GetData()
 
@@ -263,14 +950,62 @@ func testBuffer(buf buffer.Buffer, t *testing.T) {
 		}
 	}
 
-	for _, record := range data {
-		err := buf.PushDLQ(key, record)
+	for i, record := range data {
+		err := buf.PushDLQ(key, buffer.NewDLQEnvelope(key, record, buffer.DLQStageConverter, fmt.Errorf("error %d", i), "test"))
 
 		if err != nil {
 			t.Error(err)
 		}
 	}
 
+	dlq, err := buf.GetDLQ()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(dlq[key]) != len(data) {
+		t.Errorf("DLQ length is %d, expected %d", len(dlq[key]), len(data))
+	}
+
+	for i, item := range dlq[key] {
+		if item.Key != key || item.Stage != buffer.DLQStageConverter || item.Error != fmt.Sprintf("error %d", i) || item.Record.ToJson() != data[i].ToJson() {
+			t.Errorf("DLQ envelope %d is not equal to source", i)
+			break
+		}
+	}
+
+	// entries pushed after the read are kept
+	err = buf.PushDLQ(key, buffer.NewDLQEnvelope(key, data[0], buffer.DLQStageWriter, fmt.Errorf("late"), "test"))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = buf.RemoveDLQ(key, len(dlq[key]))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	dlq, _ = buf.GetDLQ()
+
+	if len(dlq[key]) != 1 || dlq[key][0].Error != "late" {
+		t.Errorf("DLQ length is %d, expected 1 late entry", len(dlq[key]))
+	}
+
+	err = buf.ClearDLQ()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	dlq, _ = buf.GetDLQ()
+
+	if len(dlq) != 0 {
+		t.Error("DLQ was not cleared")
+	}
+
 	recData := generateData(100)
 
 	bts := bytes.Buffer{}
@@ -307,6 +1042,63 @@ func testBuffer(buf buffer.Buffer, t *testing.T) {
 	if len(recs) != 100 {
 		t.Error("Recovery length is not 100")
 	}
+
+	err = buf.PushPoison(recs[0])
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	poison, err := buf.GetPoison()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(poison) != 1 || poison[0].Key != key {
+		t.Errorf("Poison length is %d, expected 1", len(poison))
+	}
+
+	err = buf.ClearPoison()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	poison, _ = buf.GetPoison()
+
+	if len(poison) != 0 {
+		t.Error("Poison store was not cleared")
+	}
+
+	// items put after the read are kept
+	err = buf.PushRecovery("other", bytes.NewBuffer(recData[0].ToMsgPack()))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = buf.RemoveRecovery(key, len(recs))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	recs, _ = buf.GetRecovery()
+
+	if len(recs) != 1 || recs[0].Key != "other" {
+		t.Errorf("Recovery length is %d, expected 1 of other key", len(recs))
+	}
+
+	err = buf.RemoveRecovery("other", 1)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if buf.HasRecovery() {
+		t.Error("Recovery data was not removed")
+	}
 }
 
 func generateData(qty int) []domain.Record {
@@ -0,0 +1,847 @@
+package buffer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	//"log/slog"
+
+	"sync"
+	"time"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
+)
+
+const diskSegmentExt = ".seg"
+const diskDataDir = "data"
+const diskDLQDir = "dlq"
+const diskRecoveryDir = "recovery"
+const diskRecoveryKey = "recovery"
+const diskPoisonDir = "poison"
+const diskPoisonKey = "poison"
+
+// Disk is a write-ahead-log buffer, every record is appended to a per-key segment file before it is kept in memory
+type Disk struct {
+	config   *config.Config
+	data     map[string][]domain.Record
+	bytes    map[string]int
+	dlq      map[string][]*DLQEnvelope
+	recovery []*RecoveryData
+	poison   []*RecoveryData
+	files    map[string]*os.File
+	path     string
+	mu       sync.Mutex
+	Ready    bool
+	ctx      context.Context
+}
+
+func NewDisk(ctx context.Context, config *config.Config) Buffer {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	ret := &Disk{
+		data:     make(map[string][]domain.Record),
+		bytes:    make(map[string]int),
+		dlq:      make(map[string][]*DLQEnvelope),
+		recovery: make([]*RecoveryData, 0),
+		poison:   make([]*RecoveryData, 0),
+		files:    make(map[string]*os.File),
+		path:     config.DiskPath,
+		config:   config,
+		ctx:      ctx,
+	}
+
+	for _, dir := range []string{diskDataDir, diskDLQDir, diskRecoveryDir, diskPoisonDir} {
+		err := os.MkdirAll(filepath.Join(ret.path, dir), os.ModePerm)
+
+		if err != nil {
+			slog.Error("Error creating buffer directory", "error", err, "path", ret.path, "module", "buffer.disk", "function", "NewDisk")
+			return nil
+		}
+	}
+
+	err := ret.replay()
+
+	if err != nil {
+		slog.Error("Error replaying buffer segments", "error", err, "path", ret.path, "module", "buffer.disk", "function", "NewDisk")
+		return nil
+	}
+
+	ret.Ready = true
+
+	go ret.runSync()
+
+	return ret
+}
+
+func (d *Disk) replay() error {
+	start := time.Now()
+
+	for _, dir := range []string{diskDataDir, diskDLQDir} {
+		keys, err := d.segmentKeys(dir)
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			frames, err := readSegment(d.segmentPath(dir, key))
+
+			if err != nil {
+				return err
+			}
+
+			records := make([]domain.Record, 0, len(frames))
+			envelopes := make([]*DLQEnvelope, 0)
+
+			for _, frame := range frames {
+				if dir == diskDLQDir {
+					envelope, err := DecodeDLQEnvelope(d.config.RecordType, frame)
+
+					if err != nil {
+						slog.Error("Error decoding DLQ envelope from segment, skipping", "error", err, "key", key, "dir", dir, "module", "buffer.disk", "function", "replay")
+						continue
+					}
+
+					envelopes = append(envelopes, envelope)
+					continue
+				}
+
+				record := domain.NewObj(d.config.RecordType)
+				err = record.FromMsgPack(frame)
+
+				if err != nil {
+					slog.Error("Error decoding record from segment, skipping", "error", err, "key", key, "dir", dir, "module", "buffer.disk", "function", "replay")
+					continue
+				}
+
+				records = append(records, record)
+				d.bytes[key] += len(frame)
+			}
+
+			if len(records) > 0 {
+				d.data[key] = records
+			}
+
+			if len(envelopes) > 0 {
+				d.dlq[key] = envelopes
+			}
+
+			slog.Info("Segment replayed", "key", key, "dir", dir, "records", len(records)+len(envelopes), "module", "buffer.disk", "function", "replay")
+		}
+	}
+
+	var err error
+
+	d.recovery, err = d.replayRecovery(diskRecoveryDir, diskRecoveryKey)
+
+	if err != nil {
+		return err
+	}
+
+	d.poison, err = d.replayRecovery(diskPoisonDir, diskPoisonKey)
+
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Buffer replayed", "keys", len(d.data), "dlq", len(d.dlq), "recovery", len(d.recovery), "poison", len(d.poison), "duration", time.Since(start), "module", "buffer.disk", "function", "replay")
+
+	return nil
+}
+
+func (d *Disk) replayRecovery(dir string, key string) ([]*RecoveryData, error) {
+	frames, err := readSegment(d.segmentPath(dir, key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*RecoveryData, 0, len(frames))
+
+	for _, frame := range frames {
+		item := &RecoveryData{}
+		err = item.FromMsgPack(frame)
+
+		if err != nil {
+			slog.Error("Error decoding recovery data from segment, skipping", "error", err, "dir", dir, "module", "buffer.disk", "function", "replayRecovery")
+			continue
+		}
+
+		ret = append(ret, item)
+	}
+
+	return ret, nil
+}
+
+func (d *Disk) runSync() {
+	if d.config.DiskSyncPolicy != config.DiskSyncInterval {
+		return
+	}
+
+	interval := time.Duration(d.config.DiskSyncInterval) * time.Second
+
+	for d.Ready {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		d.mu.Lock()
+		for name, file := range d.files {
+			err := file.Sync()
+
+			if err != nil {
+				slog.Error("Error syncing segment", "error", err, "segment", name, "module", "buffer.disk", "function", "runSync")
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (d *Disk) segmentPath(dir string, key string) string {
+	return filepath.Join(d.path, dir, base64.RawURLEncoding.EncodeToString([]byte(key))+diskSegmentExt)
+}
+
+func (d *Disk) segmentKeys(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(d.path, dir))
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || !strings.HasSuffix(name, diskSegmentExt) {
+			continue
+		}
+
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(name, diskSegmentExt))
+
+		if err != nil {
+			slog.Warn("Invalid segment name, skipping", "file", name, "module", "buffer.disk", "function", "segmentKeys")
+			continue
+		}
+
+		ret = append(ret, string(key))
+	}
+
+	return ret, nil
+}
+
+// append must be called with the lock held
+func (d *Disk) append(dir string, key string, data []byte) error {
+	name := d.segmentPath(dir, key)
+	file, ok := d.files[name]
+
+	if !ok {
+		var err error
+		file, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		d.files[name] = file
+	}
+
+	err := writeFrame(file, data)
+
+	if err != nil {
+		return err
+	}
+
+	if d.config.DiskSyncPolicy == config.DiskSyncAlways {
+		return file.Sync()
+	}
+
+	return nil
+}
+
+// rewrite must be called with the lock held, it replaces the segment content atomically
+func (d *Disk) rewrite(dir string, key string, frames [][]byte) error {
+	name := d.segmentPath(dir, key)
+
+	if file, ok := d.files[name]; ok {
+		file.Close()
+		delete(d.files, name)
+	}
+
+	if len(frames) == 0 {
+		err := os.Remove(name)
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	tmp := name + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+
+	for _, frame := range frames {
+		err = writeFrame(w, frame)
+
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = w.Flush()
+
+	if err == nil && d.config.DiskSyncPolicy != config.DiskSyncNone {
+		err = file.Sync()
+	}
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, name)
+
+	if err != nil || d.config.DiskSyncPolicy == config.DiskSyncNone {
+		return err
+	}
+
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir syncs a directory, so a file renamed into it survives a crash
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return file.Sync()
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// readSegment reads all complete frames of a segment, a torn frame at the end (crash during append) is truncated. A frame
+// longer than the rest of the file is a corrupt header, it is truncated the same way instead of being allocated.
+func readSegment(name string) ([][]byte, error) {
+	file, err := os.OpenFile(name, os.O_RDWR, 0644)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return [][]byte{}, nil
+		}
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	ret := make([][]byte, 0)
+	r := bufio.NewReader(file)
+	header := make([]byte, 4)
+	var offset int64
+
+	for {
+		_, err = io.ReadFull(r, header)
+
+		if err != nil {
+			break
+		}
+
+		length := int64(binary.BigEndian.Uint32(header))
+
+		if length > size-offset-4 {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+
+		frame := make([]byte, length)
+		_, err = io.ReadFull(r, frame)
+
+		if err != nil {
+			break
+		}
+
+		ret = append(ret, frame)
+		offset += int64(4 + len(frame))
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		slog.Warn("Torn frame found at the end of segment, truncating", "segment", name, "offset", offset, "module", "buffer.disk", "function", "readSegment")
+		err = file.Truncate(offset)
+
+		if err != nil {
+			return nil, err
+		}
+	} else if err != io.EOF {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func encodeRecords(records []domain.Record) [][]byte {
+	ret := make([][]byte, 0, len(records))
+
+	for _, record := range records {
+		ret = append(ret, record.ToMsgPack())
+	}
+
+	return ret
+}
+
+func (d *Disk) Close() error {
+	slog.Debug("Closing buffer", "module", "buffer.disk", "function", "Close")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Ready = false
+
+	var ret error
+
+	for name, file := range d.files {
+		err := file.Sync()
+
+		if err == nil {
+			err = file.Close()
+		}
+
+		if err != nil {
+			slog.Error("Error closing segment", "error", err, "segment", name, "module", "buffer.disk", "function", "Close")
+			ret = err
+		}
+
+		delete(d.files, name)
+	}
+
+	return ret
+}
+
+func (d *Disk) Len(key string) int {
+	slog.Debug("Getting buffer length", "key", key, "module", "buffer.disk", "function", "Len")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.data[key])
+}
+
+// ByteLen returns the msgpack encoded size of the records of a key
+func (d *Disk) ByteLen(key string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.bytes[key]
+}
+
+func (d *Disk) Push(key string, item domain.Record) (n int, err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeDisk, "push", start, err) }()
+
+	if len(key) == 0 {
+		slog.Warn("Key is empty", "module", "buffer.disk", "function", "Push")
+		return 0, errors.New("key is empty")
+	}
+
+	if item == nil {
+		slog.Warn("Item is nil", "key", key, "module", "buffer.disk", "function", "Push")
+		return 0, errors.New("item is nil")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data := item.ToMsgPack()
+	err = d.append(diskDataDir, key, data)
+
+	if err != nil {
+		slog.Error("Error appending record to segment", "error", err, "key", key, "module", "buffer.disk", "function", "Push")
+		return 0, err
+	}
+
+	values, ok := d.data[key]
+	if !ok {
+		values = make([]domain.Record, 0, d.config.BufferSize)
+	}
+
+	values = append(values, item)
+	d.data[key] = values
+	d.bytes[key] += len(data)
+
+	return len(values), nil
+}
+
+func (d *Disk) PushDLQ(key string, item *DLQEnvelope) error {
+	if item == nil || item.Record == nil {
+		slog.Warn("Item is nil", "key", key, "module", "buffer.disk", "function", "PushDLQ")
+		return errors.New("item is nil")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	slog.Debug("Pushing to DLQ", "key", key, "stage", item.Stage, "error", item.Error, "module", "buffer.disk", "function", "PushDLQ")
+
+	err := d.append(diskDLQDir, key, item.ToMsgPack())
+
+	if err != nil {
+		slog.Error("Error appending record to DLQ segment", "error", err, "key", key, "module", "buffer.disk", "function", "PushDLQ")
+		return err
+	}
+
+	d.dlq[key] = append(d.dlq[key], item)
+
+	return nil
+}
+
+func (d *Disk) GetDLQ() (map[string][]*DLQEnvelope, error) {
+	slog.Debug("GetDLQ data", "module", "buffer.disk", "function", "GetDLQ")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ret := make(map[string][]*DLQEnvelope)
+
+	for k, v := range d.dlq {
+		ret[k] = append(make([]*DLQEnvelope, 0, len(v)), v...)
+	}
+
+	return ret, nil
+}
+
+func (d *Disk) ClearDLQ() error {
+	slog.Debug("Clearing DLQ", "module", "buffer.disk", "function", "ClearDLQ")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key := range d.dlq {
+		err := d.rewrite(diskDLQDir, key, nil)
+
+		if err != nil {
+			slog.Error("Error removing DLQ segment", "error", err, "key", key, "module", "buffer.disk", "function", "ClearDLQ")
+			return err
+		}
+	}
+
+	d.dlq = make(map[string][]*DLQEnvelope)
+
+	return nil
+}
+
+// RemoveDLQ removes the first size DLQ entries of key and rewrites its segment, entries pushed after they were read are
+// kept
+func (d *Disk) RemoveDLQ(key string, size int) error {
+	slog.Debug("Removing DLQ entries", "key", key, "size", size, "module", "buffer.disk", "function", "RemoveDLQ")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	values := d.dlq[key]
+
+	if size > len(values) {
+		size = len(values)
+	}
+
+	remains := values[size:]
+	frames := make([][]byte, len(remains))
+
+	for i, item := range remains {
+		frames[i] = item.ToMsgPack()
+	}
+
+	err := d.rewrite(diskDLQDir, key, frames)
+
+	if err != nil {
+		slog.Error("Error rewriting DLQ segment", "error", err, "key", key, "module", "buffer.disk", "function", "RemoveDLQ")
+		return err
+	}
+
+	if len(remains) == 0 {
+		delete(d.dlq, key)
+		return nil
+	}
+
+	d.dlq[key] = remains
+
+	return nil
+}
+
+func (d *Disk) Get(key string) []domain.Record {
+	defer metrics.ObserveBuffer(config.BufferTypeDisk, "get", time.Now(), nil)
+
+	slog.Debug("Getting buffer", "key", key, "module", "buffer.disk", "function", "Get")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	values, ok := d.data[key]
+
+	if !ok {
+		return nil
+	}
+
+	if len(values) > d.config.BufferSize {
+		return values[:d.config.BufferSize]
+	}
+
+	return values
+}
+
+func (d *Disk) Clear(key string, size int) (err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeDisk, "clear", start, err) }()
+
+	slog.Debug("Clearing buffer", "key", key, "size", size, "module", "buffer.disk", "function", "Clear")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	values, ok := d.data[key]
+
+	if !ok {
+		return nil
+	}
+
+	if size == -1 || size > len(values) {
+		size = len(values)
+	}
+
+	remains := values[size:]
+	frames := encodeRecords(remains)
+
+	err = d.rewrite(diskDataDir, key, frames)
+
+	if err != nil {
+		slog.Error("Error truncating segment", "error", err, "key", key, "module", "buffer.disk", "function", "Clear")
+		return err
+	}
+
+	if len(remains) == 0 {
+		delete(d.data, key)
+		delete(d.bytes, key)
+		return nil
+	}
+
+	d.data[key] = remains
+	d.bytes[key] = 0
+
+	for _, frame := range frames {
+		d.bytes[key] += len(frame)
+	}
+
+	return nil
+}
+
+// Rollback has nothing to do here, Get doesn't remove records from buffer until Clear is called
+func (d *Disk) Rollback(key string) error {
+	slog.Debug("Rolling back batch", "key", key, "module", "buffer.disk", "function", "Rollback")
+	return nil
+}
+
+func (d *Disk) Keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := make([]string, 0, len(d.data))
+
+	for k := range d.data {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+func (d *Disk) IsReady() bool {
+	return d.Ready
+}
+
+func (d *Disk) HasRecovery() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.recovery) > 0
+}
+
+func (d *Disk) PushRecovery(key string, buf *bytes.Buffer) error {
+	return d.PutRecovery(NewRecoveryData(key, buf))
+}
+
+func (d *Disk) PutRecovery(item *RecoveryData) error {
+	slog.Debug("Pushing data to post recovery", "key", item.Key, "attempts", item.Attempts, "module", "buffer.disk", "function", "PutRecovery", "size", len(item.Data))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.append(diskRecoveryDir, diskRecoveryKey, item.ToMsgPack())
+
+	if err != nil {
+		slog.Error("Error appending recovery data to segment", "error", err, "key", item.Key, "module", "buffer.disk", "function", "PutRecovery")
+		return err
+	}
+
+	d.recovery = append(d.recovery, item)
+
+	return nil
+}
+
+func (d *Disk) GetRecovery() ([]*RecoveryData, error) {
+	slog.Debug("Getting recovery data", "module", "buffer.disk", "function", "GetRecovery")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append(make([]*RecoveryData, 0, len(d.recovery)), d.recovery...), nil
+}
+
+func (d *Disk) ClearRecoveryData() error {
+	slog.Debug("Clearing recovery data", "module", "buffer.disk", "function", "ClearRecoveryData")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.rewrite(diskRecoveryDir, diskRecoveryKey, nil)
+
+	if err != nil {
+		slog.Error("Error removing recovery segment", "error", err, "module", "buffer.disk", "function", "ClearRecoveryData")
+		return err
+	}
+
+	d.recovery = make([]*RecoveryData, 0)
+
+	return nil
+}
+
+// RemoveRecovery removes the first size recovery items of key and rewrites the recovery segment, items put after they
+// were read are kept
+func (d *Disk) RemoveRecovery(key string, size int) error {
+	slog.Debug("Removing recovery data", "key", key, "size", size, "module", "buffer.disk", "function", "RemoveRecovery")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	remains := removeRecovery(d.recovery, key, size)
+	frames := make([][]byte, len(remains))
+
+	for i, item := range remains {
+		frames[i] = item.ToMsgPack()
+	}
+
+	err := d.rewrite(diskRecoveryDir, diskRecoveryKey, frames)
+
+	if err != nil {
+		slog.Error("Error rewriting recovery segment", "error", err, "key", key, "module", "buffer.disk", "function", "RemoveRecovery")
+		return err
+	}
+
+	d.recovery = remains
+
+	return nil
+}
+
+func (d *Disk) PushPoison(item *RecoveryData) error {
+	slog.Debug("Pushing to poison store", "key", item.Key, "attempts", item.Attempts, "module", "buffer.disk", "function", "PushPoison")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.append(diskPoisonDir, diskPoisonKey, item.ToMsgPack())
+
+	if err != nil {
+		slog.Error("Error appending poison data to segment", "error", err, "key", item.Key, "module", "buffer.disk", "function", "PushPoison")
+		return err
+	}
+
+	d.poison = append(d.poison, item)
+
+	return nil
+}
+
+func (d *Disk) GetPoison() ([]*RecoveryData, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append(make([]*RecoveryData, 0, len(d.poison)), d.poison...), nil
+}
+
+func (d *Disk) ClearPoison() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.rewrite(diskPoisonDir, diskPoisonKey, nil)
+
+	if err != nil {
+		slog.Error("Error removing poison segment", "error", err, "module", "buffer.disk", "function", "ClearPoison")
+		return err
+	}
+
+	d.poison = make([]*RecoveryData, 0)
+
+	return nil
+}
+
+func (d *Disk) CheckLock(key string) bool {
+	return true
+}
+
+func (d *Disk) RenewLock(key string) bool {
+	return true
+}
+
+func (d *Disk) ReleaseLock(key string) error {
+	return nil
+}
+
+// Token returns 0, a local buffer is flushed by only one instance and doesn't need fencing
+func (d *Disk) Token(key string) int64 {
+	return 0
+}
+
+func (d *Disk) CheckToken(key string, token int64) bool {
+	return true
+}
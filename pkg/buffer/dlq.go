@@ -0,0 +1,106 @@
+package buffer
+
+import (
+	"data2parquet/pkg/domain"
+	"errors"
+	"time"
+
+	msgp "github.com/vmihailenco/msgpack/v5"
+)
+
+// Stages where a record can fail and be pushed to DLQ
+const (
+	DLQStageConverter = "converter"
+	DLQStageSchema    = "schema"
+	DLQStageWriter    = "writer"
+	DLQStageTransform = "transform"
+	DLQStageBuffer    = "buffer"
+	DLQStageUnknown   = "unknown"
+)
+
+// DLQEnvelope wraps a DLQ record with the reason it failed, so DLQ can be triaged by error and stage. Record is stored
+// msgpack encoded on Data, Key is the key the record was flushed from.
+type DLQEnvelope struct {
+	Key       string        `msg:"key" json:"key"`
+	Record    domain.Record `msg:"-" msgpack:"-" json:"record"`
+	Data      []byte        `msg:"data" json:"-"`
+	Error     string        `msg:"error" json:"error"`
+	Stage     string        `msg:"stage" json:"stage"`
+	Timestamp time.Time     `msg:"timestamp" json:"timestamp"`
+	Instance  string        `msg:"instance" json:"instance"`
+	Attempts  int           `msg:"attempts" json:"attempts"`
+}
+
+func NewDLQEnvelope(key string, record domain.Record, stage string, err error, instance string) *DLQEnvelope {
+	ret := &DLQEnvelope{
+		Key:       key,
+		Record:    record,
+		Stage:     stage,
+		Timestamp: time.Now(),
+		Instance:  instance,
+		Attempts:  1,
+	}
+
+	if err != nil {
+		ret.Error = err.Error()
+	}
+
+	return ret
+}
+
+// Fail updates the envelope with a new failure of the same record, e.g. on DLQ replay
+func (e *DLQEnvelope) Fail(stage string, err error, instance string) {
+	e.Stage = stage
+	e.Error = ""
+	e.Timestamp = time.Now()
+	e.Instance = instance
+	e.Attempts++
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+func (e *DLQEnvelope) ToMsgPack() []byte {
+	if e.Record != nil {
+		e.Data = e.Record.ToMsgPack()
+	}
+
+	data, err := msgp.Marshal(e)
+
+	if err != nil {
+		slog.Error("Error marshalling MsgPack", "error", err)
+		return nil
+	}
+
+	return data
+}
+
+// DecodeDLQEnvelope decodes an envelope and its record. DLQ entries stored by older versions are raw records, they are
+// wrapped in an envelope with unknown stage.
+func DecodeDLQEnvelope(recordType string, data []byte) (*DLQEnvelope, error) {
+	ret := &DLQEnvelope{}
+	err := msgp.Unmarshal(data, ret)
+
+	if err == nil && len(ret.Data) > 0 {
+		ret.Record = domain.NewObj(recordType)
+		err = ret.Record.FromMsgPack(ret.Data)
+
+		return ret, err
+	}
+
+	record := domain.NewObj(recordType)
+	errRecord := record.FromMsgPack(data)
+
+	if errRecord != nil {
+		return nil, errors.Join(err, errRecord)
+	}
+
+	return &DLQEnvelope{
+		Key:      record.Key(),
+		Record:   record,
+		Data:     data,
+		Stage:    DLQStageUnknown,
+		Attempts: 1,
+	}, nil
+}
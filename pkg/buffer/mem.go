@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 
 	//"log/slog"
 
@@ -12,13 +13,45 @@ import (
 
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
+)
+
+var ErrBufferFull = errors.New("buffer is full")
+
+// FullError is returned by Push when a memory buffer limit is reached and the record was not stored
+type FullError struct {
+	Key   string
+	Limit string
+}
+
+func (e *FullError) Error() string {
+	return fmt.Sprintf("buffer is full, %s limit reached for key %s", e.Limit, e.Key)
+}
+
+func (e *FullError) Is(target error) bool {
+	return target == ErrBufferFull
+}
+
+const (
+	memLimitRecords    = "records"
+	memLimitBytes      = "bytes"
+	memLimitKeyRecords = "key-records"
+	memLimitKeyBytes   = "key-bytes"
 )
 
 type Mem struct {
 	config   *config.Config
 	data     map[string][]domain.Record
-	dlq      map[string][]domain.Record
+	sizes    map[string][]int
+	inflight map[string]int
+	records  int
+	bytes    int
+	keyBytes map[string]int
+	space    chan struct{}
+	spill    *spill
+	dlq      map[string][]*DLQEnvelope
 	recovery []*RecoveryData
+	poison   []*RecoveryData
 	mu       sync.Mutex
 	Ready    bool
 	ctx      context.Context
@@ -27,19 +60,49 @@ type Mem struct {
 func NewMem(ctx context.Context, config *config.Config) Buffer {
 	ret := &Mem{
 		data:     make(map[string][]domain.Record),
-		dlq:      make(map[string][]domain.Record),
+		sizes:    make(map[string][]int),
+		inflight: make(map[string]int),
+		keyBytes: make(map[string]int),
+		space:    make(chan struct{}),
+		dlq:      make(map[string][]*DLQEnvelope),
 		recovery: make([]*RecoveryData, 0),
+		poison:   make([]*RecoveryData, 0),
 		config:   config,
 		ctx:      ctx,
 		Ready:    true,
 	}
 
+	ret.initSpill()
+
 	return ret
 }
 
+func (m *Mem) initSpill() {
+	if m.config.MemFullPolicy != config.MemFullPolicySpill {
+		return
+	}
+
+	sp, err := newSpill(m.config.MemSpillPath)
+
+	if err != nil {
+		slog.Error("Error creating spill directory, records will be rejected when buffer is full", "error", err, "path", m.config.MemSpillPath, "module", "buffer.mem", "function", "initSpill")
+		return
+	}
+
+	m.spill = sp
+}
+
 func (m *Mem) Close() error {
 	slog.Debug("Closing buffer", "module", "buffer.mem", "function", "Close")
 	m.Ready = false
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.spill != nil {
+		return m.spill.close()
+	}
+
 	return nil
 }
 
@@ -53,17 +116,34 @@ func (m *Mem) Len(key string) int {
 		return 0
 	}
 
-	if _, ok := m.data[key]; !ok {
-		return 0
+	ret := len(m.data[key])
+
+	if m.spill != nil {
+		ret += m.spill.len(key)
 	}
 
-	return len(m.data[key])
+	return ret
 }
 
-func (m *Mem) Push(key string, item domain.Record) (int, error) {
+// ByteLen returns the msgpack encoded size of the records of a key, it is only tracked when `MemMaxBytes`,
+// `MemMaxKeyBytes` or `FlushBytes` is set, otherwise only spilled records are counted
+func (m *Mem) ByteLen(key string) int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	ret := m.keyBytes[key]
+
+	if m.spill != nil {
+		ret += m.spill.byteLen(key)
+	}
+
+	return ret
+}
+
+func (m *Mem) Push(key string, item domain.Record) (n int, err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeMem, "push", start, err) }()
+
 	if len(key) == 0 {
 		slog.Warn("Key is empty", "module", "buffer.mem", "function", "Push")
 		return 0, errors.New("key is empty")
@@ -74,6 +154,52 @@ func (m *Mem) Push(key string, item domain.Record) (int, error) {
 		return 0, errors.New("item is nil")
 	}
 
+	size := m.recordSize(item)
+	deadline := time.Now().Add(time.Duration(m.config.MemBlockTimeout) * time.Second)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// records of a key with spilled records are spilled too, so the key keeps its order
+	if m.spill != nil && m.spill.len(key) > 0 {
+		return m.pushSpill(key, item)
+	}
+
+	for limit := m.checkLimits(key, size); len(limit) > 0; limit = m.checkLimits(key, size) {
+		switch m.config.MemFullPolicy {
+		case config.MemFullPolicyReject:
+			slog.Warn("Buffer is full, rejecting record", "key", key, "limit", limit, "module", "buffer.mem", "function", "Push")
+			return 0, &FullError{Key: key, Limit: limit}
+		case config.MemFullPolicyDropOldest:
+			if !m.dropOldest(key, limit) {
+				slog.Warn("Buffer is full and all records are being flushed, rejecting record", "key", key, "limit", limit, "module", "buffer.mem", "function", "Push")
+				return 0, &FullError{Key: key, Limit: limit}
+			}
+		case config.MemFullPolicySpill:
+			if m.spill == nil {
+				return 0, &FullError{Key: key, Limit: limit}
+			}
+			return m.pushSpill(key, item)
+		default:
+			wait := time.Until(deadline)
+
+			if wait <= 0 {
+				slog.Warn("Buffer is full, timeout waiting for free space", "key", key, "limit", limit, "module", "buffer.mem", "function", "Push")
+				return 0, &FullError{Key: key, Limit: limit}
+			}
+
+			space := m.space
+			m.mu.Unlock()
+
+			select {
+			case <-space:
+			case <-time.After(wait):
+			}
+
+			m.mu.Lock()
+		}
+	}
+
 	values, ok := m.data[key]
 	if !ok {
 		values = make([]domain.Record, 0, m.config.BufferSize)
@@ -82,12 +208,101 @@ func (m *Mem) Push(key string, item domain.Record) (int, error) {
 	values = append(values, item)
 
 	m.data[key] = values
+	m.sizes[key] = append(m.sizes[key], size)
+	m.records++
+	m.bytes += size
+	m.keyBytes[key] += size
 
 	return len(values), nil
 }
 
-func (m *Mem) PushDLQ(key string, item domain.Record) error {
-	if item == nil {
+// recordSize returns the msgpack size of a record, only when a bytes limit or flush trigger is used
+func (m *Mem) recordSize(item domain.Record) int {
+	if m.config.MemMaxBytes <= 0 && m.config.MemMaxKeyBytes <= 0 && m.config.FlushBytes <= 0 {
+		return 0
+	}
+
+	return len(item.ToMsgPack())
+}
+
+// checkLimits must be called with the lock held, it returns the limit a new record would exceed or an empty string
+func (m *Mem) checkLimits(key string, size int) string {
+	if m.config.MemMaxKeyRecords > 0 && len(m.data[key])+1 > m.config.MemMaxKeyRecords {
+		return memLimitKeyRecords
+	}
+
+	if m.config.MemMaxKeyBytes > 0 && m.keyBytes[key]+size > m.config.MemMaxKeyBytes {
+		return memLimitKeyBytes
+	}
+
+	if m.config.MemMaxRecords > 0 && m.records+1 > m.config.MemMaxRecords {
+		return memLimitRecords
+	}
+
+	if m.config.MemMaxBytes > 0 && m.bytes+size > m.config.MemMaxBytes {
+		return memLimitBytes
+	}
+
+	return ""
+}
+
+// dropOldest must be called with the lock held, it drops the oldest record not being flushed of the key, or of the biggest
+// key when a global limit is reached and the key has no records to drop
+func (m *Mem) dropOldest(key string, limit string) bool {
+	target := key
+
+	if len(m.data[key]) <= m.inflight[key] {
+		if limit == memLimitKeyRecords || limit == memLimitKeyBytes {
+			return false
+		}
+
+		target = ""
+
+		for k, values := range m.data {
+			if len(values) > m.inflight[k] && (len(target) == 0 || len(values) > len(m.data[target])) {
+				target = k
+			}
+		}
+
+		if len(target) == 0 {
+			return false
+		}
+	}
+
+	i := m.inflight[target]
+	size := m.sizes[target][i]
+
+	m.data[target] = append(m.data[target][:i], m.data[target][i+1:]...)
+	m.sizes[target] = append(m.sizes[target][:i], m.sizes[target][i+1:]...)
+	m.records--
+	m.bytes -= size
+	m.keyBytes[target] -= size
+
+	slog.Warn("Buffer is full, oldest record dropped", "key", key, "dropped-key", target, "limit", limit, "module", "buffer.mem", "function", "dropOldest")
+
+	return true
+}
+
+// pushSpill must be called with the lock held
+func (m *Mem) pushSpill(key string, item domain.Record) (int, error) {
+	err := m.spill.push(key, item.ToMsgPack())
+
+	if err != nil {
+		slog.Error("Error spilling record to disk", "error", err, "key", key, "module", "buffer.mem", "function", "pushSpill")
+		return 0, err
+	}
+
+	return len(m.data[key]) + m.spill.len(key), nil
+}
+
+// notify must be called with the lock held, it wakes up all Push calls waiting for free space
+func (m *Mem) notify() {
+	close(m.space)
+	m.space = make(chan struct{})
+}
+
+func (m *Mem) PushDLQ(key string, item *DLQEnvelope) error {
+	if item == nil || item.Record == nil {
 		slog.Warn("Item is nil", "key", key, "module", "buffer.mem", "function", "PushDLQ")
 		return errors.New("item is nil")
 	}
@@ -95,10 +310,10 @@ func (m *Mem) PushDLQ(key string, item domain.Record) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	slog.Debug("Pushing to recovery", "key", key, "record", item, "module", "buffer.mem", "function", "PushDLQ")
+	slog.Debug("Pushing to DLQ", "key", key, "stage", item.Stage, "error", item.Error, "module", "buffer.mem", "function", "PushDLQ")
 
 	if _, ok := m.dlq[key]; !ok {
-		m.dlq[key] = make([]domain.Record, 0, m.config.BufferSize)
+		m.dlq[key] = make([]*DLQEnvelope, 0)
 	}
 
 	m.dlq[key] = append(m.dlq[key], item)
@@ -106,19 +321,16 @@ func (m *Mem) PushDLQ(key string, item domain.Record) error {
 	return nil
 }
 
-func (m *Mem) GetDLQ() (map[string][]domain.Record, error) {
+func (m *Mem) GetDLQ() (map[string][]*DLQEnvelope, error) {
 	slog.Debug("GetDLQ data", "module", "buffer.mem", "function", "GetDLQ")
-	if m.recovery == nil {
-		return make(map[string][]domain.Record), nil
-	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	ret := make(map[string][]domain.Record)
+	ret := make(map[string][]*DLQEnvelope)
 
 	for k, v := range m.dlq {
-		ret[k] = v
+		ret[k] = append(make([]*DLQEnvelope, 0, len(v)), v...)
 	}
 
 	return ret, nil
@@ -133,12 +345,33 @@ func (m *Mem) ClearDLQ() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.dlq = make(map[string][]domain.Record)
+	m.dlq = make(map[string][]*DLQEnvelope)
+
+	return nil
+}
+
+// RemoveDLQ removes the first size DLQ entries of key, entries pushed after they were read are kept
+func (m *Mem) RemoveDLQ(key string, size int) error {
+	slog.Debug("Removing DLQ entries", "key", key, "size", size, "module", "buffer.mem", "function", "RemoveDLQ")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := m.dlq[key]
+
+	if size >= len(values) {
+		delete(m.dlq, key)
+		return nil
+	}
+
+	m.dlq[key] = values[size:]
 
 	return nil
 }
 
 func (m *Mem) Get(key string) []domain.Record {
+	defer metrics.ObserveBuffer(config.BufferTypeMem, "get", time.Now(), nil)
+
 	slog.Debug("Getting buffer", "key", key, "module", "buffer.mem", "function", "Get")
 
 	m.mu.Lock()
@@ -148,20 +381,47 @@ func (m *Mem) Get(key string) []domain.Record {
 		return nil
 	}
 
-	if _, ok := m.data[key]; !ok {
-		return nil
+	values := m.data[key]
+
+	if len(values) > m.config.BufferSize {
+		values = values[:m.config.BufferSize]
+	}
+
+	m.inflight[key] = len(values)
+
+	if m.spill == nil || len(values) == m.config.BufferSize || m.spill.len(key) == 0 {
+		return values
 	}
 
-	l := len(m.data[key])
+	frames, err := m.spill.read(key, m.config.BufferSize-len(values))
 
-	if l > m.config.BufferSize {
-		return m.data[key][:m.config.BufferSize]
+	if err != nil {
+		slog.Error("Error reading spilled records", "error", err, "key", key, "module", "buffer.mem", "function", "Get")
+		return values
 	}
 
-	return m.data[key]
+	ret := make([]domain.Record, len(values), len(values)+len(frames))
+	copy(ret, values)
+
+	for _, frame := range frames {
+		record := domain.NewObj(m.config.RecordType)
+		err = record.FromMsgPack(frame)
+
+		if err != nil {
+			slog.Error("Error decoding spilled record, skipping", "error", err, "key", key, "module", "buffer.mem", "function", "Get")
+			continue
+		}
+
+		ret = append(ret, record)
+	}
+
+	return ret
 }
 
-func (m *Mem) Clear(key string, size int) error {
+func (m *Mem) Clear(key string, size int) (err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeMem, "clear", start, err) }()
+
 	slog.Debug("Clearing buffer", "key", key, "size", size, "module", "buffer.mem", "function", "Clear")
 	if m.data == nil {
 		return nil
@@ -169,29 +429,80 @@ func (m *Mem) Clear(key string, size int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, ok := m.data[key]; !ok {
-		return nil
+	delete(m.inflight, key)
+	defer m.notify()
+
+	values := m.data[key]
+	cleared := size
+
+	if size == -1 || size > len(values) {
+		cleared = len(values)
 	}
 
-	if size == -1 || size > len(m.data[key]) {
+	for _, s := range m.sizes[key][:cleared] {
+		m.bytes -= s
+		m.keyBytes[key] -= s
+	}
+
+	m.records -= cleared
+
+	if cleared == len(values) {
 		delete(m.data, key)
-		return nil
+		delete(m.sizes, key)
+		delete(m.keyBytes, key)
+	} else {
+		m.data[key] = values[cleared:]
+		m.sizes[key] = m.sizes[key][cleared:]
 	}
 
-	m.data[key] = m.data[key][size:]
+	if m.spill != nil && (size == -1 || size > cleared) {
+		remains := size
+
+		if size > 0 {
+			remains = size - cleared
+		}
+
+		err := m.spill.clear(key, remains)
+
+		if err != nil {
+			slog.Error("Error clearing spilled records", "error", err, "key", key, "module", "buffer.mem", "function", "Clear")
+			return err
+		}
+	}
 
 	return nil
 }
-func (m *Mem) Keys() []string {
-	keys := make([]string, 0, len(m.data))
+
+// Rollback has nothing to do here, Get doesn't remove records from buffer until Clear is called
+func (m *Mem) Rollback(key string) error {
+	slog.Debug("Rolling back batch", "key", key, "module", "buffer.mem", "function", "Rollback")
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	delete(m.inflight, key)
+
+	return nil
+}
+
+func (m *Mem) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.data))
+
 	for k := range m.data {
 		keys = append(keys, k)
 	}
 
+	if m.spill != nil {
+		for _, k := range m.spill.keys() {
+			if _, ok := m.data[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+	}
+
 	return keys
 }
 
@@ -207,16 +518,16 @@ func (m *Mem) HasRecovery() bool {
 }
 
 func (m *Mem) PushRecovery(key string, buf *bytes.Buffer) error {
-	slog.Debug("Pushing to DLQ", "key", key, "module", "buffer.mem", "function", "PushDLQ")
+	return m.PutRecovery(NewRecoveryData(key, buf))
+}
+
+func (m *Mem) PutRecovery(item *RecoveryData) error {
+	slog.Debug("Pushing data to post recovery", "key", item.Key, "attempts", item.Attempts, "module", "buffer.mem", "function", "PutRecovery")
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.recovery = append(m.recovery, &RecoveryData{
-		Key:       key,
-		Data:      buf.Bytes(),
-		Timestamp: time.Now(),
-	})
+	m.recovery = append(m.recovery, item)
 
 	return nil
 }
@@ -245,6 +556,62 @@ func (m *Mem) ClearRecoveryData() error {
 	return nil
 }
 
+// RemoveRecovery removes the first size recovery items of key, items put after they were read are kept
+func (m *Mem) RemoveRecovery(key string, size int) error {
+	slog.Debug("Removing recovery data", "key", key, "size", size, "module", "buffer.mem", "function", "RemoveRecovery")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.recovery = removeRecovery(m.recovery, key, size)
+
+	return nil
+}
+
+func (m *Mem) PushPoison(item *RecoveryData) error {
+	slog.Debug("Pushing to poison store", "key", item.Key, "attempts", item.Attempts, "module", "buffer.mem", "function", "PushPoison")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.poison = append(m.poison, item)
+
+	return nil
+}
+
+func (m *Mem) GetPoison() ([]*RecoveryData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append(make([]*RecoveryData, 0, len(m.poison)), m.poison...), nil
+}
+
+func (m *Mem) ClearPoison() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.poison = make([]*RecoveryData, 0)
+
+	return nil
+}
+
 func (m *Mem) CheckLock(key string) bool {
 	return true
 }
+
+func (m *Mem) RenewLock(key string) bool {
+	return true
+}
+
+func (m *Mem) ReleaseLock(key string) error {
+	return nil
+}
+
+// Token returns 0, a local buffer is flushed by only one instance and doesn't need fencing
+func (m *Mem) Token(key string) int64 {
+	return 0
+}
+
+func (m *Mem) CheckToken(key string, token int64) bool {
+	return true
+}
@@ -0,0 +1,434 @@
+package buffer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	//"log/slog"
+
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
+)
+
+const redisStreamField = "data"
+
+// RedisStream uses a Redis stream per key and a consumer group, so many instances can flush the same key without a global lock.
+// DLQ and recovery data are stored like Redis buffer does. The consumer name is `RedisLockInstanceName` (hostname by
+// default), stable across restarts so an instance resumes its own pending entries and doesn't leave a consumer behind on
+// each start, it must be unique by instance.
+type RedisStream struct {
+	*Redis
+	consumer string
+	groups   map[string]bool
+	inflight map[string][]string
+	sizes    map[string]int64
+	mu       sync.Mutex
+}
+
+func NewRedisStream(ctx context.Context, config *config.Config, client redis.UniversalClient) Buffer {
+	base := newRedis(ctx, config, client)
+
+	if base == nil {
+		return nil
+	}
+
+	ret := &RedisStream{
+		Redis:    base,
+		consumer: config.RedisLockInstanceName,
+		groups:   make(map[string]bool),
+		inflight: make(map[string][]string),
+		sizes:    make(map[string]int64),
+	}
+
+	if len(ret.consumer) == 0 {
+		ret.consumer = base.instanceId
+	}
+
+	slog.Info("Redis stream buffer created", "group", config.RedisStreamGroup, "consumer", ret.consumer, "module", "buffer.redis-stream", "function", "NewRedisStream")
+
+	return ret
+}
+
+func (r *RedisStream) makeStreamKey(key string) string {
+	return fmt.Sprintf("%s:%s", r.config.RedisStreamPrefix, r.tagKey(key))
+}
+
+func (r *RedisStream) checkGroup(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.groups[key] {
+		return nil
+	}
+
+	err := r.getClient().XGroupCreateMkStream(r.ctx, r.makeStreamKey(key), r.config.RedisStreamGroup, "0").Err()
+
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		slog.Error("Error creating consumer group", "error", err, "key", key, "group", r.config.RedisStreamGroup, "module", "buffer.redis-stream", "function", "checkGroup")
+		return err
+	}
+
+	r.groups[key] = true
+	r.removeIdleConsumers(key)
+
+	return nil
+}
+
+// removeIdleConsumers deletes consumers of other instances without pending entries and idle longer than
+// `RedisStreamClaimIdle`, e.g. instances that were replaced or consumers named by older versions, after their entries
+// were claimed by XAUTOCLAIM
+func (r *RedisStream) removeIdleConsumers(key string) {
+	stream := r.makeStreamKey(key)
+	consumers, err := r.getClient().XInfoConsumers(r.ctx, stream, r.config.RedisStreamGroup).Result()
+
+	if err != nil {
+		slog.Warn("Error listing consumers", "error", err, "key", key, "module", "buffer.redis-stream", "function", "removeIdleConsumers")
+		return
+	}
+
+	minIdle := time.Duration(r.config.RedisStreamClaimIdle) * time.Second
+
+	for _, consumer := range consumers {
+		if consumer.Name == r.consumer || consumer.Pending > 0 || time.Duration(consumer.Idle)*time.Millisecond < minIdle {
+			continue
+		}
+
+		err = r.getClient().XGroupDelConsumer(r.ctx, stream, r.config.RedisStreamGroup, consumer.Name).Err()
+
+		if err != nil {
+			slog.Warn("Error removing idle consumer", "error", err, "key", key, "consumer", consumer.Name, "module", "buffer.redis-stream", "function", "removeIdleConsumers")
+			continue
+		}
+
+		slog.Info("Idle consumer removed", "key", key, "consumer", consumer.Name, "module", "buffer.redis-stream", "function", "removeIdleConsumers")
+	}
+}
+
+func (r *RedisStream) Len(key string) int {
+	cmd := r.getClient().XLen(r.ctx, r.makeStreamKey(key))
+
+	if cmd.Err() != nil {
+		slog.Error("Error getting stream length", "error", cmd.Err(), "key", key, "module", "buffer.redis-stream", "function", "Len")
+		return 0
+	}
+
+	return int(cmd.Val())
+}
+
+// ByteLen returns the msgpack encoded size of the entries of a key stream, including entries being flushed
+func (r *RedisStream) ByteLen(key string) int {
+	return r.Redis.ByteLen(key)
+}
+
+func (r *RedisStream) Push(key string, item domain.Record) (n int, err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeRedisStream, "push", start, err) }()
+
+	if len(key) == 0 {
+		slog.Warn("Key is empty", "module", "buffer.redis-stream", "function", "Push")
+		return 0, fmt.Errorf("key is empty")
+	}
+
+	if item == nil {
+		slog.Warn("Item is nil", "module", "buffer.redis-stream", "function", "Push")
+		return 0, fmt.Errorf("item is nil")
+	}
+
+	err = r.checkGroup(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	client := r.getClient()
+	stream := r.makeStreamKey(key)
+	data := item.ToMsgPack()
+	var length *redis.IntCmd
+
+	_, err = client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(r.ctx, r.config.RedisKeys, key)
+		pipe.XAdd(r.ctx, &redis.XAddArgs{
+			Stream: stream,
+			Values: map[string]interface{}{redisStreamField: data},
+		})
+		pipe.IncrBy(r.ctx, r.makeSizeKey(key), int64(len(data)))
+		length = pipe.XLen(r.ctx, stream)
+		return nil
+	})
+
+	if err != nil {
+		slog.Error("Error adding to stream", "error", err, "key", key, "module", "buffer.redis-stream", "function", "Push")
+		return 0, err
+	}
+
+	return int(length.Val()), nil
+}
+
+// CheckLock always returns true, consumer group delivers each entry to only one consumer
+func (r *RedisStream) CheckLock(key string) bool {
+	return true
+}
+
+// Get returns a batch with entries still pending for this consumer (a batch rolled back), entries claimed from consumers idle
+// longer than `RedisStreamClaimIdle` and new entries, in this order, up to `BufferSize` records.
+func (r *RedisStream) Get(key string) []domain.Record {
+	defer metrics.ObserveBuffer(config.BufferTypeRedisStream, "get", time.Now(), nil)
+
+	ret := make([]domain.Record, 0)
+
+	if r.checkGroup(key) != nil {
+		return ret
+	}
+
+	stream := r.makeStreamKey(key)
+	size := int64(r.config.BufferSize)
+	messages := make([]redis.XMessage, 0, size)
+
+	pending, err := r.readGroup(stream, "0", size)
+
+	if err != nil {
+		slog.Error("Error reading pending entries", "error", err, "key", key, "module", "buffer.redis-stream", "function", "Get")
+		return ret
+	}
+
+	messages = append(messages, pending...)
+
+	if int64(len(messages)) < size {
+		claimed, err := r.autoClaim(stream, size-int64(len(messages)))
+
+		if err != nil && err != redis.Nil {
+			slog.Error("Error claiming idle entries", "error", err, "key", key, "module", "buffer.redis-stream", "function", "Get")
+		}
+
+		if len(claimed) > 0 {
+			slog.Info("Entries claimed from idle consumers", "key", key, "count", len(claimed), "module", "buffer.redis-stream", "function", "Get")
+			messages = append(messages, claimed...)
+			r.removeIdleConsumers(key)
+		}
+	}
+
+	if int64(len(messages)) < size {
+		fresh, err := r.readGroup(stream, ">", size-int64(len(messages)))
+
+		if err != nil {
+			slog.Error("Error reading new entries", "error", err, "key", key, "module", "buffer.redis-stream", "function", "Get")
+		}
+
+		messages = append(messages, fresh...)
+	}
+
+	ids := make([]string, 0, len(messages))
+	seen := make(map[string]bool, len(messages))
+	var batchBytes int64
+
+	for _, msg := range messages {
+		if seen[msg.ID] {
+			continue
+		}
+
+		seen[msg.ID] = true
+		ids = append(ids, msg.ID)
+
+		data := []byte(fmt.Sprint(msg.Values[redisStreamField]))
+		batchBytes += int64(len(data))
+
+		rec := domain.NewObj(r.config.RecordType)
+		err = rec.FromMsgPack(data)
+
+		if err != nil {
+			slog.Error("Error decoding record, skipping", "error", err, "key", key, "id", msg.ID, "module", "buffer.redis-stream", "function", "Get")
+			continue
+		}
+
+		ret = append(ret, rec)
+	}
+
+	r.mu.Lock()
+	r.inflight[key] = ids
+	r.sizes[key] = batchBytes
+	r.mu.Unlock()
+
+	slog.Debug("Got buffer", "key", key, "entries", len(ids), "records", len(ret), "module", "buffer.redis-stream", "function", "Get")
+
+	return ret
+}
+
+// autoClaim runs XAUTOCLAIM as a raw command, go-redis v8 only parses the Redis 6.2 reply and Redis 7 adds a third element
+// with the deleted entry IDs
+func (r *RedisStream) autoClaim(stream string, count int64) ([]redis.XMessage, error) {
+	minIdle := time.Duration(r.config.RedisStreamClaimIdle) * time.Second
+	reply, err := r.getClient().Do(r.ctx, "XAUTOCLAIM", stream, r.config.RedisStreamGroup, r.consumer, minIdle.Milliseconds(), "0-0", "COUNT", count).Slice()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) < 2 {
+		return nil, fmt.Errorf("unexpected XAUTOCLAIM reply with %d elements", len(reply))
+	}
+
+	entries, ok := reply[1].([]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("unexpected XAUTOCLAIM entries type %T", reply[1])
+	}
+
+	ret := make([]redis.XMessage, 0, len(entries))
+
+	for _, entry := range entries {
+		fields, ok := entry.([]interface{})
+
+		if !ok || len(fields) < 2 {
+			continue
+		}
+
+		msg := redis.XMessage{ID: fmt.Sprint(fields[0]), Values: make(map[string]interface{})}
+		values, _ := fields[1].([]interface{})
+
+		for i := 0; i+1 < len(values); i += 2 {
+			msg.Values[fmt.Sprint(values[i])] = values[i+1]
+		}
+
+		ret = append(ret, msg)
+	}
+
+	return ret, nil
+}
+
+func (r *RedisStream) readGroup(stream string, start string, count int64) ([]redis.XMessage, error) {
+	result, err := r.getClient().XReadGroup(r.ctx, &redis.XReadGroupArgs{
+		Group:    r.config.RedisStreamGroup,
+		Consumer: r.consumer,
+		Streams:  []string{stream, start},
+		Count:    count,
+		Block:    -1,
+	}).Result()
+
+	if err == redis.Nil {
+		return []redis.XMessage{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]redis.XMessage, 0)
+
+	for _, s := range result {
+		ret = append(ret, s.Messages...)
+	}
+
+	return ret, nil
+}
+
+// Clear acknowledges and removes the entries returned by the last Get for this key
+func (r *RedisStream) Clear(key string, size int) (err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeRedisStream, "clear", start, err) }()
+
+	r.mu.Lock()
+	ids := r.inflight[key]
+	bytes := r.sizes[key]
+	delete(r.inflight, key)
+	delete(r.sizes, key)
+	r.mu.Unlock()
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	client := r.getClient()
+	stream := r.makeStreamKey(key)
+
+	for i := 0; i < len(ids); i += redisBatchSize {
+		end := i + redisBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch := ids[i:end]
+
+		_, err := client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAck(r.ctx, stream, r.config.RedisStreamGroup, batch...)
+			pipe.XDel(r.ctx, stream, batch...)
+			return nil
+		})
+
+		if err != nil {
+			slog.Error("Error acknowledging entries", "error", err, "key", key, "module", "buffer.redis-stream", "function", "Clear")
+			return err
+		}
+	}
+
+	errSize := client.DecrBy(r.ctx, r.makeSizeKey(key), bytes).Err()
+
+	if errSize != nil {
+		slog.Error("Error updating key size", "error", errSize, "key", key, "module", "buffer.redis-stream", "function", "Clear")
+	}
+
+	slog.Debug("Cleared buffer", "key", key, "size", len(ids), "module", "buffer.redis-stream", "function", "Clear")
+
+	return nil
+}
+
+// Rollback keeps the entries pending for this consumer, they will be returned again on next Get or claimed by other consumer
+func (r *RedisStream) Rollback(key string) error {
+	r.mu.Lock()
+	ids := r.inflight[key]
+	delete(r.inflight, key)
+	delete(r.sizes, key)
+	r.mu.Unlock()
+
+	slog.Debug("Batch rolled back, entries kept pending", "key", key, "size", len(ids), "module", "buffer.redis-stream", "function", "Rollback")
+
+	return nil
+}
+
+// RenewLock has nothing to renew, entries pending for this consumer are only claimed by others after `RedisStreamClaimIdle`
+func (r *RedisStream) RenewLock(key string) bool {
+	return true
+}
+
+func (r *RedisStream) ReleaseLock(key string) error {
+	return nil
+}
+
+// Token returns 0, stream batches are fenced by the consumer group ownership of their entries
+func (r *RedisStream) Token(key string) int64 {
+	return 0
+}
+
+// CheckToken returns true while the first entry of the current batch is still pending for this consumer, so a batch
+// claimed by other instance with XAUTOCLAIM is not written twice
+func (r *RedisStream) CheckToken(key string, token int64) bool {
+	r.mu.Lock()
+	ids := r.inflight[key]
+	r.mu.Unlock()
+
+	if len(ids) == 0 {
+		return true
+	}
+
+	pending, err := r.getClient().XPendingExt(r.ctx, &redis.XPendingExtArgs{
+		Stream:   r.makeStreamKey(key),
+		Group:    r.config.RedisStreamGroup,
+		Start:    ids[0],
+		End:      ids[0],
+		Count:    1,
+		Consumer: r.consumer,
+	}).Result()
+
+	if err != nil {
+		slog.Error("Error checking pending entries", "error", err, "key", key, "module", "buffer.redis-stream", "function", "CheckToken")
+		return false
+	}
+
+	return len(pending) == 1
+}
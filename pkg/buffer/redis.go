@@ -3,10 +3,16 @@ package buffer
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"os"
 
 	//"log/slog"
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -14,19 +20,150 @@ import (
 
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
 )
 
+const redisBatchSize = 1000
+
+// takeBatchScript moves up to ARGV[2] records from the data list (KEYS[1]) to the in-flight list (KEYS[2]) atomically,
+// discounting their size from the data size counter (KEYS[5]).
+// A pending in-flight batch (from a flush that did not commit) is returned again instead of taking new records.
+// Only the lock owner (KEYS[3] == ARGV[1]) can take a batch. Each batch taken gets a new fencing token from the
+// fence hash (KEYS[4]), stored with the batch and returned with its records.
+var takeBatchScript = redis.NewScript(`
+if redis.call('GET', KEYS[3]) ~= ARGV[1] then
+	return false
+end
+
+local items = redis.call('LRANGE', KEYS[2], 0, -1)
+
+if #items == 0 then
+	items = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[2]) - 1)
+	if #items == 0 then
+		return {0, items}
+	end
+
+	for i = 1, #items, 1000 do
+		redis.call('RPUSH', KEYS[2], unpack(items, i, math.min(i + 999, #items)))
+	end
+
+	redis.call('LTRIM', KEYS[1], #items, -1)
+
+	local size = 0
+	for i = 1, #items do
+		size = size + #items[i]
+	end
+
+	if redis.call('DECRBY', KEYS[5], size) <= 0 then
+		redis.call('DEL', KEYS[5])
+	end
+end
+
+local token = redis.call('HINCRBY', KEYS[4], 'counter', 1)
+redis.call('HSET', KEYS[4], 'batch', token)
+
+return {token, items}
+`)
+
+// commitBatchScript drops the in-flight list (KEYS[1]) and its fencing token (KEYS[3]) once the batch was written,
+// only if the lock (KEYS[2]) is still owned by ARGV[1]
+var commitBatchScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) ~= ARGV[1] then
+	return -1
+end
+
+local size = redis.call('LLEN', KEYS[1])
+redis.call('DEL', KEYS[1])
+redis.call('HDEL', KEYS[3], 'batch')
+
+return size
+`)
+
+// rollbackBatchScript moves the in-flight list (KEYS[1]) back to the head of the data list (KEYS[2]) keeping the original order,
+// adds its size back to the data size counter (KEYS[5]) and drops its fencing token (KEYS[4]), only if the lock (KEYS[3])
+// is still owned by ARGV[1]
+var rollbackBatchScript = redis.NewScript(`
+if redis.call('GET', KEYS[3]) ~= ARGV[1] then
+	return -1
+end
+
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+
+local size = 0
+for i = #items, 1, -1 do
+	redis.call('LPUSH', KEYS[2], items[i])
+	size = size + #items[i]
+end
+
+if size > 0 then
+	redis.call('INCRBY', KEYS[5], size)
+end
+
+redis.call('DEL', KEYS[1])
+redis.call('HDEL', KEYS[4], 'batch')
+
+return #items
+`)
+
+// checkTokenScript returns 1 if the lock (KEYS[1]) is owned by ARGV[1] and ARGV[2] is the fencing token of the current batch (KEYS[2])
+var checkTokenScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+
+if redis.call('HGET', KEYS[2], 'batch') ~= ARGV[2] then
+	return 0
+end
+
+return 1
+`)
+
+// renewLockScript extends the lock (KEYS[1]) TTL to ARGV[2] milliseconds, only if it is owned by ARGV[1]
+var renewLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+
+return 1
+`)
+
+// releaseLockScript deletes the lock (KEYS[1]), only if it is owned by ARGV[1]
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+
+return redis.call('DEL', KEYS[1])
+`)
+
 type Redis struct {
 	config     *config.Config
-	client     *redis.Client
+	client     redis.UniversalClient
 	ctx        context.Context
 	instanceId string
+	tokens     map[string]int64
+	mu         sync.Mutex
 }
 
-func NewRedis(ctx context.Context, config *config.Config, client *redis.Client) Buffer {
+func NewRedis(ctx context.Context, config *config.Config, client redis.UniversalClient) Buffer {
+	ret := newRedis(ctx, config, client)
+
+	if ret == nil {
+		return nil
+	}
+
+	return ret
+}
+
+func newRedis(ctx context.Context, config *config.Config, client redis.UniversalClient) *Redis {
 	ret := &Redis{
 		config: config,
 		ctx:    ctx,
+		tokens: make(map[string]int64),
 	}
 
 	if client != nil {
@@ -42,6 +179,8 @@ func NewRedis(ctx context.Context, config *config.Config, client *redis.Client)
 		return nil
 	}
 
+	ret.indexLegacyKeys()
+
 	return ret
 }
 
@@ -59,18 +198,84 @@ func (r *Redis) Close() error {
 	return nil
 }
 
-func createClient(cfg *config.Config) *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:        cfg.RedisHost,
-		Password:    cfg.RedisPassword,
-		DB:          cfg.RedisDB,
-		ReadTimeout: time.Duration(cfg.RedisTimeout),
-	})
+// NewClient returns a Redis client connected as set by `RedisMode`, so other Redis stores (e.g. the schema registry)
+// share the buffer connection settings
+func NewClient(cfg *config.Config) redis.UniversalClient {
+	return createClient(cfg)
+}
+
+func createClient(cfg *config.Config) redis.UniversalClient {
+	addrs := cfg.GetRedisAddresses()
+	tlsConfig := createTLSConfig(cfg)
+
+	switch cfg.RedisMode {
+	case config.RedisModeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.RedisMasterName,
+			SentinelAddrs:    addrs,
+			SentinelPassword: cfg.RedisSentinelPassword,
+			Password:         cfg.RedisPassword,
+			DB:               cfg.RedisDB,
+			ReadTimeout:      time.Duration(cfg.RedisTimeout),
+			TLSConfig:        tlsConfig,
+		})
+	case config.RedisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:       addrs,
+			Password:    cfg.RedisPassword,
+			ReadTimeout: time.Duration(cfg.RedisTimeout),
+			TLSConfig:   tlsConfig,
+		})
+	default:
+		addr := cfg.RedisHost
+		if len(addrs) > 0 {
+			addr = addrs[0]
+		}
+
+		return redis.NewClient(&redis.Options{
+			Addr:        addr,
+			Password:    cfg.RedisPassword,
+			DB:          cfg.RedisDB,
+			ReadTimeout: time.Duration(cfg.RedisTimeout),
+			TLSConfig:   tlsConfig,
+		})
+	}
+}
+
+func createTLSConfig(cfg *config.Config) *tls.Config {
+	if !cfg.RedisTLS {
+		return nil
+	}
+
+	ret := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.RedisTLSInsecure,
+	}
+
+	if len(cfg.RedisTLSCAFile) > 0 {
+		ca, err := os.ReadFile(cfg.RedisTLSCAFile)
+
+		if err != nil {
+			slog.Error("Error reading Redis CA file, using system CAs", "error", err, "file", cfg.RedisTLSCAFile, "module", "buffer.redis", "function", "createTLSConfig")
+			return ret
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(ca) {
+			slog.Error("No certificate found in Redis CA file, using system CAs", "file", cfg.RedisTLSCAFile, "module", "buffer.redis", "function", "createTLSConfig")
+			return ret
+		}
+
+		ret.RootCAs = pool
+	}
+
+	return ret
 }
 
-func (r *Redis) getClient() *redis.Client {
+func (r *Redis) getClient() redis.UniversalClient {
 	if r.client == nil {
-		slog.Info("Connecting to redis", "host", r.config.RedisHost, "db", r.config.RedisDB)
+		slog.Info("Connecting to redis", "mode", r.config.RedisMode, "addresses", r.config.GetRedisAddresses(), "db", r.config.RedisDB)
 		r.client = createClient(r.config)
 
 		slog.Debug("Connected to redis")
@@ -84,20 +289,57 @@ func (r *Redis) makeInstanceName() {
 	r.instanceId = fmt.Sprintf("%s-%s", r.config.RedisLockInstanceName, ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String())
 }
 
+// tagKey wraps the record key in a hash tag on cluster mode, so data, in-flight and lock keys of a record key stay on the same slot
+func (r *Redis) tagKey(key string) string {
+	if r.config.RedisMode == config.RedisModeCluster {
+		return "{" + key + "}"
+	}
+
+	return key
+}
+
 func (r *Redis) makeDataKey(key string) string {
-	return fmt.Sprintf("%s:%s", r.config.RedisDataPrefix, key)
+	return fmt.Sprintf("%s:%s", r.config.RedisDataPrefix, r.tagKey(key))
 }
 
 func (r *Redis) makeRecoveryKey(key string) string {
-	return fmt.Sprintf("%s:%s", r.config.RedisRecoveryKey, key)
+	return fmt.Sprintf("%s:%s", r.config.RedisRecoveryKey, r.tagKey(key))
 }
 
 func (r *Redis) makeDLQKey(key string) string {
-	return fmt.Sprintf("%s:%s", r.config.RedisDLQPrefix, key)
+	return fmt.Sprintf("%s:%s", r.config.RedisDLQPrefix, r.tagKey(key))
+}
+
+func (r *Redis) makeDLQIndexKey() string {
+	return fmt.Sprintf("%s:%s", r.config.RedisKeys, r.config.RedisDLQPrefix)
+}
+
+func (r *Redis) makeRecoveryIndexKey() string {
+	return fmt.Sprintf("%s:%s", r.config.RedisKeys, r.config.RedisRecoveryKey)
+}
+
+func (r *Redis) makePoisonKey(key string) string {
+	return fmt.Sprintf("%s:%s", r.config.RedisPoisonKey, r.tagKey(key))
+}
+
+func (r *Redis) makePoisonIndexKey() string {
+	return fmt.Sprintf("%s:%s", r.config.RedisKeys, r.config.RedisPoisonKey)
+}
+
+func (r *Redis) makeInFlightKey(key string) string {
+	return fmt.Sprintf("%s:%s", r.config.RedisInFlightPrefix, r.tagKey(key))
 }
 
 func (r *Redis) makeLockKey(key string) string {
-	return fmt.Sprintf("%s:%s", r.config.RedisLockPrefix, key)
+	return fmt.Sprintf("%s:%s", r.config.RedisLockPrefix, r.tagKey(key))
+}
+
+func (r *Redis) makeSizeKey(key string) string {
+	return fmt.Sprintf("%s:%s", r.config.RedisSizePrefix, r.tagKey(key))
+}
+
+func (r *Redis) makeFenceKey(key string) string {
+	return fmt.Sprintf("%s:%s", r.config.RedisFencePrefix, r.tagKey(key))
 }
 
 func (r *Redis) Len(key string) int {
@@ -112,7 +354,26 @@ func (r *Redis) Len(key string) int {
 	return int(cmd.Val())
 }
 
-func (r *Redis) Push(key string, item domain.Record) (int, error) {
+// ByteLen returns the msgpack encoded size of the records waiting on the data list of a key, a batch being flushed is not counted
+func (r *Redis) ByteLen(key string) int {
+	size, err := r.getClient().Get(r.ctx, r.makeSizeKey(key)).Int()
+
+	if err != nil && err != redis.Nil {
+		slog.Error("Error getting key size", "error", err, "key", key, "module", "buffer.redis", "function", "ByteLen")
+		return 0
+	}
+
+	if size < 0 {
+		return 0
+	}
+
+	return size
+}
+
+func (r *Redis) Push(key string, item domain.Record) (n int, err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeRedis, "push", start, err) }()
+
 	if len(key) == 0 {
 		slog.Warn("Key is empty", "module", "buffer.redis", "function", "Push")
 		return 0, fmt.Errorf("key is empty") // Fix: Changed "Key" to "key"
@@ -124,60 +385,65 @@ func (r *Redis) Push(key string, item domain.Record) (int, error) {
 	}
 
 	client := r.getClient()
-	sadd := client.SAdd(r.ctx, r.config.RedisKeys, key)
-
-	if sadd.Err() != nil {
-		slog.Error("Error adding key", "error", sadd.Err())
-		return 0, sadd.Err()
-	}
-
-	rkey := r.makeDataKey(key)
 	data := item.ToMsgPack()
+	var length *redis.IntCmd
 
-	ret := client.RPush(r.ctx, rkey, data)
+	_, err = client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(r.ctx, r.config.RedisKeys, key)
+		length = pipe.RPush(r.ctx, r.makeDataKey(key), data)
+		pipe.IncrBy(r.ctx, r.makeSizeKey(key), int64(len(data)))
+		return nil
+	})
 
-	if ret.Err() != nil {
-		slog.Error("Error pushing to key", "error", ret.Err())
-		return 0, ret.Err()
+	if err != nil {
+		slog.Error("Error pushing to key", "error", err)
+		return 0, err
 	}
 
-	l := int(ret.Val())
-
-	return l, nil
+	return int(length.Val()), nil
 }
 
-func (r *Redis) PushDLQ(key string, item domain.Record) error {
+func (r *Redis) PushDLQ(key string, item *DLQEnvelope) error {
+	if item == nil || item.Record == nil {
+		slog.Warn("Item is nil", "key", key, "module", "buffer.redis", "function", "PushDLQ")
+		return errors.New("item is nil")
+	}
+
 	rKey := r.makeDLQKey(key)
 
 	msg := item.ToMsgPack()
-	slog.Debug("Pushing to DLQ", "key", key, "module", "buffer.redis", "function", "PushDLQ", "size", len(msg))
+	slog.Debug("Pushing to DLQ", "key", key, "stage", item.Stage, "error", item.Error, "module", "buffer.redis", "function", "PushDLQ", "size", len(msg))
 
 	client := r.getClient()
-	cmd := client.RPush(r.ctx, rKey, msg)
+	_, err := client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(r.ctx, rKey, msg)
+		pipe.SAdd(r.ctx, r.makeDLQIndexKey(), key)
+		return nil
+	})
 
-	if cmd.Err() != nil {
-		slog.Error("Error pushing to DLQ", "error", cmd.Err())
-		return cmd.Err()
+	if err != nil {
+		slog.Error("Error pushing to DLQ", "error", err)
+		return err
 	}
 
 	return nil
 }
 
-func (r *Redis) GetDLQ() (map[string][]domain.Record, error) {
+func (r *Redis) GetDLQ() (map[string][]*DLQEnvelope, error) {
 	ctx := r.ctx
+	client := r.getClient()
 
-	keys := r.client.Keys(ctx, r.makeDLQKey("*"))
+	keys := client.SMembers(ctx, r.makeDLQIndexKey())
 
 	if keys.Err() != nil {
 		slog.Error("GetDLQ - Error getting keys", "error", keys.Err())
 		return nil, keys.Err()
 	}
 
-	ret := make(map[string][]domain.Record)
-	client := r.getClient()
+	ret := make(map[string][]*DLQEnvelope)
 
 	for _, key := range keys.Val() {
-		result := client.LRange(ctx, key, 0, -1)
+		result := client.LRange(ctx, r.makeDLQKey(key), 0, -1)
 
 		if result.Err() != nil {
 			slog.Error("GetDLQ - Error getting key", "error", result.Err())
@@ -186,17 +452,17 @@ func (r *Redis) GetDLQ() (map[string][]domain.Record, error) {
 
 		vals := result.Val()
 
-		items := make([]domain.Record, len(vals))
+		items := make([]*DLQEnvelope, len(vals))
 
 		for i, v := range vals {
-			record := domain.NewObj(r.config.RecordType)
-			err := record.FromMsgPack([]byte(v))
+			item, err := DecodeDLQEnvelope(r.config.RecordType, []byte(v))
+
 			if err != nil {
-				slog.Error("Get DLQ - Error decoding record", "error", err, "module", "buffer.redis", "function", "RecoveryData")
+				slog.Error("Get DLQ - Error decoding record", "error", err, "module", "buffer.redis", "function", "GetDLQ")
 				return nil, err
 			}
 
-			items[i] = record
+			items[i] = item
 		}
 
 		ret[key] = append(ret[key], items...)
@@ -235,72 +501,184 @@ func (r *Redis) CheckLock(key string) bool {
 
 	if lockOwner == r.instanceId {
 		slog.Debug("Already locked for this instance, continue to use", "key", key, "id", r.instanceId)
-		return true
+		return r.RenewLock(key)
 	}
 
 	slog.Debug("Buffer already locked by another instance", "key", key, "this-id", r.instanceId, "current-id", lockOwner, "CheckLock", ret)
+	metrics.LockContention.WithLabelValues(key).Inc()
 
 	return ret
 }
 
 func (r *Redis) Get(key string) []domain.Record {
-	rkey := r.makeDataKey(key)
+	defer metrics.ObserveBuffer(config.BufferTypeRedis, "get", time.Now(), nil)
+
 	client := r.getClient()
 
-	cmd := client.LLen(r.ctx, rkey)
+	keys := []string{r.makeDataKey(key), r.makeInFlightKey(key), r.makeLockKey(key), r.makeFenceKey(key), r.makeSizeKey(key)}
+	result := takeBatchScript.Run(r.ctx, client, keys, r.instanceId, r.config.BufferSize)
 
-	if cmd.Err() != nil {
-		slog.Error("Error getting key", "error", cmd.Err())
+	if result.Err() == redis.Nil {
+		slog.Warn("Lock is not owned by this instance, can't take a batch", "key", key, "id", r.instanceId, "module", "buffer.redis", "function", "Get")
 		return make([]domain.Record, 0)
 	}
 
-	size := cmd.Val()
-
-	if size > int64(r.config.BufferSize) {
-		slog.Debug("Buffer size is bigger than config, will get partial data", "key", key, "buffer-size", size, "get-size", r.config.BufferSize)
-		size = int64(r.config.BufferSize)
+	if result.Err() != nil {
+		slog.Error("Error taking batch", "error", result.Err(), "key", key, "module", "buffer.redis", "function", "Get")
+		return make([]domain.Record, 0)
 	}
 
-	result := client.LRange(r.ctx, rkey, 0, size-1)
+	batch, ok := result.Val().([]interface{})
 
-	if result.Err() != nil {
-		slog.Error("Error getting key", "error", result.Err())
+	if !ok || len(batch) != 2 {
+		slog.Error("Unexpected batch result", "key", key, "result", result.Val(), "module", "buffer.redis", "function", "Get")
 		return make([]domain.Record, 0)
 	}
 
-	ret := make([]domain.Record, size)
+	token, _ := batch[0].(int64)
+	vals, _ := batch[1].([]interface{})
 
-	var err error
-	for i, v := range result.Val() {
+	r.mu.Lock()
+	r.tokens[key] = token
+	r.mu.Unlock()
+
+	ret := make([]domain.Record, 0, len(vals))
+
+	for _, v := range vals {
 		rec := domain.NewObj(r.config.RecordType)
-		err = rec.FromMsgPack([]byte(v))
+		err := rec.FromMsgPack([]byte(fmt.Sprint(v)))
 		if err != nil {
-			slog.Error("Error decoding record", "error", err, "module", "buffer.redis", "function", "Get", "record", v)
-			return ret
+			slog.Error("Error decoding record, skipping", "error", err, "module", "buffer.redis", "function", "Get", "record", v)
+			continue
 		}
-		ret[i] = rec
+		ret = append(ret, rec)
 	}
 
-	slog.Debug("Got buffer", "key", key, "size", size, "records", len(ret))
+	slog.Debug("Got buffer", "key", key, "size", len(vals), "records", len(ret), "token", token)
 
 	return ret
 }
 
-func (r *Redis) Clear(key string, size int) error {
-	rkey := r.makeDataKey(key)
+func (r *Redis) Clear(key string, size int) (err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveBuffer(config.BufferTypeRedis, "clear", start, err) }()
+
+	client := r.getClient()
+
+	r.forgetToken(key)
+
+	keys := []string{r.makeInFlightKey(key), r.makeLockKey(key), r.makeFenceKey(key)}
+	cmd := commitBatchScript.Run(r.ctx, client, keys, r.instanceId)
+
+	if cmd.Err() != nil {
+		slog.Error("Error clearing key", "error", cmd.Err(), "key", key, "module", "buffer.redis", "function", "Clear")
+		return cmd.Err()
+	}
+
+	cleared, _ := cmd.Int()
+
+	if cleared < 0 {
+		slog.Error("Lock lost before commit, batch will be flushed again by lock owner", "key", key, "id", r.instanceId, "module", "buffer.redis", "function", "Clear")
+		return errors.New("lock is not owned by this instance")
+	}
+
+	if size >= 0 && cleared != size {
+		slog.Warn("Committed batch size is different from requested", "key", key, "size", size, "cleared", cleared, "module", "buffer.redis", "function", "Clear")
+	}
+
+	slog.Debug("Cleared buffer", "key", key, "size", cleared, "module", "buffer.redis", "function", "Clear")
+	return nil
+}
+
+func (r *Redis) Rollback(key string) error {
 	client := r.getClient()
 
-	cmd := client.LPopCount(r.ctx, rkey, size)
+	r.forgetToken(key)
+
+	keys := []string{r.makeInFlightKey(key), r.makeDataKey(key), r.makeLockKey(key), r.makeFenceKey(key), r.makeSizeKey(key)}
+	cmd := rollbackBatchScript.Run(r.ctx, client, keys, r.instanceId)
 
 	if cmd.Err() != nil {
-		slog.Error("Error clearing key", "error", cmd.Err())
+		slog.Error("Error rolling back batch", "error", cmd.Err(), "key", key, "module", "buffer.redis", "function", "Rollback")
 		return cmd.Err()
 	}
 
-	slog.Debug("Cleared buffer", "key", key, "size", size, "module", "buffer.redis", "function", "Clear")
+	restored, _ := cmd.Int()
+
+	if restored < 0 {
+		slog.Warn("Lock lost before rollback, batch is kept in-flight to lock owner", "key", key, "id", r.instanceId, "module", "buffer.redis", "function", "Rollback")
+		return errors.New("lock is not owned by this instance")
+	}
+
+	slog.Debug("Batch rolled back", "key", key, "size", restored, "module", "buffer.redis", "function", "Rollback")
 	return nil
 }
 
+// RenewLock extends the lock TTL while a flush is running, it returns false if the lock is not owned by this instance anymore
+func (r *Redis) RenewLock(key string) bool {
+	ttl := time.Duration(r.config.RedisLockTTL) * time.Second
+	cmd := renewLockScript.Run(r.ctx, r.getClient(), []string{r.makeLockKey(key)}, r.instanceId, ttl.Milliseconds())
+
+	if cmd.Err() != nil {
+		slog.Error("Error renewing lock", "error", cmd.Err(), "key", key, "id", r.instanceId, "module", "buffer.redis", "function", "RenewLock")
+		return false
+	}
+
+	renewed, _ := cmd.Int()
+
+	if renewed == 0 {
+		slog.Warn("Lock is not owned by this instance, can't renew it", "key", key, "id", r.instanceId, "module", "buffer.redis", "function", "RenewLock")
+		return false
+	}
+
+	slog.Debug("Lock renewed", "key", key, "id", r.instanceId, "ttl", ttl, "module", "buffer.redis", "function", "RenewLock")
+	return true
+}
+
+func (r *Redis) ReleaseLock(key string) error {
+	cmd := releaseLockScript.Run(r.ctx, r.getClient(), []string{r.makeLockKey(key)}, r.instanceId)
+
+	if cmd.Err() != nil {
+		slog.Error("Error releasing lock", "error", cmd.Err(), "key", key, "id", r.instanceId, "module", "buffer.redis", "function", "ReleaseLock")
+		return cmd.Err()
+	}
+
+	released, _ := cmd.Int()
+
+	slog.Debug("Lock released", "key", key, "id", r.instanceId, "released", released > 0, "module", "buffer.redis", "function", "ReleaseLock")
+	return nil
+}
+
+// Token returns the fencing token of the batch returned by the last Get for this key
+func (r *Redis) Token(key string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.tokens[key]
+}
+
+// CheckToken returns true while this instance owns the lock and token is the fencing token of the current batch
+func (r *Redis) CheckToken(key string, token int64) bool {
+	keys := []string{r.makeLockKey(key), r.makeFenceKey(key)}
+	cmd := checkTokenScript.Run(r.ctx, r.getClient(), keys, r.instanceId, token)
+
+	if cmd.Err() != nil {
+		slog.Error("Error checking fencing token", "error", cmd.Err(), "key", key, "token", token, "module", "buffer.redis", "function", "CheckToken")
+		return false
+	}
+
+	valid, _ := cmd.Int()
+
+	return valid == 1
+}
+
+func (r *Redis) forgetToken(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.tokens, key)
+}
+
 func (r *Redis) Keys() []string {
 	client := r.getClient()
 	cmd := client.SMembers(r.ctx, r.config.RedisKeys)
@@ -332,65 +710,102 @@ func (r *Redis) IsReady() bool {
 
 func (r *Redis) HasRecovery() bool {
 	client := r.getClient()
-	cmd := client.Keys(r.ctx, r.makeRecoveryKey("*"))
+	cmd := client.SCard(r.ctx, r.makeRecoveryIndexKey())
 
 	if cmd.Err() != nil {
 		slog.Error("Error getting keys", "error", cmd.Err())
 		return false
 	}
 
-	return len(cmd.Val()) > 0
+	return cmd.Val() > 0
 }
 
 func (r *Redis) PushRecovery(key string, buf *bytes.Buffer) error {
 	slog.Debug("Pushing data to post recovery", "key", key, "module", "buffer.redis", "function", "PushRecovery", "size", buf.Len())
-	data := &RecoveryData{
-		Key:       key,
-		Data:      buf.Bytes(),
-		Timestamp: time.Now(),
-	}
 
-	if data.Data == nil {
+	if buf.Len() == 0 {
 		slog.Error("PushRecovery - No data to push", "key", key)
 		return nil
 	}
-	client := r.getClient()
 
-	cmd := client.LPush(r.ctx, r.makeRecoveryKey(key), data.ToMsgPack())
+	return r.PutRecovery(NewRecoveryData(key, buf))
+}
 
-	if cmd.Err() != nil {
-		slog.Error("PushRecovery - Error pushing to recovery", "error", cmd.Err())
-		return cmd.Err()
+func (r *Redis) PutRecovery(item *RecoveryData) error {
+	err := r.pushIndexed(r.makeRecoveryIndexKey(), r.makeRecoveryKey, item)
+
+	if err != nil {
+		slog.Error("PutRecovery - Error pushing to recovery", "error", err, "key", item.Key)
+		return err
 	}
 
 	return nil
 }
 
 func (r *Redis) GetRecovery() ([]*RecoveryData, error) {
+	return r.getIndexed(r.makeRecoveryIndexKey(), r.makeRecoveryKey)
+}
+
+func (r *Redis) PushPoison(item *RecoveryData) error {
+	err := r.pushIndexed(r.makePoisonIndexKey(), r.makePoisonKey, item)
+
+	if err != nil {
+		slog.Error("PushPoison - Error pushing to poison store", "error", err, "key", item.Key)
+		return err
+	}
+
+	return nil
+}
+
+func (r *Redis) GetPoison() ([]*RecoveryData, error) {
+	return r.getIndexed(r.makePoisonIndexKey(), r.makePoisonKey)
+}
+
+func (r *Redis) ClearPoison() error {
+	err := r.clearIndexed(r.makePoisonIndexKey(), r.makePoisonKey)
+
+	if err != nil {
+		slog.Error("Error deleting key from poison store", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// pushIndexed stores a recovery item on its key list and adds the key to the index set
+func (r *Redis) pushIndexed(index string, makeKey func(string) string, item *RecoveryData) error {
 	client := r.getClient()
-	keys := client.Keys(r.ctx, r.makeRecoveryKey("*"))
+
+	_, err := client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(r.ctx, makeKey(item.Key), item.ToMsgPack())
+		pipe.SAdd(r.ctx, index, item.Key)
+		return nil
+	})
+
+	return err
+}
+
+func (r *Redis) getIndexed(index string, makeKey func(string) string) ([]*RecoveryData, error) {
+	client := r.getClient()
+	keys := client.SMembers(r.ctx, index)
 
 	if keys.Err() != nil {
-		slog.Error("GetRecovery - Error getting keys", "error", keys.Err())
+		slog.Error("GetRecovery - Error getting keys", "error", keys.Err(), "index", index)
 		return []*RecoveryData{}, keys.Err()
 	}
 
-	recKeys := keys.Val()
 	ret := make([]*RecoveryData, 0)
 
-	for i, key := range recKeys {
-		result := client.LRange(r.ctx, key, 0, -1)
+	for _, key := range keys.Val() {
+		result := client.LRange(r.ctx, makeKey(key), 0, -1)
 
 		if result.Err() != nil {
 			slog.Error("GetRecovery - Error getting key", "error", result.Err(), "key", key)
 			return ret, result.Err()
 		}
 
-		vals := result.Val()
-		item := &RecoveryData{}
-		items := make([]*RecoveryData, len(vals))
-
-		for _, v := range vals {
+		for _, v := range result.Val() {
+			item := &RecoveryData{}
 			err := item.FromMsgPack([]byte(v))
 
 			if err != nil {
@@ -398,57 +813,211 @@ func (r *Redis) GetRecovery() ([]*RecoveryData, error) {
 				return ret, err
 			}
 
-			items[i] = item
+			ret = append(ret, item)
 		}
-
-		ret = append(ret, items...)
 	}
 
 	return ret, nil
 }
 
 func (r *Redis) ClearRecoveryData() error {
-	client := r.getClient()
-	keys := client.Keys(r.ctx, r.makeRecoveryKey("*"))
+	err := r.clearIndexed(r.makeRecoveryIndexKey(), r.makeRecoveryKey)
 
-	if keys.Err() != nil {
-		slog.Error("ClearRecoveryData - Error getting keys", "error", keys.Err())
-		return keys.Err()
+	if err != nil {
+		slog.Error("Error deleting key from recovery data", "error", err)
+		return err
 	}
 
-	recKeys := keys.Val()
+	slog.Debug("Cleared recovery data", "module", "buffer.redis", "function", "ClearRecoveryData")
+
+	return nil
+}
 
-	popRet := client.Del(r.ctx, recKeys...)
+// RemoveDLQ removes the first size DLQ entries of key with LTRIM, entries pushed after they were read are kept
+func (r *Redis) RemoveDLQ(key string, size int) error {
+	err := r.trimIndexed(r.makeDLQIndexKey(), r.makeDLQKey, key, size)
 
-	if popRet.Err() != nil {
-		slog.Error("Error deleting key from recovery data", "error", popRet.Err())
-		return popRet.Err()
+	if err != nil {
+		slog.Error("Error removing DLQ entries", "error", err, "key", key, "size", size, "module", "buffer.redis", "function", "RemoveDLQ")
+		return err
 	}
 
-	slog.Debug("Cleared recovery data", "module", "buffer.redis", "function", "ClearRecoveryData")
+	return nil
+}
+
+// RemoveRecovery removes the first size recovery items of key with LTRIM, items pushed after they were read are kept
+func (r *Redis) RemoveRecovery(key string, size int) error {
+	err := r.trimIndexed(r.makeRecoveryIndexKey(), r.makeRecoveryKey, key, size)
+
+	if err != nil {
+		slog.Error("Error removing recovery data", "error", err, "key", key, "size", size, "module", "buffer.redis", "function", "RemoveRecovery")
+		return err
+	}
 
 	return nil
 }
 
 func (r *Redis) ClearDLQ() error {
+	err := r.clearIndexed(r.makeDLQIndexKey(), r.makeDLQKey)
+
+	if err != nil {
+		slog.Error("Error deleting key from DLQ", "error", err)
+		return err
+	}
+
+	slog.Debug("Cleared DLQ", "module", "buffer.redis", "function", "ClearDLQ")
+
+	return nil
+}
+
+// clearIndexed deletes all lists tracked by an index set, keys added to the index while clearing are kept
+func (r *Redis) clearIndexed(index string, makeKey func(string) string) error {
 	client := r.getClient()
-	keys := client.Keys(r.ctx, r.makeDLQKey("*"))
+	members := client.SMembers(r.ctx, index)
 
-	if keys.Err() != nil {
-		slog.Error("ClearDLQ - Error getting keys", "error", keys.Err())
-		return keys.Err()
+	if members.Err() != nil {
+		return members.Err()
 	}
 
-	recKeys := keys.Val()
+	keys := members.Val()
 
-	popRet := client.Del(r.ctx, recKeys...)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for i := 0; i < len(keys); i += redisBatchSize {
+		end := i + redisBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := keys[i:end]
+
+		_, err := client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			ids := make([]interface{}, len(batch))
 
-	if popRet.Err() != nil {
-		slog.Error("Error deleting key from DLQ", "error", popRet.Err())
-		return popRet.Err()
+			for j, key := range batch {
+				pipe.Del(r.ctx, makeKey(key))
+				ids[j] = key
+			}
+
+			pipe.SRem(r.ctx, index, ids...)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
 	}
 
-	slog.Debug("Cleared DLQ", "module", "buffer.redis", "function", "ClearDLQ")
+	return nil
+}
+
+// trimIndexed removes the first size items of a key list, the key leaves the index set when its list becomes empty.
+// pushIndexed adds the key to the index after the item is pushed, so a list found not empty after removing the key
+// from the index had a push in between and is added again.
+func (r *Redis) trimIndexed(index string, makeKey func(string) string, key string, size int) error {
+	client := r.getClient()
+	name := makeKey(key)
+
+	var length *redis.IntCmd
+
+	_, err := client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.LTrim(r.ctx, name, int64(size), -1)
+		length = pipe.LLen(r.ctx, name)
+		return nil
+	})
+
+	if err != nil || length.Val() > 0 {
+		return err
+	}
+
+	err = client.SRem(r.ctx, index, key).Err()
+
+	if err != nil {
+		return err
+	}
+
+	remains, err := client.LLen(r.ctx, name).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if remains > 0 {
+		return client.SAdd(r.ctx, index, key).Err()
+	}
 
 	return nil
 }
+
+// indexLegacyKeys uses SCAN to add DLQ and recovery keys created without index sets to them
+func (r *Redis) indexLegacyKeys() {
+	client := r.getClient()
+
+	for prefix, index := range map[string]string{r.config.RedisDLQPrefix: r.makeDLQIndexKey(), r.config.RedisRecoveryKey: r.makeRecoveryIndexKey()} {
+		count := 0
+
+		err := r.scanKeys(prefix+":*", func(keys []string) error {
+			members := make([]interface{}, len(keys))
+
+			for i, key := range keys {
+				members[i] = strings.Trim(strings.TrimPrefix(key, prefix+":"), "{}")
+			}
+
+			count += len(keys)
+
+			return client.SAdd(r.ctx, index, members...).Err()
+		})
+
+		if err != nil {
+			slog.Error("Error indexing keys", "error", err, "prefix", prefix, "module", "buffer.redis", "function", "indexLegacyKeys")
+		}
+
+		slog.Debug("Keys indexed", "prefix", prefix, "index", index, "count", count, "module", "buffer.redis", "function", "indexLegacyKeys")
+	}
+}
+
+// scanKeys iterates over keys matching a pattern with SCAN, on cluster mode all master nodes are scanned
+func (r *Redis) scanKeys(pattern string, fn func(keys []string) error) error {
+	if cluster, ok := r.getClient().(*redis.ClusterClient); ok {
+		mu := &sync.Mutex{}
+		locked := func(keys []string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return fn(keys)
+		}
+
+		return cluster.ForEachMaster(r.ctx, func(ctx context.Context, client *redis.Client) error {
+			return scanNode(ctx, client, pattern, locked)
+		})
+	}
+
+	return scanNode(r.ctx, r.getClient(), pattern, fn)
+}
+
+func scanNode(ctx context.Context, client redis.UniversalClient, pattern string, fn func(keys []string) error) error {
+	var cursor uint64
+
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, redisBatchSize).Result()
+
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			err = fn(keys)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
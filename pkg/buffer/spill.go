@@ -0,0 +1,356 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const spillOffsetExt = ".off"
+const spillCompactSize = 64 * 1024 * 1024
+
+// spill stores records that don't fit on memory buffer limits in per-key segment files, only counters and read offsets
+// are kept in memory. It is not safe for concurrent use, Mem calls it with its lock held.
+type spill struct {
+	path     string
+	segments map[string]*spillSegment
+}
+
+type spillSegment struct {
+	name   string
+	file   *os.File
+	offset int64
+	count  int
+	bytes  int
+}
+
+func newSpill(path string) (*spill, error) {
+	err := os.MkdirAll(path, os.ModePerm)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &spill{
+		path:     path,
+		segments: make(map[string]*spillSegment),
+	}
+
+	entries, err := os.ReadDir(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || !strings.HasSuffix(name, diskSegmentExt) {
+			continue
+		}
+
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(name, diskSegmentExt))
+
+		if err != nil {
+			slog.Warn("Invalid spill segment name, skipping", "file", name, "module", "buffer.spill", "function", "newSpill")
+			continue
+		}
+
+		seg := &spillSegment{name: filepath.Join(path, name)}
+		seg.offset = readOffset(seg.name + spillOffsetExt)
+		frames, err := seg.read(-1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		seg.count = len(frames)
+
+		for _, frame := range frames {
+			seg.bytes += len(frame)
+		}
+
+		if seg.count == 0 {
+			seg.remove()
+			continue
+		}
+
+		ret.segments[string(key)] = seg
+
+		slog.Info("Spill segment loaded", "key", string(key), "records", seg.count, "module", "buffer.spill", "function", "newSpill")
+	}
+
+	return ret, nil
+}
+
+func (s *spill) push(key string, data []byte) error {
+	seg, ok := s.segments[key]
+
+	if !ok {
+		seg = &spillSegment{name: filepath.Join(s.path, base64.RawURLEncoding.EncodeToString([]byte(key))+diskSegmentExt)}
+		s.segments[key] = seg
+	}
+
+	if seg.file == nil {
+		file, err := os.OpenFile(seg.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		seg.file = file
+	}
+
+	err := writeFrame(seg.file, data)
+
+	if err != nil {
+		return err
+	}
+
+	seg.count++
+	seg.bytes += len(data)
+
+	return nil
+}
+
+func (s *spill) len(key string) int {
+	if seg, ok := s.segments[key]; ok {
+		return seg.count
+	}
+
+	return 0
+}
+
+// byteLen returns the size of the records of a key, without frame headers
+func (s *spill) byteLen(key string) int {
+	if seg, ok := s.segments[key]; ok {
+		return seg.bytes
+	}
+
+	return 0
+}
+
+func (s *spill) keys() []string {
+	ret := make([]string, 0, len(s.segments))
+
+	for key := range s.segments {
+		ret = append(ret, key)
+	}
+
+	return ret
+}
+
+// read returns up to size records of a key from the oldest, without removing them
+func (s *spill) read(key string, size int) ([][]byte, error) {
+	seg, ok := s.segments[key]
+
+	if !ok || size == 0 {
+		return [][]byte{}, nil
+	}
+
+	return seg.read(size)
+}
+
+// clear removes the oldest size records of a key, -1 removes all of them
+func (s *spill) clear(key string, size int) error {
+	seg, ok := s.segments[key]
+
+	if !ok {
+		return nil
+	}
+
+	if size < 0 || size >= seg.count {
+		delete(s.segments, key)
+		return seg.remove()
+	}
+
+	frames, err := seg.read(size)
+
+	if err != nil {
+		return err
+	}
+
+	for _, frame := range frames {
+		seg.offset += int64(4 + len(frame))
+		seg.bytes -= len(frame)
+	}
+
+	seg.count -= len(frames)
+
+	if seg.offset >= spillCompactSize {
+		return seg.compact()
+	}
+
+	return writeOffset(seg.name+spillOffsetExt, seg.offset)
+}
+
+func (s *spill) close() error {
+	var ret error
+
+	for _, seg := range s.segments {
+		if seg.file != nil {
+			err := seg.file.Close()
+
+			if err != nil {
+				ret = err
+			}
+
+			seg.file = nil
+		}
+	}
+
+	return ret
+}
+
+func (seg *spillSegment) read(size int) ([][]byte, error) {
+	file, err := os.Open(seg.name)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return [][]byte{}, nil
+		}
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Seek(seg.offset, io.SeekStart)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([][]byte, 0)
+	r := bufio.NewReader(file)
+	header := make([]byte, 4)
+	offset := seg.offset
+
+	for size < 0 || len(ret) < size {
+		_, err = io.ReadFull(r, header)
+
+		if err != nil {
+			break
+		}
+
+		// a length beyond the end of file is a torn or corrupt frame, it is not allocated
+		length := int64(binary.BigEndian.Uint32(header))
+
+		if length > info.Size()-offset-4 {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+
+		frame := make([]byte, length)
+		_, err = io.ReadFull(r, frame)
+
+		if err != nil {
+			break
+		}
+
+		ret = append(ret, frame)
+		offset += 4 + length
+	}
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// compact copies the pending records to a new segment, so cleared records don't use disk space anymore
+func (seg *spillSegment) compact() error {
+	if seg.file != nil {
+		seg.file.Close()
+		seg.file = nil
+	}
+
+	src, err := os.Open(seg.name)
+
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	_, err = src.Seek(seg.offset, io.SeekStart)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := seg.name + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, seg.name)
+
+	if err != nil {
+		return err
+	}
+
+	seg.offset = 0
+
+	return writeOffset(seg.name+spillOffsetExt, seg.offset)
+}
+
+func (seg *spillSegment) remove() error {
+	if seg.file != nil {
+		seg.file.Close()
+		seg.file = nil
+	}
+
+	for _, name := range []string{seg.name, seg.name + spillOffsetExt} {
+		err := os.Remove(name)
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readOffset(name string) int64 {
+	data, err := os.ReadFile(name)
+
+	if err != nil || len(data) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+func writeOffset(name string, offset int64) error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(offset))
+
+	return os.WriteFile(name, data, 0644)
+}
@@ -0,0 +1,126 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"data2parquet/pkg/converter"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/logger" // "log/slog"
+)
+
+var slog = logger.GetLogger()
+
+// Parquet key-value metadata of chained files
+const MetaKey = "data2parquet.chain.key"
+const MetaSeq = "data2parquet.chain.seq"
+const MetaPrevHash = "data2parquet.chain.prev-hash"
+const MetaPrevFile = "data2parquet.chain.prev-file"
+
+const ManifestSuffix = ".chain.json"
+const HeadDir = "_chain"
+
+var ErrNotChained = errors.New("file has no chain metadata")
+
+// Link is the chain entry of a file, it is stored on the file sidecar manifest and, for the last file of a key, as the
+// key chain head. File paths are relative to the writer output (`WriterFilePath` or S3 bucket).
+type Link struct {
+	Key      string    `json:"key"`
+	Seq      int64     `json:"seq"`
+	File     string    `json:"file"`
+	Hash     string    `json:"hash"`
+	PrevHash string    `json:"prev_hash,omitempty"`
+	PrevFile string    `json:"prev_file,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Hash returns the hex SHA-256 of file data
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HeadPath returns the path of the chain head of a key
+func HeadPath(key string) string {
+	return HeadDir + "/" + strings.ReplaceAll(key, domain.KeySeparator, "_") + ".json"
+}
+
+// ManifestPath returns the path of the sidecar manifest of a file
+func ManifestPath(file string) string {
+	return file + ManifestSuffix
+}
+
+// Metadata returns the Parquet metadata of the next file of a key, head is nil on its first file
+func Metadata(key string, head *Link) map[string]string {
+	ret := map[string]string{
+		MetaKey: key,
+		MetaSeq: "1",
+	}
+
+	if head != nil {
+		ret[MetaSeq] = strconv.FormatInt(head.Seq+1, 10)
+		ret[MetaPrevHash] = head.Hash
+		ret[MetaPrevFile] = head.File
+	}
+
+	return ret
+}
+
+// NewLink returns the link of a chained file from its data, sequence and previous file come from its metadata
+func NewLink(file string, data []byte) (*Link, error) {
+	meta, err := converter.ReadMetadata(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, found := meta[MetaKey]
+
+	if !found {
+		return nil, ErrNotChained
+	}
+
+	seq, err := strconv.ParseInt(meta[MetaSeq], 10, 64)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid chain sequence %q: %w", meta[MetaSeq], err)
+	}
+
+	return &Link{
+		Key:      key,
+		Seq:      seq,
+		File:     file,
+		Hash:     Hash(data),
+		PrevHash: meta[MetaPrevHash],
+		PrevFile: meta[MetaPrevFile],
+		Time:     time.Now().UTC(),
+	}, nil
+}
+
+func (l *Link) ToJson() []byte {
+	data, err := json.Marshal(l)
+
+	if err != nil {
+		slog.Error("Error marshalling chain link", "error", err, "module", "chain", "function", "ToJson")
+		return nil
+	}
+
+	return data
+}
+
+func ParseLink(data []byte) (*Link, error) {
+	ret := &Link{}
+	err := json.Unmarshal(data, ret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,239 @@
+package chain
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Store reads the writer output, paths are relative to it
+type Store interface {
+	List(prefix string) ([]string, error)
+	Read(path string) ([]byte, error)
+}
+
+const (
+	BreakFileMissing     = "file-missing"
+	BreakManifestMissing = "manifest-missing"
+	BreakManifestInvalid = "manifest-invalid"
+	BreakHashMismatch    = "hash-mismatch"
+	BreakMetadata        = "metadata-mismatch"
+	BreakGap             = "sequence-gap"
+	BreakFork            = "fork"
+	BreakPrevHash        = "prev-hash-mismatch"
+	BreakHead            = "head-mismatch"
+)
+
+type Break struct {
+	Key    string `json:"key,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+	File   string `json:"file,omitempty"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Report struct {
+	Keys   int      `json:"keys"`
+	Files  int      `json:"files"`
+	Breaks []*Break `json:"breaks"`
+}
+
+// Verify walks the chained files under prefix and reports breaks: files deleted, changed, reordered or without
+// manifest. With an empty prefix the whole output is checked, so each chain must start on sequence 1 and end on its
+// head, with a prefix (e.g. a capability or a day) only links inside it are checked.
+func Verify(store Store, prefix string) (*Report, error) {
+	paths, err := store.List(prefix)
+
+	if err != nil {
+		slog.Error("Error listing files", "error", err, "prefix", prefix, "module", "chain", "function", "Verify")
+		return nil, err
+	}
+
+	ret := &Report{Breaks: make([]*Break, 0)}
+	files := make(map[string]bool)
+	manifests := make([]string, 0)
+	heads := make([]string, 0)
+
+	for _, path := range paths {
+		if strings.HasPrefix(path, HeadDir+"/") {
+			heads = append(heads, path)
+			continue
+		}
+
+		if strings.HasSuffix(path, ManifestSuffix) {
+			manifests = append(manifests, path)
+		} else if strings.HasSuffix(path, ".parquet") {
+			files[path] = true
+		}
+	}
+
+	chains := make(map[string][]*Link)
+
+	for _, manifest := range manifests {
+		file := strings.TrimSuffix(manifest, ManifestSuffix)
+		link, err := checkManifest(store, manifest, file, files[file])
+		delete(files, file)
+
+		if err != nil {
+			ret.Breaks = append(ret.Breaks, err)
+			if link == nil {
+				continue
+			}
+		}
+
+		chains[link.Key] = append(chains[link.Key], link)
+		ret.Files++
+	}
+
+	// files without manifest are reported only when they are chained, files written before the chain was enabled are
+	// not part of it
+	for file := range files {
+		data, err := store.Read(file)
+
+		if err != nil {
+			ret.Breaks = append(ret.Breaks, &Break{File: file, Reason: BreakFileMissing, Detail: err.Error()})
+			continue
+		}
+
+		link, err := NewLink(file, data)
+
+		if err == nil {
+			ret.Breaks = append(ret.Breaks, &Break{Key: link.Key, Seq: link.Seq, File: file, Reason: BreakManifestMissing})
+		}
+	}
+
+	ret.Keys = len(chains)
+
+	for key, links := range chains {
+		ret.Breaks = append(ret.Breaks, checkChain(store, key, links, len(prefix) == 0)...)
+	}
+
+	// a head without files means all files of its key were deleted
+	for _, path := range heads {
+		data, err := store.Read(path)
+
+		if err != nil {
+			ret.Breaks = append(ret.Breaks, &Break{File: path, Reason: BreakHead, Detail: err.Error()})
+			continue
+		}
+
+		head, err := ParseLink(data)
+
+		if err != nil {
+			ret.Breaks = append(ret.Breaks, &Break{File: path, Reason: BreakHead, Detail: err.Error()})
+			continue
+		}
+
+		if _, found := chains[head.Key]; !found {
+			ret.Breaks = append(ret.Breaks, &Break{Key: head.Key, Seq: head.Seq, File: head.File, Reason: BreakHead, Detail: "chain head without files"})
+		}
+	}
+
+	sort.Slice(ret.Breaks, func(i, j int) bool {
+		if ret.Breaks[i].Key != ret.Breaks[j].Key {
+			return ret.Breaks[i].Key < ret.Breaks[j].Key
+		}
+
+		if ret.Breaks[i].Seq != ret.Breaks[j].Seq {
+			return ret.Breaks[i].Seq < ret.Breaks[j].Seq
+		}
+
+		return ret.Breaks[i].File < ret.Breaks[j].File
+	})
+
+	slog.Info("Chain verified", "prefix", prefix, "keys", ret.Keys, "files", ret.Files, "breaks", len(ret.Breaks), "module", "chain", "function", "Verify")
+
+	return ret, nil
+}
+
+// checkManifest returns the manifest link and a break when its file is missing or doesn't match it, the link is nil when
+// the manifest can't be read
+func checkManifest(store Store, manifest string, file string, listed bool) (*Link, *Break) {
+	data, err := store.Read(manifest)
+
+	if err != nil {
+		return nil, &Break{File: file, Reason: BreakManifestInvalid, Detail: err.Error()}
+	}
+
+	link, err := ParseLink(data)
+
+	if err != nil {
+		return nil, &Break{File: file, Reason: BreakManifestInvalid, Detail: err.Error()}
+	}
+
+	if !listed {
+		return link, &Break{Key: link.Key, Seq: link.Seq, File: file, Reason: BreakFileMissing}
+	}
+
+	data, err = store.Read(file)
+
+	if err != nil {
+		reason := BreakManifestInvalid
+
+		if errors.Is(err, os.ErrNotExist) {
+			reason = BreakFileMissing
+		}
+
+		return link, &Break{Key: link.Key, Seq: link.Seq, File: file, Reason: reason, Detail: err.Error()}
+	}
+
+	if Hash(data) != link.Hash {
+		return link, &Break{Key: link.Key, Seq: link.Seq, File: file, Reason: BreakHashMismatch}
+	}
+
+	actual, err := NewLink(file, data)
+
+	if err != nil || actual.Key != link.Key || actual.Seq != link.Seq || actual.PrevHash != link.PrevHash {
+		return link, &Break{Key: link.Key, Seq: link.Seq, File: file, Reason: BreakMetadata}
+	}
+
+	return link, nil
+}
+
+// checkChain checks the links of a key are a single sequence, each one pointing to the hash of the previous one
+func checkChain(store Store, key string, links []*Link, full bool) []*Break {
+	ret := make([]*Break, 0)
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Seq < links[j].Seq
+	})
+
+	if full && links[0].Seq != 1 {
+		ret = append(ret, &Break{Key: key, Seq: 1, Reason: BreakGap, Detail: "chain doesn't start on sequence 1"})
+	}
+
+	for i := 1; i < len(links); i++ {
+		prev := links[i-1]
+		link := links[i]
+
+		switch {
+		case link.Seq == prev.Seq:
+			ret = append(ret, &Break{Key: key, Seq: link.Seq, File: link.File, Reason: BreakFork, Detail: "same sequence as " + prev.File})
+		case link.Seq > prev.Seq+1:
+			ret = append(ret, &Break{Key: key, Seq: prev.Seq + 1, File: link.File, Reason: BreakGap, Detail: "files missing before this one"})
+		case link.PrevHash != prev.Hash:
+			ret = append(ret, &Break{Key: key, Seq: link.Seq, File: link.File, Reason: BreakPrevHash, Detail: "previous file is " + prev.File})
+		}
+	}
+
+	if !full {
+		return ret
+	}
+
+	data, err := store.Read(HeadPath(key))
+
+	if err != nil {
+		ret = append(ret, &Break{Key: key, Reason: BreakHead, Detail: err.Error()})
+		return ret
+	}
+
+	head, err := ParseLink(data)
+	last := links[len(links)-1]
+
+	if err != nil || head.Seq != last.Seq || head.Hash != last.Hash {
+		ret = append(ret, &Break{Key: key, Seq: last.Seq, File: last.File, Reason: BreakHead, Detail: "last file is not the chain head, newer files may be missing"})
+	}
+
+	return ret
+}
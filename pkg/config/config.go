@@ -2,9 +2,11 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 
+	"data2parquet/pkg/layout"
 	"data2parquet/pkg/logger" //"log/slog"
 	"os"
 	"strings"
@@ -14,87 +16,225 @@ var slog = logger.GetLogger()
 
 type Config struct {
 	//Address: HTTP server Address configuration tag, describe the address of the server, its an optional field only used for HTTP server. The default value is empty.
+	//AuditChain: AuditChain configuration tag, describe the tamper-evident hash chain mode, its an optional field. The default value is `false`. If set to `true` each file written for a key stores the SHA-256 hash of the previous file of the same key, on Parquet key-value metadata and on a sidecar manifest (`<file>.chain.json`), the chain head of each key is kept on `_chain/` of the output. It is a deployment-wide switch, every file of every key is chained, not only audit records, and it can't be used with `redis-stream` buffer, that has no key lock to guard the chain head. Use `chain-verify` to check the chain.
 	//BufferSize: BufferSize configuration tag, describe the size of the buffer, its an important field for control buffer and page size to flush data. The default value is `100`.
-	//BufferType: BufferType configuration tag, describe the type of the buffer, this fields accepte two values, `mem` or `redis`. The default value is `mem`.
+	//BufferType: BufferType configuration tag, describe the type of the buffer, this fields accepte four values, `mem`, `redis`, `disk` or `redis-stream`. The default value is `mem`.
 	//Debug: Debug configuration tag, describe the debug mode, its an optional field. The debug mode will generate a lot of information. The default value is `false`.
+	//DiskPath: DiskPath configuration tag, describe the directory used to store segment files when `BufferType` is `disk`, its an optional field. The default value is `./buffer`.
+	//DiskSyncInterval: DiskSyncInterval configuration tag, describe the interval in seconds between fsync calls when `DiskSyncPolicy` is `interval`, its an optional field. The default value is `1`.
+	//DiskSyncPolicy: DiskSyncPolicy configuration tag, describe when segment files are synced to disk, this fields accepte three values, `always`, `interval` or `none`. The default value is `interval`.
+	//DynamicTimeField: DynamicTimeField configuration tag, describe the field of `dynamic` records with their event time, used to choose the `year=/month=/day=/hour=` partition of their file, its an optional field. The default value is `time`. Records without it are partitioned by the time they are flushed.
+	//FlushBytes: FlushBytes configuration tag, describe the approximate size in bytes (msgpack encoded) of a key buffer that triggers a flush, alongside `BufferSize` and `FlushInterval`, use it with a big `BufferSize` to get output files close to a target size (e.g. `WriterRowGroupSize`), its an optional field. The default value is `0` (disabled).
 	//FlushInterval: FlushInterval configuration tag, describe the interval to flush data in seconds, its an important field to control the time to flush data. The default value is `5`.
+	//FlushWorkers: FlushWorkers configuration tag, describe the number of keys flushed in parallel, used as the flush scheduler worker pool size and as a limit to all flushes, its an optional field. The default value is `4`.
+	//HMACKeyID: HMACKeyID configuration tag, describe the ID of the key used to sign records when `UseHMAC` is set, other keys are only used to verify records signed before a rotation, its an optional field. The default value is empty, only allowed when a single key is loaded.
+	//HMACKeys: HMACKeys configuration tag, describe the HMAC keys as `id=secret` pairs separated by comma, its an optional field. The default value is empty.
+	//HMACKeysEnv: HMACKeysEnv configuration tag, describe the name of an environment variable with HMAC keys as `id=secret` pairs separated by comma, its an optional field. The default value is empty.
+	//HMACKeysFile: HMACKeysFile configuration tag, describe the path of a file with one HMAC key as `id=secret` per line, its an optional field. The default value is empty.
 	//IgnoredFields: IgnoredFields configuration tag, describe the fields to ignore in the data, its an optional field. The default value is empty. Fields must be separated by comma.
-	//JsonSchemaPath: JsonSchemaPath configuration tag, describe the path to the JSON schema file, its an optional field. The default value is empty. *This feature is not implemented yet.
+	//JsonSchemaPath: JsonSchemaPath configuration tag, describe the path to the xitongsys JSON schema file of `dynamic` records data, its an optional field. The default value is empty, the schema is inferred from each batch of records and cached by key.
+	//KeyIdleTimeout: KeyIdleTimeout configuration tag, describe the time in seconds without new records after which an empty key stops being tracked by the flush scheduler, its an optional field. The default value is `10x` `FlushInterval` value.
 	//LogFormatter: LogFormatter configuration tag, describe the log formatter, this fields accepte four values, `color`, `text`, `json` or `multi`. The default value is `color`.
-	//MaskFields: MaskFields configuration tag, describe the fields to mask in the data, its an optional field. The default value is empty. Fields must be separated by comma.
+	//MaskFields: MaskFields configuration tag, describe the fields to mask in the data, its an optional field. The default value is empty. Fields must be separated by comma. Values are replaced with `*`, use `MaskRules` for other strategies.
+	//MaskRules: MaskRules configuration tag, describe the masking strategy of each field, its an optional field. The default value is empty. On fluent-bit plugin it is set as a JSON array. See `MaskRule`.
+	//MaxInFlightBytes: MaxInFlightBytes configuration tag, describe the max size in bytes of converted batches being written at the same time by all keys, a flush waits for other flushes to finish before writing when this limit would be exceeded, its an optional field. The default value is `0` (no limit).
+	//MemBlockTimeout: MemBlockTimeout configuration tag, describe the time in seconds `Push` waits for free space when `MemFullPolicy` is `block`, after that the record is rejected, its an optional field. The default value is `5`.
+	//MemFullPolicy: MemFullPolicy configuration tag, describe what memory buffer does when a limit is reached, this fields accepte four values, `block` (wait for a flush up to `MemBlockTimeout`), `reject` (return a buffer full error), `drop-oldest` (drop the oldest record not being flushed) or `spill` (store records on disk at `MemSpillPath`). The default value is `block`.
+	//MemMaxBytes: MemMaxBytes configuration tag, describe the max size in bytes (msgpack encoded) of all records kept by memory buffer, its an optional field. The default value is `0` (no limit).
+	//MemMaxKeyBytes: MemMaxKeyBytes configuration tag, describe the max size in bytes (msgpack encoded) of records kept by memory buffer for each key, its an optional field. The default value is `0` (no limit).
+	//MemMaxKeyRecords: MemMaxKeyRecords configuration tag, describe the max number of records kept by memory buffer for each key, its an optional field. The default value is `0` (no limit).
+	//MemMaxRecords: MemMaxRecords configuration tag, describe the max number of records kept by memory buffer, its an optional field. The default value is `0` (no limit).
+	//MemSpillPath: MemSpillPath configuration tag, describe the directory used to store records that don't fit on memory buffer limits when `MemFullPolicy` is `spill`, its an optional field. The default value is `./spill`.
+	//MetricsAddress: MetricsAddress configuration tag, describe the address (e.g. `:9090`) of a standalone listener exposing Prometheus metrics on `/metrics`, used by the fluent-bit plugin where there is no HTTP server, its an optional field. The default value is empty, the listener is disabled.
+	//PIIDetectors: PIIDetectors configuration tag, describe the built-in PII detectors run on string fields of each record before it is pushed to buffer, separated by comma, this fields accepte `credit-card`, `email`, `cpf`, `ssn`, `bearer-token` or `all`, its an optional field. The default value is empty, detection is disabled unless `PIIPatterns` is set. Matches are replaced with typed placeholders, e.g. `[EMAIL]`.
+	//PIIFields: PIIFields configuration tag, describe the fields scanned by PII detectors, separated by comma, its an optional field. The default value is empty, all string fields are scanned except the `RecordKey` fields, so scrubbing doesn't change the key of a record.
+	//PIIPatterns: PIIPatterns configuration tag, describe custom PII detectors as a list of `name` and `pattern` (regular expression), matches are replaced with `[NAME]`, its an optional field. The default value is empty. On fluent-bit plugin it is set as a JSON array.
 	//Port: Port configuration tag, describe the port of the server, its an optional field only used for HTTP server. The default value is `8080``.
+	//Processors: Processors configuration tag, describe the ordered list of processors applied to each record before it is pushed to buffer, its an optional field. The default value is empty. On fluent-bit plugin it is set as a JSON array. See `ProcessorConfig`.
+	//RecordKey: RecordKey configuration tag, describe the fields composing the key of each record, used to buffer records and to name and partition files, as a list of `fields` (the first one found is used, the others are fallbacks) and `default` value, its an optional field. The default value is `business-capability`, `business-domain`, `business-service` and `application-service` to `log` records, `capability`, `domain`, `service` and `application` to `dynamic` records. On fluent-bit plugin it is set as a JSON array. See `KeyField`.
 	//RecordType: RecordType configuration tag, describe the type of the record, this fields accepte two values, `log` or `dynamic``. The default value is log. *Dynamic type is not implemented yet.
 	//RecoveryAttempts: RecoveryAttempts configuration tag, describe the number of attempts to recover data, its an optional field. The default value is `0``.
+	//RecoveryBackoff: RecoveryBackoff configuration tag, describe the initial delay in seconds before resending recovery data, doubled on each failed attempt with random jitter, its an optional field. The default value is `1`.
+	//RecoveryMaxBackoff: RecoveryMaxBackoff configuration tag, describe the max delay in seconds between attempts to resend recovery data, its an optional field. The default value is `300`.
+	//RedisAddresses: RedisAddresses configuration tag, describe the list of Redis addresses (host:port) separated by comma, sentinel addresses when `RedisMode` is `sentinel` or cluster nodes when `RedisMode` is `cluster`, its an optional field. The default value is empty, in this case `RedisHost` will be used.
 	//RedisDataPrefix: RedisDataPrefix configuration tag, describe the prefix of the data key in Redis, its an optional field. The default value is `data`.
 	//RedisDB: RedisDB configuration tag, describe the database number in Redis, its an optional field. The default value is `0`.
 	//RedisDLQPrefix: RedisDLQPrefix configuration tag, describe the prefix of the DLQ key in Redis, its an optional field. The default value is `dlq`.
+	//RedisFencePrefix: RedisFencePrefix configuration tag, describe the prefix of the fencing key in Redis, used to hold the fencing token counter of each key, its an optional field. The default value is `fence`.
 	//RedisHost: RedisHost configuration tag, describe the host of the Redis server, its an optional field if you use 'BufferType` as `mem`, but became required if `BufferType` is `redis`. The default value is empty but need to be set if `BufferType` is `redis`.
+	//RedisInFlightPrefix: RedisInFlightPrefix configuration tag, describe the prefix of the in-flight key in Redis, used to hold a batch while it is being flushed, its an optional field. The default value is `inflight`.
 	//RedisKeys: RedisKeys configuration tag, describe the keys of the Redis server, its an optional field. The default value is `keys`.
 	//RedisLockInstanceName: RedisLockInstanceName configuration tag, describe the instance name of the lock key in Redis, its an optional field. The default value is empty and in this case, instance hostname will be considered.
 	//RedisLockPrefix: RedisLockPrefix configuration tag, describe the prefix of the lock key in Redis, its an optional field. The default value is `lock`.
-	//RedisLockTTL: RedisLockTTL configuration tag, describe the TTL of the lock key in Redis, its an optional field. The default value is `1.5x` 'FlushInterval` value.
+	//RedisLockTTL: RedisLockTTL configuration tag, describe the TTL in seconds of the lock key in Redis, the lock is renewed every third of this time while a flush is running, its an optional field. The default value is `1.5x` 'FlushInterval` value.
+	//RedisMasterName: RedisMasterName configuration tag, describe the master name monitored by sentinels, its an optional field but became required if `RedisMode` is `sentinel`. The default value is empty.
+	//RedisMode: RedisMode configuration tag, describe how to connect to Redis, this fields accepte three values, `single`, `sentinel` or `cluster`. The default value is `single`.
 	//RedisPassword: RedisPassword configuration tag, describe the password of the Redis server, its an optional field. The default value is empty.
+	//RedisPoisonKey: RedisPoisonKey configuration tag, describe the poison store key in Redis, where recovery data that exhausted `RecoveryAttempts` is kept, its an optional field. The default value is `poison`.
 	//RedisRecoveryKey: RedisRecoveryKey configuration tag, describe the recovery key in Redis, its an optional field. The default value is `recovery`.
+	//RedisSchemaPrefix: RedisSchemaPrefix configuration tag, describe the prefix of the key in Redis that holds the schema versions of each key when `SchemaRegistry` is `redis`, its an optional field. The default value is `schema`.
+	//RedisSentinelPassword: RedisSentinelPassword configuration tag, describe the password of the sentinel servers, its an optional field only used if `RedisMode` is `sentinel`. The default value is empty.
+	//RedisSizePrefix: RedisSizePrefix configuration tag, describe the prefix of the key in Redis that holds the size in bytes of each data key, its an optional field. The default value is `size`.
+	//RedisStreamClaimIdle: RedisStreamClaimIdle configuration tag, describe the time in seconds a stream entry can stay pending for a consumer before other instance claims it, used when `BufferType` is `redis-stream`, its an optional field. The default value is `3x` `FlushInterval` value.
+	//RedisStreamGroup: RedisStreamGroup configuration tag, describe the consumer group name used to read streams when `BufferType` is `redis-stream`, its an optional field. The default value is `data2parquet`.
+	//RedisStreamPrefix: RedisStreamPrefix configuration tag, describe the prefix of the stream key in Redis when `BufferType` is `redis-stream`, its an optional field. The default value is `stream`.
 	//RedisTimeout: RedisTimeout configuration tag, describe the timeout of the Redis server, its an optional field. The default value is empty, in this case, `0` will be the value (Redis defaults).
+	//RedisTLS: RedisTLS configuration tag, describe the use of TLS to connect to Redis, its an optional field. The default value is `false`.
+	//RedisTLSCAFile: RedisTLSCAFile configuration tag, describe the path of a PEM file with the CA used to verify Redis certificates, its an optional field. The default value is empty, in this case system CAs will be used.
+	//RedisTLSInsecure: RedisTLSInsecure configuration tag, describe if Redis certificates must not be verified, its an optional field, use only for tests. The default value is `false`.
+	//SchemaRegistry: SchemaRegistry configuration tag, describe where the schema versions of `dynamic` records are registered, this fields accepte three values, `none`, `file` (on `SchemaRegistryPath`) or `redis` (shared by all instances), its an optional field. The default value is `none`. When set, schemas only evolve with backward-compatible changes and records that would break them are pushed to DLQ.
+	//SchemaRegistryPath: SchemaRegistryPath configuration tag, describe the directory used to store schema versions when `SchemaRegistry` is `file`, its an optional field. The default value is `./schemas`.
 	//S3BucketName: S3BucketName configuration tag, describe the bucket name in S3, its an optional field. The default value is empty but need to be set if you use `aws-s3` as a writer.
 	//S3Endpoint: S3Endpoint configuration tag, describe the endpoint of the S3 server, its an optional field. The default value is empty but need to be set if you use `aws-s3` as a writer.
 	//S3Region: S3Region configuration tag, describe the region of the S3 server, its an optional field. The default value is empty but need to be set if you use `aws-s3` as a writer.
 	//S3RoleARN: S3RoleName configuration tag, describe the role name of the S3 server, its an optional field. The default value is empty but need to be set if you use `aws-s3` as a writer.
 	//S3STSEndpoint: S3STSEndpoint configuration tag, describe the endpoint of the STS server, its an optional field. The default value is empty but need to be set if you use `aws-s3` as a writer.
+	//TracingEndpoint: TracingEndpoint configuration tag, describe the OTLP collector endpoint (e.g. `localhost:4318`) when `TracingExporter` is `otlp`, its an optional field. The default value is empty, the `OTEL_EXPORTER_OTLP_ENDPOINT` environment variable or `localhost:4318` is used.
+	//TracingExporter: TracingExporter configuration tag, describe where OpenTelemetry spans are exported, this fields accepte three values, `none`, `stdout` or `otlp` (OTLP over HTTP). The default value is `none`.
+	//TracingInsecure: TracingInsecure configuration tag, describe if OTLP exporter uses plain HTTP instead of HTTPS, its an optional field. The default value is `false`.
+	//TracingServiceName: TracingServiceName configuration tag, describe the service name set on exported spans, its an optional field. The default value is `data2parquet`.
 	//TryAutoRecover: TryAutoRecover configuration tag, describe the auto recover mode, its an optional field. The default value is `false`. If set to `true` the system will try to recover the data that failed to write after flash, using recovery cache.
 	//UseDLQ: UseDLQ configuration tag, describe the use of DLQ, its an optional field. The default value is `false`. If set to `true` the system will use the DLQ to store the data that failed to write after flash.
 	//UseHash: UseHash configuration tag, describe the use of hash, its an optional field. The default value is `false`. If set to `true` the system will use the hash to store the data in the buffer.
-	//UseHMAC: UseHMAC configuration tag, describe the use of HMAC, its an optional field. The default value is `false`. If set to `true` the system will use the HMAC to sign the data.
+	//UseHMAC: UseHMAC configuration tag, describe the use of HMAC, its an optional field. The default value is `false`. If set to `true` the system will sign each record with HMAC-SHA256 using the `HMACKeyID` key, stored on `hmac` column as `<key id>:<hex digest>`.
 	//WriterCompressionType: WriterCompressionType configuration tag, describe the compression type of the writer, its an optional field. The default and recommended value is `snappy`. This fields accepte two values, `snappy`, `gzip` or `none`.
 	//WriterFilePath: WriterFilePath configuration tag, describe the file path of the writer, its an optional field. The default value is `./out`.
+	//WriterPathTemplate: WriterPathTemplate configuration tag, describe the path of output files inside `WriterFilePath` or S3 bucket, with placeholders for record info (`{capability}`, `{domain}`, `{service}`, `{application}`, `{key}`, `{record_type}`), record fields (`{field:<name>}`), event time in UTC (`{year}`, `{month}`, `{day}`, `{hour}`, `{minute}`, `{date}`), `{id}` and `{hash}`, its an optional field. The default value is `capability={capability}/year={year}/month={month}/day={day}/hour={hour}/{id}-{key}{hash}.parquet` for `log` records.
 	//WriterRowGroupSize: WriterRowGroupSize configuration tag, describe the row group size of the writer, its an optional field. The default value is `134217728` (128M).
 	//WriterType: WriterType configuration tag, describe the type of the writer, this fields accepte two values, `file` or `aws-s3`. The default value is `file`.
 
-	Address               string `json:"address,omitempty"`
-	BufferSize            int    `json:"buffer_size"`
-	BufferType            string `json:"buffer_type"`
-	Debug                 bool   `json:"debug,omitempty"`
-	FlushInterval         int    `json:"flush_interval"`
-	IgnoredFields         string `json:"ignored_fields,omitempty"`
-	JsonSchemaPath        string `json:"json_schema_path,omitempty"`
-	LogFormatter          string `json:"log_formatter,omitempty"`
-	MaskFields            string `json:"mask_fields,omitempty"`
-	Port                  int    `json:"port,omitempty"`
-	RecordType            string `json:"record_type"`
-	RecoveryAttempts      int    `json:"recovery_attempts,omitempty"`
-	RedisDataPrefix       string `json:"redis_data_prefix,omitempty"`
-	RedisDB               int    `json:"redis_db,omitempty"`
-	RedisDLQPrefix        string `json:"redis_dlq_prefix,omitempty"`
-	RedisHost             string `json:"redis_host,omitempty"`
-	RedisKeys             string `json:"redis_keys,omitempty"`
-	RedisLockInstanceName string `json:"redis_lock_instance_name,omitempty"`
-	RedisLockPrefix       string `json:"redis_lock_prefix,omitempty"`
-	RedisLockTTL          int    `json:"redis_lock_ttl,omitempty"`
-	RedisPassword         string `json:"redis_password,omitempty"`
-	RedisRecoveryKey      string `json:"redis_recovery_key,omitempty"`
-	RedisTimeout          int    `json:"redis_timeout,omitempty"`
-	S3BuketName           string `json:"s3_bucket_name"`
-	S3DefaultCapability   string `json:"s3_default_capability,omitempty"`
-	S3Endpoint            string `json:"s3_endpoint,omitempty"`
-	S3Region              string `json:"s3_region"`
-	S3RoleARN             string `json:"s3_role_arn,omitempty"`
-	S3STSEndpoint         string `json:"s3_sts_endpoint,omitempty"`
-	TryAutoRecover        bool   `json:"try_auto_recover,omitempty"`
-	UseDLQ                bool   `json:"use_dlq,omitempty"`
-	UseHash               bool   `json:"use_hash,omitempty"`
-	UseHMAC               bool   `json:"use_hmac,omitempty"`
-	WriterCompressionType string `json:"writer_compression_type,omitempty"`
-	WriterFilePath        string `json:"writer_file_path,omitempty"`
-	WriterRowGroupSize    int64  `json:"writer_row_group_size,omitempty"`
-	WriterType            string `json:"writer_type"`
+	Address               string             `json:"address,omitempty"`
+	AuditChain            bool               `json:"audit_chain,omitempty"`
+	BufferSize            int                `json:"buffer_size"`
+	BufferType            string             `json:"buffer_type"`
+	Debug                 bool               `json:"debug,omitempty"`
+	DynamicTimeField      string             `json:"dynamic_time_field,omitempty"`
+	DiskPath              string             `json:"disk_path,omitempty"`
+	DiskSyncInterval      int                `json:"disk_sync_interval,omitempty"`
+	DiskSyncPolicy        string             `json:"disk_sync_policy,omitempty"`
+	FlushBytes            int                `json:"flush_bytes,omitempty"`
+	FlushInterval         int                `json:"flush_interval"`
+	FlushWorkers          int                `json:"flush_workers,omitempty"`
+	HMACKeyID             string             `json:"hmac_key_id,omitempty"`
+	HMACKeys              string             `json:"hmac_keys,omitempty"`
+	HMACKeysEnv           string             `json:"hmac_keys_env,omitempty"`
+	HMACKeysFile          string             `json:"hmac_keys_file,omitempty"`
+	IgnoredFields         string             `json:"ignored_fields,omitempty"`
+	JsonSchemaPath        string             `json:"json_schema_path,omitempty"`
+	KeyIdleTimeout        int                `json:"key_idle_timeout,omitempty"`
+	LogFormatter          string             `json:"log_formatter,omitempty"`
+	MaskFields            string             `json:"mask_fields,omitempty"`
+	MaskRules             []*MaskRule        `json:"mask_rules,omitempty"`
+	MaxInFlightBytes      int                `json:"max_inflight_bytes,omitempty"`
+	MemBlockTimeout       int                `json:"mem_block_timeout,omitempty"`
+	MemFullPolicy         string             `json:"mem_full_policy,omitempty"`
+	MemMaxBytes           int                `json:"mem_max_bytes,omitempty"`
+	MemMaxKeyBytes        int                `json:"mem_max_key_bytes,omitempty"`
+	MemMaxKeyRecords      int                `json:"mem_max_key_records,omitempty"`
+	MemMaxRecords         int                `json:"mem_max_records,omitempty"`
+	MemSpillPath          string             `json:"mem_spill_path,omitempty"`
+	MetricsAddress        string             `json:"metrics_address,omitempty"`
+	Port                  int                `json:"port,omitempty"`
+	PIIDetectors          string             `json:"pii_detectors,omitempty"`
+	PIIFields             string             `json:"pii_fields,omitempty"`
+	PIIPatterns           []*PIIPattern      `json:"pii_patterns,omitempty"`
+	Processors            []*ProcessorConfig `json:"processors,omitempty"`
+	RecordKey             []*KeyField        `json:"record_key,omitempty"`
+	RecordType            string             `json:"record_type"`
+	RecoveryAttempts      int                `json:"recovery_attempts,omitempty"`
+	RecoveryBackoff       int                `json:"recovery_backoff,omitempty"`
+	RecoveryMaxBackoff    int                `json:"recovery_max_backoff,omitempty"`
+	RedisAddresses        string             `json:"redis_addresses,omitempty"`
+	RedisDataPrefix       string             `json:"redis_data_prefix,omitempty"`
+	RedisDB               int                `json:"redis_db,omitempty"`
+	RedisDLQPrefix        string             `json:"redis_dlq_prefix,omitempty"`
+	RedisFencePrefix      string             `json:"redis_fence_prefix,omitempty"`
+	RedisHost             string             `json:"redis_host,omitempty"`
+	RedisInFlightPrefix   string             `json:"redis_inflight_prefix,omitempty"`
+	RedisKeys             string             `json:"redis_keys,omitempty"`
+	RedisLockInstanceName string             `json:"redis_lock_instance_name,omitempty"`
+	RedisLockPrefix       string             `json:"redis_lock_prefix,omitempty"`
+	RedisLockTTL          int                `json:"redis_lock_ttl,omitempty"`
+	RedisMasterName       string             `json:"redis_master_name,omitempty"`
+	RedisMode             string             `json:"redis_mode,omitempty"`
+	RedisPassword         string             `json:"redis_password,omitempty"`
+	RedisPoisonKey        string             `json:"redis_poison_key,omitempty"`
+	RedisRecoveryKey      string             `json:"redis_recovery_key,omitempty"`
+	RedisSchemaPrefix     string             `json:"redis_schema_prefix,omitempty"`
+	RedisSentinelPassword string             `json:"redis_sentinel_password,omitempty"`
+	RedisSizePrefix       string             `json:"redis_size_prefix,omitempty"`
+	RedisStreamClaimIdle  int                `json:"redis_stream_claim_idle,omitempty"`
+	RedisStreamGroup      string             `json:"redis_stream_group,omitempty"`
+	RedisStreamPrefix     string             `json:"redis_stream_prefix,omitempty"`
+	RedisTimeout          int                `json:"redis_timeout,omitempty"`
+	RedisTLS              bool               `json:"redis_tls,omitempty"`
+	RedisTLSCAFile        string             `json:"redis_tls_ca_file,omitempty"`
+	RedisTLSInsecure      bool               `json:"redis_tls_insecure,omitempty"`
+	SchemaRegistry        string             `json:"schema_registry,omitempty"`
+	SchemaRegistryPath    string             `json:"schema_registry_path,omitempty"`
+	S3BuketName           string             `json:"s3_bucket_name"`
+	S3DefaultCapability   string             `json:"s3_default_capability,omitempty"`
+	S3Endpoint            string             `json:"s3_endpoint,omitempty"`
+	S3Region              string             `json:"s3_region"`
+	S3RoleARN             string             `json:"s3_role_arn,omitempty"`
+	S3STSEndpoint         string             `json:"s3_sts_endpoint,omitempty"`
+	TracingEndpoint       string             `json:"tracing_endpoint,omitempty"`
+	TracingExporter       string             `json:"tracing_exporter,omitempty"`
+	TracingInsecure       bool               `json:"tracing_insecure,omitempty"`
+	TracingServiceName    string             `json:"tracing_service_name,omitempty"`
+	TryAutoRecover        bool               `json:"try_auto_recover,omitempty"`
+	UseDLQ                bool               `json:"use_dlq,omitempty"`
+	UseHash               bool               `json:"use_hash,omitempty"`
+	UseHMAC               bool               `json:"use_hmac,omitempty"`
+	WriterCompressionType string             `json:"writer_compression_type,omitempty"`
+	WriterFilePath        string             `json:"writer_file_path,omitempty"`
+	WriterPathTemplate    string             `json:"writer_path_template,omitempty"`
+	WriterRowGroupSize    int64              `json:"writer_row_group_size,omitempty"`
+	WriterType            string             `json:"writer_type"`
 }
 
 const BufferTypeMem = "mem"
 const BufferTypeRedis = "redis"
+const BufferTypeDisk = "disk"
+const BufferTypeRedisStream = "redis-stream"
 
 var BufferTypes = map[string]int{
-	BufferTypeMem:   1,
-	BufferTypeRedis: 2,
+	BufferTypeMem:         1,
+	BufferTypeRedis:       2,
+	BufferTypeDisk:        3,
+	BufferTypeRedisStream: 4,
+}
+
+const DiskSyncAlways = "always"
+const DiskSyncInterval = "interval"
+const DiskSyncNone = "none"
+
+var DiskSyncPolicies = map[string]int{
+	DiskSyncAlways:   1,
+	DiskSyncInterval: 2,
+	DiskSyncNone:     3,
+}
+
+const MemFullPolicyBlock = "block"
+const MemFullPolicyReject = "reject"
+const MemFullPolicyDropOldest = "drop-oldest"
+const MemFullPolicySpill = "spill"
+
+var MemFullPolicies = map[string]int{
+	MemFullPolicyBlock:      1,
+	MemFullPolicyReject:     2,
+	MemFullPolicyDropOldest: 3,
+	MemFullPolicySpill:      4,
+}
+
+const RedisModeSingle = "single"
+const RedisModeSentinel = "sentinel"
+const RedisModeCluster = "cluster"
+
+var RedisModes = map[string]int{
+	RedisModeSingle:   1,
+	RedisModeSentinel: 2,
+	RedisModeCluster:  3,
 }
 
 const WriterTypeAWSS3 = "aws-s3"
@@ -105,6 +245,155 @@ var WriterTypes = map[string]int{
 	WriterTypeAWSS3: 2,
 }
 
+const TracingExporterNone = "none"
+const TracingExporterStdout = "stdout"
+const TracingExporterOTLP = "otlp"
+
+const SchemaRegistryNone = "none"
+const SchemaRegistryFile = "file"
+const SchemaRegistryRedis = "redis"
+
+var SchemaRegistries = map[string]int{
+	SchemaRegistryNone:  1,
+	SchemaRegistryFile:  2,
+	SchemaRegistryRedis: 3,
+}
+
+var TracingExporters = map[string]int{
+	TracingExporterNone:   1,
+	TracingExporterStdout: 2,
+	TracingExporterOTLP:   3,
+}
+
+// ProcessorConfig describes one processor of `Processors`, fields used depend on its `Type`:
+//   - `drop-level`: drops records with a level on `Values` (case insensitive).
+//   - `drop-field`: drops records where `Field` value is on `Values` or matches `Pattern`.
+//   - `rename`: renames fields, `Fields` maps the current name to the new name.
+//   - `add`: sets static fields, `Fields` maps the field name to its value.
+//   - `copy`: copies `Field` value to `Target`.
+//   - `move`: moves `Field` value to `Target`.
+//   - `parse-json`: parses the JSON object on `Field` string value and sets its fields on the record, or on `Target` when set. `Field` is removed.
+//   - `sample`: keeps only a `Rate` (greater than 0 and up to 1) fraction of records.
+//   - `redact`: replaces `Pattern` matches by `Replace` (default `*`) on string fields listed on `Values`, or on all string fields when empty.
+type ProcessorConfig struct {
+	Type    string            `json:"type"`
+	Field   string            `json:"field,omitempty"`
+	Target  string            `json:"target,omitempty"`
+	Values  []string          `json:"values,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Pattern string            `json:"pattern,omitempty"`
+	Replace string            `json:"replace,omitempty"`
+	Rate    float64           `json:"rate,omitempty"`
+}
+
+const ProcessorTypeDropLevel = "drop-level"
+const ProcessorTypeDropField = "drop-field"
+const ProcessorTypeRename = "rename"
+const ProcessorTypeAdd = "add"
+const ProcessorTypeCopy = "copy"
+const ProcessorTypeMove = "move"
+const ProcessorTypeParseJSON = "parse-json"
+const ProcessorTypeSample = "sample"
+const ProcessorTypeRedact = "redact"
+
+var ProcessorTypes = map[string]int{
+	ProcessorTypeDropLevel: 1,
+	ProcessorTypeDropField: 2,
+	ProcessorTypeRename:    3,
+	ProcessorTypeAdd:       4,
+	ProcessorTypeCopy:      5,
+	ProcessorTypeMove:      6,
+	ProcessorTypeParseJSON: 7,
+	ProcessorTypeSample:    8,
+	ProcessorTypeRedact:    9,
+}
+
+// MaskRule describes how a field is masked. `Field` is a record field or a nested key (e.g. of `args`), `user-id`
+// matches the field and any nested key with that name, `args.user-id` only the `user-id` key of `args`. Strategies:
+//   - `redact`: replaces the value with `Replace` (default `*`).
+//   - `last`: keeps the last `Keep` characters (default `4`) and replaces the others with `*`.
+//   - `hash`: replaces the value with the hex SHA-256 of `Salt` and the value, the same value gives the same pseudonym so
+//     masked fields can still be joined and counted.
+//   - `email`: keeps the first character of the user and the domain, `j*******@example.com`.
+//   - `ip`: keeps the first `Keep` octets of IPv4 (default `2`) or groups of IPv6 (default `4`), `10.1.*.*`.
+//   - `regex`: replaces `Pattern` matches with `Replace` (default `*`), to mask parts of free text like `message`.
+type MaskRule struct {
+	Field    string `json:"field"`
+	Strategy string `json:"strategy"`
+	Keep     int    `json:"keep,omitempty"`
+	Salt     string `json:"salt,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+	Replace  string `json:"replace,omitempty"`
+
+	rgx *regexp.Regexp
+}
+
+const MaskStrategyRedact = "redact"
+const MaskStrategyLast = "last"
+const MaskStrategyHash = "hash"
+const MaskStrategyEmail = "email"
+const MaskStrategyIP = "ip"
+const MaskStrategyRegex = "regex"
+
+var MaskStrategies = map[string]int{
+	MaskStrategyRedact: 1,
+	MaskStrategyLast:   2,
+	MaskStrategyHash:   3,
+	MaskStrategyEmail:  4,
+	MaskStrategyIP:     5,
+	MaskStrategyRegex:  6,
+}
+
+// KeyField is a part of the record key of `RecordKey`. `Fields` are record fields or nested keys (e.g. `args.tenant`),
+// the first one with a value is used, so the others are fallbacks. Records without any of them get `Default`. Parts are
+// joined with `:`, the key of a record keyed by `[{"fields": ["env", "environment"], "default": "prod"}, {"fields":
+// ["business-service"]}]` is `prod:payments`.
+type KeyField struct {
+	Fields  []string `json:"fields"`
+	Default string   `json:"default,omitempty"`
+}
+
+// Name returns the field that names the key part, its first field
+func (k *KeyField) Name() string {
+	return k.Fields[0]
+}
+
+var DefaultLogRecordKey = []*KeyField{
+	{Fields: []string{"business-capability"}},
+	{Fields: []string{"business-domain"}},
+	{Fields: []string{"business-service"}},
+	{Fields: []string{"application-service"}},
+}
+
+var DefaultDynamicRecordKey = []*KeyField{
+	{Fields: []string{"capability"}, Default: "dynamic_capability"},
+	{Fields: []string{"domain"}, Default: "dynamic_domain"},
+	{Fields: []string{"service"}, Default: "dynamic_service"},
+	{Fields: []string{"application"}, Default: "dynamic_application"},
+}
+
+// PIIPattern is a custom PII detector of `PIIPatterns`
+type PIIPattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+const PIIDetectorCreditCard = "credit-card"
+const PIIDetectorEmail = "email"
+const PIIDetectorCPF = "cpf"
+const PIIDetectorSSN = "ssn"
+const PIIDetectorBearerToken = "bearer-token"
+const PIIDetectorAll = "all"
+
+var PIIDetectors = map[string]int{
+	PIIDetectorCreditCard:  1,
+	PIIDetectorEmail:       2,
+	PIIDetectorCPF:         3,
+	PIIDetectorSSN:         4,
+	PIIDetectorBearerToken: 5,
+	PIIDetectorAll:         6,
+}
+
 const RecordTypeLog = "log"
 const RecordTypeLogLegacy = "log_legacy"
 const RecordTypeDynamic = "dynamic"
@@ -116,48 +405,131 @@ var RecordTypes = map[string]int{
 }
 
 var keys = []string{
+	"AuditChain",
 	"BufferSize",
 	"BufferType",
 	"Debug",
+	"DynamicTimeField",
 	"DisableLogColors",
+	"DiskPath",
+	"DiskSyncInterval",
+	"DiskSyncPolicy",
+	"FlushBytes",
 	"FlushInterval",
+	"FlushWorkers",
+	"HMACKeyID",
+	"HMACKeys",
+	"HMACKeysEnv",
+	"HMACKeysFile",
 	"IgnoredFields",
 	"JsonSchemaPath",
+	"KeyIdleTimeout",
 	"LogFormatter",
 	"MaskFields",
+	"MaskRules",
+	"MaxInFlightBytes",
+	"MemBlockTimeout",
+	"MemFullPolicy",
+	"MemMaxBytes",
+	"MemMaxKeyBytes",
+	"MemMaxKeyRecords",
+	"MemMaxRecords",
+	"MemSpillPath",
+	"MetricsAddress",
+	"PIIDetectors",
+	"PIIFields",
+	"PIIPatterns",
+	"Processors",
+	"RecordKey",
 	"RecordType",
 	"RecoveryAttempts",
+	"RecoveryBackoff",
+	"RecoveryMaxBackoff",
+	"RedisAddresses",
 	"RedisDataPrefix",
 	"RedisDB",
+	"RedisFencePrefix",
 	"RedisHost",
+	"RedisInFlightPrefix",
 	"RedisKeys",
 	"RedisLockInstanceName",
 	"RedisLockPrefix",
 	"RedisLockTTL",
+	"RedisMasterName",
+	"RedisMode",
 	"RedisPassword",
+	"RedisPoisonKey",
 	"RedisRecoveryKey",
+	"RedisSchemaPrefix",
+	"RedisSentinelPassword",
+	"RedisSizePrefix",
 	"RedisSQLPrefix",
+	"RedisStreamClaimIdle",
+	"RedisStreamGroup",
+	"RedisStreamPrefix",
 	"RedisTimeout",
+	"RedisTLS",
+	"RedisTLSCAFile",
+	"RedisTLSInsecure",
+	"SchemaRegistry",
+	"SchemaRegistryPath",
 	"S3BucketName",
 	"S3DefaultCapability",
 	"S3Endpoint",
 	"S3Region",
 	"S3RoleARN",
 	"S3STSEndpoint",
+	"TracingEndpoint",
+	"TracingExporter",
+	"TracingInsecure",
+	"TracingServiceName",
 	"TryAutoRecover",
 	"UseDLQ",
 	"UseHash",
 	"UseHMAC",
 	"WriterCompressionType",
 	"WriterFilePath",
+	"WriterPathTemplate",
 	"WriterRowGroupSize",
 	"WriterType",
 }
 
 var UseHMAC = false
+
+// DynamicTimeField is the event time field of `dynamic` records set by `SetDefaults`
+var DynamicTimeField = "time"
+
+// PathTemplate is the parsed `WriterPathTemplate` set by `SetDefaults`
+var PathTemplate = layout.MustParse(DefaultPathTemplate)
+
+const DefaultPathTemplate = "capability={capability}/year={year}/month={month}/day={day}/hour={hour}/{id}-{key}{hash}.parquet"
+const DefaultDynamicPathTemplate = "{capability}/year={year}/month={month}/day={day}/hour={hour}/{id}-{key}-{hash}.parquet"
+
+// RecordKey holds the valid `RecordKey` set by `SetDefaults`, nil when the default key of the record type is used
+var RecordKey []*KeyField
+
+// KeyFields returns the parts of the record key of a record type
+func KeyFields(recordType string) []*KeyField {
+	if len(RecordKey) > 0 {
+		return RecordKey
+	}
+
+	if strings.ToLower(recordType) == RecordTypeDynamic {
+		return DefaultDynamicRecordKey
+	}
+
+	return DefaultLogRecordKey
+}
+
+// HMACSecrets holds the HMAC keys loaded by `SetDefaults` by key ID, `HMACSigningKey` is the ID of the key used to sign
+var HMACSecrets = make(map[string][]byte)
+var HMACSigningKey = ""
 var IgnoredFields = make(map[string]any)
 var MaskFields = make(map[string]any)
 
+// MaskRules holds the valid rules of `MaskRules` loaded by `SetDefaults` by field, in config order
+var MaskRules = make(map[string][]*MaskRule)
+
 func NewConfig() *Config {
 	ret := &Config{}
 
@@ -217,8 +589,12 @@ func (c *Config) WriteToFile(filename string) error {
 func (c *Config) Set(cfg map[string]string) error {
 	for key, value := range cfg {
 		switch key {
+		case "AuditChain":
+			c.AuditChain = strings.ToLower(value) == "true"
 		case "Debug":
 			c.Debug = strings.ToLower(value) == "true"
+		case "DynamicTimeField":
+			c.DynamicTimeField = value
 		case "TryAutoRecover":
 			c.TryAutoRecover = strings.ToLower(value) == "true"
 		case "RecoveryAttempts":
@@ -226,6 +602,16 @@ func (c *Config) Set(cfg map[string]string) error {
 			c.WriterType = value
 		case "BufferType":
 			c.BufferType = value
+		case "DiskPath":
+			c.DiskPath = value
+		case "DiskSyncPolicy":
+			c.DiskSyncPolicy = strings.ToLower(value)
+		case "DiskSyncInterval":
+			_, err := fmt.Sscanf(value, "%d", &c.DiskSyncInterval)
+			if err != nil {
+				slog.Warn("Error parsing DiskSyncInterval", "error", err)
+				c.DiskSyncInterval = 1
+			}
 		case "FlushInterval":
 			_, err := fmt.Sscanf(value, "%d", &c.FlushInterval)
 			if err != nil {
@@ -240,6 +626,8 @@ func (c *Config) Set(cfg map[string]string) error {
 			}
 		case "WriterFilePath":
 			c.WriterFilePath = value
+		case "WriterPathTemplate":
+			c.WriterPathTemplate = value
 		case "WriterCompression_type":
 			c.WriterCompressionType = value
 		case "WriterRowGroupSize":
@@ -270,6 +658,8 @@ func (c *Config) Set(cfg map[string]string) error {
 			c.RedisRecoveryKey = value
 		case "RedisDataPrefix":
 			c.RedisDataPrefix = value
+		case "RedisInFlightPrefix":
+			c.RedisInFlightPrefix = value
 		case "RedisKeys":
 			c.RedisKeys = value
 		case "S3BucketName":
@@ -319,10 +709,162 @@ func (c *Config) Set(cfg map[string]string) error {
 		case "LogFormatter":
 			c.LogFormatter = strings.ToLower(value)
 
+		case "HMACKeyID":
+			c.HMACKeyID = value
+		case "HMACKeys":
+			c.HMACKeys = value
+		case "HMACKeysEnv":
+			c.HMACKeysEnv = value
+		case "HMACKeysFile":
+			c.HMACKeysFile = value
 		case "IgnoredFields":
 			c.IgnoredFields = value
 		case "MaskFields":
 			c.MaskFields = value
+		case "RedisAddresses":
+			c.RedisAddresses = value
+		case "RedisMasterName":
+			c.RedisMasterName = value
+		case "RedisMode":
+			c.RedisMode = strings.ToLower(value)
+		case "RedisSentinelPassword":
+			c.RedisSentinelPassword = value
+		case "RedisTLS":
+			c.RedisTLS = strings.ToLower(value) == "true"
+		case "RedisTLSCAFile":
+			c.RedisTLSCAFile = value
+		case "RedisTLSInsecure":
+			c.RedisTLSInsecure = strings.ToLower(value) == "true"
+		case "RedisStreamClaimIdle":
+			_, err := fmt.Sscanf(value, "%d", &c.RedisStreamClaimIdle)
+			if err != nil {
+				slog.Warn("Error parsing RedisStreamClaimIdle", "error", err)
+				c.RedisStreamClaimIdle = 0
+			}
+		case "RedisStreamGroup":
+			c.RedisStreamGroup = value
+		case "RedisStreamPrefix":
+			c.RedisStreamPrefix = value
+		case "RedisFencePrefix":
+			c.RedisFencePrefix = value
+		case "MemBlockTimeout":
+			_, err := fmt.Sscanf(value, "%d", &c.MemBlockTimeout)
+			if err != nil {
+				slog.Warn("Error parsing MemBlockTimeout", "error", err)
+				c.MemBlockTimeout = 0
+			}
+		case "MemFullPolicy":
+			c.MemFullPolicy = strings.ToLower(value)
+		case "MemMaxBytes":
+			_, err := fmt.Sscanf(value, "%d", &c.MemMaxBytes)
+			if err != nil {
+				slog.Warn("Error parsing MemMaxBytes", "error", err)
+				c.MemMaxBytes = 0
+			}
+		case "MemMaxKeyBytes":
+			_, err := fmt.Sscanf(value, "%d", &c.MemMaxKeyBytes)
+			if err != nil {
+				slog.Warn("Error parsing MemMaxKeyBytes", "error", err)
+				c.MemMaxKeyBytes = 0
+			}
+		case "MemMaxKeyRecords":
+			_, err := fmt.Sscanf(value, "%d", &c.MemMaxKeyRecords)
+			if err != nil {
+				slog.Warn("Error parsing MemMaxKeyRecords", "error", err)
+				c.MemMaxKeyRecords = 0
+			}
+		case "MemMaxRecords":
+			_, err := fmt.Sscanf(value, "%d", &c.MemMaxRecords)
+			if err != nil {
+				slog.Warn("Error parsing MemMaxRecords", "error", err)
+				c.MemMaxRecords = 0
+			}
+		case "MemSpillPath":
+			c.MemSpillPath = value
+		case "FlushBytes":
+			_, err := fmt.Sscanf(value, "%d", &c.FlushBytes)
+			if err != nil {
+				slog.Warn("Error parsing FlushBytes", "error", err)
+				c.FlushBytes = 0
+			}
+		case "RedisSizePrefix":
+			c.RedisSizePrefix = value
+		case "RedisSchemaPrefix":
+			c.RedisSchemaPrefix = value
+		case "SchemaRegistry":
+			c.SchemaRegistry = strings.ToLower(value)
+		case "SchemaRegistryPath":
+			c.SchemaRegistryPath = value
+		case "FlushWorkers":
+			_, err := fmt.Sscanf(value, "%d", &c.FlushWorkers)
+			if err != nil {
+				slog.Warn("Error parsing FlushWorkers", "error", err)
+				c.FlushWorkers = 0
+			}
+		case "KeyIdleTimeout":
+			_, err := fmt.Sscanf(value, "%d", &c.KeyIdleTimeout)
+			if err != nil {
+				slog.Warn("Error parsing KeyIdleTimeout", "error", err)
+				c.KeyIdleTimeout = 0
+			}
+		case "MaxInFlightBytes":
+			_, err := fmt.Sscanf(value, "%d", &c.MaxInFlightBytes)
+			if err != nil {
+				slog.Warn("Error parsing MaxInFlightBytes", "error", err)
+				c.MaxInFlightBytes = 0
+			}
+		case "RecoveryBackoff":
+			_, err := fmt.Sscanf(value, "%d", &c.RecoveryBackoff)
+			if err != nil {
+				slog.Warn("Error parsing RecoveryBackoff", "error", err)
+				c.RecoveryBackoff = 0
+			}
+		case "RecoveryMaxBackoff":
+			_, err := fmt.Sscanf(value, "%d", &c.RecoveryMaxBackoff)
+			if err != nil {
+				slog.Warn("Error parsing RecoveryMaxBackoff", "error", err)
+				c.RecoveryMaxBackoff = 0
+			}
+		case "RedisPoisonKey":
+			c.RedisPoisonKey = value
+		case "MaskRules":
+			err := json.Unmarshal([]byte(value), &c.MaskRules)
+			if err != nil {
+				slog.Error("Error parsing MaskRules", "error", err, "module", "config", "function", "Set")
+				return err
+			}
+		case "PIIDetectors":
+			c.PIIDetectors = value
+		case "PIIFields":
+			c.PIIFields = value
+		case "PIIPatterns":
+			err := json.Unmarshal([]byte(value), &c.PIIPatterns)
+			if err != nil {
+				slog.Error("Error parsing PIIPatterns", "error", err, "module", "config", "function", "Set")
+				return err
+			}
+		case "RecordKey":
+			err := json.Unmarshal([]byte(value), &c.RecordKey)
+			if err != nil {
+				slog.Error("Error parsing RecordKey", "error", err, "module", "config", "function", "Set")
+				return err
+			}
+		case "Processors":
+			err := json.Unmarshal([]byte(value), &c.Processors)
+			if err != nil {
+				slog.Error("Error parsing Processors", "error", err, "module", "config", "function", "Set")
+				return err
+			}
+		case "MetricsAddress":
+			c.MetricsAddress = value
+		case "TracingExporter":
+			c.TracingExporter = strings.ToLower(value)
+		case "TracingEndpoint":
+			c.TracingEndpoint = value
+		case "TracingInsecure":
+			c.TracingInsecure = strings.ToLower(value) == "true"
+		case "TracingServiceName":
+			c.TracingServiceName = value
 		default:
 			slog.Warn("Unknown key", "key", key, "value", value, "module", "config", "function", "Set")
 		}
@@ -337,46 +879,114 @@ func (c *Config) Get() map[string]interface{} {
 	ret := make(map[string]interface{})
 
 	ret["Address"] = c.Address
+	ret["AuditChain"] = c.AuditChain
 	ret["BufferSize"] = c.BufferSize
 	ret["BufferType"] = c.BufferType
 	ret["Debug"] = c.Debug
+	ret["DynamicTimeField"] = c.DynamicTimeField
+	ret["DiskPath"] = c.DiskPath
+	ret["DiskSyncInterval"] = c.DiskSyncInterval
+	ret["DiskSyncPolicy"] = c.DiskSyncPolicy
+	ret["FlushBytes"] = c.FlushBytes
 	ret["FlushInterval"] = c.FlushInterval
+	ret["FlushWorkers"] = c.FlushWorkers
+	ret["HMACKeyID"] = c.HMACKeyID
+	ret["HMACKeys"] = maskSecret(c.HMACKeys)
+	ret["HMACKeysEnv"] = c.HMACKeysEnv
+	ret["HMACKeysFile"] = c.HMACKeysFile
 	ret["IgnoredFields"] = c.IgnoredFields
 	ret["JsonSchemaPath"] = c.JsonSchemaPath
+	ret["KeyIdleTimeout"] = c.KeyIdleTimeout
 	ret["LogFormatter"] = c.LogFormatter
 	ret["MaskFields"] = c.MaskFields
+	ret["MaskRules"] = c.maskRules()
+	ret["MaxInFlightBytes"] = c.MaxInFlightBytes
+	ret["MemBlockTimeout"] = c.MemBlockTimeout
+	ret["MemFullPolicy"] = c.MemFullPolicy
+	ret["MemMaxBytes"] = c.MemMaxBytes
+	ret["MemMaxKeyBytes"] = c.MemMaxKeyBytes
+	ret["MemMaxKeyRecords"] = c.MemMaxKeyRecords
+	ret["MemMaxRecords"] = c.MemMaxRecords
+	ret["MemSpillPath"] = c.MemSpillPath
+	ret["MetricsAddress"] = c.MetricsAddress
 	ret["Port"] = c.Port
+	ret["PIIDetectors"] = c.PIIDetectors
+	ret["PIIFields"] = c.PIIFields
+	ret["PIIPatterns"] = c.PIIPatterns
+	ret["Processors"] = c.Processors
+	ret["RecordKey"] = c.RecordKey
 	ret["RecordType"] = c.RecordType
 	ret["RecoveryAttempts"] = c.RecoveryAttempts
+	ret["RecoveryBackoff"] = c.RecoveryBackoff
+	ret["RecoveryMaxBackoff"] = c.RecoveryMaxBackoff
+	ret["RedisAddresses"] = c.RedisAddresses
 	ret["RedisDataPrefix"] = c.RedisDataPrefix
 	ret["RedisDB"] = c.RedisDB
 	ret["RedisDLQPrefix"] = c.RedisDLQPrefix
+	ret["RedisFencePrefix"] = c.RedisFencePrefix
 	ret["RedisHost"] = c.RedisHost
+	ret["RedisInFlightPrefix"] = c.RedisInFlightPrefix
 	ret["RedisKeys"] = c.RedisKeys
 	ret["RedisLockInstanceName"] = c.RedisLockInstanceName
 	ret["RedisLockPrefix"] = c.RedisLockPrefix
 	ret["RedisLockTTL"] = c.RedisLockTTL
+	ret["RedisMasterName"] = c.RedisMasterName
+	ret["RedisMode"] = c.RedisMode
 	ret["RedisPassword"] = c.RedisPassword
+	ret["RedisPoisonKey"] = c.RedisPoisonKey
 	ret["RedisRecoveryKey"] = c.RedisRecoveryKey
+	ret["RedisSchemaPrefix"] = c.RedisSchemaPrefix
+	ret["RedisSentinelPassword"] = c.RedisSentinelPassword
+	ret["RedisSizePrefix"] = c.RedisSizePrefix
+	ret["RedisStreamClaimIdle"] = c.RedisStreamClaimIdle
+	ret["RedisStreamGroup"] = c.RedisStreamGroup
+	ret["RedisStreamPrefix"] = c.RedisStreamPrefix
 	ret["RedisTimeout"] = c.RedisTimeout
+	ret["RedisTLS"] = c.RedisTLS
+	ret["RedisTLSCAFile"] = c.RedisTLSCAFile
+	ret["RedisTLSInsecure"] = c.RedisTLSInsecure
+	ret["SchemaRegistry"] = c.SchemaRegistry
+	ret["SchemaRegistryPath"] = c.SchemaRegistryPath
 	ret["S3BucketName"] = c.S3BuketName
 	ret["S3DefaultCapability"] = c.S3DefaultCapability
 	ret["S3Endpoint"] = c.S3Endpoint
 	ret["S3Region"] = c.S3Region
 	ret["S3RoleARN"] = c.S3RoleARN
 	ret["S3STSEndpoint"] = c.S3STSEndpoint
+	ret["TracingEndpoint"] = c.TracingEndpoint
+	ret["TracingExporter"] = c.TracingExporter
+	ret["TracingInsecure"] = c.TracingInsecure
+	ret["TracingServiceName"] = c.TracingServiceName
 	ret["TryAutoRecover"] = c.TryAutoRecover
 	ret["UseDLQ"] = c.UseDLQ
 	ret["UseHash"] = c.UseHash
 	ret["UseHMAC"] = c.UseHMAC
 	ret["WriterCompressionType"] = c.WriterCompressionType
 	ret["WriterFilePath"] = c.WriterFilePath
+	ret["WriterPathTemplate"] = c.WriterPathTemplate
 	ret["WriterRowGroupSize"] = c.WriterRowGroupSize
 	ret["WriterType"] = c.WriterType
 
 	return ret
 }
 
+func (c *Config) GetRedisAddresses() []string {
+	ret := make([]string, 0)
+
+	for _, addr := range strings.Split(c.RedisAddresses, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) > 0 {
+			ret = append(ret, addr)
+		}
+	}
+
+	if len(ret) == 0 && len(c.RedisHost) > 0 {
+		ret = append(ret, c.RedisHost)
+	}
+
+	return ret
+}
+
 func (c *Config) SetDefaults() {
 	if c.Port < 1 {
 		c.Port = 8080
@@ -407,6 +1017,40 @@ func (c *Config) SetDefaults() {
 		c.BufferType = BufferTypeMem
 	}
 
+	if c.BufferType == BufferTypeDisk {
+		if len(c.DiskPath) == 0 {
+			slog.Debug("Disk path is empty, setting to ./buffer")
+			c.DiskPath = "./buffer"
+		}
+
+		if _, ok := DiskSyncPolicies[c.DiskSyncPolicy]; !ok {
+			slog.Debug("Disk sync policy is empty or invalid, setting to interval", "policy", c.DiskSyncPolicy)
+			c.DiskSyncPolicy = DiskSyncInterval
+		}
+
+		if c.DiskSyncInterval < 1 {
+			slog.Debug("Disk sync interval is less than 1 second, setting to 1")
+			c.DiskSyncInterval = 1
+		}
+	}
+
+	if c.BufferType == BufferTypeMem {
+		if _, ok := MemFullPolicies[c.MemFullPolicy]; !ok {
+			slog.Debug("Memory buffer full policy is empty or invalid, setting to block", "policy", c.MemFullPolicy)
+			c.MemFullPolicy = MemFullPolicyBlock
+		}
+
+		if c.MemBlockTimeout < 1 {
+			slog.Debug("Memory buffer block timeout is less than 1 second, setting to 5")
+			c.MemBlockTimeout = 5
+		}
+
+		if c.MemFullPolicy == MemFullPolicySpill && len(c.MemSpillPath) == 0 {
+			slog.Debug("Memory buffer spill path is empty, setting to ./spill")
+			c.MemSpillPath = "./spill"
+		}
+	}
+
 	if c.BufferSize < 100 {
 		slog.Debug("Buffer size is less than 100, setting to 100")
 		c.BufferSize = 100
@@ -417,6 +1061,21 @@ func (c *Config) SetDefaults() {
 		c.FlushInterval = 5
 	}
 
+	if c.MaxInFlightBytes < 0 {
+		slog.Debug("Max in-flight bytes is less than 0, setting to 0 (no limit)")
+		c.MaxInFlightBytes = 0
+	}
+
+	if c.FlushWorkers < 1 {
+		slog.Debug("Flush workers is less than 1, setting to 4")
+		c.FlushWorkers = 4
+	}
+
+	if c.KeyIdleTimeout < c.FlushInterval {
+		slog.Debug("Key idle timeout is less than flush interval, setting to 10 times the flush interval")
+		c.KeyIdleTimeout = 10 * c.FlushInterval
+	}
+
 	if len(c.RedisKeys) == 0 {
 		slog.Debug("Redis keys is empty, setting to keys")
 		c.RedisKeys = "keys"
@@ -437,6 +1096,26 @@ func (c *Config) SetDefaults() {
 		c.RedisDataPrefix = "data"
 	}
 
+	if len(c.RedisInFlightPrefix) == 0 {
+		slog.Debug("Redis in-flight prefix is empty, setting to inflight")
+		c.RedisInFlightPrefix = "inflight"
+	}
+
+	if len(c.RedisSizePrefix) == 0 {
+		slog.Debug("Redis size prefix is empty, setting to size")
+		c.RedisSizePrefix = "size"
+	}
+
+	if c.FlushBytes < 0 {
+		slog.Debug("Flush bytes is less than 0, setting to 0 (disabled)")
+		c.FlushBytes = 0
+	}
+
+	if len(c.RedisFencePrefix) == 0 {
+		slog.Debug("Redis fence prefix is empty, setting to fence")
+		c.RedisFencePrefix = "fence"
+	}
+
 	if len(c.RedisRecoveryKey) == 0 {
 		slog.Debug("Redis recovery key is empty, setting to recovery")
 		c.RedisRecoveryKey = "recovery"
@@ -447,6 +1126,26 @@ func (c *Config) SetDefaults() {
 		c.RecoveryAttempts = 0
 	}
 
+	if c.RecoveryBackoff < 1 {
+		slog.Debug("Recovery backoff is less than 1 second, setting to 1")
+		c.RecoveryBackoff = 1
+	}
+
+	if c.RecoveryMaxBackoff < 1 {
+		slog.Debug("Recovery max backoff is less than 1 second, setting to 300")
+		c.RecoveryMaxBackoff = 300
+	}
+
+	if c.RecoveryMaxBackoff < c.RecoveryBackoff {
+		slog.Debug("Recovery max backoff is less than recovery backoff, setting to recovery backoff")
+		c.RecoveryMaxBackoff = c.RecoveryBackoff
+	}
+
+	if len(c.RedisPoisonKey) == 0 {
+		slog.Debug("Redis poison key is empty, setting to poison")
+		c.RedisPoisonKey = "poison"
+	}
+
 	if len(c.RecordType) == 0 {
 		slog.Debug("Record type is empty, setting to log")
 		c.RecordType = RecordTypeLog
@@ -454,9 +1153,10 @@ func (c *Config) SetDefaults() {
 
 	c.RecordType = strings.ToLower(c.RecordType)
 
-	if c.BufferType == BufferTypeRedis {
+	if c.BufferType == BufferTypeRedis || c.BufferType == BufferTypeRedisStream {
 		if c.RedisLockTTL < int(c.FlushInterval+c.FlushInterval/2) {
 			slog.Debug("Redis lock TTL is less than 1.5 times the flush interval, setting to 1.5 times the flush interval")
+			c.RedisLockTTL = int(c.FlushInterval + c.FlushInterval/2)
 		}
 
 		if len(c.RedisLockInstanceName) == 0 {
@@ -475,9 +1175,35 @@ func (c *Config) SetDefaults() {
 			c.RedisDB = 0
 		}
 
-		if len(c.RedisHost) == 0 {
+		if _, ok := RedisModes[c.RedisMode]; !ok {
+			slog.Debug("Redis mode is empty or invalid, setting to single", "mode", c.RedisMode)
+			c.RedisMode = RedisModeSingle
+		}
+
+		if len(c.RedisHost) == 0 && len(c.RedisAddresses) == 0 {
 			slog.Error("Redis host is empty, please set it")
 		}
+
+		if c.RedisMode == RedisModeSentinel && len(c.RedisMasterName) == 0 {
+			slog.Error("Redis master name is empty, please set it to use sentinel mode")
+		}
+	}
+
+	if c.BufferType == BufferTypeRedisStream {
+		if len(c.RedisStreamPrefix) == 0 {
+			slog.Debug("Redis stream prefix is empty, setting to stream")
+			c.RedisStreamPrefix = "stream"
+		}
+
+		if len(c.RedisStreamGroup) == 0 {
+			slog.Debug("Redis stream group is empty, setting to data2parquet")
+			c.RedisStreamGroup = "data2parquet"
+		}
+
+		if c.RedisStreamClaimIdle < 1 {
+			slog.Debug("Redis stream claim idle is less than 1 second, setting to 3 times the flush interval")
+			c.RedisStreamClaimIdle = 3 * c.FlushInterval
+		}
 	}
 
 	if len(c.S3DefaultCapability) == 0 {
@@ -492,9 +1218,86 @@ func (c *Config) SetDefaults() {
 		}
 	}
 
+	if _, ok := TracingExporters[c.TracingExporter]; !ok {
+		slog.Debug("Tracing exporter is empty or invalid, setting to none", "exporter", c.TracingExporter)
+		c.TracingExporter = TracingExporterNone
+	}
+
+	if len(c.TracingServiceName) == 0 {
+		slog.Debug("Tracing service name is empty, setting to data2parquet")
+		c.TracingServiceName = "data2parquet"
+	}
+
+	if len(c.DynamicTimeField) == 0 {
+		slog.Debug("Dynamic time field is empty, setting to time")
+		c.DynamicTimeField = "time"
+	}
+
+	if len(c.SchemaRegistry) == 0 {
+		slog.Debug("Schema registry is empty, setting to none")
+		c.SchemaRegistry = SchemaRegistryNone
+	}
+
+	if _, ok := SchemaRegistries[c.SchemaRegistry]; !ok {
+		slog.Error("Schema registry is invalid, please set it to none, file or redis", "registry", c.SchemaRegistry)
+	}
+
+	if c.SchemaRegistry != SchemaRegistryNone && c.RecordType != RecordTypeDynamic {
+		slog.Warn("Schema registry is only used by dynamic records", "registry", c.SchemaRegistry, "recordType", c.RecordType)
+	}
+
+	if c.SchemaRegistry == SchemaRegistryFile && len(c.SchemaRegistryPath) == 0 {
+		slog.Debug("Schema registry path is empty, setting to ./schemas")
+		c.SchemaRegistryPath = "./schemas"
+	}
+
+	if c.SchemaRegistry == SchemaRegistryRedis && len(c.RedisSchemaPrefix) == 0 {
+		slog.Debug("Redis schema prefix is empty, setting to schema")
+		c.RedisSchemaPrefix = "schema"
+	}
+
 	slog.SetFormatterByName(c.LogFormatter)
 
 	UseHMAC = c.UseHMAC
+	DynamicTimeField = c.DynamicTimeField
+
+	defaultTemplate := DefaultPathTemplate
+
+	if c.RecordType == RecordTypeDynamic {
+		defaultTemplate = DefaultDynamicPathTemplate
+	}
+
+	if len(c.WriterPathTemplate) == 0 {
+		slog.Debug("Writer path template is empty, using default", "template", defaultTemplate)
+		c.WriterPathTemplate = defaultTemplate
+	}
+
+	tmpl, err := layout.Parse(c.WriterPathTemplate)
+
+	if err != nil {
+		slog.Error("Invalid writer path template, using default", "error", err, "template", c.WriterPathTemplate, "module", "config", "function", "SetDefaults")
+		tmpl = layout.MustParse(defaultTemplate)
+	}
+
+	PathTemplate = tmpl
+	RecordKey = nil
+
+	if len(c.RecordKey) > 0 {
+		err = c.CheckRecordKey()
+
+		if err != nil {
+			slog.Error("Invalid record key, using default", "error", err, "module", "config", "function", "SetDefaults")
+		} else {
+			RecordKey = c.RecordKey
+		}
+	}
+
+	err = c.loadHMACKeys()
+
+	if err != nil {
+		slog.Error("Error loading HMAC keys", "error", err, "module", "config", "function", "SetDefaults")
+	}
+
 	rgxFields := regexp.MustCompile(`;|:|,| |\||\/|\\`)
 
 	if len(c.IgnoredFields) > 0 {
@@ -515,5 +1318,226 @@ func (c *Config) SetDefaults() {
 		}
 	}
 
+	MaskRules = make(map[string][]*MaskRule)
+
+	for i, rule := range c.MaskRules {
+		err := rule.compile()
+
+		if err != nil {
+			slog.Error("Invalid mask rule, it will be ignored", "error", err, "index", i, "module", "config", "function", "SetDefaults")
+			continue
+		}
+
+		field := strings.ToLower(rule.Field)
+		MaskRules[field] = append(MaskRules[field], rule)
+	}
+
 	slog.Debug("Config", "data", c.Get())
 }
+
+func maskSecret(value string) string {
+	if len(value) == 0 {
+		return value
+	}
+
+	return "***"
+}
+
+// loadHMACKeys sets `HMACSecrets` with keys of `HMACKeys`, `HMACKeysFile` and `HMACKeysEnv`, and `HMACSigningKey` with
+// `HMACKeyID` or the ID of the only key loaded
+func (c *Config) loadHMACKeys() error {
+	HMACSecrets = make(map[string][]byte)
+	HMACSigningKey = c.HMACKeyID
+
+	pairs := strings.Split(c.HMACKeys, ",")
+
+	if len(c.HMACKeysFile) > 0 {
+		data, err := os.ReadFile(c.HMACKeysFile)
+
+		if err != nil {
+			return err
+		}
+
+		pairs = append(pairs, strings.Split(string(data), "\n")...)
+	}
+
+	if len(c.HMACKeysEnv) > 0 {
+		pairs = append(pairs, strings.Split(os.Getenv(c.HMACKeysEnv), ",")...)
+	}
+
+	// errors report the position of an invalid entry, never its value, a malformed entry may be a secret
+	for i, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+
+		if len(pair) == 0 || strings.HasPrefix(pair, "#") {
+			continue
+		}
+
+		id, secret, found := strings.Cut(pair, "=")
+
+		if !found || len(id) == 0 || len(secret) == 0 {
+			return fmt.Errorf("invalid HMAC key at position %d, expected id=secret", i)
+		}
+
+		if strings.Contains(id, ":") {
+			return fmt.Errorf("invalid HMAC key id %q, it can't contain ':'", id)
+		}
+
+		HMACSecrets[id] = []byte(secret)
+	}
+
+	if len(HMACSigningKey) == 0 && len(HMACSecrets) == 1 {
+		for id := range HMACSecrets {
+			HMACSigningKey = id
+		}
+	}
+
+	slog.Debug("HMAC keys loaded", "keys", len(HMACSecrets), "signing-key", HMACSigningKey, "module", "config", "function", "loadHMACKeys")
+
+	return nil
+}
+
+// compile checks a mask rule and compiles its pattern
+func (m *MaskRule) compile() error {
+	if m == nil {
+		return errors.New("empty mask rule")
+	}
+
+	if len(m.Field) == 0 {
+		return errors.New("mask rule without field")
+	}
+
+	if _, found := MaskStrategies[m.Strategy]; !found {
+		return fmt.Errorf("unknown mask strategy %q of field %q", m.Strategy, m.Field)
+	}
+
+	if m.Keep < 0 {
+		return fmt.Errorf("invalid keep %d of field %q", m.Keep, m.Field)
+	}
+
+	// an unsalted hash of a small value set (e.g. user IDs) is reversed by hashing all values
+	if m.Strategy == MaskStrategyHash && len(m.Salt) == 0 {
+		return fmt.Errorf("hash mask of field %q without salt", m.Field)
+	}
+
+	if m.Strategy == MaskStrategyRegex {
+		if len(m.Pattern) == 0 {
+			return fmt.Errorf("regex mask of field %q without pattern", m.Field)
+		}
+
+		rgx, err := regexp.Compile(m.Pattern)
+
+		if err != nil {
+			return fmt.Errorf("invalid pattern of field %q: %w", m.Field, err)
+		}
+
+		m.rgx = rgx
+	}
+
+	return nil
+}
+
+// Regexp returns the compiled `Pattern` of a `regex` rule
+func (m *MaskRule) Regexp() *regexp.Regexp {
+	return m.rgx
+}
+
+// maskRules returns `MaskRules` with salts masked, to be logged
+func (c *Config) maskRules() []*MaskRule {
+	ret := make([]*MaskRule, 0, len(c.MaskRules))
+
+	for _, rule := range c.MaskRules {
+		if rule == nil {
+			continue
+		}
+
+		item := *rule
+		item.Salt = maskSecret(item.Salt)
+		ret = append(ret, &item)
+	}
+
+	return ret
+}
+
+// CheckPathTemplate returns an error when `WriterPathTemplate` is invalid, `SetDefaults` uses the default template in this
+// case, so files would not be written where they are expected
+func (c *Config) CheckPathTemplate() error {
+	if len(c.WriterPathTemplate) == 0 {
+		return nil
+	}
+
+	_, err := layout.Parse(c.WriterPathTemplate)
+
+	if err != nil {
+		return fmt.Errorf("invalid WriterPathTemplate %q: %w", c.WriterPathTemplate, err)
+	}
+
+	return nil
+}
+
+// CheckAuditChain returns an error when `AuditChain` is set with a buffer without key lock, flushes of the same key on
+// many instances would read the same chain head and fork the chain
+func (c *Config) CheckAuditChain() error {
+	if c.AuditChain && c.BufferType == BufferTypeRedisStream {
+		return fmt.Errorf("AuditChain can't be used with %s buffer, it has no key lock to guard the chain head", c.BufferType)
+	}
+
+	return nil
+}
+
+// CheckRecordKey returns an error when `RecordKey` is invalid, `SetDefaults` uses the default key in this case, so records
+// would not be buffered and written by the expected key
+func (c *Config) CheckRecordKey() error {
+	names := make(map[string]bool)
+
+	for i, part := range c.RecordKey {
+		if part == nil || len(part.Fields) == 0 {
+			return fmt.Errorf("record key part %d without fields", i)
+		}
+
+		for _, field := range part.Fields {
+			if len(field) == 0 {
+				return fmt.Errorf("record key part %d with an empty field", i)
+			}
+		}
+
+		if names[part.Name()] {
+			return fmt.Errorf("record key part %d (%s) is duplicated", i, part.Name())
+		}
+
+		names[part.Name()] = true
+	}
+
+	return nil
+}
+
+// CheckMasks returns an error when a rule of `MaskRules` is invalid, invalid rules are ignored by `SetDefaults` so the
+// receiver must not start with them, sensitive data would be stored as is
+func (c *Config) CheckMasks() error {
+	for i, rule := range c.MaskRules {
+		err := rule.compile()
+
+		if err != nil {
+			return fmt.Errorf("mask rule %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// CheckHMAC returns an error when `UseHMAC` is set and the signing key was not loaded
+func (c *Config) CheckHMAC() error {
+	if !c.UseHMAC {
+		return nil
+	}
+
+	if len(HMACSigningKey) == 0 {
+		return errors.New("UseHMAC is set but there is no signing key, set HMACKeyID and HMACKeys, HMACKeysFile or HMACKeysEnv")
+	}
+
+	if _, found := HMACSecrets[HMACSigningKey]; !found {
+		return fmt.Errorf("HMAC signing key %q not found", HMACSigningKey)
+	}
+
+	return nil
+}
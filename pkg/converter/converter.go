@@ -4,8 +4,16 @@ import (
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
 	"data2parquet/pkg/logger" //"log/slog"
+	"data2parquet/pkg/metrics"
+	"data2parquet/pkg/registry"
+	"encoding/json"
+	"errors"
 	"io"
 	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/xitongsys/parquet-go/parquet"
 	"github.com/xitongsys/parquet-go/writer"
@@ -45,6 +53,9 @@ type Converter struct {
 	jsonSchemaPath  string
 	jsonSchemaData  string
 	np              int64
+	schemas         map[string]*keySchema
+	schemaMu        *sync.Mutex
+	registry        registry.Registry
 }
 
 func New(cfg *config.Config) *Converter {
@@ -55,6 +66,8 @@ func New(cfg *config.Config) *Converter {
 		recordType:      cfg.RecordType,
 		jsonSchemaPath:  cfg.JsonSchemaPath,
 		np:              4,
+		schemas:         make(map[string]*keySchema),
+		schemaMu:        &sync.Mutex{},
 	}
 
 	if cfg.RecordType == config.RecordTypeDynamic && len(cfg.JsonSchemaPath) != 0 {
@@ -70,6 +83,12 @@ func New(cfg *config.Config) *Converter {
 	return ret
 }
 
+// UseRegistry sets the schema registry of `Dynamic` records, schemas inferred from batches are then registered by key and
+// only evolve with backward-compatible changes. It is not used when a schema is loaded from `JsonSchemaPath`.
+func (c *Converter) UseRegistry(reg registry.Registry) {
+	c.registry = reg
+}
+
 func (c *Converter) loadJsonSchema() error {
 	if len(c.jsonSchemaPath) == 0 {
 		return nil
@@ -88,18 +107,83 @@ func (c *Converter) loadJsonSchema() error {
 	return nil
 }
 
-func (c *Converter) createParquetWriter(w io.Writer) (*writer.ParquetWriter, error) {
+// ErrNoFields is the error of `Dynamic` records when no field of a batch has a known type, e.g. all are empty or null, so
+// they go to DLQ instead of going back to buffer
+var ErrNoFields = errors.New("dynamic records without fields, schema can't be inferred")
+
+// dynamicSchema returns the JSON schema of a batch of `Dynamic` records, the schema loaded from `JsonSchemaPath` or one
+// inferred from the batch and the previous batches of the key. The inferred column is nil when the schema was loaded, and
+// it is only kept for the next batches when cache is set.
+func (c *Converter) dynamicSchema(key string, data []domain.Record, cache bool) (string, *column, error) {
+	if len(c.jsonSchemaData) > 0 {
+		return c.jsonSchemaData, nil, nil
+	}
+
+	c.schemaMu.Lock()
+	var prev *column
+
+	if cached, found := c.schemas[key]; found {
+		prev = cached.root
+	}
+
+	root := inferSchema(prev, data)
+
+	if cache {
+		c.schemas[key] = &keySchema{root: root}
+	}
+
+	c.schemaMu.Unlock()
+
+	ret := root.normalize()
+
+	if ret == nil || ret.kind != kindGroup {
+		return "", nil, ErrNoFields
+	}
+
+	schema, err := ret.JSONSchema()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	slog.Debug("Dynamic schema inferred", "key", key, "schema", schema, "module", "converter", "function", "dynamicSchema")
+
+	return schema, ret, nil
+}
+
+// dynamicRow returns the JSON row of a `Dynamic` record, converted to the inferred column when there is one
+func dynamicRow(root *column, record domain.Record) (string, error) {
+	if root != nil {
+		return root.Row(record.GetData())
+	}
+
+	data, err := json.Marshal(record.GetData())
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// createParquetWriter returns a writer of records structs, or of JSON rows when jsonSchema is set (`Dynamic` records)
+func (c *Converter) createParquetWriter(w io.Writer, jsonSchema string) (*writer.ParquetWriter, error) {
 	var pw *writer.ParquetWriter
 	var err error
 
-	if c.config.RecordType == config.RecordTypeDynamic {
-		pw, err = writer.NewParquetWriterFromWriter(w, c.jsonSchemaData, c.np)
+	if len(jsonSchema) > 0 {
+		var jw *writer.JSONWriter
+		jw, err = writer.NewJSONWriterFromWriter(jsonSchema, w, c.np)
+
+		if err == nil {
+			pw = &jw.ParquetWriter
+		}
 	} else {
 		pw, err = writer.NewParquetWriterFromWriter(w, domain.NewObj(c.config.RecordType), c.np)
 	}
 
 	if err != nil {
-		slog.Error("Error creating parquet writer", "error", err, "module", "converter", "function", "createParquetWriter", "recordType", c.config.RecordType, "jsonSchemaData", c.jsonSchemaData)
+		slog.Error("Error creating parquet writer", "error", err, "module", "converter", "function", "createParquetWriter", "recordType", c.config.RecordType, "jsonSchemaData", jsonSchema)
 		return nil, err
 	}
 
@@ -110,6 +194,22 @@ func (c *Converter) createParquetWriter(w io.Writer) (*writer.ParquetWriter, err
 }
 
 func (c *Converter) Write(key string, data []domain.Record, w io.Writer) []*Result {
+	return c.WriteWithMetadata(key, data, w, nil)
+}
+
+// WriteWithMetadata converts records like `Write` and stores metadata on Parquet file key-value metadata
+func (c *Converter) WriteWithMetadata(key string, data []domain.Record, w io.Writer, metadata map[string]string) []*Result {
+	return c.convert(key, data, w, metadata, false)
+}
+
+// Check converts records like `Write` and discards the data, returning the records that would fail. Schemas of `Dynamic`
+// records are checked against the schema of the key without registering a new version or changing the cached schema.
+func (c *Converter) Check(key string, data []domain.Record) []*Result {
+	return c.convert(key, data, io.Discard, nil, true)
+}
+
+// convert writes records to w, check is set by dry runs that must not change schemas
+func (c *Converter) convert(key string, data []domain.Record, w io.Writer, metadata map[string]string, check bool) []*Result {
 	ret := make([]*Result, 0)
 	if data == nil {
 		slog.Debug("No data to write", "module", "writer", "function", "writeToFile", "key", key)
@@ -121,7 +221,60 @@ func (c *Converter) Write(key string, data []domain.Record, w io.Writer) []*Resu
 		return ret
 	}
 
-	pw, err := c.createParquetWriter(w)
+	start := time.Now()
+
+	defer func() {
+		metrics.ConversionDuration.Observe(time.Since(start).Seconds())
+
+		if len(ret) > 0 {
+			metrics.ConversionErrors.WithLabelValues(key).Add(float64(len(ret)))
+		}
+	}()
+
+	jsonSchema := ""
+	var root *column
+	var err error
+
+	if c.config.RecordType == config.RecordTypeDynamic && c.registry != nil && len(c.jsonSchemaData) == 0 {
+		evolve := c.evolveSchema
+
+		if check {
+			evolve = c.checkSchema
+		}
+
+		schema, accepted, rejected, err := evolve(key, data)
+
+		if err != nil {
+			slog.Error("Error checking schema on registry", "error", err, "module", "writer", "function", "writeToFile", "key", key)
+			ret = append(ret, schemaErrors(key, data, err)...)
+			return ret
+		}
+
+		for _, item := range rejected {
+			slog.Warn("Record rejected by schema", "error", item.Error, "module", "writer", "function", "writeToFile", "key", key, "record", item.Record.ToJson())
+		}
+
+		ret = append(ret, rejected...)
+
+		if len(accepted) == 0 {
+			slog.Warn("All records rejected by schema, no file written", "module", "writer", "function", "writeToFile", "key", key, "rejected", len(rejected))
+			return ret
+		}
+
+		data = accepted
+		jsonSchema, root = schema.parquet, schema.root.normalize()
+		metadata = withMetadata(metadata, MetaSchemaVersion, strconv.Itoa(schema.version))
+	} else if c.config.RecordType == config.RecordTypeDynamic {
+		jsonSchema, root, err = c.dynamicSchema(key, data, !check)
+
+		if err != nil {
+			slog.Error("Error getting dynamic schema", "error", err, "module", "writer", "function", "writeToFile", "key", key)
+			ret = append(ret, schemaErrors(key, data, err)...)
+			return ret
+		}
+	}
+
+	pw, err := c.createParquetWriter(w, jsonSchema)
 	if err != nil {
 		slog.Error("Error creating parquet writer", "error", err, "module", "writer", "function", "writeToFile", "key", key)
 		ret = append(ret, &Result{Key: key, Error: err})
@@ -131,13 +284,38 @@ func (c *Converter) Write(key string, data []domain.Record, w io.Writer) []*Resu
 	defer pw.PFile.Close()
 
 	for _, record := range data {
-		if err = pw.Write(record); err != nil {
+		var row interface{} = record
+
+		if len(jsonSchema) > 0 {
+			row, err = dynamicRow(root, record)
+
+			if err != nil {
+				slog.Error("Error converting dynamic record", "error", err, "module", "writer", "function", "writeToFile", "key", key, "record", record.ToJson())
+				ret = append(ret, &Result{Key: key, Error: err, Record: record})
+				continue
+			}
+		}
+
+		if err = pw.Write(row); err != nil {
 			slog.Error("Error writing parquet file", "error", err, "module", "writer", "function", "writeToFile", "key", key, "record", record.ToJson())
 
 			ret = append(ret, &Result{Key: key, Error: err, Record: record})
 		}
 	}
 
+	keys := make([]string, 0, len(metadata))
+
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value := metadata[k]
+		pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata, &parquet.KeyValue{Key: k, Value: &value})
+	}
+
 	slog.Debug("Stopping parquet writer", "module", "writer", "function", "writeToFile", "key", key)
 	err = pw.WriteStop()
 
@@ -151,6 +329,35 @@ func (c *Converter) Write(key string, data []domain.Record, w io.Writer) []*Resu
 	return ret
 }
 
+// schemaErrors returns the results of a batch without schema, a result by record when records have no fields and a
+// batch error otherwise (e.g. registry unavailable), so data goes back to buffer
+func schemaErrors(key string, data []domain.Record, err error) []*Result {
+	if !errors.Is(err, ErrNoFields) {
+		return []*Result{{Key: key, Error: err}}
+	}
+
+	ret := make([]*Result, 0, len(data))
+
+	for _, record := range data {
+		ret = append(ret, &Result{Key: key, Error: err, Record: record})
+	}
+
+	return ret
+}
+
+// withMetadata returns a copy of metadata with a new entry, so the map of the caller is not changed
+func withMetadata(metadata map[string]string, key string, value string) map[string]string {
+	ret := make(map[string]string, len(metadata)+1)
+
+	for k, v := range metadata {
+		ret[k] = v
+	}
+
+	ret[key] = value
+
+	return ret
+}
+
 func (w *Result) IsError() bool {
 	if w == nil {
 		return false
@@ -0,0 +1,242 @@
+package converter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
+	"data2parquet/pkg/registry"
+)
+
+// MetaSchemaVersion is the Parquet key-value metadata with the registered schema version of a file, set when
+// `SchemaRegistry` is enabled
+const MetaSchemaVersion = "data2parquet.schema-version"
+
+// ErrSchemaIncompatible is the error of records that would break the registered schema of their key, they are not
+// written and go to DLQ
+var ErrSchemaIncompatible = errors.New("record is incompatible with schema")
+
+// registerAttempts is how many times a batch is checked again when another instance registers a version first
+const registerAttempts = 3
+
+// keySchema is the schema a batch of a key is written with. Root holds every field seen, version and parquet are of the
+// registered schema, that only has fields with a known type.
+type keySchema struct {
+	root    *column
+	version int
+	parquet string
+}
+
+// checkColumn returns an error when a record value can't be written to the columns of a schema without breaking files
+// already written. Backward-compatible changes are new fields, null or missing values (the column becomes optional)
+// and `int` widened to `double`, any value fits a `json` column.
+func checkColumn(schema *column, value *column, path string) error {
+	if schema == nil || value == nil || schema.kind == kindNull || value.kind == kindNull || schema.kind == kindJSON {
+		return nil
+	}
+
+	switch {
+	case schema.kind == kindGroup && value.kind == kindGroup:
+		for k, field := range value.fields {
+			err := checkColumn(schema.fields[k], field, fieldPath(path, k))
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case schema.kind == kindList && value.kind == kindList:
+		return checkColumn(schema.element, value.element, path+"[]")
+	case schema.kind == value.kind:
+		return nil
+	case schema.kind == kindDouble && value.kind == kindInt:
+		return nil
+	case schema.kind == kindInt && value.kind == kindDouble:
+		return nil
+	}
+
+	if len(path) == 0 {
+		return fmt.Errorf("record is %s, expected %s", value.kind, schema.kind)
+	}
+
+	return fmt.Errorf("field %q is %s, expected %s", path, value.kind, schema.kind)
+}
+
+func fieldPath(path string, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+
+	return path + "." + name
+}
+
+// latestSchema returns the schema of a key, cached or loaded from the registry. It must be called holding schemaMu.
+func (c *Converter) latestSchema(key string) (*keySchema, error) {
+	if ret, found := c.schemas[key]; found {
+		return ret, nil
+	}
+
+	ret, err := c.loadSchema(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.schemas[key] = ret
+
+	return ret, nil
+}
+
+// loadSchema returns the last registered schema of a key, empty when the key has no version yet
+func (c *Converter) loadSchema(key string) (*keySchema, error) {
+	latest, err := c.registry.Latest(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &keySchema{}
+
+	if latest != nil {
+		ret.version, ret.parquet, ret.root = latest.Version, latest.Parquet, &column{}
+		err = json.Unmarshal(latest.Columns, ret.root)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema version %d of key %s: %w", latest.Version, key, err)
+		}
+
+		metrics.SchemaVersion.WithLabelValues(key).Set(float64(latest.Version))
+	}
+
+	return ret, nil
+}
+
+// checkRecords checks records one by one against a schema and the records accepted before them, it returns the schema
+// merged with accepted records and the incompatible ones as results
+func checkRecords(key string, current *keySchema, data []domain.Record) (*column, []domain.Record, []*Result) {
+	root := current.root
+	accepted := make([]domain.Record, 0, len(data))
+	rejected := make([]*Result, 0)
+
+	for _, record := range data {
+		value := valueColumn(record.GetData())
+		err := checkColumn(root, value, "")
+
+		if err != nil {
+			err = fmt.Errorf("%w version %d of key %s: %s", ErrSchemaIncompatible, current.version, key, err.Error())
+			rejected = append(rejected, &Result{Key: key, Error: err, Record: record})
+			continue
+		}
+
+		root = mergeColumn(root, value)
+		accepted = append(accepted, record)
+	}
+
+	return root, accepted, rejected
+}
+
+// nextSchema returns the schema of a merged root, with the version of current or the next one when the root changes
+// the written schema
+func nextSchema(current *keySchema, root *column) (*keySchema, error) {
+	ret := &keySchema{root: root, version: current.version, parquet: current.parquet}
+	written := root.normalize()
+
+	if written == nil || written.kind != kindGroup {
+		return nil, ErrNoFields
+	}
+
+	parquet, err := written.JSONSchema()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if parquet != current.parquet {
+		ret.version++
+		ret.parquet = parquet
+	}
+
+	return ret, nil
+}
+
+// checkSchema returns the schema a batch would be written with, like evolveSchema, without registering a new version or
+// changing the cached schema of the key
+func (c *Converter) checkSchema(key string, data []domain.Record) (*keySchema, []domain.Record, []*Result, error) {
+	c.schemaMu.Lock()
+	current, found := c.schemas[key]
+	c.schemaMu.Unlock()
+
+	if !found {
+		var err error
+		current, err = c.loadSchema(key)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	root, accepted, rejected := checkRecords(key, current, data)
+	next, err := nextSchema(current, root)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return next, accepted, rejected, nil
+}
+
+// evolveSchema returns the registered schema a batch is written with. Records are checked one by one against the schema
+// and the records accepted before them, incompatible records are returned as results and left out of the batch. When
+// accepted records change the schema, a new version is registered.
+func (c *Converter) evolveSchema(key string, data []domain.Record) (*keySchema, []domain.Record, []*Result, error) {
+	c.schemaMu.Lock()
+	defer c.schemaMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		current, err := c.latestSchema(key)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		root, accepted, rejected := checkRecords(key, current, data)
+		next, err := nextSchema(current, root)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if next.version == current.version {
+			c.schemas[key] = next
+			return next, accepted, rejected, nil
+		}
+
+		columns, err := json.Marshal(root)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		err = c.registry.Register(&registry.Schema{Key: key, Version: next.version, Columns: columns, Parquet: next.parquet, Created: time.Now()})
+
+		if errors.Is(err, registry.ErrVersionConflict) && attempt < registerAttempts {
+			slog.Info("Schema registered by other instance, checking records again", "key", key, "version", next.version, "module", "converter", "function", "evolveSchema")
+			delete(c.schemas, key)
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		slog.Info("Schema version registered", "key", key, "version", next.version, "rejected", len(rejected), "module", "converter", "function", "evolveSchema")
+		metrics.SchemaVersion.WithLabelValues(key).Set(float64(next.version))
+		c.schemas[key] = next
+
+		return next, accepted, rejected, nil
+	}
+}
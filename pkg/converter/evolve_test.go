@@ -0,0 +1,188 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go/parquet"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/registry"
+)
+
+func newRegistryConverter(t *testing.T, path string) *Converter {
+	reg, err := registry.NewFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := New(&config.Config{RecordType: config.RecordTypeDynamic, WriterRowGroupSize: 1024 * 1024})
+	ret.UseRegistry(reg)
+
+	return ret
+}
+
+// writeVersion writes a batch and returns its data, the schema version of its metadata and the rejected records
+func writeVersion(t *testing.T, conv *Converter, key string, records []domain.Record) ([]byte, string, []*Result) {
+	buf := new(bytes.Buffer)
+	result := conv.Write(key, records, buf)
+
+	for _, item := range result {
+		if item.Record == nil {
+			t.Fatalf("Error writing parquet data: %s", item.Error)
+		}
+	}
+
+	meta, err := ReadMetadata(buf.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), meta[MetaSchemaVersion], result
+}
+
+func TestSchemaEvolution(t *testing.T) {
+	path := t.TempDir()
+	conv := newRegistryConverter(t, path)
+
+	_, version, rejected := writeVersion(t, conv, "key", dynamicRecords(
+		map[string]interface{}{"service": "dynamic", "count": 1.0, "user": map[string]interface{}{"name": "john"}, "empty": nil},
+	))
+
+	if version != "1" || len(rejected) > 0 {
+		t.Fatalf("Expected version 1 without rejected records, got %q %v", version, rejected)
+	}
+
+	// widened type, added optional column and a type for a field that was always null
+	data, version, rejected := writeVersion(t, conv, "key", dynamicRecords(
+		map[string]interface{}{"service": "dynamic", "count": 1.5, "extra": "value", "empty": 2.0, "user": map[string]interface{}{"name": "jane"}},
+	))
+
+	if version != "2" || len(rejected) > 0 {
+		t.Fatalf("Expected version 2 without rejected records, got %q %v", version, rejected)
+	}
+
+	elements, _ := readDynamic(t, data)
+
+	if elements["Parquet_go_root\x01Count"].GetType() != parquet.Type_DOUBLE || elements["Parquet_go_root\x01Empty"].GetRepetitionType() != parquet.FieldRepetitionType_OPTIONAL {
+		t.Error("Count must be widened to double and Empty added as optional")
+	}
+
+	// a new converter loads the last version from the registry
+	conv = newRegistryConverter(t, path)
+	records := dynamicRecords(
+		map[string]interface{}{"service": "dynamic", "count": "many"},
+		map[string]interface{}{"service": "dynamic", "count": 3.0, "user": map[string]interface{}{"name": "jim"}},
+		map[string]interface{}{"service": "dynamic", "user": map[string]interface{}{"name": 10.0}},
+		map[string]interface{}{"service": "dynamic", "user": "john"},
+	)
+	data, version, rejected = writeVersion(t, conv, "key", records)
+
+	if version != "2" {
+		t.Errorf("Schema without changes must keep version 2, got %q", version)
+	}
+
+	reasons := []string{
+		`field "count" is string, expected double`,
+		`field "user.name" is int, expected string`,
+		`field "user" is string, expected group`,
+	}
+
+	if len(rejected) != len(reasons) {
+		t.Fatalf("Expected %d rejected records, got %v", len(reasons), rejected)
+	}
+
+	for i, item := range rejected {
+		if !errors.Is(item.Error, ErrSchemaIncompatible) || !strings.Contains(item.Error.Error(), "version 2 of key key: "+reasons[i]) {
+			t.Errorf("Unexpected reason %q, expected %q", item.Error, reasons[i])
+		}
+	}
+
+	if rejected[0].Record != records[0] {
+		t.Error("Rejected results must hold their record")
+	}
+
+	if _, rows := readDynamic(t, data); rows != `[{"Count":3,"Empty":null,"Extra":null,"Service":"dynamic","User":{"Name":"jim"}}]` {
+		t.Errorf("Unexpected rows %s", rows)
+	}
+}
+
+func TestSchemaNames(t *testing.T) {
+	conv := newRegistryConverter(t, t.TempDir())
+
+	writeVersion(t, conv, "key", dynamicRecords(map[string]interface{}{"name": "lower"}))
+	data, version, _ := writeVersion(t, conv, "key", dynamicRecords(map[string]interface{}{"name": "lower", "Name": "upper"}))
+
+	if version != "2" {
+		t.Errorf("Expected version 2, got %q", version)
+	}
+
+	// columns keep the name of the version they were added
+	if _, rows := readDynamic(t, data); rows != `[{"Name_2":"upper","Name":"lower"}]` {
+		t.Errorf("Unexpected rows %s", rows)
+	}
+}
+
+func TestSchemaNoFields(t *testing.T) {
+	conv := newRegistryConverter(t, t.TempDir())
+	records := dynamicRecords(map[string]interface{}{"empty": nil}, map[string]interface{}{})
+	result := conv.Write("key", records, new(bytes.Buffer))
+
+	if len(result) != len(records) || !errors.Is(result[0].Error, ErrNoFields) || result[1].Record != records[1] {
+		t.Errorf("Records without fields must fail one by one, got %v", result)
+	}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	path := t.TempDir()
+	conv := newRegistryConverter(t, path)
+
+	writeVersion(t, conv, "key", dynamicRecords(map[string]interface{}{"service": "dynamic", "count": 1.0}))
+
+	records := dynamicRecords(
+		map[string]interface{}{"service": "dynamic", "count": 1.5, "extra": "value"},
+		map[string]interface{}{"service": "dynamic", "count": "many"},
+	)
+	result := conv.Check("key", records)
+
+	if len(result) != 1 || result[0].Record != records[1] || !errors.Is(result[0].Error, ErrSchemaIncompatible) {
+		t.Fatalf("Expected 1 rejected record, got %v", result)
+	}
+
+	reg, err := registry.NewFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if versions, _ := reg.Versions("key"); len(versions) != 1 {
+		t.Errorf("Check must not register versions, got %d", len(versions))
+	}
+
+	// the cached schema is not widened by the check, so the next write keeps version 1
+	if _, version, _ := writeVersion(t, conv, "key", dynamicRecords(map[string]interface{}{"service": "dynamic", "count": 2.0})); version != "1" {
+		t.Errorf("Expected version 1, got %q", version)
+	}
+}
+
+func TestSchemaAllRejected(t *testing.T) {
+	conv := newRegistryConverter(t, t.TempDir())
+
+	writeVersion(t, conv, "key", dynamicRecords(map[string]interface{}{"service": "dynamic", "count": 1.0}))
+
+	buf := new(bytes.Buffer)
+	result := conv.Write("key", dynamicRecords(map[string]interface{}{"service": "dynamic", "count": "many"}), buf)
+
+	if len(result) != 1 || !errors.Is(result[0].Error, ErrSchemaIncompatible) {
+		t.Fatalf("Expected 1 rejected record, got %v", result)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("No data must be written when all records are rejected, got %d bytes", buf.Len())
+	}
+}
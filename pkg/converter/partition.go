@@ -0,0 +1,123 @@
+package converter
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"data2parquet/pkg/domain"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// MetaPartition is the Parquet key-value metadata with the hour partition of a file records, as RFC3339
+const MetaPartition = "data2parquet.partition"
+
+// MetaPath is the Parquet key-value metadata with the path of a file rendered from `WriterPathTemplate`, `{id}` and
+// `{hash}` are filled by the writer
+const MetaPath = "data2parquet.path"
+
+// Partition holds the records of a batch rendered to the same path, Time is the hour of its first event
+type Partition struct {
+	Path    string
+	Time    time.Time
+	Records []domain.Record
+}
+
+// Split groups records by the path rendered from `WriterPathTemplate` (by default the hour of their event time), ordered
+// by time, so a flush with late records or around midnight is written to one file by partition. Records keep their
+// order inside each partition.
+func (c *Converter) Split(data []domain.Record) []*Partition {
+	parts := make(map[string]*Partition)
+	ret := make([]*Partition, 0, 1)
+
+	for _, record := range data {
+		path := domain.Path(record)
+		tm := domain.Partition(record.EventTime())
+		part, found := parts[path]
+
+		if !found {
+			part = &Partition{Path: path, Time: tm, Records: make([]domain.Record, 0, len(data))}
+			parts[path] = part
+			ret = append(ret, part)
+		} else if tm.Before(part.Time) {
+			part.Time = tm
+		}
+
+		part.Records = append(part.Records, record)
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Time.Before(ret[j].Time)
+	})
+
+	return ret
+}
+
+// Metadata returns the key-value metadata of a partition file
+func (p *Partition) Metadata() map[string]string {
+	return map[string]string{
+		MetaPartition: p.Time.Format(time.RFC3339),
+		MetaPath:      p.Path,
+	}
+}
+
+// ReadMetadata returns the key-value metadata of Parquet data, only its footer is read
+func ReadMetadata(data []byte) (map[string]string, error) {
+	file, err := buffer.NewBufferFile(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &reader.ParquetReader{PFile: file}
+	err = pr.ReadFooter()
+
+	if err != nil {
+		return nil, fmt.Errorf("reading parquet footer: %w", err)
+	}
+
+	ret := make(map[string]string)
+
+	for _, kv := range pr.Footer.KeyValueMetadata {
+		if kv != nil && kv.Value != nil {
+			ret[kv.Key] = *kv.Value
+		}
+	}
+
+	return ret, nil
+}
+
+// ReadPartition returns the partition stored on Parquet data, data written without it (e.g. recovery data written by an
+// older version) is partitioned by the current time
+func ReadPartition(data []byte) time.Time {
+	meta, err := ReadMetadata(data)
+
+	if err != nil {
+		slog.Warn("Error reading parquet metadata, using current time as partition", "error", err, "module", "converter", "function", "ReadPartition")
+		return time.Now()
+	}
+
+	ret, err := time.Parse(time.RFC3339, meta[MetaPartition])
+
+	if err != nil {
+		slog.Debug("Parquet data without partition, using current time", "module", "converter", "function", "ReadPartition")
+		return time.Now()
+	}
+
+	return ret
+}
+
+// ReadPath returns the path stored on Parquet data, false when data was written without it
+func ReadPath(data []byte) (string, bool) {
+	meta, err := ReadMetadata(data)
+
+	if err != nil {
+		return "", false
+	}
+
+	ret, found := meta[MetaPath]
+
+	return ret, found && len(ret) > 0
+}
@@ -0,0 +1,479 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/schema"
+
+	"data2parquet/pkg/domain"
+)
+
+// kind is the Parquet type inferred for a value of `Dynamic` records, kinds are widened when records of a batch don't
+// agree: `int` to `double`, and any other mix to `json`
+type kind int
+
+const (
+	kindNull kind = iota
+	kindBool
+	kindInt
+	kindDouble
+	kindString
+	kindGroup
+	kindList
+	kindJSON
+)
+
+var kindNames = map[kind]string{
+	kindNull:   "null",
+	kindBool:   "bool",
+	kindInt:    "int",
+	kindDouble: "double",
+	kindString: "string",
+	kindGroup:  "group",
+	kindList:   "list",
+	kindJSON:   "json",
+}
+
+func (k kind) String() string {
+	return kindNames[k]
+}
+
+// column is an inferred field of `Dynamic` data. Nested maps are groups with their own fields and lists have the column of
+// their elements. A column is optional when it is null or missing on any record. Names are the Parquet names of group
+// fields, kept when fields are added so a column is never renamed.
+type column struct {
+	kind     kind
+	optional bool
+	fields   map[string]*column
+	element  *column
+	names    map[string]string
+}
+
+// columnJSON is how a column is stored on the schema registry
+type columnJSON struct {
+	Kind     string             `json:"kind"`
+	Optional bool               `json:"optional,omitempty"`
+	Fields   map[string]*column `json:"fields,omitempty"`
+	Element  *column            `json:"element,omitempty"`
+	Names    map[string]string  `json:"names,omitempty"`
+}
+
+func (c *column) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&columnJSON{Kind: c.kind.String(), Optional: c.optional, Fields: c.fields, Element: c.element, Names: c.names})
+}
+
+func (c *column) UnmarshalJSON(data []byte) error {
+	value := &columnJSON{}
+	err := json.Unmarshal(data, value)
+
+	if err != nil {
+		return err
+	}
+
+	for k, name := range kindNames {
+		if name == value.Kind {
+			*c = column{kind: k, optional: value.Optional, fields: value.Fields, element: value.Element, names: value.Names}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown column kind %q", value.Kind)
+}
+
+// inferSchema returns the column of the data of a batch of records, merged into prev (the schema of previous batches of
+// the same key) so a field is not dropped or narrowed because it is missing on a batch
+func inferSchema(prev *column, data []domain.Record) *column {
+	ret := prev
+
+	for _, record := range data {
+		ret = mergeColumn(ret, valueColumn(record.GetData()))
+	}
+
+	return ret
+}
+
+func valueColumn(v interface{}) *column {
+	switch value := v.(type) {
+	case nil:
+		return &column{kind: kindNull, optional: true}
+	case bool:
+		return &column{kind: kindBool}
+	case string:
+		return &column{kind: kindString}
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return &column{kind: kindInt}
+		}
+
+		f, err := value.Float64()
+
+		if err != nil {
+			return &column{kind: kindJSON}
+		}
+
+		return valueColumn(f)
+	case float32:
+		return valueColumn(float64(value))
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return &column{kind: kindNull, optional: true}
+		}
+
+		// numbers decoded from JSON are float64, integral values are kept as int until a fraction is found
+		if value == math.Trunc(value) && math.Abs(value) < 1<<63 {
+			return &column{kind: kindInt}
+		}
+
+		return &column{kind: kindDouble}
+	}
+
+	if fields, ok := mapFields(v); ok {
+		ret := &column{kind: kindGroup, fields: make(map[string]*column, len(fields))}
+
+		for k, item := range fields {
+			ret.fields[k] = valueColumn(item)
+		}
+
+		ret.names = columnNames(nil, ret.fields)
+
+		return ret
+	}
+
+	if items, ok := listItems(v); ok {
+		ret := &column{kind: kindList}
+
+		for _, item := range items {
+			if item != nil {
+				ret.element = mergeColumn(ret.element, valueColumn(item))
+			}
+		}
+
+		return ret
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &column{kind: kindInt}
+	default:
+		return &column{kind: kindJSON}
+	}
+}
+
+// mergeColumn returns a column that holds values of a and b, a nil column is a field missing on all records seen so far
+func mergeColumn(a *column, b *column) *column {
+	if a == nil {
+		return b
+	}
+
+	if b == nil {
+		return a
+	}
+
+	ret := &column{kind: a.kind, optional: a.optional || b.optional}
+
+	switch {
+	case a.kind == kindNull:
+		ret.kind, ret.fields, ret.element, ret.names = b.kind, b.fields, b.element, b.names
+		ret.optional = true
+	case b.kind == kindNull:
+		ret.fields, ret.element, ret.names = a.fields, a.element, a.names
+		ret.optional = true
+	case a.kind == b.kind && a.kind == kindGroup:
+		ret.fields = make(map[string]*column, len(a.fields))
+
+		for k, field := range a.fields {
+			ret.fields[k] = field
+		}
+
+		for k, field := range b.fields {
+			ret.fields[k] = mergeColumn(ret.fields[k], field)
+		}
+
+		// fields missing on one side are optional
+		for k, field := range ret.fields {
+			if _, found := a.fields[k]; !found || b.fields[k] == nil {
+				optional := *field
+				optional.optional = true
+				ret.fields[k] = &optional
+			}
+		}
+
+		ret.names = columnNames(a.names, ret.fields)
+	case a.kind == b.kind && a.kind == kindList:
+		ret.element = mergeColumn(a.element, b.element)
+	case a.kind == b.kind:
+	case (a.kind == kindInt && b.kind == kindDouble) || (a.kind == kindDouble && b.kind == kindInt):
+		ret.kind = kindDouble
+	default:
+		ret.kind = kindJSON
+	}
+
+	return ret
+}
+
+// normalize returns the column written to Parquet, nil when its type is still unknown: fields that were always null,
+// groups without fields (Parquet groups need at least one) and lists without elements are not written until a value gives
+// them a type, so that value is an added column and not a change of the type written before
+func (c *column) normalize() *column {
+	ret := &column{kind: c.kind, optional: c.optional}
+
+	switch c.kind {
+	case kindNull:
+		return nil
+	case kindGroup:
+		ret.fields = make(map[string]*column, len(c.fields))
+
+		for k, field := range c.fields {
+			if item := field.normalize(); item != nil {
+				ret.fields[k] = item
+			}
+		}
+
+		if len(ret.fields) == 0 {
+			return nil
+		}
+
+		ret.names = columnNames(c.names, ret.fields)
+	case kindList:
+		if c.element == nil {
+			return nil
+		}
+
+		ret.element = c.element.normalize()
+
+		if ret.element == nil {
+			return nil
+		}
+	}
+
+	return ret
+}
+
+// columnNames returns the Parquet name of each field, names of prev are kept. Schema tags can't hold `,` or `=` and the
+// JSON writer matches row keys to columns by their Go variable name, so names are cleaned and suffixed when two fields
+// would get the same one (e.g. `name` and `Name`).
+func columnNames(prev map[string]string, fields map[string]*column) map[string]string {
+	keys := make([]string, 0, len(fields))
+
+	for k := range fields {
+		if _, found := prev[k]; !found {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) == 0 && prev != nil {
+		return prev
+	}
+
+	sort.Strings(keys)
+
+	ret := make(map[string]string, len(prev)+len(keys))
+	used := make(map[string]bool, len(prev)+len(keys))
+
+	for k, name := range prev {
+		ret[k] = name
+		used[common.StringToVariableName(name)] = true
+	}
+
+	for _, k := range keys {
+		name := strings.Map(func(r rune) rune {
+			if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.') {
+				return r
+			}
+
+			return '_'
+		}, k)
+
+		if len(name) == 0 {
+			name = "_"
+		}
+
+		unique := name
+
+		for i := 2; used[common.StringToVariableName(unique)]; i++ {
+			unique = fmt.Sprintf("%s_%d", name, i)
+		}
+
+		used[common.StringToVariableName(unique)] = true
+		ret[k] = unique
+	}
+
+	return ret
+}
+
+// JSONSchema returns the xitongsys JSON schema of a normalized group column
+func (c *column) JSONSchema() (string, error) {
+	root := c.schemaItem("parquet_go_root")
+	root.Tag = "name=parquet_go_root, repetitiontype=REQUIRED"
+
+	data, err := json.Marshal(root)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func (c *column) schemaItem(name string) *schema.JSONSchemaItemType {
+	repetition := "REQUIRED"
+
+	if c.optional {
+		repetition = "OPTIONAL"
+	}
+
+	ret := schema.NewJSONSchemaItem()
+
+	switch c.kind {
+	case kindBool:
+		ret.Tag = fmt.Sprintf("name=%s, type=BOOLEAN, repetitiontype=%s", name, repetition)
+	case kindInt:
+		ret.Tag = fmt.Sprintf("name=%s, type=INT64, repetitiontype=%s", name, repetition)
+	case kindDouble:
+		ret.Tag = fmt.Sprintf("name=%s, type=DOUBLE, repetitiontype=%s", name, repetition)
+	case kindGroup:
+		ret.Tag = fmt.Sprintf("name=%s, repetitiontype=%s", name, repetition)
+		ret.Fields = make([]*schema.JSONSchemaItemType, 0, len(c.fields))
+
+		keys := make([]string, 0, len(c.fields))
+
+		for k := range c.fields {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			ret.Fields = append(ret.Fields, c.fields[k].schemaItem(c.names[k]))
+		}
+	case kindList:
+		ret.Tag = fmt.Sprintf("name=%s, type=LIST, repetitiontype=%s", name, repetition)
+		ret.Fields = []*schema.JSONSchemaItemType{c.element.schemaItem("element")}
+	default:
+		ret.Tag = fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=%s", name, repetition)
+	}
+
+	return ret
+}
+
+// Row returns the JSON row of record data for a normalized group column, values are converted to the column kinds
+func (c *column) Row(data map[string]interface{}) (string, error) {
+	ret, err := json.Marshal(c.rowValue(data))
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(ret), nil
+}
+
+func (c *column) rowValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return nil
+	}
+
+	switch c.kind {
+	case kindGroup:
+		fields, _ := mapFields(v)
+		ret := make(map[string]interface{}, len(fields))
+
+		for k, item := range fields {
+			field, found := c.fields[k]
+
+			if !found {
+				continue
+			}
+
+			if value := field.rowValue(item); value != nil {
+				ret[c.names[k]] = value
+			}
+		}
+
+		return ret
+	case kindList:
+		items, _ := listItems(v)
+		ret := make([]interface{}, 0, len(items))
+
+		for _, item := range items {
+			if value := c.element.rowValue(item); value != nil {
+				ret = append(ret, value)
+			}
+		}
+
+		return ret
+	case kindJSON:
+		data, err := json.Marshal(v)
+
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+
+		return string(data)
+	default:
+		return v
+	}
+}
+
+// mapFields returns the fields of a map with string keys
+func mapFields(v interface{}) (map[string]interface{}, bool) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return value, true
+	case map[string]string:
+		ret := make(map[string]interface{}, len(value))
+
+		for k, item := range value {
+			ret[k] = item
+		}
+
+		return ret, true
+	}
+
+	rv := reflect.ValueOf(v)
+
+	if rv.Kind() != reflect.Map {
+		return nil, false
+	}
+
+	ret := make(map[string]interface{}, rv.Len())
+	iter := rv.MapRange()
+
+	for iter.Next() {
+		ret[fmt.Sprintf("%v", iter.Key().Interface())] = iter.Value().Interface()
+	}
+
+	return ret, true
+}
+
+// listItems returns the items of a slice or array, byte slices are not lists
+func listItems(v interface{}) ([]interface{}, bool) {
+	if value, ok := v.([]interface{}); ok {
+		return value, true
+	}
+
+	rv := reflect.ValueOf(v)
+
+	if (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+
+	ret := make([]interface{}, rv.Len())
+
+	for i := range ret {
+		ret[i] = rv.Index(i).Interface()
+	}
+
+	return ret, true
+}
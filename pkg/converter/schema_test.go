@@ -0,0 +1,197 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+)
+
+func dynamicRecords(data ...map[string]interface{}) []domain.Record {
+	ret := make([]domain.Record, len(data))
+
+	for i, item := range data {
+		ret[i] = domain.NewRecord(config.RecordTypeDynamic, item)
+	}
+
+	return ret
+}
+
+// readDynamic returns the schema elements by path and the rows of Parquet data as JSON
+func readDynamic(t *testing.T, data []byte) (map[string]*parquet.SchemaElement, string) {
+	pf, err := buffer.NewBufferFile(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, err := reader.NewParquetReader(pf, nil, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pr.ReadStop()
+
+	elements := make(map[string]*parquet.SchemaElement)
+
+	for i, element := range pr.SchemaHandler.SchemaElements {
+		elements[pr.SchemaHandler.IndexMap[int32(i)]] = element
+	}
+
+	rows, err := pr.ReadByNumber(int(pr.GetNumRows()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := json.Marshal(rows)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return elements, string(ret)
+}
+
+func TestInferSchema(t *testing.T) {
+	conv := New(&config.Config{RecordType: config.RecordTypeDynamic, WriterRowGroupSize: 1024 * 1024})
+	records := dynamicRecords(
+		map[string]interface{}{
+			"service": "dynamic",
+			"count":   1.0,
+			"ratio":   2.0,
+			"mixed":   "text",
+			"user":    map[string]interface{}{"name": "john", "age": 30.0},
+			"tags":    []interface{}{"a", "b"},
+			"Name":    "upper",
+			"name":    "lower",
+		},
+		map[string]interface{}{
+			"service": "dynamic",
+			"count":   2.0,
+			"ratio":   2.5,
+			"mixed":   10.0,
+			"user":    map[string]interface{}{"name": "jane", "admin": true},
+			"tags":    []interface{}{},
+			"name":    "lower",
+			"empty":   nil,
+		},
+	)
+
+	buf := new(bytes.Buffer)
+
+	if CheckWriterError(conv.Write("key", records, buf)) {
+		t.Fatal("Error writing parquet data")
+	}
+
+	elements, rows := readDynamic(t, buf.Bytes())
+
+	if _, found := elements["Parquet_go_root\x01Empty"]; found {
+		t.Error("Fields that were always null must not be written")
+	}
+
+	tests := map[string][2]interface{}{
+		"Service":                 {parquet.Type_BYTE_ARRAY, parquet.FieldRepetitionType_REQUIRED},
+		"Count":                   {parquet.Type_INT64, parquet.FieldRepetitionType_REQUIRED},
+		"Ratio":                   {parquet.Type_DOUBLE, parquet.FieldRepetitionType_REQUIRED},
+		"Mixed":                   {parquet.Type_BYTE_ARRAY, parquet.FieldRepetitionType_REQUIRED},
+		"Name":                    {parquet.Type_BYTE_ARRAY, parquet.FieldRepetitionType_OPTIONAL},
+		"Name_2":                  {parquet.Type_BYTE_ARRAY, parquet.FieldRepetitionType_REQUIRED},
+		"User\x01Age":             {parquet.Type_INT64, parquet.FieldRepetitionType_OPTIONAL},
+		"User\x01Name":            {parquet.Type_BYTE_ARRAY, parquet.FieldRepetitionType_REQUIRED},
+		"User\x01Admin":           {parquet.Type_BOOLEAN, parquet.FieldRepetitionType_OPTIONAL},
+		"Tags\x01List\x01Element": {parquet.Type_BYTE_ARRAY, parquet.FieldRepetitionType_REQUIRED},
+	}
+
+	for path, test := range tests {
+		element, found := elements["Parquet_go_root\x01"+path]
+
+		if !found {
+			t.Errorf("Column %q not found", path)
+			continue
+		}
+
+		if element.GetType() != test[0] || element.GetRepetitionType() != test[1] {
+			t.Errorf("%q: expected %v %v, got %v %v", path, test[0], test[1], element.GetType(), element.GetRepetitionType())
+		}
+	}
+
+	expected := `[{"Name":"upper","Count":1,"Mixed":"\"text\"","Name_2":"lower","Ratio":2,"Service":"dynamic","Tags":["a","b"],"User":{"Admin":null,"Age":30,"Name":"john"}},` +
+		`{"Name":null,"Count":2,"Mixed":"10","Name_2":"lower","Ratio":2.5,"Service":"dynamic","Tags":[],"User":{"Admin":true,"Age":null,"Name":"jane"}}]`
+
+	if rows != expected {
+		t.Errorf("Unexpected rows %s", rows)
+	}
+}
+
+func TestInferSchemaCache(t *testing.T) {
+	conv := New(&config.Config{RecordType: config.RecordTypeDynamic, WriterRowGroupSize: 1024 * 1024})
+	batches := [][]domain.Record{
+		dynamicRecords(map[string]interface{}{"service": "dynamic", "count": 1.0}),
+		dynamicRecords(map[string]interface{}{"service": "dynamic", "count": 1.5, "extra": "value"}),
+	}
+
+	var data []byte
+
+	for _, batch := range batches {
+		buf := new(bytes.Buffer)
+
+		if CheckWriterError(conv.Write("key", batch, buf)) {
+			t.Fatal("Error writing parquet data")
+		}
+
+		data = buf.Bytes()
+	}
+
+	elements, rows := readDynamic(t, data)
+
+	if element := elements["Parquet_go_root\x01Count"]; element.GetType() != parquet.Type_DOUBLE {
+		t.Errorf("Count must be widened to double, got %v", element.GetType())
+	}
+
+	if element := elements["Parquet_go_root\x01Extra"]; element.GetRepetitionType() != parquet.FieldRepetitionType_OPTIONAL {
+		t.Errorf("Extra must be optional, missing on the first batch, got %v", element.GetRepetitionType())
+	}
+
+	if rows != `[{"Count":1.5,"Extra":"value","Service":"dynamic"}]` {
+		t.Errorf("Unexpected rows %s", rows)
+	}
+
+	buf := new(bytes.Buffer)
+
+	if CheckWriterError(conv.Write("other", batches[0], buf)) {
+		t.Fatal("Error writing parquet data")
+	}
+
+	if elements, _ := readDynamic(t, buf.Bytes()); elements["Parquet_go_root\x01Count"].GetType() != parquet.Type_INT64 {
+		t.Error("Schemas must be cached by key")
+	}
+}
+
+func TestDynamicJSONSchema(t *testing.T) {
+	conv := New(&config.Config{RecordType: config.RecordTypeDynamic, JsonSchemaPath: "../../etc/log-schema.json", WriterRowGroupSize: 1024 * 1024})
+	records := dynamicRecords(
+		map[string]interface{}{"time": "2024-06-01T10:00:00Z", "level": "info", "message": "message", "ignored": 1.0},
+		map[string]interface{}{"message": "other", "correlation_id": "abc"},
+	)
+
+	buf := new(bytes.Buffer)
+
+	if CheckWriterError(conv.Write("key", records, buf)) {
+		t.Fatal("Error writing parquet data")
+	}
+
+	_, rows := readDynamic(t, buf.Bytes())
+
+	if !strings.Contains(rows, `"Message":"message"`) || !strings.Contains(rows, `"Correlation_id":"abc"`) || strings.Contains(rows, "Ignored") {
+		t.Errorf("Unexpected rows %s", rows)
+	}
+}
@@ -0,0 +1,99 @@
+package converter
+
+import (
+	"fmt"
+
+	"data2parquet/pkg/domain"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+const verifyBatchSize = 1000
+
+type VerifyFailure struct {
+	Row   int64  `json:"row"`
+	Error string `json:"error"`
+}
+
+type VerifyResult struct {
+	Rows    int64            `json:"rows"`
+	Valid   int64            `json:"valid"`
+	Invalid []*VerifyFailure `json:"invalid,omitempty"`
+}
+
+// VerifyHMACFile checks the HMAC of each row of a Parquet file written with `log` record type
+func VerifyHMACFile(path string) (*VerifyResult, error) {
+	file, err := local.NewLocalFileReader(path)
+
+	if err != nil {
+		slog.Error("Error opening parquet file", "error", err, "path", path, "module", "converter", "function", "VerifyHMACFile")
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return verifyHMAC(file)
+}
+
+// VerifyHMAC checks the HMAC of each row of Parquet data written with `log` record type
+func VerifyHMAC(data []byte) (*VerifyResult, error) {
+	file, err := buffer.NewBufferFile(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyHMAC(file)
+}
+
+func verifyHMAC(file source.ParquetFile) (*VerifyResult, error) {
+	pr, err := reader.NewParquetReader(file, new(domain.Log), 1)
+
+	if err != nil {
+		slog.Error("Error creating parquet reader", "error", err, "module", "converter", "function", "verifyHMAC")
+		return nil, err
+	}
+
+	defer pr.ReadStop()
+
+	ret := &VerifyResult{
+		Rows:    pr.GetNumRows(),
+		Invalid: make([]*VerifyFailure, 0),
+	}
+
+	for row := int64(0); row < ret.Rows; {
+		size := ret.Rows - row
+
+		if size > verifyBatchSize {
+			size = verifyBatchSize
+		}
+
+		rows := make([]domain.Log, size)
+		err = pr.Read(&rows)
+
+		if err != nil {
+			slog.Error("Error reading parquet rows", "error", err, "row", row, "module", "converter", "function", "verifyHMAC")
+			return nil, fmt.Errorf("reading rows from %d: %w", row, err)
+		}
+
+		for i := range rows {
+			err = rows[i].VerifyHMAC()
+
+			if err != nil {
+				ret.Invalid = append(ret.Invalid, &VerifyFailure{Row: row + int64(i), Error: err.Error()})
+				continue
+			}
+
+			ret.Valid++
+		}
+
+		row += size
+	}
+
+	slog.Debug("HMAC verified", "rows", ret.Rows, "valid", ret.Valid, "invalid", len(ret.Invalid), "module", "converter", "function", "verifyHMAC")
+
+	return ret, nil
+}
@@ -0,0 +1,147 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+)
+
+func setHMACKeys(t *testing.T, keys string, signing string) {
+	cfg := &config.Config{UseHMAC: true, HMACKeys: keys, HMACKeyID: signing}
+	cfg.SetDefaults()
+
+	err := cfg.CheckHMAC()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		(&config.Config{}).SetDefaults()
+	})
+}
+
+func signedRecords(qty int) []domain.Record {
+	ret := make([]domain.Record, qty)
+
+	for i := 0; i < qty; i++ {
+		ret[i] = domain.NewRecord(config.RecordTypeLog, map[string]interface{}{
+			"time":                "2024-06-01T10:00:00Z",
+			"message":             "message",
+			"business-capability": "capability",
+			"business-domain":     "domain",
+			"business-service":    "service",
+			"application-service": "application",
+			"correlation-id":      "abc",
+			"tags":                []string{"a", "b"},
+			"args":                map[string]string{"host": "server"},
+			"custom":              "value",
+		})
+	}
+
+	return ret
+}
+
+func writeParquet(t *testing.T, records []domain.Record) []byte {
+	conv := New(&config.Config{RecordType: config.RecordTypeLog, WriterRowGroupSize: 1024 * 1024})
+	buf := new(bytes.Buffer)
+
+	if CheckWriterError(conv.Write("key", records, buf)) {
+		t.Fatal("Error writing parquet data")
+	}
+
+	return buf.Bytes()
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	setHMACKeys(t, "k1=first-secret", "")
+
+	records := signedRecords(3)
+	records[1].(*domain.Log).Message = "tampered"
+
+	data := writeParquet(t, records)
+	path := filepath.Join(t.TempDir(), "data.parquet")
+
+	err := os.WriteFile(path, data, 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyHMACFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 || result.Valid != 2 || len(result.Invalid) != 1 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	if result.Invalid[0].Row != 1 || result.Invalid[0].Error != domain.ErrHMACMismatch.Error() {
+		t.Errorf("Unexpected failure %+v", result.Invalid[0])
+	}
+}
+
+func TestVerifyHMACRotation(t *testing.T) {
+	setHMACKeys(t, "k1=first-secret", "k1")
+	old := writeParquet(t, signedRecords(2))
+
+	setHMACKeys(t, "k1=first-secret,k2=second-secret", "k2")
+	current := signedRecords(1)
+
+	if log := current[0].(*domain.Log); log.HMAC[:3] != "k2:" {
+		t.Errorf("Record signed with %s, expected k2", log.HMAC)
+	}
+
+	for _, data := range [][]byte{old, writeParquet(t, current)} {
+		result, err := VerifyHMAC(data)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result.Invalid) > 0 {
+			t.Errorf("Unexpected failures %+v", result.Invalid[0])
+		}
+	}
+
+	setHMACKeys(t, "k2=second-secret", "k2")
+	result, err := VerifyHMAC(old)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Invalid) != 2 || !errors.Is(domain.VerifyHMAC([]byte("data"), "k1:00"), domain.ErrHMACUnknownKey) {
+		t.Errorf("Records signed by removed key must be invalid, got %+v", result)
+	}
+}
+
+func TestHMACConfig(t *testing.T) {
+	t.Setenv("D2P_TEST_HMAC_KEYS", "env=env-secret")
+
+	path := filepath.Join(t.TempDir(), "keys")
+	err := os.WriteFile(path, []byte("# rotated on 2024-06\nfile=file-secret\n"), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{UseHMAC: true, HMACKeys: "inline=inline-secret", HMACKeysFile: path, HMACKeysEnv: "D2P_TEST_HMAC_KEYS"}
+	cfg.SetDefaults()
+	defer (&config.Config{}).SetDefaults()
+
+	if len(config.HMACSecrets) != 3 || string(config.HMACSecrets["file"]) != "file-secret" || string(config.HMACSecrets["env"]) != "env-secret" {
+		t.Errorf("Unexpected HMAC keys %v", config.HMACSecrets)
+	}
+
+	if cfg.CheckHMAC() == nil {
+		t.Error("HMAC check must fail without HMACKeyID when many keys are loaded")
+	}
+}
@@ -3,8 +3,11 @@ package domain
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	msgp "github.com/vmihailenco/msgpack/v5"
+
+	"data2parquet/pkg/config"
 )
 
 type Dynamic struct {
@@ -46,19 +49,37 @@ func (d *Dynamic) UpdateInfo() {
 		d.Info.DynamicApplication = fmt.Sprintf("%s", v)
 	}
 
-	d.Info.makeKey()
+	d.Info.makeKey(func(name string) (string, bool) {
+		return lookupField(d.Data, name)
+	})
 }
 
 func (d *Dynamic) GetData() map[string]interface{} {
 	return d.Data
 }
 
+// Fields returns a copy of record data, it can be changed and decoded to a new record
+func (d *Dynamic) Fields() map[string]interface{} {
+	ret := make(map[string]interface{}, len(d.Data))
+
+	for k, v := range d.Data {
+		ret[k] = v
+	}
+
+	return ret
+}
+
 func (d *Dynamic) Decode(data map[string]interface{}) {
 	for k, v := range data {
 		d.Data[fmt.Sprint(k)] = v
 	}
 }
 
+// EventTime returns the time on `DynamicTimeField`, or the current time when it is missing or can't be parsed
+func (d *Dynamic) EventTime() time.Time {
+	return TryParseRecordTime(d.Data[config.DynamicTimeField])
+}
+
 func (d *Dynamic) GetInfo() RecordInfo {
 	return d.Info
 }
@@ -90,6 +111,8 @@ func (d *Dynamic) FromJson(data string) error {
 		return err
 	}
 
+	d.UpdateInfo()
+
 	return nil
 }
 
@@ -112,5 +135,7 @@ func (d *Dynamic) FromMsgPack(data []byte) error {
 		return err
 	}
 
+	d.UpdateInfo()
+
 	return nil
 }
@@ -1,8 +1,6 @@
 package domain
 
 import (
-	"fmt"
-	"strings"
 	"time"
 
 	"data2parquet/pkg/config"
@@ -14,21 +12,19 @@ type DynamicInfo struct {
 	DynamicCapability  string `msg:"capability" json:"capability,omitempty"`
 	DynamicApplication string `msg:"application" json:"application,omitempty"`
 	key                string
+	values             map[string]string
 }
 
 func NewDynamicInfoFromKey(key string) RecordInfo {
-	values := strings.Split(key, KeySeparator)
-
-	for len(values) < 4 {
-		values = append(values, "unkown")
-	}
+	values := parseKey(config.RecordTypeDynamic, key)
 
 	ret := &DynamicInfo{
-		DynamicCapability:  values[0],
-		DynamicDomain:      values[1],
-		DynamicService:     values[2],
-		DynamicApplication: values[3],
+		DynamicCapability:  keyValue(values, "capability"),
+		DynamicDomain:      keyValue(values, "domain"),
+		DynamicService:     keyValue(values, "service"),
+		DynamicApplication: keyValue(values, "application"),
 		key:                key,
+		values:             values,
 	}
 
 	return ret
@@ -54,18 +50,40 @@ func (i *DynamicInfo) Application() string {
 	return i.DynamicApplication
 }
 
+// Key returns the key composed from `RecordKey`, info decoded without it (e.g. from JSON) is keyed by its own fields
 func (i *DynamicInfo) Key() string {
-	return fmt.Sprintf("%s%s%s%s%s%s%s", i.Capability(), KeySeparator, i.Domain(), KeySeparator, i.Service(), KeySeparator, i.Application())
+	if len(i.key) == 0 {
+		i.makeKey(func(name string) (string, bool) {
+			switch name {
+			case "capability":
+				return i.DynamicCapability, len(i.DynamicCapability) > 0
+			case "domain":
+				return i.DynamicDomain, len(i.DynamicDomain) > 0
+			case "service":
+				return i.DynamicService, len(i.DynamicService) > 0
+			case "application":
+				return i.DynamicApplication, len(i.DynamicApplication) > 0
+			default:
+				return "", false
+			}
+		})
+	}
+
+	return i.key
 }
 
-func (i *DynamicInfo) Target(id string, hash string) string {
-	tm := time.Now()
-	year, month, day := tm.Date()
-	hour, _, _ := tm.Clock()
+// Value returns the value of a key part by its name
+func (i *DynamicInfo) Value(name string) (string, bool) {
+	v, found := i.values[name]
+	return v, found
+}
 
-	return fmt.Sprintf("%s/year=%04d/month=%02d/day=%02d/hour=%02d/%s-%s-%s.parquet", i.Capability(), year, month, day, hour, id, i.Key(), hash)
+// Target returns the path of a file of records with event time on partition, rendered from `WriterPathTemplate` without
+// record fields
+func (i *DynamicInfo) Target(partition time.Time, id string, hash string) string {
+	return target(i, partition, id, hash)
 }
 
-func (i *DynamicInfo) makeKey() {
-	i.key = fmt.Sprintf("%s%s%s%s%s%s%s", i.Capability(), KeySeparator, i.Domain(), KeySeparator, i.Service(), KeySeparator, i.Application())
+func (i *DynamicInfo) makeKey(lookup Lookup) {
+	i.key, i.values = composeKey(config.RecordTypeDynamic, lookup)
 }
@@ -0,0 +1,91 @@
+package domain
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"data2parquet/pkg/config"
+)
+
+var ErrHMACMissing = errors.New("record has no HMAC")
+var ErrHMACUnknownKey = errors.New("HMAC key is unknown")
+var ErrHMACMismatch = errors.New("HMAC doesn't match record")
+
+// SignHMAC returns the HMAC-SHA256 of data with the signing key as `<key id>:<hex digest>`, empty when the signing key
+// is not loaded
+func SignHMAC(data []byte) string {
+	secret, found := config.HMACSecrets[config.HMACSigningKey]
+
+	if !found {
+		slog.Error("HMAC signing key not found, record will not be signed", "key-id", config.HMACSigningKey)
+		return ""
+	}
+
+	return config.HMACSigningKey + ":" + makeHMAC(secret, data)
+}
+
+// VerifyHMAC checks a signature made by `SignHMAC`, its key is looked up by ID so records signed before a key rotation
+// are verified while the old key is loaded
+func VerifyHMAC(data []byte, signature string) error {
+	if len(signature) == 0 {
+		return ErrHMACMissing
+	}
+
+	id, digest, _ := strings.Cut(signature, ":")
+	secret, found := config.HMACSecrets[id]
+
+	if !found {
+		return fmt.Errorf("%w: %q", ErrHMACUnknownKey, id)
+	}
+
+	if !hmac.Equal([]byte(digest), []byte(makeHMAC(secret, data))) {
+		return ErrHMACMismatch
+	}
+
+	return nil
+}
+
+func makeHMAC(secret []byte, data []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonical returns the signed content of a record: its fields without HMAC, as JSON with sorted keys. Empty values are
+// left out, so a field unset and a field set empty (the same after a Parquet round trip) are signed the same way.
+func (l *Log) canonical() []byte {
+	fields := l.Fields()
+
+	for k, v := range fields {
+		switch value := v.(type) {
+		case string:
+			if len(value) == 0 {
+				delete(fields, k)
+			}
+		case bool:
+			if !value {
+				delete(fields, k)
+			}
+		}
+	}
+
+	data, err := json.Marshal(fields)
+
+	if err != nil {
+		slog.Error("Error marshalling canonical record", "error", err)
+		return nil
+	}
+
+	return data
+}
+
+// VerifyHMAC checks the record HMAC against its current fields
+func (l *Log) VerifyHMAC() error {
+	return VerifyHMAC(l.canonical(), l.HMAC)
+}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"strings"
+
+	"data2parquet/pkg/config"
+)
+
+// Lookup returns the value of a record field and true when it is set and not empty
+type Lookup func(name string) (string, bool)
+
+// composeKey returns the key of a record from `RecordKey` and the value of each key part by its name. Values are cleaned
+// so the key can be parsed back by `parseKey`.
+func composeKey(recordType string, lookup Lookup) (string, map[string]string) {
+	parts := config.KeyFields(recordType)
+	values := make(map[string]string, len(parts))
+	ret := make([]string, len(parts))
+
+	for i, part := range parts {
+		value := part.Default
+
+		for _, field := range part.Fields {
+			if v, found := lookup(field); found {
+				value = v
+				break
+			}
+		}
+
+		value = strings.ReplaceAll(value, KeySeparator, "_")
+		values[part.Name()] = value
+		ret[i] = value
+	}
+
+	return strings.Join(ret, KeySeparator), values
+}
+
+// parseKey returns the value of each key part by its name, parts missing on key get their default
+func parseKey(recordType string, key string) map[string]string {
+	parts := config.KeyFields(recordType)
+	values := strings.SplitN(key, KeySeparator, len(parts))
+	ret := make(map[string]string, len(parts))
+
+	for i, part := range parts {
+		ret[part.Name()] = part.Default
+
+		if i < len(values) {
+			ret[part.Name()] = values[i]
+		}
+	}
+
+	return ret
+}
+
+// keyValue returns a value of a parsed key, record info not on the key is `undefined`
+func keyValue(values map[string]string, name string) string {
+	if v, found := values[name]; found {
+		return v
+	}
+
+	return undefinedValue
+}
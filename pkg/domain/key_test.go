@@ -0,0 +1,116 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"data2parquet/pkg/config"
+)
+
+func setRecordKey(t *testing.T, cfg *config.Config) {
+	cfg.SetDefaults()
+
+	err := cfg.CheckRecordKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		(&config.Config{}).SetDefaults()
+	})
+}
+
+func TestRecordKey(t *testing.T) {
+	setRecordKey(t, &config.Config{
+		RecordType: config.RecordTypeLog,
+		RecordKey: []*config.KeyField{
+			{Fields: []string{"stage", "args.environment"}, Default: "prod"},
+			{Fields: []string{"args.tenant"}, Default: "shared"},
+			{Fields: []string{"business-service"}},
+		},
+		WriterPathTemplate: "stage={field:stage}/{service}/{capability}/{id}.parquet",
+	})
+
+	tests := []struct {
+		data map[string]interface{}
+		key  string
+	}{
+		{map[string]interface{}{"stage": "dev", "business-service": "payments", "args": map[string]interface{}{"tenant": "acme"}}, "dev:acme:payments"},
+		{map[string]interface{}{"business-service": "payments", "args": map[string]interface{}{"environment": "qa:eu"}}, "qa_eu:shared:payments"},
+		{map[string]interface{}{"stage": "", "business-capability": "capability"}, "prod:shared:"},
+	}
+
+	for _, test := range tests {
+		record := NewLog(test.data)
+
+		if record.Key() != test.key {
+			t.Errorf("Expected key %s, got %s", test.key, record.Key())
+		}
+	}
+
+	info := NewRecordInfoFromKey(config.RecordTypeLog, "dev:acme:payments")
+
+	if info.Key() != "dev:acme:payments" || info.Service() != "payments" || info.Capability() != "undefined" {
+		t.Errorf("Unexpected info from key %+v", info)
+	}
+
+	if v, found := info.Value("args.tenant"); !found || v != "acme" {
+		t.Errorf("Unexpected tenant %s", v)
+	}
+
+	if path := info.Target(time.Now(), "id", ""); path != "stage=dev/payments/undefined/id.parquet" {
+		t.Errorf("Unexpected target %s", path)
+	}
+
+	if info := NewRecordInfoFromKey(config.RecordTypeLog, "dev"); info.Service() != "" || info.Key() != "dev" {
+		t.Errorf("Missing key parts must get their default, got %+v", info)
+	}
+}
+
+func TestDefaultRecordKey(t *testing.T) {
+	log := NewLog(map[string]interface{}{
+		"business-capability": "capability",
+		"business-domain":     "domain",
+		"business-service":    "service",
+		"application-service": "application",
+	})
+
+	if log.Key() != "capability:domain:service:application" {
+		t.Errorf("Unexpected log key %s", log.Key())
+	}
+
+	dynamic := NewDynamic(map[string]interface{}{"service": "service", "domain": "domain"})
+
+	if dynamic.Key() != "dynamic_capability:domain:service:dynamic_application" {
+		t.Errorf("Unexpected dynamic key %s", dynamic.Key())
+	}
+
+	decoded := &Dynamic{}
+
+	if err := decoded.FromMsgPack(dynamic.ToMsgPack()); err != nil || decoded.Key() != dynamic.Key() {
+		t.Errorf("Unexpected decoded key %s", decoded.Key())
+	}
+
+	info := NewRecordInfoFromKey(config.RecordTypeDynamic, dynamic.Key())
+
+	if info.Capability() != "dynamic_capability" || info.Domain() != "domain" || info.Key() != dynamic.Key() {
+		t.Errorf("Unexpected dynamic info %+v", info)
+	}
+}
+
+func TestRecordKeyConfig(t *testing.T) {
+	invalid := [][]*config.KeyField{
+		{{}},
+		{{Fields: []string{""}}},
+		{{Fields: []string{"env"}}, {Fields: []string{"env", "environment"}}},
+	}
+
+	for _, key := range invalid {
+		cfg := &config.Config{RecordKey: key}
+
+		if cfg.CheckRecordKey() == nil {
+			t.Errorf("Record key %+v must be invalid", key)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	msgp "github.com/vmihailenco/msgpack/v5"
 
@@ -99,7 +100,14 @@ var LogLevel = map[string]int{
 }
 
 func NewLog(data map[string]interface{}) Record {
-	ret := &Log{
+	ret := newLog()
+	ret.Decode(data)
+
+	return ret
+}
+
+func newLog() *Log {
+	return &Log{
 		ExtraFields: make(map[string]string),
 		TraceIP:     make([]string, 0),
 		Tags:        make([]string, 0),
@@ -109,10 +117,6 @@ func NewLog(data map[string]interface{}) Record {
 		Level:       LevelInfo,
 		Message:     "",
 	}
-
-	ret.Decode(data)
-
-	return ret
 }
 
 func (l *Log) UpdateInfo() {
@@ -123,9 +127,18 @@ func (l *Log) UpdateInfo() {
 		ApplicationService: l.ApplicationService,
 	}
 
-	ret.makeKey()
+	var fields map[string]interface{}
+
+	ret.makeKey(func(name string) (string, bool) {
+		if fields == nil {
+			fields = l.Fields()
+		}
+
+		return lookupField(fields, name)
+	})
+
 	if config.UseHMAC {
-		l.HMAC = GetMD5Sum(l.ToMsgPack())
+		l.HMAC = SignHMAC(l.canonical())
 	}
 
 	l.info = ret
@@ -171,8 +184,88 @@ func (l *Log) GetData() map[string]interface{} {
 	return ret
 }
 
+// Fields returns record fields as a flat map with the keys accepted by `Decode`, unset fields are not present and extra
+// fields are on the top level, so the map can be changed and decoded to a new record
+func (l *Log) Fields() map[string]interface{} {
+	ret := make(map[string]interface{})
+
+	for k, v := range l.ExtraFields {
+		ret[k] = v
+	}
+
+	ret["time"] = l.Time
+	ret["level"] = l.Level
+	ret["message"] = l.Message
+	ret["business-capability"] = l.BusinessCapability
+	ret["business-domain"] = l.BusinessDomain
+	ret["business-service"] = l.BusinessService
+	ret["application-service"] = l.ApplicationService
+
+	optional := map[string]*string{
+		"correlation-id":                l.CorrelationId,
+		"session-id":                    l.SessionId,
+		"message-id":                    l.MessageId,
+		"person-id":                     l.PersonId,
+		"user-id":                       l.UserId,
+		"device-id":                     l.DeviceId,
+		"resource-type":                 l.ResourceType,
+		"cloud-provider":                l.CloudProvider,
+		"source-id":                     l.SourceId,
+		"http-response":                 l.HTTPResponse,
+		"error-code":                    l.ErrorCode,
+		"stack-trace":                   l.StackTrace,
+		"duration":                      l.Duration,
+		"region":                        l.Region,
+		"az":                            l.AZ,
+		"transaction-message-reference": l.TransactionMessageReference,
+		"ttl":                           l.Ttl,
+		"logger-name":                   l.LoggerName,
+		"thread-name":                   l.ThreadName,
+	}
+
+	for k, v := range optional {
+		if v != nil {
+			ret[k] = *v
+		}
+	}
+
+	if l.Audit != nil {
+		ret["audit"] = *l.Audit
+	}
+
+	if l.AutoIndex != nil {
+		ret["auto-index"] = *l.AutoIndex
+	}
+
+	if len(l.Args) > 0 {
+		args := make(map[string]string, len(l.Args))
+
+		for k, v := range l.Args {
+			args[k] = v
+		}
+
+		ret["args"] = args
+	}
+
+	if len(l.Tags) > 0 {
+		ret["tags"] = append([]string{}, l.Tags...)
+	}
+
+	if len(l.TraceIP) > 0 {
+		ret["trace-ip"] = append([]string{}, l.TraceIP...)
+	}
+
+	return ret
+}
+
 func (l *Log) Decode(data map[string]interface{}) {
-	for k, v := range data {
+	l.decode(data, nil)
+}
+
+// decode sets record fields from data masked by `MaskFields` and `MaskRules`, values equal to original fields are not
+// masked again
+func (l *Log) decode(data map[string]interface{}, original map[string]interface{}) {
+	for k, v := range maskData(data, original) {
 		key := strings.ReplaceAll(strings.ToLower(fmt.Sprintf("%v", k)), "_", "-")
 
 		if len(key) == 0 {
@@ -183,10 +276,6 @@ func (l *Log) Decode(data map[string]interface{}) {
 			continue
 		}
 
-		if _, ignore := config.MaskFields[key]; ignore {
-			v = "*"
-		}
-
 		switch key {
 		case "time":
 			l.Time = v.(string)
@@ -443,6 +532,11 @@ func makeKey(prefix string, key any) string {
 	return strings.ReplaceAll(strings.ToLower(fmt.Sprintf("%s%v", prefix, key)), "_", "-")
 }
 
+// EventTime returns the record time, or the current time when it can't be parsed
+func (l *Log) EventTime() time.Time {
+	return TryParseRecordTime(l.Time)
+}
+
 func (l *Log) GetInfo() RecordInfo {
 	if l.info == nil {
 		l.UpdateInfo()
@@ -1,8 +1,6 @@
 package domain
 
 import (
-	"fmt"
-	"strings"
 	"time"
 
 	"data2parquet/pkg/config"
@@ -14,21 +12,19 @@ type LogInfo struct {
 	BusinessService    string `msg:"business-service" json:"business-service,omitempty"`
 	ApplicationService string `msg:"application-service" json:"application-service,omitempty"`
 	key                string
+	values             map[string]string
 }
 
 func NewLogInfoFromKey(key string) RecordInfo {
-	values := strings.Split(key, KeySeparator)
-
-	for len(values) < 4 {
-		values = append(values, "unkown")
-	}
+	values := parseKey(config.RecordTypeLog, key)
 
 	ret := &LogInfo{
-		BusinessCapability: values[0],
-		BusinessDomain:     values[1],
-		BusinessService:    values[2],
-		ApplicationService: values[3],
+		BusinessCapability: keyValue(values, "business-capability"),
+		BusinessDomain:     keyValue(values, "business-domain"),
+		BusinessService:    keyValue(values, "business-service"),
+		ApplicationService: keyValue(values, "application-service"),
 		key:                key,
+		values:             values,
 	}
 
 	return ret
@@ -58,14 +54,33 @@ func (i *LogInfo) Key() string {
 	return i.key
 }
 
-func (i *LogInfo) Target(id string, hash string) string {
-	tm := time.Now()
-	year, month, day := tm.Date()
-	hour, _, _ := tm.Clock()
+// Target returns the path of a file of records with event time on partition, rendered from `WriterPathTemplate` without
+// record fields
+func (i *LogInfo) Target(partition time.Time, id string, hash string) string {
+	return target(i, partition, id, hash)
+}
 
-	return fmt.Sprintf("capability=%s/year=%04d/month=%02d/day=%02d/hour=%02d/%s-%s%s.parquet", i.Capability(), year, month, day, hour, id, i.Key(), hash)
+// Value returns the value of a key part by its name
+func (i *LogInfo) Value(name string) (string, bool) {
+	v, found := i.values[name]
+	return v, found
 }
 
-func (i *LogInfo) makeKey() {
-	i.key = fmt.Sprintf("%s%s%s%s%s%s%s", i.Capability(), KeySeparator, i.Domain(), KeySeparator, i.Service(), KeySeparator, i.Application())
+// makeKey composes the key from `RecordKey`, business fields are read from info so the record fields are only looked up
+// by custom keys
+func (i *LogInfo) makeKey(lookup Lookup) {
+	i.key, i.values = composeKey(config.RecordTypeLog, func(name string) (string, bool) {
+		switch name {
+		case "business-capability":
+			return i.BusinessCapability, len(i.BusinessCapability) > 0
+		case "business-domain":
+			return i.BusinessDomain, len(i.BusinessDomain) > 0
+		case "business-service":
+			return i.BusinessService, len(i.BusinessService) > 0
+		case "application-service":
+			return i.ApplicationService, len(i.ApplicationService) > 0
+		default:
+			return lookup(name)
+		}
+	})
 }
@@ -0,0 +1,250 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"data2parquet/pkg/config"
+)
+
+const maskChar = "*"
+
+// maskData returns a copy of record data with values masked by `MaskFields` and `MaskRules`, nested maps (e.g. `args`)
+// are masked by key too. Values equal to the same key of original, fields of a record already masked, are kept.
+func maskData(data map[string]interface{}, original map[string]interface{}) map[string]interface{} {
+	if len(config.MaskFields) == 0 && len(config.MaskRules) == 0 {
+		return data
+	}
+
+	ret := make(map[string]interface{}, len(data))
+
+	for k, v := range data {
+		key := strings.ReplaceAll(strings.ToLower(k), "_", "-")
+
+		prev, found := original[key]
+
+		if found && reflect.DeepEqual(prev, v) {
+			ret[k] = v
+			continue
+		}
+
+		ret[k] = maskField(key, key, v, prev)
+	}
+
+	return ret
+}
+
+// maskField masks a value by its path, `<parent>.<key>` for nested keys, or by its key name
+func maskField(path string, key string, v interface{}, original interface{}) interface{} {
+	rules := config.MaskRules[path]
+
+	if path != key {
+		rules = append(rules[:len(rules):len(rules)], config.MaskRules[key]...)
+	}
+
+	// `MaskFields` are redacted when they have no rule
+	if len(rules) == 0 {
+		if _, redact := config.MaskFields[key]; !redact {
+			return maskNested(path, v, original)
+		}
+
+		rules = []*config.MaskRule{{Field: key, Strategy: config.MaskStrategyRedact}}
+	}
+
+	switch value := v.(type) {
+	case nil:
+		return v
+	case string:
+		return maskString(rules, value)
+	case []string:
+		ret := make([]string, len(value))
+
+		for i, item := range value {
+			ret[i] = maskString(rules, item)
+		}
+
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(value))
+
+		for i, item := range value {
+			ret[i] = maskString(rules, fmt.Sprintf("%v", item))
+		}
+
+		return ret
+	case map[string]string:
+		ret := make(map[string]string, len(value))
+
+		for k, item := range value {
+			ret[k] = maskString(rules, item)
+		}
+
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(value))
+
+		for k, item := range value {
+			ret[k] = maskString(rules, fmt.Sprintf("%v", item))
+		}
+
+		return ret
+	default:
+		return maskString(rules, fmt.Sprintf("%v", v))
+	}
+}
+
+// maskNested masks the keys of a nested map, a value without rules is returned as is
+func maskNested(path string, v interface{}, original interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]string:
+		ret := make(map[string]string, len(value))
+
+		for k, item := range value {
+			key := strings.ReplaceAll(strings.ToLower(k), "_", "-")
+
+			if prev, found := lookup(original, k); found && prev == item {
+				ret[k] = item
+				continue
+			}
+
+			ret[k] = fmt.Sprintf("%v", maskField(path+"."+key, key, item, nil))
+		}
+
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(value))
+
+		for k, item := range value {
+			key := strings.ReplaceAll(strings.ToLower(k), "_", "-")
+
+			prev, found := lookup(original, k)
+
+			if found && reflect.DeepEqual(prev, item) {
+				ret[k] = item
+				continue
+			}
+
+			ret[k] = maskField(path+"."+key, key, item, prev)
+		}
+
+		return ret
+	default:
+		return v
+	}
+}
+
+func lookup(m interface{}, key string) (interface{}, bool) {
+	switch value := m.(type) {
+	case map[string]string:
+		ret, found := value[key]
+		return ret, found
+	case map[string]interface{}:
+		ret, found := value[key]
+		return ret, found
+	default:
+		return nil, false
+	}
+}
+
+func maskString(rules []*config.MaskRule, value string) string {
+	for _, rule := range rules {
+		value = maskValue(rule, value)
+	}
+
+	return value
+}
+
+func maskValue(rule *config.MaskRule, value string) string {
+	if len(value) == 0 {
+		return value
+	}
+
+	switch rule.Strategy {
+	case config.MaskStrategyLast:
+		return maskLast(value, rule.Keep)
+	case config.MaskStrategyHash:
+		sum := sha256.Sum256([]byte(rule.Salt + value))
+		return hex.EncodeToString(sum[:])
+	case config.MaskStrategyEmail:
+		return maskEmail(value)
+	case config.MaskStrategyIP:
+		return maskIP(value, rule.Keep)
+	case config.MaskStrategyRegex:
+		return rule.Regexp().ReplaceAllString(value, replacement(rule))
+	default:
+		return replacement(rule)
+	}
+}
+
+func replacement(rule *config.MaskRule) string {
+	if len(rule.Replace) > 0 {
+		return rule.Replace
+	}
+
+	return maskChar
+}
+
+// maskLast keeps the last characters of value, all of them are masked when value is not longer than them
+func maskLast(value string, keep int) string {
+	if keep == 0 {
+		keep = 4
+	}
+
+	chars := []rune(value)
+
+	if len(chars) <= keep {
+		return strings.Repeat(maskChar, len(chars))
+	}
+
+	return strings.Repeat(maskChar, len(chars)-keep) + string(chars[len(chars)-keep:])
+}
+
+func maskEmail(value string) string {
+	user, domain, found := strings.Cut(value, "@")
+
+	if !found || len(user) == 0 || len(domain) == 0 {
+		return strings.Repeat(maskChar, len([]rune(value)))
+	}
+
+	chars := []rune(user)
+
+	return string(chars[0]) + strings.Repeat(maskChar, len(chars)-1) + "@" + domain
+}
+
+// maskIP keeps the first octets of IPv4 or groups of IPv6, other values are fully masked
+func maskIP(value string, keep int) string {
+	ip := net.ParseIP(strings.TrimSpace(value))
+
+	if ip == nil {
+		return strings.Repeat(maskChar, len([]rune(value)))
+	}
+
+	sep := "."
+	parts := make([]string, 0, net.IPv6len/2)
+
+	if v4 := ip.To4(); v4 != nil {
+		for _, octet := range v4 {
+			parts = append(parts, fmt.Sprintf("%d", octet))
+		}
+	} else {
+		sep = ":"
+
+		for i := 0; i < net.IPv6len; i += 2 {
+			parts = append(parts, fmt.Sprintf("%x", uint16(ip[i])<<8|uint16(ip[i+1])))
+		}
+	}
+
+	if keep == 0 {
+		keep = len(parts) / 2
+	}
+
+	for i := keep; i < len(parts); i++ {
+		parts[i] = maskChar
+	}
+
+	return strings.Join(parts, sep)
+}
@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"testing"
+
+	"data2parquet/pkg/config"
+)
+
+func setMasks(t *testing.T, fields string, rules ...*config.MaskRule) {
+	cfg := &config.Config{MaskFields: fields, MaskRules: rules}
+	cfg.SetDefaults()
+
+	err := cfg.CheckMasks()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		config.MaskFields = make(map[string]any)
+		(&config.Config{}).SetDefaults()
+	})
+}
+
+func maskedLog(userId string) *Log {
+	return NewLog(map[string]interface{}{
+		"time":         "2024-06-01T10:00:00Z",
+		"message":      "card 4111-1111-1111-1111 declined",
+		"user_id":      userId,
+		"session-id":   "session-12345678",
+		"person-id":    "john.doe@example.com",
+		"device-id":    "device",
+		"trace-ip":     []interface{}{"10.1.2.3", "2001:db8:0:1:2:3:4:5"},
+		"args":         map[string]interface{}{"token": "secret", "host": "server"},
+		"details":      map[string]interface{}{"card": "4111111111111111"},
+		"custom-field": "custom",
+	}).(*Log)
+}
+
+func TestMask(t *testing.T) {
+	setMasks(t, "device-id,custom-field",
+		&config.MaskRule{Field: "user-id", Strategy: config.MaskStrategyHash, Salt: "salt"},
+		&config.MaskRule{Field: "session-id", Strategy: config.MaskStrategyLast},
+		&config.MaskRule{Field: "person-id", Strategy: config.MaskStrategyEmail},
+		&config.MaskRule{Field: "trace-ip", Strategy: config.MaskStrategyIP},
+		&config.MaskRule{Field: "message", Strategy: config.MaskStrategyRegex, Pattern: `\d{4}-\d{4}-\d{4}-(\d{4})`, Replace: "****-$1"},
+		&config.MaskRule{Field: "args.token", Strategy: config.MaskStrategyRedact, Replace: "[redacted]"},
+		&config.MaskRule{Field: "card", Strategy: config.MaskStrategyLast, Keep: 2},
+	)
+
+	log := maskedLog("user-1")
+
+	tests := map[string][2]string{
+		"message":      {log.Message, "card ****-1111 declined"},
+		"session-id":   {*log.SessionId, "************5678"},
+		"person-id":    {*log.PersonId, "j*******@example.com"},
+		"device-id":    {*log.DeviceId, "*"},
+		"ipv4":         {log.TraceIP[0], "10.1.*.*"},
+		"ipv6":         {log.TraceIP[1], "2001:db8:0:1:*:*:*:*"},
+		"args.token":   {log.Args["token"], "[redacted]"},
+		"args.host":    {log.Args["host"], "server"},
+		"details.card": {log.Args["details-card"], "**************11"},
+		"custom-field": {log.ExtraFields["custom-field"], "*"},
+	}
+
+	for name, test := range tests {
+		if test[0] != test[1] {
+			t.Errorf("%s: expected %q, got %q", name, test[1], test[0])
+		}
+	}
+
+	if len(*log.UserId) != 64 || *log.UserId == "user-1" {
+		t.Errorf("User ID is not hashed: %s", *log.UserId)
+	}
+
+	if *maskedLog("user-1").UserId != *log.UserId || *maskedLog("user-2").UserId == *log.UserId {
+		t.Error("Hashed user IDs must be the same only for the same user")
+	}
+}
+
+func TestMaskRebuild(t *testing.T) {
+	setMasks(t, "",
+		&config.MaskRule{Field: "user-id", Strategy: config.MaskStrategyHash, Salt: "salt"},
+		&config.MaskRule{Field: "token", Strategy: config.MaskStrategyRedact},
+	)
+
+	log := maskedLog("user-1")
+	data := log.Fields()
+	data["args"].(map[string]string)["token"] = "new-secret"
+	data["correlation-id"] = "abc"
+
+	rebuilt := Rebuild(config.RecordTypeLog, log, data).(*Log)
+
+	if *rebuilt.UserId != *log.UserId {
+		t.Errorf("Hashed user ID changed on rebuild, %s != %s", *rebuilt.UserId, *log.UserId)
+	}
+
+	if rebuilt.Args["token"] != "*" || *rebuilt.CorrelationId != "abc" {
+		t.Errorf("Unexpected rebuilt record %s", rebuilt.ToString())
+	}
+}
+
+func TestMaskRules(t *testing.T) {
+	rules := []*config.MaskRule{
+		{Field: "user-id", Strategy: "unknown"},
+		{Field: "user-id", Strategy: config.MaskStrategyHash},
+		{Field: "message", Strategy: config.MaskStrategyRegex},
+		{Field: "message", Strategy: config.MaskStrategyRegex, Pattern: "("},
+		{Strategy: config.MaskStrategyRedact},
+	}
+
+	for _, rule := range rules {
+		cfg := &config.Config{MaskRules: []*config.MaskRule{rule}}
+
+		if cfg.CheckMasks() == nil {
+			t.Errorf("Mask rule %+v must be invalid", rule)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/layout"
+)
+
+const undefinedValue = "undefined"
+
+// Path renders `WriterPathTemplate` for a record, `{id}` and `{hash}` are kept to be filled by the writer. Records with
+// the same path are written to the same file.
+func Path(record Record) string {
+	info := record.GetInfo()
+	tm := record.EventTime()
+	var fields map[string]interface{}
+
+	return config.PathTemplate.Render(func(name string, arg string) (string, bool) {
+		if name != layout.Field {
+			return resolveInfo(info, tm, name)
+		}
+
+		if fields == nil {
+			fields = record.Fields()
+		}
+
+		return fieldValue(fields, arg), true
+	})
+}
+
+// target renders `WriterPathTemplate` with record info only, record fields not on the key are `undefined`
+func target(info RecordInfo, tm time.Time, id string, hash string) string {
+	path := config.PathTemplate.Render(func(name string, arg string) (string, bool) {
+		if name == layout.Field {
+			if v, found := info.Value(arg); found {
+				return v, true
+			}
+
+			return undefinedValue, true
+		}
+
+		return resolveInfo(info, tm, name)
+	})
+
+	return layout.Fill(path, id, hash)
+}
+
+func resolveInfo(info RecordInfo, tm time.Time, name string) (string, bool) {
+	tm = tm.UTC()
+
+	switch name {
+	case layout.Capability:
+		return info.Capability(), true
+	case layout.Domain:
+		return info.Domain(), true
+	case layout.Service:
+		return info.Service(), true
+	case layout.Application:
+		return info.Application(), true
+	case layout.Key:
+		return info.Key(), true
+	case layout.RecordType:
+		return info.RecordType(), true
+	case layout.Year:
+		return fmt.Sprintf("%04d", tm.Year()), true
+	case layout.Month:
+		return fmt.Sprintf("%02d", tm.Month()), true
+	case layout.Day:
+		return fmt.Sprintf("%02d", tm.Day()), true
+	case layout.Hour:
+		return fmt.Sprintf("%02d", tm.Hour()), true
+	case layout.Minute:
+		return fmt.Sprintf("%02d", tm.Minute()), true
+	case layout.Date:
+		return tm.Format(time.DateOnly), true
+	default:
+		return "", false
+	}
+}
+
+// fieldValue returns a field of `Fields`, nested map keys are set as `args.<key>`
+func fieldValue(fields map[string]interface{}, name string) string {
+	if ret, found := lookupField(fields, name); found {
+		return ret
+	}
+
+	return undefinedValue
+}
+
+// lookupField returns a field of `Fields` and true when it is set and not empty
+func lookupField(fields map[string]interface{}, name string) (string, bool) {
+	v, found := fields[name]
+
+	if !found {
+		if parent, key, nested := strings.Cut(name, "."); nested {
+			switch m := fields[parent].(type) {
+			case map[string]string:
+				v, found = m[key]
+			case map[string]interface{}:
+				v, found = m[key]
+			}
+		}
+	}
+
+	if !found || v == nil {
+		return "", false
+	}
+
+	ret := fmt.Sprintf("%v", v)
+
+	return ret, len(ret) > 0
+}
@@ -28,6 +28,8 @@ type Record interface {
 	ToMsgPack() []byte
 	FromMsgPack(data []byte) error
 	GetData() map[string]interface{}
+	Fields() map[string]interface{}
+	EventTime() time.Time
 	UpdateInfo()
 }
 
@@ -37,11 +39,14 @@ type RecordInfo interface {
 	Service() string
 	Domain() string
 	Capability() string
-	Target(id string, hash string) string
+	Application() string
+	Value(name string) (string, bool)
+	Target(partition time.Time, id string, hash string) string
 }
 
+// NewRecordInfoFromKey returns the record info of a key composed from `RecordKey`, info not on the key is `undefined`
 func NewRecordInfoFromKey(recordType string, key string) RecordInfo {
-	if strings.Contains(key, config.RecordTypeDynamic) {
+	if strings.ToLower(recordType) == config.RecordTypeDynamic {
 		return NewDynamicInfoFromKey(key)
 	}
 
@@ -60,6 +65,19 @@ func NewRecord(recordType string, data map[string]interface{}) Record {
 	return ret
 }
 
+// Rebuild decodes the fields of a record changed by processors or replay transforms to a new record. Fields of original
+// were masked when it was decoded, so only values that differ from them are masked, a hash is not hashed again.
+func Rebuild(recordType string, original Record, data map[string]interface{}) Record {
+	if log, ok := original.(*Log); ok && strings.ToLower(recordType) != config.RecordTypeDynamic {
+		ret := newLog()
+		ret.decode(data, log.Fields())
+
+		return ret
+	}
+
+	return NewRecord(recordType, data)
+}
+
 func NewObj(t string) Record {
 	switch t {
 	case config.RecordTypeDynamic:
@@ -104,6 +122,11 @@ func GetStringP(s interface{}) *string {
 	return &ret
 }
 
+// Partition returns the hour partition of an event time, in UTC
+func Partition(tm time.Time) time.Time {
+	return tm.UTC().Truncate(time.Hour)
+}
+
 func TryParseRecordTime(v any) time.Time {
 	ret := time.Now()
 
@@ -2,10 +2,12 @@ package handler
 
 import (
 	"context"
+	"data2parquet/pkg/buffer"
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
 	"data2parquet/pkg/receiver"
 	"encoding/json"
+	"errors"
 
 	"data2parquet/pkg/logger" //"log/slog"
 
@@ -66,11 +68,18 @@ func (h *LogHandler) Write(ctx *gin.Context) {
 
 	slog.Debug("Writing record", "record", record.ToString(), "module", "handler", "function", "Write")
 
-	err = h.rcv.Write(record)
+	err = h.rcv.WriteContext(ctx.Request.Context(), record)
 
 	if err != nil {
 		slog.Error("Error writing record", "error", err, "module", "handler", "function", "Write")
-		ctx.JSON(http.StatusInternalServerError, gin.H{
+
+		status := http.StatusInternalServerError
+
+		if errors.Is(err, buffer.ErrBufferFull) {
+			status = http.StatusServiceUnavailable
+		}
+
+		ctx.JSON(status, gin.H{
 			"record":    record.ToString(),
 			"error":     err.Error(),
 			"timestamp": time.Now().Unix(),
@@ -108,6 +117,82 @@ func (h *LogHandler) Flush(ctx *gin.Context) {
 	})
 }
 
+func (h *LogHandler) GetDLQ(ctx *gin.Context) {
+	start := time.Now()
+
+	slog.Debug("Get DLQ", "module", "handler", "function", "GetDLQ")
+
+	dlq, err := h.rcv.GetDLQ()
+
+	if err != nil {
+		slog.Error("Error getting DLQ", "error", err, "module", "handler", "function", "GetDLQ")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":     err.Error(),
+			"timestamp": time.Now().Unix(),
+			"elapsed":   time.Since(start).String(),
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"dlq":       dlq,
+		"timestamp": time.Now().Unix(),
+		"elapsed":   time.Since(start).String(),
+	})
+}
+
+func (h *LogHandler) ReplayDLQ(ctx *gin.Context) {
+	start := time.Now()
+
+	slog.Debug("Replay DLQ", "module", "handler", "function", "ReplayDLQ")
+
+	body, err := ctx.GetRawData()
+
+	if err != nil {
+		slog.Error("Error reading request body", "error", err, "module", "handler", "function", "ReplayDLQ")
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error":     err.Error(),
+			"timestamp": time.Now().Unix(),
+			"elapsed":   time.Since(start).String(),
+		})
+		return
+	}
+
+	request := &receiver.ReplayRequest{}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, request)
+
+		if err != nil {
+			slog.Debug("Error unmarshalling request body", "error", err, "module", "handler", "function", "ReplayDLQ")
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error":     err.Error(),
+				"timestamp": time.Now().Unix(),
+				"elapsed":   time.Since(start).String(),
+			})
+			return
+		}
+	}
+
+	result, err := h.rcv.ReplayDLQ(request.Keys, request.MakeTransform(h.config.RecordType))
+
+	if err != nil {
+		slog.Error("Error replaying DLQ", "error", err, "module", "handler", "function", "ReplayDLQ")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error":     err.Error(),
+			"timestamp": time.Now().Unix(),
+			"elapsed":   time.Since(start).String(),
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"result":    result,
+		"timestamp": time.Now().Unix(),
+		"elapsed":   time.Since(start).String(),
+	})
+}
+
 func (h *LogHandler) Healthcheck(ctx *gin.Context) {
 	start := time.Now()
 
@@ -0,0 +1,186 @@
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Placeholders of path templates, written as `{name}`, record fields as `{field:<name>}`
+const Capability = "capability"
+const Domain = "domain"
+const Service = "service"
+const Application = "application"
+const Key = "key"
+const RecordType = "record_type"
+const Year = "year"
+const Month = "month"
+const Day = "day"
+const Hour = "hour"
+const Minute = "minute"
+const Date = "date"
+const ID = "id"
+const Hash = "hash"
+const Field = "field"
+
+var Placeholders = map[string]int{
+	Capability:  1,
+	Domain:      2,
+	Service:     3,
+	Application: 4,
+	Key:         5,
+	RecordType:  6,
+	Year:        7,
+	Month:       8,
+	Day:         9,
+	Hour:        10,
+	Minute:      11,
+	Date:        12,
+	ID:          13,
+	Hash:        14,
+	Field:       15,
+}
+
+const Extension = ".parquet"
+
+// Resolver returns the value of a placeholder, arg is the field name of `{field:<name>}`. A placeholder without value is
+// kept on the path.
+type Resolver func(name string, arg string) (string, bool)
+
+type part struct {
+	literal string
+	name    string
+	arg     string
+}
+
+// Template is a parsed path template, e.g. `env={field:env}/dt={date}/{id}.parquet`
+type Template struct {
+	raw   string
+	parts []*part
+}
+
+// Parse checks a path template: placeholders must be known and `{id}` is required so each file gets its own path.
+// Paths are relative to the writer output and end with `.parquet`.
+func Parse(raw string) (*Template, error) {
+	ret := &Template{raw: raw, parts: make([]*part, 0)}
+	rest := raw
+	hasID := false
+
+	for len(rest) > 0 {
+		open := strings.IndexAny(rest, "{}")
+
+		if open < 0 {
+			ret.parts = append(ret.parts, &part{literal: rest})
+			break
+		}
+
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unexpected '}' at %d", len(raw)-len(rest)+open)
+		}
+
+		if open > 0 {
+			ret.parts = append(ret.parts, &part{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("unclosed placeholder at %d", len(raw)-len(rest)+open)
+		}
+
+		name, arg, _ := strings.Cut(rest[open+1:open+1+end], ":")
+
+		if _, found := Placeholders[name]; !found {
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+
+		if (name == Field) != (len(arg) > 0) {
+			return nil, fmt.Errorf("invalid placeholder {%s}, use {field:<name>} for record fields", rest[open+1:open+1+end])
+		}
+
+		hasID = hasID || name == ID
+		ret.parts = append(ret.parts, &part{name: name, arg: arg})
+		rest = rest[open+end+2:]
+	}
+
+	if !hasID {
+		return nil, errors.New("path template without {id}, files would overwrite each other")
+	}
+
+	if strings.HasPrefix(raw, "/") || strings.Contains("/"+raw+"/", "/../") {
+		return nil, errors.New("path template must be relative to the writer output")
+	}
+
+	if !strings.HasSuffix(raw, Extension) {
+		return nil, fmt.Errorf("path template must end with %s", Extension)
+	}
+
+	return ret, nil
+}
+
+// MustParse parses a template known to be valid, it panics otherwise
+func MustParse(raw string) *Template {
+	ret, err := Parse(raw)
+
+	if err != nil {
+		panic(fmt.Sprintf("invalid path template %q: %s", raw, err))
+	}
+
+	return ret
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+// HasField returns true when the template has record field placeholders
+func (t *Template) HasField() bool {
+	for _, p := range t.parts {
+		if p.name == Field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Render returns the path with placeholders replaced by resolver values, values are cleaned so they don't add path
+// segments or placeholders
+func (t *Template) Render(resolver Resolver) string {
+	sb := strings.Builder{}
+
+	for _, p := range t.parts {
+		if len(p.name) == 0 {
+			sb.WriteString(p.literal)
+			continue
+		}
+
+		value, found := resolver(p.name, p.arg)
+
+		if !found {
+			sb.WriteString("{" + p.name)
+
+			if len(p.arg) > 0 {
+				sb.WriteString(":" + p.arg)
+			}
+
+			sb.WriteString("}")
+			continue
+		}
+
+		sb.WriteString(clean(value))
+	}
+
+	return sb.String()
+}
+
+// Fill replaces `{id}` and `{hash}` of a rendered path
+func Fill(path string, id string, hash string) string {
+	return strings.NewReplacer("{"+ID+"}", clean(id), "{"+Hash+"}", clean(hash)).Replace(path)
+}
+
+var cleaner = strings.NewReplacer("/", "_", "\\", "_", "{", "_", "}", "_", "..", "_")
+
+func clean(value string) string {
+	return cleaner.Replace(value)
+}
@@ -0,0 +1,65 @@
+package layout
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	invalid := []string{
+		"{capability}/{key}.parquet",
+		"{id}/{unknown}.parquet",
+		"{id}/{field}.parquet",
+		"{id}/{date:x}.parquet",
+		"{id}/{hour.parquet",
+		"{id}/hour}.parquet",
+		"/{capability}/{id}.parquet",
+		"../{capability}/{id}.parquet",
+		"{capability}/{id}.json",
+	}
+
+	for _, raw := range invalid {
+		if _, err := Parse(raw); err == nil {
+			t.Errorf("Template %q must be invalid", raw)
+		}
+	}
+
+	tmpl, err := Parse("env={field:env}/dt={date}/{id}{hash}.parquet")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tmpl.HasField() || MustParse("{date}/{id}.parquet").HasField() {
+		t.Error("Unexpected HasField result")
+	}
+}
+
+func TestRender(t *testing.T) {
+	tmpl := MustParse("env={field:env}/{service}/dt={date}/{id}-{key}{hash}.parquet")
+	values := map[string]string{
+		"env":   "prod/../eu",
+		Service: "{service}",
+		Date:    "2024-06-01",
+		Key:     "capability-domain",
+	}
+
+	path := tmpl.Render(func(name string, arg string) (string, bool) {
+		if name == Field {
+			name = arg
+		}
+
+		v, found := values[name]
+
+		return v, found
+	})
+
+	if path != "env=prod___eu/_service_/dt=2024-06-01/{id}-capability-domain{hash}.parquet" {
+		t.Errorf("Unexpected rendered path %s", path)
+	}
+
+	path = Fill(path, "01J0ID", "-abc/")
+
+	if path != "env=prod___eu/_service_/dt=2024-06-01/01J0ID-capability-domain-abc_.parquet" {
+		t.Errorf("Unexpected filled path %s", path)
+	}
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"data2parquet/pkg/logger" // "log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var slog = logger.GetLogger()
+
+const Namespace = "data2parquet"
+
+// Registry holds all collectors of the pipeline, it is exposed by `Handler` and not shared with the default registry so
+// an embedding process (e.g. fluent-bit plugin) doesn't mix its own metrics with ours
+var Registry = prometheus.NewRegistry()
+
+var (
+	RecordsReceived = counterVec("records_received_total", "Records received by key", "key")
+	RecordsDropped  = counterVec("records_dropped_total", "Records dropped by processors, by processor type", "processor")
+	PIIDetections   = counterVec("pii_detections_total", "PII values scrubbed from records, by key and detector", "key", "detector")
+	BufferLength    = gaugeVec("buffer_records", "Records on buffer by key, as seen by this instance", "key")
+
+	Flushes        = counterVec("flushes_total", "Flushes that wrote data, by flush reason", "reason")
+	FlushesSkipped = counterVec("flushes_skipped_total", "Flushes skipped because key was already flushing, locked or empty, by flush reason", "reason")
+	FlushDuration  = histogramVec("flush_duration_seconds", "Duration of flushes that wrote data, by flush reason", "reason")
+	FlushedRecords = counterVec("flushed_records_total", "Records flushed by key", "key")
+
+	ConversionDuration = histogram("conversion_duration_seconds", "Duration of record conversion to parquet")
+	ConversionErrors   = counterVec("conversion_errors_total", "Records failed on conversion by key", "key")
+	SchemaVersion      = gaugeVec("schema_version", "Registered schema version of dynamic records by key", "key")
+
+	WriterBytes    = counterVec("writer_bytes_total", "Bytes written by writer type", "writer")
+	WriterDuration = histogramVec("writer_duration_seconds", "Duration of writes by writer type", "writer")
+	WriterErrors   = counterVec("writer_errors_total", "Failed writes by writer type", "writer")
+
+	BufferDuration = histogramVec("buffer_operation_duration_seconds", "Duration of buffer operations by buffer type and operation", "buffer", "operation")
+	BufferErrors   = counterVec("buffer_errors_total", "Failed buffer operations by buffer type and operation", "buffer", "operation")
+	LockContention = counterVec("lock_contention_total", "Flush locks held by another instance, by key", "key")
+	LocksLost      = counterVec("locks_lost_total", "Flush locks lost during a write, by key", "key")
+
+	DLQRecords    = counterVec("dlq_records_total", "Records pushed to DLQ by failure stage", "stage")
+	DLQDepth      = gauge("dlq_depth", "Records on DLQ, as seen by this instance")
+	RecoveryDepth = gauge("recovery_depth", "Batches waiting on recovery, as seen by this instance")
+	PoisonBatches = counter("poison_batches_total", "Recovery batches moved to poison store after exhausting attempts")
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func counterVec(name string, help string, labels ...string) *prometheus.CounterVec {
+	ret := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: Namespace, Name: name, Help: help}, labels)
+	Registry.MustRegister(ret)
+	return ret
+}
+
+func counter(name string, help string) prometheus.Counter {
+	ret := prometheus.NewCounter(prometheus.CounterOpts{Namespace: Namespace, Name: name, Help: help})
+	Registry.MustRegister(ret)
+	return ret
+}
+
+func gaugeVec(name string, help string, labels ...string) *prometheus.GaugeVec {
+	ret := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: Namespace, Name: name, Help: help}, labels)
+	Registry.MustRegister(ret)
+	return ret
+}
+
+func gauge(name string, help string) prometheus.Gauge {
+	ret := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: Namespace, Name: name, Help: help})
+	Registry.MustRegister(ret)
+	return ret
+}
+
+func histogramVec(name string, help string, labels ...string) *prometheus.HistogramVec {
+	ret := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: Namespace, Name: name, Help: help, Buckets: prometheus.DefBuckets}, labels)
+	Registry.MustRegister(ret)
+	return ret
+}
+
+func histogram(name string, help string) prometheus.Histogram {
+	ret := prometheus.NewHistogram(prometheus.HistogramOpts{Namespace: Namespace, Name: name, Help: help, Buckets: prometheus.DefBuckets})
+	Registry.MustRegister(ret)
+	return ret
+}
+
+// Since observes the duration since start, to be used with defer
+func Since(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// ObserveBuffer records the duration of a buffer operation and counts it as failed when err is not nil
+func ObserveBuffer(bufferType string, operation string, start time.Time, err error) {
+	BufferDuration.WithLabelValues(bufferType, operation).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		BufferErrors.WithLabelValues(bufferType, operation).Inc()
+	}
+}
+
+// ObserveWriter records a write of size bytes, only successful writes are counted on bytes written
+func ObserveWriter(writerType string, size int, start time.Time, err error) {
+	WriterDuration.WithLabelValues(writerType).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		WriterErrors.WithLabelValues(writerType).Inc()
+		return
+	}
+
+	WriterBytes.WithLabelValues(writerType).Add(float64(size))
+}
+
+// Handler returns the HTTP handler of the metrics registry in Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve starts a standalone metrics listener on address with `/metrics` route, it is used where there is no HTTP server
+// of our own (e.g. fluent-bit plugin). The server is returned to be shutdown by caller.
+func Serve(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	srv := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+		slog.Info("Starting metrics listener", "address", address, "module", "metrics", "function", "Serve")
+		err := srv.ListenAndServe()
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error on metrics listener", "error", err, "address", address, "module", "metrics", "function", "Serve")
+		}
+	}()
+
+	return srv
+}
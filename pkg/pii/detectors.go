@@ -0,0 +1,193 @@
+package pii
+
+import (
+	"regexp"
+	"strings"
+
+	"data2parquet/pkg/config"
+)
+
+// detector replaces the matches of its pattern with a typed placeholder, matches not accepted by valid (e.g. numbers
+// failing a check digit) are kept
+type detector struct {
+	name        string
+	placeholder string
+	rgx         *regexp.Regexp
+	valid       func(match string) bool
+	prefix      *regexp.Regexp
+}
+
+// builtins are run in this order, bearer tokens and emails first so their digits are not taken as numbers
+var builtins = []string{
+	config.PIIDetectorBearerToken,
+	config.PIIDetectorEmail,
+	config.PIIDetectorCreditCard,
+	config.PIIDetectorCPF,
+	config.PIIDetectorSSN,
+}
+
+func newBuiltin(name string) *detector {
+	switch name {
+	case config.PIIDetectorCreditCard:
+		return &detector{
+			name:        name,
+			placeholder: "[CREDIT_CARD]",
+			rgx:         regexp.MustCompile(`\b(?:\d{13,19}|\d{4}(?:[ -]\d{4}){3}|\d{4}[ -]\d{6}[ -]\d{5})\b`),
+			valid:       luhn,
+		}
+	case config.PIIDetectorEmail:
+		return &detector{
+			name:        name,
+			placeholder: "[EMAIL]",
+			rgx:         regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+		}
+	case config.PIIDetectorCPF:
+		return &detector{
+			name:        name,
+			placeholder: "[CPF]",
+			rgx:         regexp.MustCompile(`\b\d{3}\.?\d{3}\.?\d{3}-?\d{2}\b`),
+			valid:       cpf,
+		}
+	case config.PIIDetectorSSN:
+		return &detector{
+			name:        name,
+			placeholder: "[SSN]",
+			rgx:         regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+			valid:       ssn,
+		}
+	case config.PIIDetectorBearerToken:
+		return &detector{
+			name:        name,
+			placeholder: "[BEARER_TOKEN]",
+			rgx:         regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`),
+			prefix:      regexp.MustCompile(`(?i)^bearer\s+`),
+		}
+	default:
+		return nil
+	}
+}
+
+func newPattern(p *config.PIIPattern) (*detector, error) {
+	rgx, err := regexp.Compile(p.Pattern)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &detector{
+		name:        p.Name,
+		placeholder: "[" + strings.ToUpper(strings.ReplaceAll(p.Name, "-", "_")) + "]",
+		rgx:         rgx,
+	}, nil
+}
+
+// scrub returns value with matches replaced and the number of matches replaced
+func (d *detector) scrub(value string) (string, int) {
+	count := 0
+
+	ret := d.rgx.ReplaceAllStringFunc(value, func(match string) string {
+		if d.valid != nil && !d.valid(match) {
+			return match
+		}
+
+		count++
+
+		// keeps the auth scheme, so the placeholder reads as `Bearer [BEARER_TOKEN]`
+		if d.prefix != nil {
+			return d.prefix.FindString(match) + d.placeholder
+		}
+
+		return d.placeholder
+	})
+
+	return ret, count
+}
+
+func digits(value string) []int {
+	ret := make([]int, 0, len(value))
+
+	for _, c := range value {
+		if c >= '0' && c <= '9' {
+			ret = append(ret, int(c-'0'))
+		}
+	}
+
+	return ret
+}
+
+// luhn checks the check digit of card numbers
+func luhn(value string) bool {
+	nums := digits(value)
+
+	if len(nums) < 13 || len(nums) > 19 {
+		return false
+	}
+
+	sum := 0
+
+	for i := len(nums) - 1; i >= 0; i-- {
+		n := nums[i]
+
+		if (len(nums)-i)%2 == 0 {
+			n *= 2
+
+			if n > 9 {
+				n -= 9
+			}
+		}
+
+		sum += n
+	}
+
+	return sum%10 == 0
+}
+
+// cpf checks the two check digits of a Brazilian CPF, numbers with all digits equal are valid by the algorithm but not
+// issued
+func cpf(value string) bool {
+	nums := digits(value)
+
+	if len(nums) != 11 {
+		return false
+	}
+
+	same := true
+
+	for _, n := range nums[1:] {
+		if n != nums[0] {
+			same = false
+			break
+		}
+	}
+
+	if same {
+		return false
+	}
+
+	for pos := 9; pos <= 10; pos++ {
+		sum := 0
+
+		for i := 0; i < pos; i++ {
+			sum += nums[i] * (pos + 1 - i)
+		}
+
+		check := sum * 10 % 11
+
+		if check == 10 {
+			check = 0
+		}
+
+		if check != nums[pos] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ssn rejects numbers never issued as US SSN: area 000, 666 or 9xx, group 00 and serial 0000
+func ssn(value string) bool {
+	area, group, serial := value[0:3], value[4:6], value[7:11]
+
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
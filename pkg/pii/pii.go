@@ -0,0 +1,213 @@
+package pii
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/logger" // "log/slog"
+	"data2parquet/pkg/metrics"
+)
+
+var slog = logger.GetLogger()
+
+// Scrubber runs PII detectors on string fields of each record before it is pushed to buffer, replacing matches with
+// typed placeholders
+type Scrubber struct {
+	recordType string
+	detectors  []*detector
+	fields     map[string]bool
+	keys       map[string]bool
+}
+
+func New(cfg *config.Config) (*Scrubber, error) {
+	ret := &Scrubber{
+		recordType: cfg.RecordType,
+		detectors:  make([]*detector, 0),
+		fields:     make(map[string]bool),
+		keys:       make(map[string]bool),
+	}
+
+	rgxList := regexp.MustCompile(`;|,| |\|`)
+	enabled := make(map[string]bool)
+
+	for _, name := range rgxList.Split(strings.ToLower(cfg.PIIDetectors), -1) {
+		if len(name) == 0 {
+			continue
+		}
+
+		if _, found := config.PIIDetectors[name]; !found {
+			return nil, fmt.Errorf("unknown PII detector %q", name)
+		}
+
+		enabled[name] = true
+	}
+
+	for _, name := range builtins {
+		if enabled[name] || enabled[config.PIIDetectorAll] {
+			ret.detectors = append(ret.detectors, newBuiltin(name))
+		}
+	}
+
+	for i, p := range cfg.PIIPatterns {
+		if p == nil || len(p.Name) == 0 || len(p.Pattern) == 0 {
+			return nil, fmt.Errorf("PII pattern %d without name or pattern", i)
+		}
+
+		d, err := newPattern(p)
+
+		if err != nil {
+			return nil, fmt.Errorf("PII pattern %d (%s): %w", i, p.Name, err)
+		}
+
+		ret.detectors = append(ret.detectors, d)
+	}
+
+	for _, field := range rgxList.Split(strings.ToLower(cfg.PIIFields), -1) {
+		if len(field) > 0 {
+			ret.fields[field] = true
+		}
+	}
+
+	// without `PIIFields` the fields composing the record key are not scanned, a scrubbed value would change the key of
+	// the record, moving it to another buffer key and partition
+	if len(ret.fields) == 0 {
+		for _, part := range config.KeyFields(cfg.RecordType) {
+			for _, field := range part.Fields {
+				ret.keys[field] = true
+			}
+		}
+	}
+
+	slog.Debug("PII scrubber created", "detectors", len(ret.detectors), "fields", cfg.PIIFields, "module", "pii", "function", "New")
+
+	return ret, nil
+}
+
+// Scrub returns the record with PII replaced, detections are counted by key and detector. A record without PII is
+// returned as is.
+func (s *Scrubber) Scrub(record domain.Record) domain.Record {
+	if s == nil || len(s.detectors) == 0 {
+		return record
+	}
+
+	data := record.Fields()
+	found := make(map[string]int)
+
+	for k, v := range data {
+		if len(s.fields) > 0 && !s.fields[k] {
+			continue
+		}
+
+		data[k] = s.scrubField(k, v, found)
+	}
+
+	if len(found) == 0 {
+		return record
+	}
+
+	key := record.Key()
+
+	for name, count := range found {
+		metrics.PIIDetections.WithLabelValues(key, name).Add(float64(count))
+	}
+
+	slog.Debug("PII scrubbed", "key", key, "detections", found, "module", "pii", "function", "Scrub")
+
+	return domain.Rebuild(s.recordType, record, data)
+}
+
+// scrubField scrubs a record field skipping record key fields, including nested ones (e.g. `args.tenant`)
+func (s *Scrubber) scrubField(name string, v interface{}, found map[string]int) interface{} {
+	if s.keys[name] {
+		return v
+	}
+
+	switch value := v.(type) {
+	case map[string]string:
+		ret := make(map[string]string, len(value))
+
+		for k, item := range value {
+			if s.keys[name+"."+k] {
+				ret[k] = item
+				continue
+			}
+
+			ret[k] = s.scrubString(item, found)
+		}
+
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(value))
+
+		for k, item := range value {
+			if s.keys[name+"."+k] {
+				ret[k] = item
+				continue
+			}
+
+			ret[k] = s.scrubValue(item, found)
+		}
+
+		return ret
+	default:
+		return s.scrubValue(v, found)
+	}
+}
+
+// scrubValue scrubs strings, string lists and maps (e.g. `args` or nested `Dynamic` data), other values are returned as is
+func (s *Scrubber) scrubValue(v interface{}, found map[string]int) interface{} {
+	switch value := v.(type) {
+	case string:
+		return s.scrubString(value, found)
+	case []string:
+		ret := make([]string, len(value))
+
+		for i, item := range value {
+			ret[i] = s.scrubString(item, found)
+		}
+
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(value))
+
+		for i, item := range value {
+			ret[i] = s.scrubValue(item, found)
+		}
+
+		return ret
+	case map[string]string:
+		ret := make(map[string]string, len(value))
+
+		for k, item := range value {
+			ret[k] = s.scrubString(item, found)
+		}
+
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(value))
+
+		for k, item := range value {
+			ret[k] = s.scrubValue(item, found)
+		}
+
+		return ret
+	default:
+		return v
+	}
+}
+
+func (s *Scrubber) scrubString(value string, found map[string]int) string {
+	for _, d := range s.detectors {
+		var count int
+		value, count = d.scrub(value)
+
+		if count > 0 {
+			found[d.name] += count
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,198 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"data2parquet/pkg/config"
+)
+
+// Rename renames fields, a missing field is skipped
+type Rename struct {
+	fields map[string]string
+}
+
+func NewRename(pc *config.ProcessorConfig) (Processor, error) {
+	if len(pc.Fields) == 0 {
+		return nil, errors.New("fields is empty")
+	}
+
+	return &Rename{fields: pc.Fields}, nil
+}
+
+func (p *Rename) Process(data map[string]interface{}) bool {
+	for from, to := range p.fields {
+		if v, found := data[from]; found {
+			delete(data, from)
+			data[to] = v
+		}
+	}
+
+	return true
+}
+
+// Add sets static fields, replacing current values
+type Add struct {
+	fields map[string]string
+}
+
+func NewAdd(pc *config.ProcessorConfig) (Processor, error) {
+	if len(pc.Fields) == 0 {
+		return nil, errors.New("fields is empty")
+	}
+
+	return &Add{fields: pc.Fields}, nil
+}
+
+func (p *Add) Process(data map[string]interface{}) bool {
+	for k, v := range p.fields {
+		data[k] = v
+	}
+
+	return true
+}
+
+// Copy sets a field value on target field, when move is set the source field is removed
+type Copy struct {
+	field  string
+	target string
+	move   bool
+}
+
+func NewCopy(pc *config.ProcessorConfig) (Processor, error) {
+	return newCopy(pc, false)
+}
+
+func NewMove(pc *config.ProcessorConfig) (Processor, error) {
+	return newCopy(pc, true)
+}
+
+func newCopy(pc *config.ProcessorConfig, move bool) (Processor, error) {
+	if len(pc.Field) == 0 || len(pc.Target) == 0 {
+		return nil, errors.New("field and target must be set")
+	}
+
+	return &Copy{field: pc.Field, target: pc.Target, move: move}, nil
+}
+
+func (p *Copy) Process(data map[string]interface{}) bool {
+	v, found := data[p.field]
+
+	if !found {
+		return true
+	}
+
+	if p.move {
+		delete(data, p.field)
+	}
+
+	data[p.target] = v
+
+	return true
+}
+
+// ParseJSON parses a JSON object on a string field, its fields are set on the record or on target field
+type ParseJSON struct {
+	field  string
+	target string
+}
+
+func NewParseJSON(pc *config.ProcessorConfig) (Processor, error) {
+	if len(pc.Field) == 0 {
+		return nil, errors.New("field is empty")
+	}
+
+	return &ParseJSON{field: pc.Field, target: pc.Target}, nil
+}
+
+func (p *ParseJSON) Process(data map[string]interface{}) bool {
+	v, found := data[p.field]
+
+	if !found {
+		return true
+	}
+
+	value, ok := v.(string)
+
+	if !ok {
+		return true
+	}
+
+	parsed := make(map[string]interface{})
+	err := json.Unmarshal([]byte(value), &parsed)
+
+	if err != nil {
+		slog.Debug("Field is not a JSON object, skipping", "field", p.field, "error", err, "module", "processor", "function", "ParseJSON.Process")
+		return true
+	}
+
+	delete(data, p.field)
+
+	if len(p.target) > 0 {
+		data[p.target] = parsed
+		return true
+	}
+
+	for k, v := range parsed {
+		data[k] = v
+	}
+
+	return true
+}
+
+// Redact replaces pattern matches on string fields
+type Redact struct {
+	fields  []string
+	pattern *regexp.Regexp
+	replace string
+}
+
+func NewRedact(pc *config.ProcessorConfig) (Processor, error) {
+	if len(pc.Pattern) == 0 {
+		return nil, errors.New("pattern is empty")
+	}
+
+	rgx, err := regexp.Compile(pc.Pattern)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	ret := &Redact{
+		fields:  pc.Values,
+		pattern: rgx,
+		replace: pc.Replace,
+	}
+
+	if len(ret.replace) == 0 {
+		ret.replace = "*"
+	}
+
+	return ret, nil
+}
+
+func (p *Redact) Process(data map[string]interface{}) bool {
+	if len(p.fields) == 0 {
+		for k, v := range data {
+			p.redact(data, k, v)
+		}
+
+		return true
+	}
+
+	for _, k := range p.fields {
+		if v, found := data[k]; found {
+			p.redact(data, k, v)
+		}
+	}
+
+	return true
+}
+
+func (p *Redact) redact(data map[string]interface{}, key string, v interface{}) {
+	if value, ok := v.(string); ok {
+		data[key] = p.pattern.ReplaceAllString(value, p.replace)
+	}
+}
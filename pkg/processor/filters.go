@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+
+	"data2parquet/pkg/config"
+)
+
+// DropLevel drops records with one of the configured levels
+type DropLevel struct {
+	levels map[string]bool
+}
+
+func NewDropLevel(pc *config.ProcessorConfig) (Processor, error) {
+	if len(pc.Values) == 0 {
+		return nil, errors.New("values is empty")
+	}
+
+	ret := &DropLevel{
+		levels: make(map[string]bool, len(pc.Values)),
+	}
+
+	for _, level := range pc.Values {
+		ret.levels[strings.ToLower(level)] = true
+	}
+
+	return ret, nil
+}
+
+func (p *DropLevel) Process(data map[string]interface{}) bool {
+	level, found := data["level"]
+
+	if !found {
+		return true
+	}
+
+	return !p.levels[strings.ToLower(fmt.Sprint(level))]
+}
+
+// DropField drops records with a field value on the configured values, or matching the configured pattern
+type DropField struct {
+	field   string
+	values  map[string]bool
+	pattern *regexp.Regexp
+}
+
+func NewDropField(pc *config.ProcessorConfig) (Processor, error) {
+	if len(pc.Field) == 0 {
+		return nil, errors.New("field is empty")
+	}
+
+	if len(pc.Values) == 0 && len(pc.Pattern) == 0 {
+		return nil, errors.New("values and pattern are empty")
+	}
+
+	ret := &DropField{
+		field:  pc.Field,
+		values: make(map[string]bool, len(pc.Values)),
+	}
+
+	for _, value := range pc.Values {
+		ret.values[value] = true
+	}
+
+	if len(pc.Pattern) > 0 {
+		rgx, err := regexp.Compile(pc.Pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.pattern = rgx
+	}
+
+	return ret, nil
+}
+
+func (p *DropField) Process(data map[string]interface{}) bool {
+	v, found := data[p.field]
+
+	if !found {
+		return true
+	}
+
+	value := fmt.Sprint(v)
+
+	if p.values[value] {
+		return false
+	}
+
+	return p.pattern == nil || !p.pattern.MatchString(value)
+}
+
+// Sample keeps a random fraction of records
+type Sample struct {
+	rate float64
+}
+
+func NewSample(pc *config.ProcessorConfig) (Processor, error) {
+	if pc.Rate <= 0 || pc.Rate > 1 {
+		return nil, fmt.Errorf("rate %v must be greater than 0 and up to 1", pc.Rate)
+	}
+
+	return &Sample{rate: pc.Rate}, nil
+}
+
+func (p *Sample) Process(data map[string]interface{}) bool {
+	return rand.Float64() < p.rate
+}
@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"fmt"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/logger" // "log/slog"
+	"data2parquet/pkg/metrics"
+)
+
+var slog = logger.GetLogger()
+
+// ProcessorDecodeError is the `records_dropped_total` label of records dropped because the fields set by processors
+// can't be decoded to a record
+const ProcessorDecodeError = "decode-error"
+
+// Processor changes the fields of a record, it returns false to drop the record
+type Processor interface {
+	Process(data map[string]interface{}) bool
+}
+
+// Chain runs the configured processors in order on each record before it is pushed to buffer
+type Chain struct {
+	recordType string
+	processors []Processor
+	types      []string
+}
+
+func New(cfg *config.Config) (*Chain, error) {
+	ret := &Chain{
+		recordType: cfg.RecordType,
+		processors: make([]Processor, 0, len(cfg.Processors)),
+		types:      make([]string, 0, len(cfg.Processors)),
+	}
+
+	for i, pc := range cfg.Processors {
+		if pc == nil {
+			continue
+		}
+
+		p, err := newProcessor(pc)
+
+		if err != nil {
+			slog.Error("Error creating processor", "error", err, "index", i, "type", pc.Type, "module", "processor", "function", "New")
+			return nil, fmt.Errorf("processor %d (%s): %w", i, pc.Type, err)
+		}
+
+		ret.processors = append(ret.processors, p)
+		ret.types = append(ret.types, pc.Type)
+	}
+
+	slog.Debug("Processor chain created", "processors", ret.types, "module", "processor", "function", "New")
+
+	return ret, nil
+}
+
+func newProcessor(pc *config.ProcessorConfig) (Processor, error) {
+	switch pc.Type {
+	case config.ProcessorTypeDropLevel:
+		return NewDropLevel(pc)
+	case config.ProcessorTypeDropField:
+		return NewDropField(pc)
+	case config.ProcessorTypeRename:
+		return NewRename(pc)
+	case config.ProcessorTypeAdd:
+		return NewAdd(pc)
+	case config.ProcessorTypeCopy:
+		return NewCopy(pc)
+	case config.ProcessorTypeMove:
+		return NewMove(pc)
+	case config.ProcessorTypeParseJSON:
+		return NewParseJSON(pc)
+	case config.ProcessorTypeSample:
+		return NewSample(pc)
+	case config.ProcessorTypeRedact:
+		return NewRedact(pc)
+	default:
+		return nil, fmt.Errorf("unknown processor type %q", pc.Type)
+	}
+}
+
+// Process runs all processors on the record fields and decodes them to a new record, it returns false when the record
+// is dropped. Without processors the record is returned as is.
+func (c *Chain) Process(record domain.Record) (ret domain.Record, keep bool) {
+	if c == nil || len(c.processors) == 0 {
+		return record, true
+	}
+
+	data := record.Fields()
+
+	for i, p := range c.processors {
+		if !p.Process(data) {
+			slog.Debug("Record dropped by processor", "type", c.types[i], "index", i, "module", "processor", "function", "Process")
+			metrics.RecordsDropped.WithLabelValues(c.types[i]).Inc()
+			return nil, false
+		}
+	}
+
+	// decode asserts types of known fields, a processor may set a value of other type there. The record is dropped, the
+	// original one would skip processors that redact or drop data.
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Error decoding processed record, dropping record", "error", r, "key", record.Key(), "module", "processor", "function", "Process")
+			metrics.RecordsDropped.WithLabelValues(ProcessorDecodeError).Inc()
+			ret = nil
+			keep = false
+		}
+	}()
+
+	return domain.Rebuild(c.recordType, record, data), true
+}
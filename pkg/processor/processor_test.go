@@ -0,0 +1,207 @@
+package processor
+
+import (
+	"testing"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+)
+
+func newLog(data map[string]interface{}) domain.Record {
+	base := map[string]interface{}{
+		"time":                "2024-06-01T10:00:00Z",
+		"level":               "info",
+		"message":             "message",
+		"business-capability": "capability",
+		"business-domain":     "domain",
+		"business-service":    "service",
+		"application-service": "application",
+	}
+
+	for k, v := range data {
+		base[k] = v
+	}
+
+	return domain.NewRecord(config.RecordTypeLog, base)
+}
+
+func newChain(t *testing.T, recordType string, processors ...*config.ProcessorConfig) *Chain {
+	chain, err := New(&config.Config{RecordType: recordType, Processors: processors})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chain
+}
+
+func TestEmptyChain(t *testing.T) {
+	chain := newChain(t, config.RecordTypeLog)
+	record := newLog(nil)
+
+	ret, keep := chain.Process(record)
+
+	if !keep || ret != record {
+		t.Error("Empty chain must return the same record")
+	}
+}
+
+func TestLogFieldsRoundTrip(t *testing.T) {
+	record := newLog(map[string]interface{}{
+		"correlation-id": "abc",
+		"audit":          true,
+		"tags":           []string{"a", "b"},
+		"args":           map[string]string{"host": "server"},
+		"custom":         "value",
+	})
+
+	chain := newChain(t, config.RecordTypeLog, &config.ProcessorConfig{Type: config.ProcessorTypeAdd, Fields: map[string]string{"other": "x"}})
+	ret, keep := chain.Process(record)
+
+	if !keep {
+		t.Fatal("Record must be kept")
+	}
+
+	log := ret.(*domain.Log)
+
+	if log.Key() != record.Key() || log.Message != "message" || log.Level != "info" {
+		t.Errorf("Unexpected record %s", log.ToString())
+	}
+
+	if log.CorrelationId == nil || *log.CorrelationId != "abc" || log.Audit == nil || !*log.Audit {
+		t.Errorf("Optional fields lost: %s", log.ToString())
+	}
+
+	if log.SessionId != nil {
+		t.Errorf("Unset field must stay unset, got %s", *log.SessionId)
+	}
+
+	if len(log.Tags) != 2 || log.Args["host"] != "server" {
+		t.Errorf("Tags or args lost: %s", log.ToString())
+	}
+
+	if log.ExtraFields["custom"] != "value" || log.ExtraFields["other"] != "x" {
+		t.Errorf("Extra fields %v, expected custom and other", log.ExtraFields)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	chain := newChain(t, config.RecordTypeLog,
+		&config.ProcessorConfig{Type: config.ProcessorTypeDropLevel, Values: []string{"DEBUG"}},
+		&config.ProcessorConfig{Type: config.ProcessorTypeDropField, Field: "message", Values: []string{"healthcheck"}, Pattern: "^GET /ping"},
+	)
+
+	cases := []struct {
+		data map[string]interface{}
+		keep bool
+	}{
+		{map[string]interface{}{"level": "debug"}, false},
+		{map[string]interface{}{"level": "error"}, true},
+		{map[string]interface{}{"message": "healthcheck"}, false},
+		{map[string]interface{}{"message": "GET /ping 200"}, false},
+		{map[string]interface{}{"message": "GET /orders 200"}, true},
+	}
+
+	for _, c := range cases {
+		_, keep := chain.Process(newLog(c.data))
+
+		if keep != c.keep {
+			t.Errorf("Record %v keep %v, expected %v", c.data, keep, c.keep)
+		}
+	}
+}
+
+func TestFieldProcessors(t *testing.T) {
+	chain := newChain(t, config.RecordTypeDynamic,
+		&config.ProcessorConfig{Type: config.ProcessorTypeParseJSON, Field: "payload"},
+		&config.ProcessorConfig{Type: config.ProcessorTypeRename, Fields: map[string]string{"svc": "service"}},
+		&config.ProcessorConfig{Type: config.ProcessorTypeAdd, Fields: map[string]string{"env": "prod"}},
+		&config.ProcessorConfig{Type: config.ProcessorTypeCopy, Field: "service", Target: "application"},
+		&config.ProcessorConfig{Type: config.ProcessorTypeMove, Field: "user", Target: "user-id"},
+		&config.ProcessorConfig{Type: config.ProcessorTypeRedact, Values: []string{"message"}, Pattern: `\d{4}-\d{4}`, Replace: "####"},
+	)
+
+	record := domain.NewRecord(config.RecordTypeDynamic, map[string]interface{}{
+		"payload": `{"svc": "orders", "user": "u1"}`,
+		"message": "card 1234-5678 charged",
+	})
+
+	ret, keep := chain.Process(record)
+
+	if !keep {
+		t.Fatal("Record must be kept")
+	}
+
+	data := ret.GetData()
+	expected := map[string]interface{}{
+		"service":     "orders",
+		"application": "orders",
+		"env":         "prod",
+		"user-id":     "u1",
+		"message":     "card #### charged",
+	}
+
+	for k, v := range expected {
+		if data[k] != v {
+			t.Errorf("Field %s is %v, expected %v", k, data[k], v)
+		}
+	}
+
+	for _, k := range []string{"payload", "svc", "user"} {
+		if _, found := data[k]; found {
+			t.Errorf("Field %s must be removed", k)
+		}
+	}
+
+	if ret.GetInfo().Service() != "orders" {
+		t.Errorf("Record info service %s, expected orders", ret.GetInfo().Service())
+	}
+}
+
+func TestSample(t *testing.T) {
+	chain := newChain(t, config.RecordTypeLog, &config.ProcessorConfig{Type: config.ProcessorTypeSample, Rate: 0.5})
+	kept := 0
+
+	for i := 0; i < 1000; i++ {
+		if _, keep := chain.Process(newLog(nil)); keep {
+			kept++
+		}
+	}
+
+	if kept < 350 || kept > 650 {
+		t.Errorf("Sample kept %d of 1000 records, expected about 500", kept)
+	}
+}
+
+func TestInvalidProcessors(t *testing.T) {
+	invalid := []*config.ProcessorConfig{
+		{Type: "unknown"},
+		{Type: config.ProcessorTypeDropLevel},
+		{Type: config.ProcessorTypeDropField, Field: "message"},
+		{Type: config.ProcessorTypeRename},
+		{Type: config.ProcessorTypeCopy, Field: "a"},
+		{Type: config.ProcessorTypeSample, Rate: 2},
+		{Type: config.ProcessorTypeRedact, Pattern: "("},
+	}
+
+	for _, pc := range invalid {
+		_, err := New(&config.Config{Processors: []*config.ProcessorConfig{pc}})
+
+		if err == nil {
+			t.Errorf("Processor %+v must be invalid", pc)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	chain := newChain(t, config.RecordTypeLog,
+		&config.ProcessorConfig{Type: config.ProcessorTypeParseJSON, Field: "payload"},
+	)
+
+	// level must be a string, the processed record can't be decoded
+	ret, keep := chain.Process(newLog(map[string]interface{}{"payload": `{"level": 3}`}))
+
+	if keep || ret != nil {
+		t.Error("Record that can't be decoded must be dropped")
+	}
+}
@@ -0,0 +1,168 @@
+package receiver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"data2parquet/pkg/chain"
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/converter"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/writer"
+)
+
+func prepareChainReceiver(t *testing.T, files int) (*Receiver, chain.Store, []*chain.Link) {
+	cfg := &config.Config{
+		RecordType:     config.RecordTypeLog,
+		BufferType:     config.BufferTypeMem,
+		WriterType:     config.WriterTypeFile,
+		WriterFilePath: t.TempDir(),
+		BufferSize:     100,
+		FlushInterval:  60,
+		AuditChain:     true,
+	}
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	t.Cleanup(func() { rec.Close() })
+
+	store := rec.writer.(writer.ChainWriter)
+	links := make([]*chain.Link, 0, files)
+
+	for i := 0; i < files; i++ {
+		record := &domain.Log{
+			Level:              "INFO",
+			Message:            "message",
+			Time:               time.Now().Format(time.RFC3339Nano),
+			BusinessCapability: "business_capability",
+			BusinessDomain:     "business_domain",
+			BusinessService:    "chain_service",
+			ApplicationService: "application_service",
+		}
+
+		err := rec.Write(record)
+
+		if err != nil {
+			t.Fatalf("Error writing record: %s", err)
+		}
+
+		err = rec.flushKey(record.Key(), FlushReasonClose)
+
+		if err != nil {
+			t.Fatalf("Error flushing key: %s", err)
+		}
+
+		head, err := store.ChainHead(record.Key())
+
+		if err != nil || head == nil {
+			t.Fatalf("Chain head not found after flush %d: %v", i, err)
+		}
+
+		links = append(links, head)
+	}
+
+	return rec, store, links
+}
+
+func verifyChain(t *testing.T, store chain.Store) *chain.Report {
+	report, err := chain.Verify(store, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return report
+}
+
+func TestAuditChain(t *testing.T) {
+	_, store, links := prepareChainReceiver(t, 3)
+
+	for i, link := range links {
+		if link.Seq != int64(i+1) {
+			t.Errorf("Expected sequence %d, got %d", i+1, link.Seq)
+		}
+
+		if i > 0 && (link.PrevHash != links[i-1].Hash || link.PrevFile != links[i-1].File) {
+			t.Errorf("Link %d doesn't point to previous file: %+v", i, link)
+		}
+	}
+
+	data, err := store.Read(links[1].File)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := converter.ReadMetadata(data)
+
+	if err != nil || meta[chain.MetaPrevHash] != links[0].Hash {
+		t.Errorf("Parquet metadata doesn't point to previous file: %v %v", meta, err)
+	}
+
+	report := verifyChain(t, store)
+
+	if report.Keys != 1 || report.Files != 3 || len(report.Breaks) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+func TestAuditChainBreaks(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(root string, links []*chain.Link) error
+		reason string
+	}{
+		{
+			name: "deleted",
+			change: func(root string, links []*chain.Link) error {
+				os.Remove(filepath.Join(root, chain.ManifestPath(links[1].File)))
+				return os.Remove(filepath.Join(root, links[1].File))
+			},
+			reason: chain.BreakGap,
+		},
+		{
+			name: "tampered",
+			change: func(root string, links []*chain.Link) error {
+				return os.WriteFile(filepath.Join(root, links[1].File), []byte("tampered"), 0644)
+			},
+			reason: chain.BreakHashMismatch,
+		},
+		{
+			name: "truncated",
+			change: func(root string, links []*chain.Link) error {
+				os.Remove(filepath.Join(root, chain.ManifestPath(links[2].File)))
+				return os.Remove(filepath.Join(root, links[2].File))
+			},
+			reason: chain.BreakHead,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec, store, links := prepareChainReceiver(t, 3)
+
+			err := test.change(rec.config.WriterFilePath, links)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report := verifyChain(t, store)
+
+			if len(report.Breaks) != 1 || report.Breaks[0].Reason != test.reason {
+				for _, item := range report.Breaks {
+					t.Logf("Break %+v", item)
+				}
+
+				t.Errorf("Expected a single %s break, got %d", test.reason, len(report.Breaks))
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/writer"
+)
+
+// slowWriter counts writes and how many of them run at the same time
+type slowWriter struct {
+	delay      time.Duration
+	mu         sync.Mutex
+	writes     map[string]int
+	running    int
+	maxRunning int
+	err        error
+}
+
+func (w *slowWriter) Init() error { return nil }
+
+func (w *slowWriter) Close() error { return nil }
+
+func (w *slowWriter) IsReady() bool { return true }
+
+func (w *slowWriter) Write(key string, buf *bytes.Buffer, token *writer.Token) error {
+	w.mu.Lock()
+	w.writes[key]++
+	w.running++
+	if w.running > w.maxRunning {
+		w.maxRunning = w.running
+	}
+	w.mu.Unlock()
+
+	time.Sleep(w.delay)
+
+	w.mu.Lock()
+	w.running--
+	w.mu.Unlock()
+
+	return w.err
+}
+
+func prepareFlushReceiver(t *testing.T, cfg *config.Config, keys int) (*Receiver, *slowWriter, []string) {
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	w := &slowWriter{delay: 200 * time.Millisecond, writes: make(map[string]int)}
+	rec.writer = w
+
+	ret := make([]string, keys)
+
+	for i := 0; i < keys; i++ {
+		message := fmt.Sprintf("message %d", i)
+		record := &domain.Log{
+			Level:              "INFO",
+			Message:            message,
+			Time:               time.Now().Format(time.RFC3339Nano),
+			BusinessCapability: "business_capability",
+			BusinessDomain:     "business_domain",
+			BusinessService:    fmt.Sprintf("business_service_%d", i),
+			ApplicationService: "application_service",
+		}
+
+		_, err := rec.buffer.Push(record.Key(), record)
+
+		if err != nil {
+			t.Fatalf("Error pushing record: %s", err)
+		}
+
+		ret[i] = record.Key()
+	}
+
+	return rec, w, ret
+}
+
+func flushAll(rec *Receiver, keys []string, reason FlushReason) {
+	wg := sync.WaitGroup{}
+
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			rec.flushKey(key, reason)
+		}(key)
+	}
+
+	wg.Wait()
+}
+
+func TestFlushConcurrent(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    100,
+		FlushInterval: 60,
+		FlushWorkers:  4,
+	}
+
+	rec, w, keys := prepareFlushReceiver(t, cfg, 4)
+	defer rec.Close()
+
+	start := time.Now()
+	flushAll(rec, keys, FlushReasonClose)
+
+	if w.maxRunning != 4 {
+		t.Errorf("Keys written in parallel: %d, expected 4", w.maxRunning)
+	}
+
+	if time.Since(start) > 3*w.delay {
+		t.Errorf("Flush took %s, keys were not flushed concurrently", time.Since(start))
+	}
+
+	for _, key := range keys {
+		if w.writes[key] != 1 {
+			t.Errorf("Key %s written %d times, expected 1", key, w.writes[key])
+		}
+	}
+}
+
+func TestFlushSingleFlight(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    100,
+		FlushInterval: 60,
+		FlushWorkers:  4,
+	}
+
+	rec, w, keys := prepareFlushReceiver(t, cfg, 1)
+	defer rec.Close()
+
+	// triggered flushes of a key already being flushed are skipped
+	flushAll(rec, []string{keys[0], keys[0], keys[0]}, FlushReasonBytes)
+
+	if w.writes[keys[0]] != 1 {
+		t.Errorf("Key written %d times, expected 1", w.writes[keys[0]])
+	}
+
+	if w.maxRunning != 1 {
+		t.Errorf("Same key written %d times in parallel", w.maxRunning)
+	}
+}
+
+func TestFlushMaxInFlightBytes(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:       config.RecordTypeLog,
+		BufferType:       config.BufferTypeMem,
+		WriterType:       config.WriterTypeFile,
+		BufferSize:       100,
+		FlushInterval:    60,
+		FlushWorkers:     4,
+		MaxInFlightBytes: 1,
+	}
+
+	rec, w, keys := prepareFlushReceiver(t, cfg, 3)
+	defer rec.Close()
+
+	flushAll(rec, keys, FlushReasonClose)
+
+	if w.maxRunning != 1 {
+		t.Errorf("Batches written in parallel: %d, expected 1 with in-flight bytes limit", w.maxRunning)
+	}
+
+	for _, key := range keys {
+		if w.writes[key] != 1 {
+			t.Errorf("Key %s written %d times, expected 1", key, w.writes[key])
+		}
+	}
+
+	if rec.inFlight != 0 {
+		t.Errorf("In-flight bytes not released: %d", rec.inFlight)
+	}
+}
+
+func TestFlushCloseWhileWriting(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    5,
+		FlushInterval: 60,
+		FlushWorkers:  4,
+	}
+
+	rec, w, _ := prepareFlushReceiver(t, cfg, 0)
+	w.delay = time.Millisecond
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 8)
+
+	// writers keep pushing new keys while the receiver is closed, a push must not send on the closed update channel
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; ; j++ {
+				err := rec.Write(&domain.Log{
+					Level:              "INFO",
+					Message:            fmt.Sprintf("message %d", j),
+					Time:               time.Now().Format(time.RFC3339Nano),
+					BusinessCapability: "business_capability",
+					BusinessDomain:     "business_domain",
+					BusinessService:    fmt.Sprintf("business_service_%d_%d", i, j%20),
+					ApplicationService: "application_service",
+				})
+
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	err := rec.Close()
+
+	if err != nil {
+		t.Errorf("Error closing receiver: %s", err)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != ErrReceiverClosed {
+			t.Errorf("Write error: %s, expected %s", err, ErrReceiverClosed)
+		}
+	}
+
+	if rec.Close() != ErrReceiverClosed {
+		t.Errorf("Second close didn't return %s", ErrReceiverClosed)
+	}
+}
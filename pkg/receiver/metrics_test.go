@@ -0,0 +1,96 @@
+package receiver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    100,
+		FlushInterval: 60,
+	}
+
+	rec, _, _ := prepareFlushReceiver(t, cfg, 0)
+	defer rec.Close()
+
+	record := &domain.Log{
+		Level:              "INFO",
+		Message:            "message",
+		Time:               time.Now().Format(time.RFC3339Nano),
+		BusinessCapability: "business_capability",
+		BusinessDomain:     "business_domain",
+		BusinessService:    "metrics_service",
+		ApplicationService: "application_service",
+	}
+	key := record.Key()
+
+	received := testutil.ToFloat64(metrics.RecordsReceived.WithLabelValues(key))
+	flushes := testutil.ToFloat64(metrics.Flushes.WithLabelValues(string(FlushReasonClose)))
+	skipped := testutil.ToFloat64(metrics.FlushesSkipped.WithLabelValues(string(FlushReasonClose)))
+	flushed := testutil.ToFloat64(metrics.FlushedRecords.WithLabelValues(key))
+
+	for i := 0; i < 3; i++ {
+		err := rec.Write(record)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v := testutil.ToFloat64(metrics.RecordsReceived.WithLabelValues(key)) - received; v != 3 {
+		t.Errorf("Records received %v, expected 3", v)
+	}
+
+	if v := testutil.ToFloat64(metrics.BufferLength.WithLabelValues(key)); v != 3 {
+		t.Errorf("Buffer length %v, expected 3", v)
+	}
+
+	err := rec.flushKey(key, FlushReasonClose)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rec.flushKey(key, FlushReasonClose)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := testutil.ToFloat64(metrics.Flushes.WithLabelValues(string(FlushReasonClose))) - flushes; v != 1 {
+		t.Errorf("Flushes %v, expected 1", v)
+	}
+
+	if v := testutil.ToFloat64(metrics.FlushesSkipped.WithLabelValues(string(FlushReasonClose))) - skipped; v != 1 {
+		t.Errorf("Skipped flushes %v, expected 1 (empty buffer)", v)
+	}
+
+	if v := testutil.ToFloat64(metrics.FlushedRecords.WithLabelValues(key)) - flushed; v != 3 {
+		t.Errorf("Flushed records %v, expected 3", v)
+	}
+
+	if v := testutil.ToFloat64(metrics.BufferLength.WithLabelValues(key)); v != 0 {
+		t.Errorf("Buffer length %v after flush, expected 0", v)
+	}
+
+	resp := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, name := range []string{"data2parquet_records_received_total", "data2parquet_flush_duration_seconds", "data2parquet_buffer_operation_duration_seconds"} {
+		if !strings.Contains(resp.Body.String(), name) {
+			t.Errorf("Metric %s not found on metrics handler output", name)
+		}
+	}
+}
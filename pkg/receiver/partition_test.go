@@ -0,0 +1,292 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/converter"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/writer"
+)
+
+func TestFlushPartitions(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:     config.RecordTypeLog,
+		BufferType:     config.BufferTypeMem,
+		WriterType:     config.WriterTypeFile,
+		WriterFilePath: t.TempDir(),
+		BufferSize:     100,
+		FlushInterval:  60,
+	}
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	defer rec.Close()
+
+	// late record from the previous day and a batch around midnight
+	times := []string{"2024-06-01T23:30:00Z", "2024-06-02T00:10:00Z", "2024-06-01T23:59:00+02:00", "2024-06-01T23:45:00Z"}
+	key := ""
+
+	for _, tm := range times {
+		record := &domain.Log{
+			Level:              "INFO",
+			Message:            "message",
+			Time:               tm,
+			BusinessCapability: "business_capability",
+			BusinessDomain:     "business_domain",
+			BusinessService:    "partition_service",
+			ApplicationService: "application_service",
+		}
+		key = record.Key()
+
+		err := rec.Write(record)
+
+		if err != nil {
+			t.Fatalf("Error writing record: %s", err)
+		}
+	}
+
+	err := rec.flushKey(key, FlushReasonClose)
+
+	if err != nil {
+		t.Fatalf("Error flushing key: %s", err)
+	}
+
+	files, err := rec.writer.(writer.ChainWriter).List("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"year=2024/month=06/day=01/hour=21/": 1,
+		"year=2024/month=06/day=01/hour=23/": 2,
+		"year=2024/month=06/day=02/hour=00/": 1,
+	}
+
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files, got %v", len(expected), files)
+	}
+
+	for _, file := range files {
+		dir := file[strings.Index(file, "year=") : strings.LastIndex(file, "/")+1]
+		rows, found := expected[dir]
+
+		if !found {
+			t.Errorf("Unexpected partition %s", file)
+			continue
+		}
+
+		data, err := rec.writer.(writer.ChainWriter).Read(file)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pf, err := buffer.NewBufferFile(data)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pr, err := reader.NewParquetReader(pf, new(domain.Log), 1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pr.GetNumRows() != int64(rows) {
+			t.Errorf("Expected %d rows on %s, got %d", rows, dir, pr.GetNumRows())
+		}
+
+		pr.ReadStop()
+
+		meta, err := converter.ReadMetadata(data)
+
+		if err != nil || !strings.Contains(dir, converter.ReadPartition(data).Format("day=02/hour=15")) {
+			t.Errorf("Unexpected partition metadata %v on %s", meta, dir)
+		}
+	}
+}
+
+func TestFlushPathTemplate(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:         config.RecordTypeLog,
+		BufferType:         config.BufferTypeMem,
+		WriterType:         config.WriterTypeFile,
+		WriterFilePath:     t.TempDir(),
+		WriterPathTemplate: "{service}/level={field:level}/region={field:args.region}/dt={date}/{minute}/{id}.parquet",
+		BufferSize:         100,
+		FlushInterval:      60,
+	}
+
+	cfg.SetDefaults()
+
+	t.Cleanup(func() {
+		(&config.Config{}).SetDefaults()
+	})
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	defer rec.Close()
+
+	records := []struct {
+		level  string
+		region string
+	}{{"INFO", "eu"}, {"ERROR", "eu"}, {"INFO", "eu"}, {"INFO", ""}}
+	key := ""
+
+	for _, item := range records {
+		record := &domain.Log{
+			Level:              item.level,
+			Message:            "message",
+			Time:               "2024-06-01T23:30:00Z",
+			BusinessCapability: "business_capability",
+			BusinessDomain:     "business_domain",
+			BusinessService:    "template_service",
+			ApplicationService: "application_service",
+		}
+
+		if len(item.region) > 0 {
+			record.Args = map[string]string{"region": item.region}
+		}
+
+		key = record.Key()
+
+		err := rec.Write(record)
+
+		if err != nil {
+			t.Fatalf("Error writing record: %s", err)
+		}
+	}
+
+	err := rec.flushKey(key, FlushReasonClose)
+
+	if err != nil {
+		t.Fatalf("Error flushing key: %s", err)
+	}
+
+	files, err := rec.writer.(writer.ChainWriter).List("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		"template_service/level=INFO/region=eu/dt=2024-06-01/30/":        true,
+		"template_service/level=ERROR/region=eu/dt=2024-06-01/30/":       true,
+		"template_service/level=INFO/region=undefined/dt=2024-06-01/30/": true,
+	}
+
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files, got %v", len(expected), files)
+	}
+
+	for _, file := range files {
+		dir := file[:strings.LastIndex(file, "/")+1]
+
+		if !expected[strings.TrimPrefix(dir, cfg.WriterFilePath+"/")] {
+			t.Errorf("Unexpected file %s", file)
+		}
+	}
+
+	cfg.WriterPathTemplate = "{service}/{date}.parquet"
+
+	if NewReceiver(context.Background(), cfg) != nil {
+		t.Error("Receiver must not start with an invalid path template")
+	}
+}
+
+// failingWriter fails the writes listed on fail (1 is the first call) and counts the others
+type failingWriter struct {
+	fail    map[int]bool
+	calls   int
+	written int
+}
+
+func (w *failingWriter) Init() error { return nil }
+
+func (w *failingWriter) Close() error { return nil }
+
+func (w *failingWriter) IsReady() bool { return true }
+
+func (w *failingWriter) Write(key string, buf *bytes.Buffer, token *writer.Token) error {
+	w.calls++
+
+	if w.fail[w.calls] {
+		return errors.New("write failed")
+	}
+
+	w.written++
+
+	return nil
+}
+
+func TestFlushPartitionsRequeue(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    100,
+		FlushInterval: 60,
+	}
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	defer rec.Close()
+
+	w := &failingWriter{fail: map[int]bool{2: true}}
+	rec.writer = w
+	key := ""
+
+	for _, tm := range []string{"2024-06-01T10:00:00Z", "2024-06-01T11:00:00Z", "2024-06-01T11:30:00Z"} {
+		record := &domain.Log{
+			Message:            "message",
+			Time:               tm,
+			BusinessCapability: "business_capability",
+			BusinessDomain:     "business_domain",
+			BusinessService:    "requeue_service",
+			ApplicationService: "application_service",
+		}
+		key = record.Key()
+
+		if _, err := rec.buffer.Push(key, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rec.flushKey(key, FlushReasonClose); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.written != 1 || rec.buffer.Len(key) == 0 || rec.buffer.Len(key) == 3 {
+		t.Fatalf("Only records of the failed partition must go back to buffer, %d written and %d on buffer", w.written, rec.buffer.Len(key))
+	}
+
+	if err := rec.flushKey(key, FlushReasonClose); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.written != 2 || rec.buffer.Len(key) != 0 {
+		t.Errorf("Written partition must not be written again, %d writes and %d records on buffer", w.written, rec.buffer.Len(key))
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"math/rand"
+	"os"
 
 	"data2parquet/pkg/logger" //"log/slog"
 
@@ -11,26 +13,53 @@ import (
 	"time"
 
 	"data2parquet/pkg/buffer"
+	"data2parquet/pkg/chain"
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/converter"
 	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
+	"data2parquet/pkg/pii"
+	"data2parquet/pkg/processor"
+	"data2parquet/pkg/registry"
+	"data2parquet/pkg/tracing"
 	"data2parquet/pkg/writer"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var slog = logger.GetLogger()
 
 type Receiver struct {
-	config        *config.Config
-	writer        writer.Writer
-	buffer        buffer.Buffer
-	running       bool
-	last          map[string]*time.Time
-	converter     *converter.Converter
-	ctx           context.Context
-	recoveryCount map[string]int
-	interval      time.Duration
-	mu            *sync.RWMutex
-	update        chan *UpdateItem
+	config       *config.Config
+	writer       writer.Writer
+	buffer       buffer.Buffer
+	running      bool
+	last         map[string]*time.Time
+	bytes        map[string]int
+	converter    *converter.Converter
+	processors   *processor.Chain
+	scrubber     *pii.Scrubber
+	schemas      registry.Registry
+	ctx          context.Context
+	interval     time.Duration
+	mu           *sync.RWMutex
+	update       chan *UpdateItem
+	updateDone   chan struct{}
+	closeMu      *sync.RWMutex
+	closed       bool
+	keys         *sync.Map
+	scheduler    *scheduler
+	flushing     map[string]chan struct{}
+	slots        chan struct{}
+	triggered    *sync.WaitGroup
+	inFlight     int
+	inFlightCond *sync.Cond
+	recoveryMu   *sync.Mutex
+	recoveryWake chan struct{}
+	recoveryStop chan struct{}
+	replayMu     *sync.Mutex
+	instance     string
 }
 
 type BufferControl struct {
@@ -41,12 +70,14 @@ type BufferControl struct {
 type UpdateItem struct {
 	Key   string
 	Count int
+	Bytes int
 }
 
 type FlushReason string
 
 const (
 	FlushReasonSize     FlushReason = "buffer-size"
+	FlushReasonBytes    FlushReason = "bytes"
 	FlushReasonInterval FlushReason = "interval"
 	FlushReasonClose    FlushReason = "close"
 )
@@ -57,19 +88,101 @@ func NewReceiver(ctx context.Context, config *config.Config) *Receiver {
 	}
 
 	ret := &Receiver{
-		config:        config,
-		writer:        writer.New(ctx, config),
-		buffer:        buffer.New(ctx, config),
-		running:       true,
-		last:          make(map[string]*time.Time),
-		ctx:           ctx,
-		recoveryCount: make(map[string]int),
-		converter:     converter.New(config),
-		interval:      time.Duration(config.FlushInterval) * time.Second,
-		mu:            &sync.RWMutex{},
-		update:        make(chan *UpdateItem, config.BufferSize),
+		config:       config,
+		writer:       writer.New(ctx, config),
+		buffer:       buffer.New(ctx, config),
+		running:      true,
+		last:         make(map[string]*time.Time),
+		bytes:        make(map[string]int),
+		ctx:          ctx,
+		converter:    converter.New(config),
+		interval:     time.Duration(config.FlushInterval) * time.Second,
+		mu:           &sync.RWMutex{},
+		update:       make(chan *UpdateItem, config.BufferSize),
+		updateDone:   make(chan struct{}),
+		closeMu:      &sync.RWMutex{},
+		keys:         &sync.Map{},
+		flushing:     make(map[string]chan struct{}),
+		triggered:    &sync.WaitGroup{},
+		inFlightCond: sync.NewCond(&sync.Mutex{}),
+		recoveryMu:   &sync.Mutex{},
+		recoveryWake: make(chan struct{}, 1),
+		recoveryStop: make(chan struct{}),
+		replayMu:     &sync.Mutex{},
+		instance:     makeInstance(config),
+	}
+
+	workers := config.FlushWorkers
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	ret.slots = make(chan struct{}, workers)
+
+	err := config.CheckHMAC()
+
+	if err != nil {
+		slog.Error("Error checking HMAC config", "error", err)
+		return nil
+	}
+
+	err = config.CheckMasks()
+
+	if err != nil {
+		slog.Error("Error checking mask rules", "error", err)
+		return nil
+	}
+
+	err = config.CheckPathTemplate()
+
+	if err != nil {
+		slog.Error("Error checking path template", "error", err)
+		return nil
 	}
 
+	err = config.CheckRecordKey()
+
+	if err != nil {
+		slog.Error("Error checking record key", "error", err)
+		return nil
+	}
+
+	err = config.CheckAuditChain()
+
+	if err != nil {
+		slog.Error("Error checking audit chain", "error", err)
+		return nil
+	}
+
+	processors, err := processor.New(config)
+
+	if err != nil {
+		slog.Error("Error creating processors", "error", err)
+		return nil
+	}
+
+	ret.processors = processors
+
+	scrubber, err := pii.New(config)
+
+	if err != nil {
+		slog.Error("Error creating PII scrubber", "error", err)
+		return nil
+	}
+
+	ret.scrubber = scrubber
+
+	schemas, err := registry.New(config)
+
+	if err != nil {
+		slog.Error("Error creating schema registry", "error", err, "registry", config.SchemaRegistry)
+		return nil
+	}
+
+	ret.schemas = schemas
+	ret.converter.UseRegistry(schemas)
+
 	if ret.buffer == nil {
 		slog.Error("Error creating buffer")
 		return nil
@@ -87,7 +200,7 @@ func NewReceiver(ctx context.Context, config *config.Config) *Receiver {
 		return nil
 	}
 
-	err := ret.writer.Init()
+	err = ret.writer.Init()
 
 	if err != nil {
 		slog.Error("Error initializing writer", "error", err)
@@ -99,12 +212,83 @@ func NewReceiver(ctx context.Context, config *config.Config) *Receiver {
 		return nil
 	}
 
+	if _, ok := ret.writer.(writer.ChainWriter); config.AuditChain && !ok {
+		slog.Error("Writer doesn't support audit chain", "writer", config.WriterType)
+		return nil
+	}
+
+	ret.refreshDepth()
+
+	ret.scheduler = newScheduler(ret.interval, time.Duration(config.KeyIdleTimeout)*time.Second, config.FlushWorkers, ret.flushInterval, ret.expireKey)
+	ret.trackBufferKeys()
+
 	go ret.runHealthchek()
 	go ret.processUpdate()
 
+	if config.TryAutoRecover {
+		go ret.runRecovery()
+	}
+
 	return ret
 }
 
+// trackBufferKeys schedules keys already on buffer when the receiver starts, e.g. segments replayed by disk buffer after a
+// crash, so they are flushed on interval and on close without waiting for a new record
+func (r *Receiver) trackBufferKeys() {
+	keys := r.buffer.Keys()
+
+	for _, key := range keys {
+		now := time.Now()
+
+		r.mu.Lock()
+		r.last[key] = &now
+		r.mu.Unlock()
+
+		r.keys.Store(key, true)
+		r.scheduler.touch(key)
+	}
+
+	if len(keys) > 0 {
+		slog.Info("Keys found on buffer scheduled to flush", "keys", len(keys))
+	}
+}
+
+// makeInstance returns the name of this instance stored on DLQ entries, the Redis lock instance name or the hostname
+func makeInstance(cfg *config.Config) string {
+	if len(cfg.RedisLockInstanceName) > 0 {
+		return cfg.RedisLockInstanceName
+	}
+
+	host, err := os.Hostname()
+
+	if err != nil {
+		return "d2p"
+	}
+
+	return host
+}
+
+// refreshDepth sets DLQ and recovery depth metrics from buffer, after that they are kept by this instance operations
+func (r *Receiver) refreshDepth() {
+	dlq, err := r.buffer.GetDLQ()
+
+	if err == nil {
+		depth := 0
+
+		for _, items := range dlq {
+			depth += len(items)
+		}
+
+		metrics.DLQDepth.Set(float64(depth))
+	}
+
+	recovery, err := r.buffer.GetRecovery()
+
+	if err == nil {
+		metrics.RecoveryDepth.Set(float64(len(recovery)))
+	}
+}
+
 func (r *Receiver) runHealthchek() {
 	for r.running {
 		<-time.After(1 * time.Second)
@@ -125,32 +309,41 @@ func (r *Receiver) runHealthchek() {
 	slog.Info("Stopping healthcheck process")
 }
 
-func (r *Receiver) runInterval(key string) {
-	time.Sleep(r.interval)
+func (r *Receiver) flushInterval(key string) {
+	err := r.flushKey(key, FlushReasonInterval)
 
-	for r.running {
-		r.mu.Lock()
-		last, found := r.last[key]
-		if !found {
-			slog.Debug("Interval control time not found!", "key", key)
-		}
-		r.mu.Unlock()
+	if err != nil {
+		slog.Error("Error to flush key", "key", key, "error", err)
+	}
+}
 
-		since := time.Since(*last)
+// expireKey stops tracking a key without new records, only if its buffer is empty
+func (r *Receiver) expireKey(key string) bool {
+	if r.buffer.Len(key) > 0 {
+		return false
+	}
 
-		if since >= r.interval {
-			err := r.flushKey(key, FlushReasonInterval)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-			if err != nil {
-				slog.Error("Error to flush key", "key", key, "error", err)
-			}
-		}
+	r.keys.Delete(key)
+	metrics.BufferLength.DeleteLabelValues(key)
 
-		time.Sleep(r.interval)
+	// a record pushed before the key was deleted keeps it tracked, pushes after that find it missing and add it again
+	if r.buffer.Len(key) > 0 {
+		r.keys.Store(key, true)
+		return false
 	}
+
+	delete(r.last, key)
+	delete(r.bytes, key)
+
+	return true
 }
 
 func (r *Receiver) processUpdate() {
+	defer close(r.updateDone)
+
 	for r.running {
 		item, updateChannelOk := <-r.update
 		if !updateChannelOk {
@@ -167,49 +360,283 @@ func (r *Receiver) processUpdate() {
 		if _, found := r.last[item.Key]; !found {
 			last := time.Now()
 			r.last[item.Key] = &last
-			go r.runInterval(item.Key)
 		}
 		r.mu.Unlock()
 
-		if item.Count >= r.config.BufferSize {
+		r.scheduler.touch(item.Key)
+
+		if item.Count >= r.config.BufferSize && !r.isFlushing(item.Key) {
 			bfSize := r.buffer.Len(item.Key)
 
 			if bfSize > r.config.BufferSize {
-				err := r.flushKey(item.Key, FlushReasonSize)
-
-				if err != nil {
-					slog.Error("Error to flush key", "key", item.Key, "error", err)
-				}
+				r.trigger(item.Key, FlushReasonSize)
+				continue
 			}
 		}
+
+		if r.config.FlushBytes > 0 && r.checkBytes(item) {
+			r.trigger(item.Key, FlushReasonBytes)
+		}
 	}
 	slog.Info("Stopping update queue process")
 }
 
+// trigger flushes a key in background, so a slow key doesn't stop updates of other keys
+func (r *Receiver) trigger(key string, reason FlushReason) {
+	if r.isFlushing(key) {
+		return
+	}
+
+	r.triggered.Add(1)
+
+	go func() {
+		defer r.triggered.Done()
+
+		err := r.flushKey(key, reason)
+
+		if err != nil {
+			slog.Error("Error to flush key", "key", key, "error", err)
+		}
+	}()
+}
+
+func (r *Receiver) isFlushing(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, found := r.flushing[key]
+
+	return found
+}
+
+// startFlush marks a key as flushing, only one flush of each key runs at a time. A flush on close waits for the
+// running one, other reasons skip the key because the running flush takes its pending records.
+func (r *Receiver) startFlush(key string, reason FlushReason) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		running, found := r.flushing[key]
+
+		if !found {
+			r.flushing[key] = make(chan struct{})
+			return true
+		}
+
+		if reason != FlushReasonClose {
+			return false
+		}
+
+		r.mu.Unlock()
+		<-running
+		r.mu.Lock()
+	}
+}
+
+func (r *Receiver) endFlush(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	close(r.flushing[key])
+	delete(r.flushing, key)
+}
+
+// reserveBytes waits until the converted batch fits on `MaxInFlightBytes`, a batch is always accepted when nothing else
+// is being written, so a batch bigger than the limit doesn't wait forever
+func (r *Receiver) reserveBytes(size int) {
+	if r.config.MaxInFlightBytes <= 0 {
+		return
+	}
+
+	r.inFlightCond.L.Lock()
+	defer r.inFlightCond.L.Unlock()
+
+	for r.inFlight > 0 && r.inFlight+size > r.config.MaxInFlightBytes {
+		r.inFlightCond.Wait()
+	}
+
+	r.inFlight += size
+}
+
+func (r *Receiver) releaseBytes(size int) {
+	if r.config.MaxInFlightBytes <= 0 {
+		return
+	}
+
+	r.inFlightCond.L.Lock()
+	r.inFlight -= size
+	r.inFlightCond.L.Unlock()
+
+	r.inFlightCond.Broadcast()
+}
+
+// checkBytes adds the record size to the approximate size of its key buffer, when it reaches `FlushBytes` the real size is
+// checked on the buffer (other instances may have flushed it)
+func (r *Receiver) checkBytes(item *UpdateItem) bool {
+	r.mu.Lock()
+	r.bytes[item.Key] += item.Bytes
+	pending := r.bytes[item.Key]
+	r.mu.Unlock()
+
+	if pending < r.config.FlushBytes {
+		return false
+	}
+
+	size := r.buffer.ByteLen(item.Key)
+
+	r.mu.Lock()
+	r.bytes[item.Key] = size
+	r.mu.Unlock()
+
+	return size >= r.config.FlushBytes
+}
+
 func (r *Receiver) Write(record domain.Record) error {
+	return r.WriteContext(r.ctx, record)
+}
+
+// WriteContext runs processors and PII detectors on a record and pushes it to buffer like `Write`, its span is a child of
+// the span on ctx (e.g. an HTTP request). A record dropped by processors is not an error.
+func (r *Receiver) WriteContext(ctx context.Context, record domain.Record) error {
+	_, span := tracing.Tracer().Start(ctx, "Receiver.Write")
+	defer span.End()
+
+	record, keep := r.processors.Process(record)
+
+	if !keep {
+		span.SetAttributes(attribute.Bool("dropped", true))
+		return nil
+	}
+
+	record = r.scrubber.Scrub(record)
+
+	span.SetAttributes(attribute.String("key", record.Key()))
+
+	n, err := r.push(record)
+
+	if err != nil {
+		tracing.SetError(span, err)
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("buffer.records", n))
+
+	return nil
+}
+
+// ErrDLQDisabled is returned by `WriteDLQ` when `UseDLQ` is not set
+var ErrDLQDisabled = errors.New("DLQ is disabled")
+
+// WriteDLQ runs processors and PII detectors on records like `Write` and stores them on DLQ with the stage and error they
+// were rejected by, e.g. records of a Fluent Bit chunk that don't fit on buffer after other records of the chunk were
+// accepted
+func (r *Receiver) WriteDLQ(records []domain.Record, stage string, cause error) error {
+	if !r.config.UseDLQ {
+		return ErrDLQDisabled
+	}
+
+	for _, record := range records {
+		record, keep := r.processors.Process(record)
+
+		if !keep {
+			continue
+		}
+
+		record = r.scrubber.Scrub(record)
+		key := record.Key()
+
+		err := r.buffer.PushDLQ(key, buffer.NewDLQEnvelope(key, record, stage, cause, r.instance))
+
+		if err != nil {
+			slog.Error("Error pushing record to DLQ", "error", err, "key", key, "stage", stage)
+			return err
+		}
+
+		metrics.DLQRecords.WithLabelValues(stage).Inc()
+		metrics.DLQDepth.Inc()
+	}
+
+	return nil
+}
+
+// ErrReceiverClosed is returned by `Write` after `Close` was called
+var ErrReceiverClosed = errors.New("receiver is closed")
+
+// push stores a record on buffer and notifies the flush process, it returns the records on key buffer. It holds the close
+// lock until the update is sent, so `Close` doesn't close the update channel under a running push.
+func (r *Receiver) push(record domain.Record) (int, error) {
+	r.closeMu.RLock()
+	defer r.closeMu.RUnlock()
+
+	if r.closed {
+		return 0, ErrReceiverClosed
+	}
+
 	key := record.Key()
 	n, err := r.buffer.Push(key, record)
 
 	if err != nil {
 		slog.Error("Error pushing record", "error", err, "record", record.ToString())
-		return err
+		return n, err
 	}
 
-	r.update <- &UpdateItem{
+	metrics.RecordsReceived.WithLabelValues(key).Inc()
+	metrics.BufferLength.WithLabelValues(key).Set(float64(n))
+
+	item := &UpdateItem{
 		Key:   key,
 		Count: n,
 	}
 
-	return nil
+	if r.config.FlushBytes > 0 {
+		item.Bytes = len(record.ToMsgPack())
+	}
+
+	// first update of a key starts its interval flush and can't be lost, next ones are skipped when the queue is full,
+	// so a slow flush doesn't block writers
+	if _, found := r.keys.Load(key); !found {
+		r.update <- item
+		r.keys.Store(key, true)
+		return n, nil
+	}
+
+	select {
+	case r.update <- item:
+	default:
+		slog.Debug("Update queue is full, skipping update", "key", key, "count", n)
+	}
+
+	return n, nil
 }
 
-func (r *Receiver) flushKey(key string, reason FlushReason) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+func (r *Receiver) flushKey(key string, reason FlushReason) (err error) {
+	ctx, span := tracing.Tracer().Start(r.ctx, "Receiver.flushKey", trace.WithAttributes(
+		attribute.String("key", key),
+		attribute.String("reason", string(reason)),
+	))
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+
+	if !r.startFlush(key, reason) {
+		slog.Debug("Skipping flush, key is already being flushed", "reason", reason, "key", key)
+		metrics.FlushesSkipped.WithLabelValues(string(reason)).Inc()
+		span.SetAttributes(attribute.String("skipped", "flushing"))
+		return nil
+	}
+
+	defer r.endFlush(key)
+
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+
+	span.AddEvent("slot acquired")
 
 	callResend := false
 	start := time.Now()
 
+	r.mu.Lock()
 	last, found := r.last[key]
 
 	if !found {
@@ -217,161 +644,500 @@ func (r *Receiver) flushKey(key string, reason FlushReason) error {
 	}
 
 	if reason == FlushReasonInterval && time.Since(*last) < r.interval {
+		r.mu.Unlock()
 		slog.Info("Skipping buffer flush, interval time has not yet been reached", "reason", reason, "key", key)
+		metrics.FlushesSkipped.WithLabelValues(string(reason)).Inc()
+		span.SetAttributes(attribute.String("skipped", "interval"))
 		return nil
 	}
 
 	r.last[key] = &start
+	delete(r.bytes, key)
+	r.mu.Unlock()
 
 	if !r.buffer.CheckLock(key) {
 		slog.Debug("Skipping flush, buffer is locked by other process", "key", key)
+		metrics.FlushesSkipped.WithLabelValues(string(reason)).Inc()
+		span.SetAttributes(attribute.String("skipped", "locked"))
 		return nil
 	}
 
+	defer r.releaseLock(key)
+
+	span.AddEvent("lock acquired")
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.keepLock(key, done)
+
 	data := r.buffer.Get(key)
 	size := len(data)
+	token := r.buffer.Token(key)
 
-	if reason == FlushReasonSize && size < r.config.BufferSize {
-		slog.Info("Skipping buffer flush, buffer size has not yet been reached", "reason", reason, "key", key, "size", size)
-		return nil
-	}
+	span.SetAttributes(attribute.Int("records", size))
 
 	if size == 0 {
 		slog.Info("Skipping buffer flush, no data to flush here", "reason", reason, "key", key, "size", size)
+		metrics.FlushesSkipped.WithLabelValues(string(reason)).Inc()
+		span.SetAttributes(attribute.String("skipped", "empty"))
 		return nil
 	}
 
+	if reason == FlushReasonSize && size < r.config.BufferSize {
+		slog.Info("Skipping buffer flush, buffer size has not yet been reached", "reason", reason, "key", key, "size", size)
+		metrics.FlushesSkipped.WithLabelValues(string(reason)).Inc()
+		span.SetAttributes(attribute.String("skipped", "size"))
+		return r.buffer.Rollback(key)
+	}
+
 	slog.Info("Flushing key", "reason", reason, "key", key)
+	metrics.Flushes.WithLabelValues(string(reason)).Inc()
+	defer metrics.Since(metrics.FlushDuration.WithLabelValues(string(reason)), start)
+
+	fence := &writer.Token{
+		Value: token,
+		Valid: func() bool {
+			return r.buffer.CheckToken(key, token)
+		},
+	}
 
-	buf := new(bytes.Buffer)
-	result := r.converter.Write(key, data, buf)
+	parts := r.converter.Split(data)
+	span.SetAttributes(attribute.Int("partitions", len(parts)))
 
-	errCount := 0
+	stored := true
+	written := 0
+	// rejected records of partitions written or sent to recovery, they go to DLQ once the batch is committed
+	rejected := make([]*converter.Result, 0)
+	// records of partitions not stored yet, returned to buffer when some partitions were already stored
+	pending := make([]domain.Record, 0)
 
-	for _, item := range result {
-		if item.Error != nil {
-			errCount++
-			if r.config.UseDLQ {
-				slog.Error("Error converting data, push to DLQ", "error", item.Error, "key", key, "record", item.Record.ToJson())
-				err := r.buffer.PushDLQ(item.Key, item.Record)
+	for i, part := range parts {
+		var buf *bytes.Buffer
+		var partRejected []*converter.Result
+		buf, partRejected, err = r.flushPartition(ctx, key, part, fence)
 
-				if err != nil {
-					slog.Error("Error pushing to DLQ Buffer", "error", err, "key", key)
-				}
-			} else {
-				slog.Warn("DLQ is disabled, skipping record", "error", item.Error, "key", key, "record", item.Record.ToJson())
-			}
+		if errors.Is(err, writer.ErrStaleToken) {
+			slog.Warn("Lock lost during flush, batch is kept to the new lock owner", "key", key, "token", token, "lines", len(data), "written-partitions", written, "duration", time.Since(start))
+			return nil
 		}
-	}
 
-	err := r.writer.Write(key, buf)
+		if err == nil {
+			written++
+			rejected = append(rejected, partRejected...)
+			continue
+		}
 
-	if err != nil {
-		if !r.config.TryAutoRecover {
-			slog.Error("Error writing data, resend is disabled, discarding data", "error", err, "key", key, "lines", len(data))
+		if buf == nil {
+			stored = false
+		} else if !r.config.TryAutoRecover {
+			slog.Error("Error writing data, resend is disabled, returning data to buffer", "error", err, "key", key, "lines", len(data))
+			stored = false
+		} else if r.config.AuditChain {
+			// recovery would write the file after newer ones were chained to the same head, the batch is converted
+			// again on the next flush with the head of that time
+			slog.Error("Error writing chained data, returning data to buffer", "error", err, "key", key, "lines", len(data))
+			stored = false
 		} else {
-			slog.Error("Error writing data, pushing to recovery Buffer", "error", err, "key", key, "lines", len(data))
-			errWr := r.buffer.PushRecovery(key, buf)
+			slog.Error("Error writing data, pushing to recovery Buffer", "error", err, "key", key, "lines", len(part.Records), "partition", part.Path)
+			item := buffer.NewRecoveryData(key, buf)
+			item.LastError = err.Error()
+			item.NextAttempt = start.Add(r.backoff(0))
+			// resend reads and removes recovery items holding this lock, so an item put here isn't taken by it
+			r.recoveryMu.Lock()
+			errWr := r.buffer.PutRecovery(item)
+			r.recoveryMu.Unlock()
 
 			if errWr != nil {
-				slog.Error("Error pushing to recovery buffer", "error", errWr, "key", key, "lines", len(data), "duration", time.Since(start))
+				slog.Error("Error pushing to recovery buffer, returning data to buffer", "error", errWr, "key", key, "lines", len(data), "duration", time.Since(start))
+				stored = false
+			} else {
+				metrics.RecoveryDepth.Inc()
+				written++
+				rejected = append(rejected, partRejected...)
 			}
 
-			if r.config.TryAutoRecover {
-				callResend = true
+			callResend = true
+		}
+
+		if !stored {
+			for _, next := range parts[i:] {
+				pending = append(pending, next.Records...)
 			}
+			break
 		}
 	}
 
-	err = r.buffer.Clear(key, len(data))
+	// partitions already stored are not written again, the records of the others are pushed back before the batch is
+	// committed
+	if !stored && written > 0 {
+		slog.Warn("Returning records of partitions not written to buffer", "key", key, "written-partitions", written, "partitions", len(parts), "lines", len(pending))
+		stored = r.requeue(key, pending)
+	}
 
-	if err != nil {
-		slog.Error("Error clearing buffer", "error", err, "key", key, "lines", len(data))
+	if stored {
+		err = r.buffer.Clear(key, len(data))
+
+		if err != nil {
+			slog.Error("Error clearing buffer", "error", err, "key", key, "lines", len(data))
+		} else {
+			metrics.FlushedRecords.WithLabelValues(key).Add(float64(len(data) - len(pending)))
+			r.pushRejected(key, rejected)
+		}
+	} else {
+		err = r.buffer.Rollback(key)
+
+		if err != nil {
+			slog.Error("Error rolling back buffer", "error", err, "key", key, "lines", len(data))
+		}
 	}
 
+	metrics.BufferLength.WithLabelValues(key).Set(float64(r.buffer.Len(key)))
+
 	slog.Info("Buffer flush process finished", "key", key, "total-duration", time.Since(start), "lines", len(data))
 
 	if callResend {
-		go r.TryResendData()
+		r.wakeRecovery()
 	}
 
 	return err
 }
 
-func (r *Receiver) TryResendData() {
-	start := time.Now()
+// requeue pushes records of a batch back to buffer, so the batch can be committed without them. It returns false when a
+// push fails, the batch must be rolled back then.
+func (r *Receiver) requeue(key string, records []domain.Record) bool {
+	for i, record := range records {
+		_, err := r.buffer.Push(key, record)
 
-	if !r.config.TryAutoRecover {
-		return
+		if err != nil {
+			slog.Error("Error returning records to buffer, rolling back the batch", "error", err, "key", key, "pushed", i, "lines", len(records))
+			return false
+		}
 	}
 
-	slog.Debug("Trying to resend data")
-	remains := make(map[string]*bytes.Buffer)
+	return true
+}
+
+// pushRejected stores records rejected by the converter on DLQ. It is called after their batch is committed, so a
+// batch returned to buffer doesn't push them twice.
+func (r *Receiver) pushRejected(key string, rejected []*converter.Result) {
+	for _, item := range rejected {
+		if !r.config.UseDLQ {
+			slog.Warn("DLQ is disabled, skipping record", "error", item.Error, "key", key, "record", item.Record.ToJson())
+			continue
+		}
 
-	if r.buffer.HasRecovery() {
-		slog.Info("Recovery data found, trying to resend")
+		stage := dlqStage(item.Error)
+		slog.Error("Error converting data, push to DLQ", "error", item.Error, "stage", stage, "key", key, "record", item.Record.ToJson())
+		err := r.buffer.PushDLQ(item.Key, buffer.NewDLQEnvelope(item.Key, item.Record, stage, item.Error, r.instance))
 
-		r.mu.Lock()
-		defer r.mu.Unlock()
+		if err != nil {
+			slog.Error("Error pushing to DLQ Buffer", "error", err, "key", key)
+			continue
+		}
+
+		metrics.DLQRecords.WithLabelValues(stage).Inc()
+		metrics.DLQDepth.Inc()
+	}
+}
 
-		recovery, err := r.buffer.GetRecovery()
+// flushPartition converts the records of a partition and writes them to a file, buf is nil when nothing was converted.
+// Records rejected by the converter are returned apart, to be pushed to DLQ by the caller.
+func (r *Receiver) flushPartition(ctx context.Context, key string, part *converter.Partition, fence *writer.Token) (*bytes.Buffer, []*converter.Result, error) {
+	meta := part.Metadata()
+
+	if r.config.AuditChain {
+		head, err := r.writer.(writer.ChainWriter).ChainHead(key)
 
 		if err != nil {
-			slog.Error("Error getting recovery data", "error", err)
+			slog.Error("Error reading chain head, returning data to buffer", "error", err, "key", key)
+			return nil, nil, err
+		}
+
+		for k, v := range chain.Metadata(key, head) {
+			meta[k] = v
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	size := len(part.Records)
+	_, convSpan := tracing.Tracer().Start(ctx, "Converter.Write", trace.WithAttributes(
+		attribute.String("key", key),
+		attribute.String("partition", part.Path),
+		attribute.Int("records", size),
+	))
+	result := r.converter.WriteWithMetadata(key, part.Records, buf, meta)
+
+	errCount := 0
+
+	for _, item := range result {
+		// an error without record (e.g. schema registry unavailable) fails the whole partition
+		if item.Error != nil && item.Record == nil {
+			slog.Error("Error converting data, returning data to buffer", "error", item.Error, "key", key, "partition", part.Path)
+			tracing.SetError(convSpan, item.Error)
+			convSpan.End()
+			return nil, nil, item.Error
+		}
+	}
+
+	rejected := make([]*converter.Result, 0)
+
+	for _, item := range result {
+		if item.Error != nil {
+			errCount++
+			rejected = append(rejected, item)
+		}
+	}
+
+	convSpan.SetAttributes(attribute.Int("errors", errCount), attribute.Int("bytes", buf.Len()))
+	convSpan.End()
+
+	// a file without rows is not written, so it doesn't advance the audit chain either
+	if errCount == size {
+		slog.Warn("No records converted, skipping write", "key", key, "partition", part.Path, "errors", errCount)
+		return buf, rejected, nil
+	}
+
+	inFlight := buf.Len()
+	r.reserveBytes(inFlight)
+	_, wrSpan := tracing.Tracer().Start(ctx, "Writer.Write", trace.WithAttributes(
+		attribute.String("key", key),
+		attribute.String("writer", r.config.WriterType),
+		attribute.String("partition", part.Path),
+		attribute.Int("bytes", inFlight),
+	))
+	err := r.writer.Write(key, buf, fence)
+	tracing.SetError(wrSpan, err)
+	wrSpan.End()
+	r.releaseBytes(inFlight)
+
+	return buf, rejected, err
+}
+
+// dlqStage returns the DLQ stage of a conversion error, records rejected by the schema registry are kept apart from
+// conversion failures
+func dlqStage(err error) string {
+	if errors.Is(err, converter.ErrSchemaIncompatible) {
+		return buffer.DLQStageSchema
+	}
+
+	return buffer.DLQStageConverter
+}
+
+// keepLock renews the flush lock every third of its TTL until done is closed, so a slow write doesn't outlive the lock
+func (r *Receiver) keepLock(key string, done chan struct{}) {
+	interval := time.Duration(r.config.RedisLockTTL) * time.Second / 3
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
 			return
+		case <-ticker.C:
+			if !r.buffer.RenewLock(key) {
+				slog.Warn("Lock lost during flush, current write will be skipped", "key", key)
+				metrics.LocksLost.WithLabelValues(key).Inc()
+				return
+			}
 		}
+	}
+}
 
-		for _, item := range recovery {
-			attempts, found := r.recoveryCount[item.Key]
+func (r *Receiver) releaseLock(key string) {
+	err := r.buffer.ReleaseLock(key)
 
-			if !found {
-				attempts = 0
+	if err != nil {
+		slog.Error("Error releasing lock", "error", err, "key", key)
+	}
+}
+
+// TryResendData resends recovery items with their next attempt time reached
+func (r *Receiver) TryResendData() {
+	r.resend()
+}
+
+// runRecovery resends recovery data when its earliest item is due, it is woken up by flushes that push new items. Buffer
+// is also polled every flush interval, because a shared buffer may receive items from other instances.
+func (r *Receiver) runRecovery() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.recoveryStop:
+			slog.Info("Stopping recovery process")
+			return
+		case <-r.recoveryWake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
 			}
+		case <-timer.C:
+		}
+
+		wait := r.interval
+		next := r.resend()
+
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+
+		timer.Reset(wait)
+	}
+}
+
+func (r *Receiver) wakeRecovery() {
+	select {
+	case r.recoveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// backoff returns the delay before the next attempt of a recovery item, doubled on each attempt up to
+// `RecoveryMaxBackoff`, half of it is random jitter so instances don't retry at the same time
+func (r *Receiver) backoff(attempts int) time.Duration {
+	base := time.Duration(r.config.RecoveryBackoff) * time.Second
+	limit := time.Duration(r.config.RecoveryMaxBackoff) * time.Second
+
+	if base <= 0 {
+		base = time.Second
+	}
+
+	if limit < base {
+		limit = base
+	}
+
+	delay := base
+
+	for i := 0; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+
+	if delay > limit {
+		delay = limit
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// resend writes due recovery items, failed ones are scheduled again with backoff and moved to the poison store when
+// they exhaust `RecoveryAttempts`. It returns the earliest next attempt time of remaining items, zero if none remains.
+func (r *Receiver) resend() time.Time {
+	start := time.Now()
+	next := time.Time{}
+
+	if !r.config.TryAutoRecover {
+		return next
+	}
 
-			if attempts > r.config.RecoveryAttempts {
-				slog.Error("Recovery limit reached, stopping receiver", "key", item.Key)
+	if !r.buffer.HasRecovery() {
+		slog.Debug("No recovery data found")
+		return next
+	}
+
+	if !r.recoveryMu.TryLock() {
+		slog.Debug("Recovery is already running")
+		return next
+	}
+
+	defer r.recoveryMu.Unlock()
+
+	recovery, err := r.buffer.GetRecovery()
+
+	if err != nil {
+		slog.Error("Error getting recovery data", "error", err)
+		return next
+	}
+
+	remains := make([]*buffer.RecoveryData, 0)
+	sent := 0
+	attempted := 0
+
+	for _, item := range recovery {
+		if item.IsDue(start) {
+			attempted++
+			err := r.writer.Write(item.Key, bytes.NewBuffer(item.Data), nil)
+
+			if err == nil {
+				slog.Info("Recovery data sent", "key", item.Key, "size", len(item.Data), "attempts", item.Attempts+1)
+				sent++
 				continue
 			}
 
-			buf := bytes.NewBuffer(item.Data)
-			err := r.writer.Write(item.Key, buf)
+			item.Attempts++
+			item.LastError = err.Error()
 
-			if err != nil {
-				slog.Error("Error to try write recovery data", "error", err, "key", item.Key)
-				remains[item.Key] = buf
-				attempts++
-				r.recoveryCount[item.Key] = attempts
-			} else {
-				slog.Info("Recovery data sent", "key", item.Key, "size", len(item.Data))
-				delete(r.recoveryCount, item.Key)
+			if item.Attempts > r.config.RecoveryAttempts {
+				slog.Error("Recovery attempts exhausted, moving data to poison store", "error", err, "key", item.Key, "attempts", item.Attempts)
+				errPoison := r.buffer.PushPoison(item)
+
+				if errPoison == nil {
+					metrics.PoisonBatches.Inc()
+					continue
+				}
+
+				slog.Error("Error pushing to poison store, keeping recovery data", "error", errPoison, "key", item.Key)
 			}
+
+			item.NextAttempt = time.Now().Add(r.backoff(item.Attempts))
+			slog.Warn("Error to try write recovery data", "error", err, "key", item.Key, "attempts", item.Attempts, "next-attempt", item.NextAttempt)
 		}
 
-		err = r.buffer.ClearRecoveryData()
+		remains = append(remains, item)
 
-		if err != nil {
-			slog.Error("Error clearing recovery data", "error", err)
+		if next.IsZero() || item.NextAttempt.Before(next) {
+			next = item.NextAttempt
 		}
+	}
 
-		for key, buf := range remains {
-			slog.Warn("Recovery data remains, pushing to buffer again", "key", key, "lines", buf.Len())
-			err = r.buffer.PushRecovery(key, buf)
+	if attempted == 0 {
+		slog.Debug("No recovery data due", "items", len(recovery), "next-attempt", next)
+		metrics.RecoveryDepth.Set(float64(len(recovery)))
+		return next
+	}
 
-			if err != nil {
-				slog.Error("Error pushing recovery data", "error", err, "key", key)
-			}
+	// only items read are removed, items put by other instances meanwhile are kept
+	read := make(map[string]int)
+
+	for _, item := range recovery {
+		read[item.Key]++
+	}
+
+	failed := make(map[string]bool)
+
+	for key, size := range read {
+		err = r.buffer.RemoveRecovery(key, size)
+
+		if err != nil {
+			slog.Error("Error removing recovery data, keeping it to next attempt", "error", err, "key", key)
+			failed[key] = true
 		}
-	} else {
-		slog.Debug("No recovery data found")
-		return
 	}
 
-	if len(remains) > 0 {
-		slog.Debug("Recovery finished, some data remains", "duration", time.Since(start))
-		return
+	for _, item := range remains {
+		if failed[item.Key] {
+			continue
+		}
+
+		err = r.buffer.PutRecovery(item)
+
+		if err != nil {
+			slog.Error("Error pushing recovery data", "error", err, "key", item.Key)
+		}
 	}
 
-	slog.Info("Auto recovery proccess finished, no data to resend", "duration", time.Since(start))
+	metrics.RecoveryDepth.Set(float64(len(remains)))
+
+	slog.Info("Recovery process finished", "sent", sent, "remains", len(remains), "duration", time.Since(start))
+
+	return next
 }
 
 func (r *Receiver) Flush() error {
@@ -380,16 +1146,10 @@ func (r *Receiver) Flush() error {
 
 	keys := []string{}
 
-	for !r.mu.TryRLock() {
-		slog.Info("Waiting for lock")
-		time.Sleep(1 * time.Second)
-	}
-
-	for key := range r.last {
-		keys = append(keys, key)
-	}
-
-	r.mu.RUnlock()
+	r.keys.Range(func(key, _ any) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
 
 	for _, key := range keys {
 		err := r.flushKey(key, FlushReasonClose)
@@ -405,15 +1165,34 @@ func (r *Receiver) Flush() error {
 	return nil
 }
 
+// Close stops accepting records before closing the update channel, and waits the update process to finish, so no
+// flush is triggered after waiting the triggered ones. Remaining data on buffers is flushed at the end.
 func (r *Receiver) Close() error {
 	slog.Debug("Closing receiver")
-	r.running = false
+
+	r.closeMu.Lock()
+	if r.closed {
+		r.closeMu.Unlock()
+		return ErrReceiverClosed
+	}
+	r.closed = true
 	close(r.update)
+	r.closeMu.Unlock()
+
+	r.running = false
+	<-r.updateDone
+	r.scheduler.stop()
+	r.triggered.Wait()
+	close(r.recoveryStop)
 
 	slog.Info("Stopping receiver, trying to flushing remaining data from buffers")
 
 	r.Flush()
 
+	if r.schemas != nil {
+		return r.schemas.Close()
+	}
+
 	return nil
 }
 
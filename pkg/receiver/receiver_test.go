@@ -14,6 +14,7 @@ import (
 	"github.com/oklog/ulid"
 	"gopkg.in/loremipsum.v1"
 
+	"data2parquet/pkg/buffer"
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
 	"data2parquet/pkg/receiver"
@@ -57,7 +58,7 @@ func TestReceiverPush(t *testing.T) {
 		}
 	}
 
-	outputdir := cfg.WriterFilePath + "/" + filepath.Dir(data[0].GetInfo().Target(domain.MakeID(), domain.GetMD5Sum([]byte("blablabla"))))
+	outputdir := cfg.WriterFilePath + "/" + filepath.Dir(data[0].GetInfo().Target(data[0].EventTime(), domain.MakeID(), domain.GetMD5Sum([]byte("blablabla"))))
 
 	err := rec.Flush()
 
@@ -160,3 +161,72 @@ func getID() *string {
 	ret := ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String()
 	return &ret
 }
+
+func TestReceiverBufferReplay(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:     config.RecordTypeLog,
+		BufferType:     config.BufferTypeDisk,
+		DiskPath:       t.TempDir(),
+		DiskSyncPolicy: config.DiskSyncAlways,
+		WriterType:     config.WriterTypeFile,
+		WriterFilePath: t.TempDir(),
+		BufferSize:     100,
+		FlushInterval:  60,
+	}
+
+	// records left on disk by a previous run that stopped before flushing them
+	buf := buffer.NewDisk(context.Background(), cfg)
+
+	if buf == nil {
+		t.Fatal("Buffer is nil")
+	}
+
+	data := generateData(10)
+
+	for _, record := range data {
+		if _, err := buf.Push(record.Key(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf.Close()
+
+	rec := receiver.NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	err := rec.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := 0
+
+	err = filepath.WalkDir(cfg.WriterFilePath, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && filepath.Ext(path) == ".parquet" {
+			files++
+		}
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files == 0 {
+		t.Error("Replayed records were not written on close")
+	}
+
+	buf = buffer.NewDisk(context.Background(), cfg)
+
+	for _, record := range data {
+		if n := buf.Len(record.Key()); n != 0 {
+			t.Errorf("Key %s still has %d records on disk", record.Key(), n)
+		}
+	}
+
+	buf.Close()
+}
@@ -0,0 +1,96 @@
+package receiver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"data2parquet/pkg/config"
+)
+
+func TestRecoveryBackoff(t *testing.T) {
+	rec := &Receiver{config: &config.Config{RecoveryBackoff: 1, RecoveryMaxBackoff: 8}}
+
+	for attempts := 0; attempts < 10; attempts++ {
+		limit := time.Duration(1<<attempts) * time.Second
+
+		if limit > 8*time.Second {
+			limit = 8 * time.Second
+		}
+
+		delay := rec.backoff(attempts)
+
+		if delay < limit/2 || delay > limit {
+			t.Errorf("Backoff of attempt %d is %s, expected between %s and %s", attempts, delay, limit/2, limit)
+		}
+	}
+}
+
+func TestRecoveryPoison(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:         config.RecordTypeLog,
+		BufferType:         config.BufferTypeMem,
+		WriterType:         config.WriterTypeFile,
+		BufferSize:         100,
+		FlushInterval:      60,
+		FlushWorkers:       4,
+		TryAutoRecover:     true,
+		RecoveryAttempts:   2,
+		RecoveryBackoff:    60,
+		RecoveryMaxBackoff: 120,
+	}
+
+	rec, w, keys := prepareFlushReceiver(t, cfg, 1)
+	defer rec.Close()
+
+	w.delay = 0
+	w.err = errors.New("write failed")
+
+	err := rec.flushKey(keys[0], FlushReasonClose)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovery, _ := rec.buffer.GetRecovery()
+
+	if len(recovery) != 1 || recovery[0].Attempts != 0 || recovery[0].IsDue(time.Now()) {
+		t.Fatal("Failed batch was not scheduled for recovery")
+	}
+
+	// items not due are not retried
+	rec.TryResendData()
+
+	if w.writes[keys[0]] != 1 {
+		t.Errorf("Recovery data retried before its next attempt, %d writes", w.writes[keys[0]])
+	}
+
+	for attempt := 1; attempt <= cfg.RecoveryAttempts+1; attempt++ {
+		recovery, _ = rec.buffer.GetRecovery()
+
+		if len(recovery) != 1 {
+			t.Fatalf("Recovery data lost on attempt %d", attempt)
+		}
+
+		recovery[0].NextAttempt = time.Time{}
+		next := rec.resend()
+
+		if attempt <= cfg.RecoveryAttempts && time.Until(next) < 30*time.Second {
+			t.Errorf("Next attempt %d scheduled in %s, expected backoff", attempt, time.Until(next))
+		}
+	}
+
+	if rec.buffer.HasRecovery() {
+		t.Error("Recovery data remains after attempts exhausted")
+	}
+
+	poison, _ := rec.buffer.GetPoison()
+
+	if len(poison) != 1 || poison[0].Attempts != cfg.RecoveryAttempts+1 || poison[0].LastError != w.err.Error() {
+		t.Error("Exhausted recovery data was not moved to poison store")
+	}
+
+	if w.writes[keys[0]] != cfg.RecoveryAttempts+2 {
+		t.Errorf("Key written %d times, expected %d", w.writes[keys[0]], cfg.RecoveryAttempts+2)
+	}
+}
@@ -0,0 +1,233 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"data2parquet/pkg/buffer"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
+)
+
+// Transform changes a DLQ record before it is converted again, returning an error keeps the record on DLQ
+type Transform func(record domain.Record) (domain.Record, error)
+
+// ReplayRequest is the replay input used by HTTP server and CLI, Keys limits the DLQ keys replayed (all when empty)
+type ReplayRequest struct {
+	Keys      []string        `json:"keys,omitempty"`
+	Transform *FieldTransform `json:"transform,omitempty"`
+}
+
+// FieldTransform is a simple transform to fix records before replay: fields are dropped, then renamed and then set
+type FieldTransform struct {
+	Drop   []string               `json:"drop,omitempty"`
+	Rename map[string]string      `json:"rename,omitempty"`
+	Set    map[string]interface{} `json:"set,omitempty"`
+}
+
+type ReplayResult struct {
+	Total    int              `json:"total"`
+	Replayed int              `json:"replayed"`
+	Failed   []*ReplayFailure `json:"failed"`
+	Duration string           `json:"duration"`
+}
+
+// ReplayFailure counts records of a DLQ key kept on DLQ for the same reason
+type ReplayFailure struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+func (r *ReplayRequest) MakeTransform(recordType string) Transform {
+	if r == nil || r.Transform == nil {
+		return nil
+	}
+
+	return r.Transform.Apply(recordType)
+}
+
+func (t *FieldTransform) Apply(recordType string) Transform {
+	return func(record domain.Record) (domain.Record, error) {
+		data := record.Fields()
+
+		for _, field := range t.Drop {
+			delete(data, field)
+		}
+
+		for from, to := range t.Rename {
+			if v, ok := data[from]; ok {
+				delete(data, from)
+				data[to] = v
+			}
+		}
+
+		for field, v := range t.Set {
+			data[field] = v
+		}
+
+		return domain.Rebuild(recordType, record, data), nil
+	}
+}
+
+// GetDLQ returns DLQ records with their failure envelopes, grouped by key
+func (r *Receiver) GetDLQ() (map[string][]*buffer.DLQEnvelope, error) {
+	return r.buffer.GetDLQ()
+}
+
+// ReplayDLQ reads DLQ records, applies transform (optional) and converts them again. Records converted without errors are
+// written to their normal key, the others are pushed back to DLQ with the new failure on their envelope and counted by
+// reason on the result. Only the entries read of each replayed key are removed from DLQ, after their records are pushed,
+// so entries pushed meanwhile and keys not replayed are kept, and a crash mid-replay doesn't lose entries.
+func (r *Receiver) ReplayDLQ(keys []string, transform Transform) (*ReplayResult, error) {
+	start := time.Now()
+
+	r.replayMu.Lock()
+	defer r.replayMu.Unlock()
+
+	dlq, err := r.buffer.GetDLQ()
+
+	if err != nil {
+		slog.Error("Error getting DLQ", "error", err, "module", "receiver", "function", "ReplayDLQ")
+		return nil, err
+	}
+
+	selected := make(map[string]bool)
+
+	for _, key := range keys {
+		selected[key] = true
+	}
+
+	ret := &ReplayResult{Failed: make([]*ReplayFailure, 0)}
+	failures := make(map[string]map[string]int)
+	depth := 0
+
+	for _, items := range dlq {
+		depth += len(items)
+	}
+
+	fail := func(key string, item *buffer.DLQEnvelope, stage string, err error) {
+		if failures[key] == nil {
+			failures[key] = make(map[string]int)
+		}
+
+		failures[key][fmt.Sprintf("%s: %v", stage, err)]++
+		item.Fail(stage, err, r.instance)
+
+		err = r.buffer.PushDLQ(key, item)
+
+		if err != nil {
+			slog.Error("Error pushing record back to DLQ", "error", err, "key", key, "module", "receiver", "function", "ReplayDLQ")
+			return
+		}
+
+		depth++
+		metrics.DLQRecords.WithLabelValues(stage).Inc()
+	}
+
+	for key, items := range dlq {
+		if len(selected) > 0 && !selected[key] {
+			continue
+		}
+
+		ret.Total += len(items)
+
+		// records are grouped by their key after transform, it may route them to another key
+		groups := make(map[string][]domain.Record)
+		sources := make(map[domain.Record]*buffer.DLQEnvelope)
+
+		for _, item := range items {
+			fixed := item.Record
+
+			if transform != nil {
+				fixed, err = transform(item.Record)
+
+				if err == nil && fixed == nil {
+					err = errors.New("transform returned no record")
+				}
+
+				if err != nil {
+					fail(key, item, buffer.DLQStageTransform, err)
+					continue
+				}
+			}
+
+			sources[fixed] = item
+			groups[fixed.Key()] = append(groups[fixed.Key()], fixed)
+		}
+
+		for target, group := range groups {
+			result := r.converter.Check(target, group)
+			failed := make(map[domain.Record]bool)
+
+			for _, res := range result {
+				if res.Error == nil {
+					continue
+				}
+
+				// an error without record fails the whole group
+				if res.Record == nil {
+					for _, record := range group {
+						if !failed[record] {
+							failed[record] = true
+							fail(key, sources[record], buffer.DLQStageConverter, res.Error)
+						}
+					}
+					break
+				}
+
+				if !failed[res.Record] {
+					failed[res.Record] = true
+					fail(key, sources[res.Record], dlqStage(res.Error), res.Error)
+				}
+			}
+
+			for _, record := range group {
+				if failed[record] {
+					continue
+				}
+
+				// processors already ran when the record was received
+				_, err = r.push(record)
+
+				if err != nil {
+					fail(key, sources[record], buffer.DLQStageWriter, err)
+					continue
+				}
+
+				ret.Replayed++
+			}
+		}
+
+		err = r.buffer.RemoveDLQ(key, len(items))
+
+		if err != nil {
+			slog.Error("Error removing replayed entries from DLQ", "error", err, "key", key, "module", "receiver", "function", "ReplayDLQ")
+			return nil, err
+		}
+
+		depth -= len(items)
+	}
+
+	for key, reasons := range failures {
+		for reason, count := range reasons {
+			ret.Failed = append(ret.Failed, &ReplayFailure{Key: key, Reason: reason, Count: count})
+		}
+	}
+
+	sort.Slice(ret.Failed, func(i, j int) bool {
+		if ret.Failed[i].Key != ret.Failed[j].Key {
+			return ret.Failed[i].Key < ret.Failed[j].Key
+		}
+		return ret.Failed[i].Reason < ret.Failed[j].Reason
+	})
+
+	metrics.DLQDepth.Set(float64(depth))
+	ret.Duration = time.Since(start).String()
+
+	slog.Info("DLQ replay finished", "total", ret.Total, "replayed", ret.Replayed, "failed", ret.Total-ret.Replayed, "duration", ret.Duration, "module", "receiver", "function", "ReplayDLQ")
+
+	return ret, nil
+}
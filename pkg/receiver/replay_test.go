@@ -0,0 +1,198 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"data2parquet/pkg/buffer"
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+)
+
+func TestReplayDLQ(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    100,
+		FlushInterval: 60,
+		UseDLQ:        true,
+	}
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	defer rec.Close()
+
+	for _, message := range []string{"ok-1", "bad", "ok-2"} {
+		record := domain.NewRecord(cfg.RecordType, map[string]interface{}{
+			"time":                time.Now().Format(time.RFC3339Nano),
+			"message":             message,
+			"business-capability": "capability",
+			"business-domain":     "domain",
+			"business-service":    "broken-service",
+			"application-service": "application",
+		})
+
+		err := rec.buffer.PushDLQ(record.Key(), buffer.NewDLQEnvelope(record.Key(), record, buffer.DLQStageConverter, errors.New("conversion failed"), "test"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := domain.NewRecord(cfg.RecordType, map[string]interface{}{"message": "other", "business-service": "other-service"})
+	err := rec.buffer.PushDLQ(other.Key(), buffer.NewDLQEnvelope(other.Key(), other, buffer.DLQStageConverter, errors.New("conversion failed"), "test"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dlq, _ := rec.buffer.GetDLQ()
+	key := ""
+
+	for k := range dlq {
+		if k != other.Key() {
+			key = k
+		}
+	}
+
+	fix := (&FieldTransform{Set: map[string]interface{}{"business-service": "fixed-service"}}).Apply(cfg.RecordType)
+
+	transform := func(record domain.Record) (domain.Record, error) {
+		if record.(*domain.Log).Message == "bad" {
+			return nil, errors.New("can't fix")
+		}
+		return fix(record)
+	}
+
+	result, err := rec.ReplayDLQ([]string{key}, transform)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Total != 3 || result.Replayed != 2 {
+		t.Errorf("Replay result total %d replayed %d, expected 3 and 2", result.Total, result.Replayed)
+	}
+
+	if len(result.Failed) != 1 || result.Failed[0].Key != key || result.Failed[0].Count != 1 || result.Failed[0].Reason != "transform: can't fix" {
+		t.Errorf("Unexpected replay failures: %+v", result.Failed)
+	}
+
+	fixed := domain.NewRecord(cfg.RecordType, map[string]interface{}{
+		"business-capability": "capability",
+		"business-domain":     "domain",
+		"business-service":    "fixed-service",
+		"application-service": "application",
+	}).Key()
+
+	if rec.buffer.Len(fixed) != 2 {
+		t.Errorf("Replayed records were not written to their key, %d records on %s", rec.buffer.Len(fixed), fixed)
+	}
+
+	dlq, _ = rec.buffer.GetDLQ()
+
+	if len(dlq[key]) != 1 || dlq[key][0].Record.(*domain.Log).Message != "bad" {
+		t.Fatal("Failed record was not kept on DLQ")
+	}
+
+	if dlq[key][0].Stage != buffer.DLQStageTransform || dlq[key][0].Error != "can't fix" || dlq[key][0].Attempts != 2 || dlq[key][0].Instance != rec.instance {
+		t.Errorf("Failed record envelope was not updated: %+v", dlq[key][0])
+	}
+
+	if len(dlq[other.Key()]) != 1 || dlq[other.Key()][0].Attempts != 1 {
+		t.Error("Record of a key not replayed was changed on DLQ")
+	}
+}
+
+func TestFieldTransform(t *testing.T) {
+	record := domain.NewRecord(config.RecordTypeLog, map[string]interface{}{
+		"message":    "message",
+		"level":      "error",
+		"session-id": "session",
+	})
+
+	transform := &FieldTransform{
+		Drop:   []string{"level"},
+		Rename: map[string]string{"session-id": "correlation-id"},
+		Set:    map[string]interface{}{"region": "us-east-1"},
+	}
+
+	ret, err := transform.Apply(config.RecordTypeLog)(record)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := ret.(*domain.Log)
+
+	if log.Level != domain.LevelInfo || log.Message != "message" {
+		t.Errorf("Unexpected level %s or message %s", log.Level, log.Message)
+	}
+
+	if log.SessionId != nil && len(*log.SessionId) > 0 {
+		t.Errorf("Renamed field was kept: %s", *log.SessionId)
+	}
+
+	if log.CorrelationId == nil || *log.CorrelationId != "session" {
+		t.Error("Field was not renamed")
+	}
+
+	if log.Region == nil || *log.Region != "us-east-1" {
+		t.Error("Field was not set")
+	}
+}
+
+func TestWriteDLQ(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    100,
+		FlushInterval: 60,
+		Processors:    []*config.ProcessorConfig{{Type: config.ProcessorTypeRedact, Values: []string{"message"}, Pattern: `\d{4}-\d{4}`, Replace: "####"}},
+	}
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	defer rec.Close()
+
+	record := domain.NewRecord(cfg.RecordType, map[string]interface{}{"message": "card 1234-5678", "business-service": "full-service"})
+	cause := errors.New("buffer is full")
+
+	if err := rec.WriteDLQ([]domain.Record{record}, buffer.DLQStageBuffer, cause); !errors.Is(err, ErrDLQDisabled) {
+		t.Errorf("Expected DLQ disabled error, got %v", err)
+	}
+
+	cfg.UseDLQ = true
+
+	if err := rec.WriteDLQ([]domain.Record{record}, buffer.DLQStageBuffer, cause); err != nil {
+		t.Fatal(err)
+	}
+
+	dlq, _ := rec.buffer.GetDLQ()
+	items := dlq[record.Key()]
+
+	if len(items) != 1 || items[0].Stage != buffer.DLQStageBuffer || items[0].Error != cause.Error() {
+		t.Fatalf("Unexpected DLQ entries %v", items)
+	}
+
+	// processors run before records are stored on DLQ
+	if message := items[0].Record.(*domain.Log).Message; message != "card ####" {
+		t.Errorf("Processors were not run on DLQ record, message is %q", message)
+	}
+
+	if rec.buffer.Len(record.Key()) != 0 {
+		t.Error("Record must not be pushed to buffer")
+	}
+}
@@ -0,0 +1,213 @@
+package receiver
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// scheduler keeps the next interval flush deadline of each key on a min-heap, a single goroutine waits for the closest
+// deadline and sends due keys to a bounded pool of workers
+type scheduler struct {
+	interval time.Duration
+	idle     time.Duration
+	flush    func(key string)
+	expire   func(key string) bool
+	deadline deadlines
+	items    map[string]*deadline
+	mu       sync.Mutex
+	wake     chan struct{}
+	jobs     chan string
+	done     chan struct{}
+	stopped  chan struct{}
+	wg       sync.WaitGroup
+}
+
+type deadline struct {
+	key  string
+	at   time.Time
+	seen time.Time
+}
+
+// newScheduler starts the scheduler, flush is called by workers when a key deadline is reached and expire is called
+// for keys without new records for idle time, returning true if the key can stop being tracked
+func newScheduler(interval time.Duration, idle time.Duration, workers int, flush func(key string), expire func(key string) bool) *scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if idle < interval {
+		idle = 10 * interval
+	}
+
+	ret := &scheduler{
+		interval: interval,
+		idle:     idle,
+		flush:    flush,
+		expire:   expire,
+		deadline: make(deadlines, 0),
+		items:    make(map[string]*deadline),
+		wake:     make(chan struct{}, 1),
+		jobs:     make(chan string, workers),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		ret.wg.Add(1)
+		go ret.work()
+	}
+
+	go ret.run()
+
+	return ret
+}
+
+// touch registers activity on a key, a new key gets its first deadline one interval from now
+func (s *scheduler) touch(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if item, found := s.items[key]; found {
+		item.seen = now
+		return
+	}
+
+	item := &deadline{key: key, at: now.Add(s.interval), seen: now}
+	s.items[key] = item
+	heap.Push(&s.deadline, item)
+
+	s.notify()
+}
+
+// len returns the number of keys tracked by the scheduler
+func (s *scheduler) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.items)
+}
+
+// stop waits for running flushes, keys still scheduled are not flushed
+func (s *scheduler) stop() {
+	close(s.done)
+	<-s.stopped
+	s.wg.Wait()
+}
+
+// notify must be called with the lock held
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) run() {
+	defer close(s.stopped)
+	defer close(s.jobs)
+
+	for {
+		s.mu.Lock()
+		wait := s.interval
+
+		if len(s.deadline) > 0 {
+			wait = time.Until(s.deadline[0].at)
+		}
+
+		s.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		for _, key := range s.due() {
+			select {
+			case s.jobs <- key:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// due removes keys with past deadlines from the heap, they are scheduled again when their flush is finished
+func (s *scheduler) due() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ret := make([]string, 0)
+
+	for len(s.deadline) > 0 && !s.deadline[0].at.After(now) {
+		item := heap.Pop(&s.deadline).(*deadline)
+		ret = append(ret, item.key)
+	}
+
+	return ret
+}
+
+func (s *scheduler) work() {
+	defer s.wg.Done()
+
+	for key := range s.jobs {
+		s.flush(key)
+		s.finish(key)
+	}
+}
+
+func (s *scheduler) finish(key string) {
+	s.mu.Lock()
+	item := s.items[key]
+	idle := time.Since(item.seen) >= s.idle
+	s.mu.Unlock()
+
+	expired := idle && s.expire(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a record may have arrived while the key was expiring, in this case it keeps being tracked
+	if expired && time.Since(item.seen) >= s.idle {
+		delete(s.items, key)
+		slog.Debug("Idle key expired from flush scheduler", "key", key, "idle", time.Since(item.seen))
+		return
+	}
+
+	item.at = time.Now().Add(s.interval)
+	heap.Push(&s.deadline, item)
+
+	s.notify()
+}
+
+// deadlines implements heap.Interface ordered by the next flush time
+type deadlines []*deadline
+
+func (d deadlines) Len() int { return len(d) }
+
+func (d deadlines) Less(i, j int) bool { return d[i].at.Before(d[j].at) }
+
+func (d deadlines) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+func (d *deadlines) Push(x any) {
+	*d = append(*d, x.(*deadline))
+}
+
+func (d *deadlines) Pop() any {
+	old := *d
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*d = old[:n-1]
+	return item
+}
@@ -0,0 +1,73 @@
+package receiver
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	interval := 50 * time.Millisecond
+	mu := sync.Mutex{}
+	flushes := make(map[string]int)
+	running := 0
+	maxRunning := 0
+
+	flush := func(key string) {
+		mu.Lock()
+		flushes[key]++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+
+	expire := func(key string) bool {
+		return key != "keep"
+	}
+
+	s := newScheduler(interval, 3*interval, 4, flush, expire)
+
+	for i := 0; i < 8; i++ {
+		s.touch(fmt.Sprintf("key-%d", i))
+	}
+
+	s.touch("keep")
+
+	time.Sleep(2 * interval)
+
+	mu.Lock()
+	for i := 0; i < 8; i++ {
+		if flushes[fmt.Sprintf("key-%d", i)] == 0 {
+			t.Errorf("key-%d was not flushed", i)
+		}
+	}
+
+	if maxRunning < 2 || maxRunning > 4 {
+		t.Errorf("Flushes running in parallel: %d, expected between 2 and 4", maxRunning)
+	}
+	mu.Unlock()
+
+	time.Sleep(6 * interval)
+
+	if s.len() != 1 {
+		t.Errorf("Idle keys were not expired, %d keys tracked", s.len())
+	}
+
+	s.stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if flushes["keep"] < 3 {
+		t.Errorf("Key not expired was flushed %d times, expected at least 3", flushes["keep"])
+	}
+}
@@ -0,0 +1,159 @@
+package receiver
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"data2parquet/pkg/buffer"
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/registry"
+)
+
+func TestSchemaRegistryDLQ(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:         config.RecordTypeDynamic,
+		BufferType:         config.BufferTypeMem,
+		WriterType:         config.WriterTypeFile,
+		WriterFilePath:     t.TempDir(),
+		BufferSize:         100,
+		FlushInterval:      60,
+		UseDLQ:             true,
+		SchemaRegistry:     config.SchemaRegistryFile,
+		SchemaRegistryPath: t.TempDir(),
+	}
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	defer rec.Close()
+
+	key := ""
+
+	for _, batch := range [][]interface{}{{1.0, 2.0}, {"three", 4.5}, {"five"}} {
+		for _, value := range batch {
+			record := domain.NewRecord(cfg.RecordType, map[string]interface{}{"service": "schema", "value": value})
+			key = record.Key()
+
+			if err := rec.Write(record); err != nil {
+				t.Fatalf("Error writing record: %s", err)
+			}
+		}
+
+		if err := rec.flushKey(key, FlushReasonClose); err != nil {
+			t.Fatalf("Error flushing key: %s", err)
+		}
+	}
+
+	dlq, err := rec.buffer.GetDLQ()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dlq[key]) != 2 {
+		t.Fatalf("Expected 2 records on DLQ, got %v", dlq)
+	}
+
+	// the batch with all records rejected doesn't write a file
+	files := 0
+
+	err = filepath.WalkDir(cfg.WriterFilePath, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && strings.HasSuffix(path, ".parquet") {
+			files++
+		}
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files != 2 {
+		t.Errorf("Expected 2 files written, got %d", files)
+	}
+
+	item := dlq[key][0]
+
+	if item.Stage != buffer.DLQStageSchema || !strings.Contains(item.Error, `field "value" is string, expected int`) {
+		t.Errorf("Unexpected DLQ entry %s: %s", item.Stage, item.Error)
+	}
+
+	reg, err := registry.NewFile(cfg.SchemaRegistryPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// value widened to double by the second batch
+	if versions, _ := reg.Versions(key); len(versions) != 2 {
+		t.Errorf("Expected 2 schema versions, got %d", len(versions))
+	}
+}
+
+func TestSchemaDLQRetry(t *testing.T) {
+	cfg := &config.Config{
+		RecordType:         config.RecordTypeDynamic,
+		BufferType:         config.BufferTypeMem,
+		WriterType:         config.WriterTypeFile,
+		BufferSize:         100,
+		FlushInterval:      60,
+		UseDLQ:             true,
+		SchemaRegistry:     config.SchemaRegistryFile,
+		SchemaRegistryPath: t.TempDir(),
+	}
+
+	rec := NewReceiver(context.Background(), cfg)
+
+	if rec == nil {
+		t.Fatal("Receiver is nil")
+	}
+
+	defer rec.Close()
+
+	// the batch with a rejected record fails to be written once and goes back to buffer
+	w := &failingWriter{fail: map[int]bool{2: true}}
+	rec.writer = w
+	key := ""
+
+	for _, batch := range [][]interface{}{{1.0}, {"two", 3.0}} {
+		for _, value := range batch {
+			record := domain.NewRecord(cfg.RecordType, map[string]interface{}{"service": "retry", "value": value})
+			key = record.Key()
+
+			if _, err := rec.buffer.Push(key, record); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := rec.flushKey(key, FlushReasonClose); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rec.buffer.Len(key) != 2 {
+		t.Fatalf("Failed batch must go back to buffer, got %d records", rec.buffer.Len(key))
+	}
+
+	dlq, _ := rec.buffer.GetDLQ()
+
+	if len(dlq[key]) != 0 {
+		t.Fatalf("Rejected records of a batch returned to buffer must not go to DLQ, got %d", len(dlq[key]))
+	}
+
+	if err := rec.flushKey(key, FlushReasonClose); err != nil {
+		t.Fatal(err)
+	}
+
+	dlq, _ = rec.buffer.GetDLQ()
+
+	if len(dlq[key]) != 1 || w.written != 2 {
+		t.Errorf("Expected 1 record on DLQ and 2 files, got %d and %d", len(dlq[key]), w.written)
+	}
+}
@@ -0,0 +1,161 @@
+package receiver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/tracing"
+)
+
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+
+	prevProvider := otel.GetTracerProvider()
+	prevPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	defer func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	}()
+
+	cfg := &config.Config{
+		RecordType:    config.RecordTypeLog,
+		BufferType:    config.BufferTypeMem,
+		WriterType:    config.WriterTypeFile,
+		BufferSize:    100,
+		FlushInterval: 60,
+	}
+
+	rec, _, _ := prepareFlushReceiver(t, cfg, 0)
+	defer rec.Close()
+
+	record := &domain.Log{
+		Level:              "INFO",
+		Message:            "message",
+		Time:               time.Now().Format(time.RFC3339Nano),
+		BusinessCapability: "business_capability",
+		BusinessDomain:     "business_domain",
+		BusinessService:    "tracing_service",
+		ApplicationService: "application_service",
+	}
+	key := record.Key()
+
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(tracing.Middleware())
+	engine.POST("/record/", func(c *gin.Context) {
+		err := rec.WriteContext(c.Request.Context(), record)
+
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		c.Status(http.StatusCreated)
+	})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/record/", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp := httptest.NewRecorder()
+	engine.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Response status %d, expected %d", resp.Code, http.StatusCreated)
+	}
+
+	err := rec.flushKey(key, FlushReasonClose)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+
+	server := findSpan(spans, "POST /record/")
+
+	if server == nil {
+		t.Fatal("HTTP server span not found")
+	}
+
+	if server.SpanContext().TraceID().String() != traceID {
+		t.Errorf("HTTP server span trace %s, expected incoming trace %s", server.SpanContext().TraceID(), traceID)
+	}
+
+	write := findSpan(spans, "Receiver.Write")
+
+	if write == nil {
+		t.Fatal("Receiver.Write span not found")
+	}
+
+	if write.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Receiver.Write span parent %s, expected HTTP server span %s", write.Parent().SpanID(), server.SpanContext().SpanID())
+	}
+
+	flush := findSpan(spans, "Receiver.flushKey")
+
+	if flush == nil {
+		t.Fatal("Receiver.flushKey span not found")
+	}
+
+	if v := spanAttribute(flush, "key").AsString(); v != key {
+		t.Errorf("Flush key attribute %s, expected %s", v, key)
+	}
+
+	if v := spanAttribute(flush, "reason").AsString(); v != string(FlushReasonClose) {
+		t.Errorf("Flush reason attribute %s, expected %s", v, FlushReasonClose)
+	}
+
+	if v := spanAttribute(flush, "records").AsInt64(); v != 1 {
+		t.Errorf("Flush records attribute %d, expected 1", v)
+	}
+
+	for _, name := range []string{"Converter.Write", "Writer.Write"} {
+		span := findSpan(spans, name)
+
+		if span == nil {
+			t.Errorf("%s span not found", name)
+			continue
+		}
+
+		if span.Parent().SpanID() != flush.SpanContext().SpanID() {
+			t.Errorf("%s span parent %s, expected flush span %s", name, span.Parent().SpanID(), flush.SpanContext().SpanID())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File stores the versions of each key as a JSON array on `<path>/<key>.json`. Files are replaced atomically, but
+// versions are only checked inside this process, instances sharing schemas must use the Redis registry.
+type File struct {
+	path string
+	mu   *sync.Mutex
+}
+
+func NewFile(path string) (*File, error) {
+	err := os.MkdirAll(path, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{path: path, mu: &sync.Mutex{}}, nil
+}
+
+func (f *File) fileName(key string) string {
+	return filepath.Join(f.path, url.PathEscape(key)+".json")
+}
+
+func (f *File) read(key string) ([]*Schema, error) {
+	data, err := os.ReadFile(f.fileName(key))
+
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Schema{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Schema, 0)
+	err = json.Unmarshal(data, &ret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (f *File) Latest(key string) (*Schema, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	versions, err := f.read(key)
+
+	if err != nil || len(versions) == 0 {
+		return nil, err
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+func (f *File) Register(schema *Schema) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	versions, err := f.read(schema.Key)
+
+	if err != nil {
+		return err
+	}
+
+	err = checkNext(schema.Key, len(versions), schema)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(append(versions, schema))
+
+	if err != nil {
+		return err
+	}
+
+	name := f.fileName(schema.Key)
+	tmp := name + ".tmp"
+
+	err = os.WriteFile(tmp, data, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, name)
+
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Schema registered", "key", schema.Key, "version", schema.Version, "file", name, "module", "registry.file", "function", "Register")
+
+	return nil
+}
+
+func (f *File) Versions(key string) ([]*Schema, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.read(key)
+}
+
+func (f *File) Close() error {
+	return nil
+}
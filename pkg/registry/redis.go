@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+
+	"data2parquet/pkg/buffer"
+	"data2parquet/pkg/config"
+)
+
+// registerScript appends a version (ARGV[2]) to the versions list of a key (KEYS[1]) only when it is the next one
+// (ARGV[1]), so instances registering the same key at the same time don't overwrite each other. It returns the current
+// number of versions when the version is not the next one.
+var registerScript = redis.NewScript(`
+local count = redis.call('LLEN', KEYS[1])
+
+if count ~= tonumber(ARGV[1]) - 1 then
+	return count
+end
+
+redis.call('RPUSH', KEYS[1], ARGV[2])
+return -1
+`)
+
+// Redis stores the versions of each key as a list of JSON on `<RedisSchemaPrefix>:<key>`, shared by all instances
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+	ctx    context.Context
+}
+
+// NewRedis returns a Redis registry, client is created from config when nil
+func NewRedis(cfg *config.Config, client redis.UniversalClient) (*Redis, error) {
+	if client == nil {
+		client = buffer.NewClient(cfg)
+	}
+
+	ret := &Redis{client: client, prefix: cfg.RedisSchemaPrefix, ctx: context.Background()}
+
+	err := client.Ping(ret.ctx).Err()
+
+	if err != nil {
+		return nil, fmt.Errorf("redis schema registry is not ready: %w", err)
+	}
+
+	return ret, nil
+}
+
+func (r *Redis) makeKey(key string) string {
+	return r.prefix + ":" + key
+}
+
+func (r *Redis) Latest(key string) (*Schema, error) {
+	data, err := r.client.LIndex(r.ctx, r.makeKey(key), -1).Bytes()
+
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Schema{}
+	err = json.Unmarshal(data, ret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (r *Redis) Register(schema *Schema) error {
+	data, err := json.Marshal(schema)
+
+	if err != nil {
+		return err
+	}
+
+	count, err := registerScript.Run(r.ctx, r.client, []string{r.makeKey(schema.Key)}, schema.Version, data).Int()
+
+	if err != nil {
+		return err
+	}
+
+	if count >= 0 {
+		return checkNext(schema.Key, count, schema)
+	}
+
+	slog.Info("Schema registered", "key", schema.Key, "version", schema.Version, "module", "registry.redis", "function", "Register")
+
+	return nil
+}
+
+func (r *Redis) Versions(key string) ([]*Schema, error) {
+	items, err := r.client.LRange(r.ctx, r.makeKey(key), 0, -1).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Schema, 0, len(items))
+
+	for _, item := range items {
+		schema := &Schema{}
+		err = json.Unmarshal([]byte(item), schema)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, schema)
+	}
+
+	return ret, nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
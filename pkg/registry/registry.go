@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/logger" // "log/slog"
+)
+
+var slog = logger.GetLogger()
+
+// ErrVersionConflict is returned by `Register` when the version is not the next one of its key, e.g. another instance
+// registered a schema first. Load `Latest` and check the schema again.
+var ErrVersionConflict = errors.New("schema version conflict")
+
+// Schema is a registered version of the schema of a key. Columns is the converter description of the schema, used to
+// check new records, and Parquet the xitongsys JSON schema files of this version are written with.
+type Schema struct {
+	Key     string          `json:"key"`
+	Version int             `json:"version"`
+	Columns json.RawMessage `json:"columns"`
+	Parquet string          `json:"parquet"`
+	Created time.Time       `json:"created"`
+}
+
+// Registry stores the schema versions of each key, versions start at 1 and are only appended
+type Registry interface {
+	// Latest returns the last version of a key schema, nil when the key has no schema yet
+	Latest(key string) (*Schema, error)
+	// Register appends a schema version, it must be the version after `Latest`
+	Register(schema *Schema) error
+	// Versions returns all versions of a key schema, oldest first
+	Versions(key string) ([]*Schema, error)
+	Close() error
+}
+
+// New returns the registry set by `SchemaRegistry`, nil when it is disabled or records are not `dynamic` (`log` records
+// have a fixed schema)
+func New(cfg *config.Config) (Registry, error) {
+	if cfg.RecordType != config.RecordTypeDynamic {
+		return nil, nil
+	}
+
+	switch cfg.SchemaRegistry {
+	case "", config.SchemaRegistryNone:
+		return nil, nil
+	case config.SchemaRegistryFile:
+		return NewFile(cfg.SchemaRegistryPath)
+	case config.SchemaRegistryRedis:
+		return NewRedis(cfg, nil)
+	default:
+		return nil, fmt.Errorf("unknown schema registry %q", cfg.SchemaRegistry)
+	}
+}
+
+func checkNext(key string, latest int, schema *Schema) error {
+	if schema.Version != latest+1 {
+		slog.Warn("Schema version conflict", "key", key, "version", schema.Version, "latest", latest, "module", "registry", "function", "Register")
+		return fmt.Errorf("%w: key %s is on version %d, got %d", ErrVersionConflict, key, latest, schema.Version)
+	}
+
+	return nil
+}
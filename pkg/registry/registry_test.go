@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"data2parquet/pkg/config"
+)
+
+func TestFile(t *testing.T) {
+	path := t.TempDir()
+	reg, err := NewFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "capability:domain:service/a:application"
+
+	latest, err := reg.Latest(key)
+
+	if err != nil || latest != nil {
+		t.Fatalf("Expected no schema, got %v %v", latest, err)
+	}
+
+	for version := 1; version <= 2; version++ {
+		err = reg.Register(&Schema{Key: key, Version: version, Columns: json.RawMessage(`{"kind":"group"}`), Parquet: "{}"})
+
+		if err != nil {
+			t.Fatalf("Error registering version %d: %s", version, err)
+		}
+	}
+
+	err = reg.Register(&Schema{Key: key, Version: 2, Columns: json.RawMessage(`{}`)})
+
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected version conflict, got %v", err)
+	}
+
+	// versions are read back by a new registry on the same path
+	reg, err = NewFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err = reg.Latest(key)
+
+	if err != nil || latest == nil || latest.Version != 2 || string(latest.Columns) != `{"kind":"group"}` {
+		t.Fatalf("Unexpected latest schema %+v %v", latest, err)
+	}
+
+	versions, err := reg.Versions(key)
+
+	if err != nil || len(versions) != 2 || versions[0].Version != 1 {
+		t.Errorf("Unexpected versions %v %v", versions, err)
+	}
+
+	if versions, _ := reg.Versions("other"); len(versions) != 0 {
+		t.Errorf("Versions must be kept by key, got %v", versions)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := map[*config.Config]bool{
+		{RecordType: config.RecordTypeDynamic, SchemaRegistry: config.SchemaRegistryNone}:                                  false,
+		{RecordType: config.RecordTypeLog, SchemaRegistry: config.SchemaRegistryFile, SchemaRegistryPath: t.TempDir()}:     false,
+		{RecordType: config.RecordTypeDynamic, SchemaRegistry: config.SchemaRegistryFile, SchemaRegistryPath: t.TempDir()}: true,
+	}
+
+	for cfg, enabled := range tests {
+		reg, err := New(cfg)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (reg != nil) != enabled {
+			t.Errorf("Registry of %s records with %s: expected enabled %v", cfg.RecordType, cfg.SchemaRegistry, enabled)
+		}
+	}
+
+	if _, err := New(&config.Config{RecordType: config.RecordTypeDynamic, SchemaRegistry: "zookeeper"}); err == nil {
+		t.Error("Unknown registry must be an error")
+	}
+}
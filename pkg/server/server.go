@@ -5,7 +5,9 @@ import (
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/handler"
 	"data2parquet/pkg/logger" // "log/slog"
+	"data2parquet/pkg/metrics"
 	"data2parquet/pkg/receiver"
+	"data2parquet/pkg/tracing"
 	"fmt"
 	"os"
 
@@ -50,9 +52,13 @@ func NewServer(ctx context.Context, config *config.Config) *Server {
 	}
 
 	s.engine = gin.Default()
+	s.engine.Use(tracing.Middleware())
 	s.engine.POST("/record/", s.handler.Write)
 	s.engine.POST("/flush/", s.handler.Flush)
+	s.engine.GET("/dlq/", s.handler.GetDLQ)
+	s.engine.POST("/dlq/replay/", s.handler.ReplayDLQ)
 	s.engine.GET("/healthcheck/", s.handler.Healthcheck)
+	s.engine.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	s.srv = &http.Server{
 		Addr:    s.makeAddress(),
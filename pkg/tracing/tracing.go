@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"data2parquet/pkg/config"
+	"data2parquet/pkg/logger" // "log/slog"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var slog = logger.GetLogger()
+
+const Name = "data2parquet"
+
+// Tracer returns the tracer of pipeline spans, it is taken from the global provider on each call so `Init` (or a test
+// provider) set after packages are loaded is used
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// Init sets the global tracer provider with the exporter on `TracingExporter` and W3C trace context propagation. The
+// returned function flushes pending spans and stops the provider, with `none` exporter spans are not recorded.
+func Init(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch cfg.TracingExporter {
+	case config.TracingExporterStdout:
+		exporter, err = stdouttrace.New()
+	case config.TracingExporterOTLP:
+		opts := make([]otlptracehttp.Option, 0)
+
+		if len(cfg.TracingEndpoint) > 0 {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.TracingEndpoint))
+		}
+
+		if cfg.TracingInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		slog.Debug("Tracing is disabled", "module", "tracing", "function", "Init")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if err != nil {
+		slog.Error("Error creating tracing exporter", "error", err, "exporter", cfg.TracingExporter, "module", "tracing", "function", "Init")
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.TracingServiceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	slog.Info("Tracing initialized", "exporter", cfg.TracingExporter, "endpoint", cfg.TracingEndpoint, "module", "tracing", "function", "Init")
+
+	return provider.Shutdown, nil
+}
+
+// SetError marks span as failed when err is not nil
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Middleware starts a server span for each request, continuing the trace of incoming headers (`traceparent`). The
+// request context carries the span to handlers.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+
+		if len(route) == 0 {
+			route = c.Request.URL.Path
+		}
+
+		ctx, span := Tracer().Start(ctx, fmt.Sprintf("%s %s", c.Request.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
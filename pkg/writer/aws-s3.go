@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"io"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -15,8 +17,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/smithy-go"
 
+	"data2parquet/pkg/chain"
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
 )
 
 type S3 struct {
@@ -142,35 +146,133 @@ func (s *S3) CheckBucket() error {
 	return err
 }
 
-func (s *S3) Write(key string, buf *bytes.Buffer) error {
+func (s *S3) Write(key string, buf *bytes.Buffer, token *Token) (err error) {
 	start := time.Now()
+	defer func() { metrics.ObserveWriter(config.WriterTypeAWSS3, buf.Len(), start, err) }()
 	recInfo := domain.NewRecordInfoFromKey(s.config.RecordType, key)
 	id := domain.MakeID()
 	var hash = ""
 	if s.config.UseHash {
 		hash = "-" + domain.GetMD5Sum(buf.Bytes())
 	}
-	s3Key := recInfo.Target(id, hash)
+	s3Key := targetPath(recInfo, buf.Bytes(), id, hash)
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.config.S3BuketName),
+		Key:    aws.String(s3Key),
+		Body:   bytes.NewReader(buf.Bytes()),
+	}
 
-	_, err := s.client.PutObject(
-		s.ctx,
-		&s3.PutObjectInput{
-			Bucket: aws.String(s.config.S3BuketName),
-			Key:    aws.String(s3Key),
-			Body:   bytes.NewReader(buf.Bytes()),
-		},
-	)
+	if token != nil {
+		input.Metadata = map[string]string{"fencing-token": strconv.FormatInt(token.Value, 10)}
+	}
+
+	if token.IsStale() {
+		slog.Warn("Fencing token is stale, skipping write", "module", "writer.s3", "function", "Write", "key", key, "file", s3Key, "token", token.Value)
+		return ErrStaleToken
+	}
+
+	_, err = s.client.PutObject(s.ctx, input)
 
 	if err != nil {
 		slog.Error("Error writing to S3", "error", err, "module", "writer.s3", "function", "Write", "key", key)
 		return err
 	}
 
+	if s.config.AuditChain {
+		err = s.writeChain(s3Key, buf.Bytes())
+
+		if err != nil {
+			slog.Error("Error writing chain link to S3", "error", err, "module", "writer.s3", "function", "Write", "key", key, "file", s3Key)
+			return err
+		}
+	}
+
 	slog.Info("S3 written", "file", s3Key, "duration", time.Since(start), "file-size", buf.Len(), "bucket", s.config.S3BuketName)
 
 	return nil
 }
 
+// writeChain stores the sidecar manifest of a chained file and sets it as its key chain head
+func (s *S3) writeChain(s3Key string, data []byte) error {
+	link, err := chain.NewLink(s3Key, data)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.put(chain.ManifestPath(s3Key), link.ToJson())
+
+	if err != nil {
+		return err
+	}
+
+	return s.put(chain.HeadPath(link.Key), link.ToJson())
+}
+
+func (s *S3) put(s3Key string, data []byte) error {
+	_, err := s.client.PutObject(s.ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.config.S3BuketName),
+		Key:    aws.String(s3Key),
+		Body:   bytes.NewReader(data),
+	})
+
+	return err
+}
+
+func (s *S3) ChainHead(key string) (*chain.Link, error) {
+	data, err := s.Read(chain.HeadPath(key))
+
+	var notFound *types.NoSuchKey
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.ParseLink(data)
+}
+
+func (s *S3) Read(s3Key string) ([]byte, error) {
+	out, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.S3BuketName),
+		Key:    aws.String(s3Key),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer out.Body.Close()
+
+	return io.ReadAll(out.Body)
+}
+
+// List returns the keys of objects under prefix
+func (s *S3) List(prefix string) ([]string, error) {
+	ret := make([]string, 0)
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.S3BuketName),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(s.ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Contents {
+			ret = append(ret, aws.ToString(obj.Key))
+		}
+	}
+
+	return ret, nil
+}
+
 func (s *S3) Close() error {
 	slog.Debug("Closing AWS-S3 writer")
 	return nil
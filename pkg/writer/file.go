@@ -3,12 +3,17 @@ package writer
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"data2parquet/pkg/chain"
 	"data2parquet/pkg/config"
 	"data2parquet/pkg/domain"
+	"data2parquet/pkg/metrics"
 )
 
 type File struct {
@@ -28,8 +33,9 @@ func (f *File) Init() error {
 	return nil
 }
 
-func (f *File) Write(key string, buf *bytes.Buffer) error {
+func (f *File) Write(key string, buf *bytes.Buffer, token *Token) (err error) {
 	start := time.Now()
+	defer func() { metrics.ObserveWriter(config.WriterTypeFile, buf.Len(), start, err) }()
 
 	recInfo := domain.NewRecordInfoFromKey(f.config.RecordType, key)
 	id := domain.MakeID()
@@ -37,36 +43,153 @@ func (f *File) Write(key string, buf *bytes.Buffer) error {
 	if f.config.UseHash {
 		hash = "-" + domain.GetMD5Sum(buf.Bytes())
 	}
-	filePath := f.config.WriterFilePath + "/" + recInfo.Target(id, hash)
+	target := targetPath(recInfo, buf.Bytes(), id, hash)
+	filePath := f.config.WriterFilePath + "/" + target
 
-	err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
 
 	if err != nil {
 		slog.Error("Error creating directory", "error", err, "key", key, "file", filePath)
 		return err
 	}
 
-	file, err := os.Create(filePath)
+	tmpPath := filePath + ".tmp"
+	file, err := os.Create(tmpPath)
 
 	if err != nil {
-		slog.Error("Error creating file", "error", err, "key", key, "file", filePath)
+		slog.Error("Error creating file", "error", err, "key", key, "file", tmpPath)
 		return err
 	}
 
-	defer file.Close()
+	l, err := file.Write(buf.Bytes())
 
-	l, err := file.ReadFrom(buf)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
 
 	if err != nil {
-		slog.Error("Error writing to file", "error", err, "key", key, "file", filePath)
+		slog.Error("Error writing to file", "error", err, "key", key, "file", tmpPath)
+		os.Remove(tmpPath)
 		return err
 	}
 
+	if token.IsStale() {
+		slog.Warn("Fencing token is stale, skipping write", "key", key, "file", filePath, "token", token.Value)
+		os.Remove(tmpPath)
+		return ErrStaleToken
+	}
+
+	err = os.Rename(tmpPath, filePath)
+
+	if err != nil {
+		slog.Error("Error renaming file", "error", err, "key", key, "file", filePath)
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if f.config.AuditChain {
+		err = f.writeChain(target, buf.Bytes())
+
+		if err != nil {
+			slog.Error("Error writing chain link", "error", err, "key", key, "file", filePath)
+			return err
+		}
+	}
+
 	slog.Info("File written", "key", key, "file", filePath, "duration", time.Since(start), "file-size", l)
 
 	return err
 }
 
+// writeChain stores the sidecar manifest of a chained file and sets it as its key chain head
+func (f *File) writeChain(target string, data []byte) error {
+	link, err := chain.NewLink(target, data)
+
+	if err != nil {
+		return err
+	}
+
+	err = f.writeFile(chain.ManifestPath(target), link.ToJson())
+
+	if err != nil {
+		return err
+	}
+
+	return f.writeFile(chain.HeadPath(link.Key), link.ToJson())
+}
+
+// writeFile replaces a file under `WriterFilePath` with a rename, so readers never see a partial file
+func (f *File) writeFile(path string, data []byte) error {
+	filePath := filepath.Join(f.config.WriterFilePath, path)
+
+	err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filePath+".tmp", data, 0644)
+
+	if err != nil {
+		os.Remove(filePath + ".tmp")
+		return err
+	}
+
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+func (f *File) ChainHead(key string) (*chain.Link, error) {
+	data, err := f.Read(chain.HeadPath(key))
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.ParseLink(data)
+}
+
+func (f *File) Read(path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(f.config.WriterFilePath, path))
+}
+
+// List returns the paths of files under prefix, relative to `WriterFilePath`
+func (f *File) List(prefix string) ([]string, error) {
+	ret := make([]string, 0)
+	root := filepath.Clean(f.config.WriterFilePath)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if strings.HasPrefix(rel, prefix) {
+			ret = append(ret, rel)
+		}
+
+		return nil
+	})
+
+	return ret, err
+}
+
 func (f *File) Close() error {
 	slog.Debug("Closing file writer")
 	return nil
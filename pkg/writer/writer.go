@@ -3,19 +3,55 @@ package writer
 import (
 	"bytes"
 	"context"
+	"data2parquet/pkg/chain"
 	"data2parquet/pkg/config"
+	"data2parquet/pkg/converter"
+	"data2parquet/pkg/domain"
+	"data2parquet/pkg/layout"
 	"data2parquet/pkg/logger" // "log/slog"
+	"errors"
 )
 
 var slog = logger.GetLogger()
 
+var ErrStaleToken = errors.New("fencing token is stale, write skipped")
+
 type Writer interface {
 	Init() error
-	Write(key string, buf *bytes.Buffer) error
+	Write(key string, buf *bytes.Buffer, token *Token) error
 	Close() error
 	IsReady() bool
 }
 
+// ChainWriter is implemented by writers that keep the hash chain of written files (`AuditChain`). A chained file is
+// written with its sidecar manifest and becomes the chain head of its key, the output can be read to verify the chain.
+type ChainWriter interface {
+	Writer
+	chain.Store
+	ChainHead(key string) (*chain.Link, error)
+}
+
+// Token is the fencing token of the batch being written. Valid is checked right before data is stored, so a late write
+// from an instance that lost the flush lock is skipped. A nil token means the write is not fenced (e.g. recovery data).
+type Token struct {
+	Value int64
+	Valid func() bool
+}
+
+func (t *Token) IsStale() bool {
+	return t != nil && t.Valid != nil && !t.Valid()
+}
+
+// targetPath returns the path of a file, rendered by the converter from `WriterPathTemplate` or, for data written without
+// it, from the key and the partition
+func targetPath(recInfo domain.RecordInfo, data []byte, id string, hash string) string {
+	if path, found := converter.ReadPath(data); found {
+		return layout.Fill(path, id, hash)
+	}
+
+	return recInfo.Target(converter.ReadPartition(data), id, hash)
+}
+
 func New(ctx context.Context, cfg *config.Config) Writer {
 	if ctx == nil {
 		ctx = context.Background()